@@ -0,0 +1,342 @@
+// shortenerctl - клиент командной строки для HTTP API сокращателя.
+// Токен пользователя сохраняется в файле конфига, поэтому команды работают от одного пользователя
+package main
+
+import (
+	"bufio"
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/client"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultServer = "http://localhost:8080/"
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+const usage = `Использование: shortenerctl [флаги] команда [аргументы]
+
+Команды:
+  shorten [-file путь] [url...]  сократить ссылки, файл - по ссылке в строке, - для stdin
+  list                           мои ссылки
+  delete hash...                 убрать ссылки из моих ссылок
+  stats hash                     статистика переходов
+
+Вместо hash можно передать короткую ссылку целиком.
+
+Флаги:
+`
+
+var errInvalidURLs = errors.New("some urls are invalid")
+
+// config - то, что сохраняется между запусками
+type config struct {
+	Server string `json:"server,omitempty"`
+	// токен пользователя на Server
+	Token string `json:"token,omitempty"`
+}
+
+func main() {
+	if err := run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "shortenerctl:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("shortenerctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", defaultConfigPath(), "Файл конфига с адресом сервера и токеном пользователя")
+	server := flags.String("server", "", "Адрес сервера, запоминается в конфиге. По умолчанию из конфига или "+defaultServer)
+	format := flags.String("o", outputTable, "Формат вывода: table или json")
+	timeout := flags.Duration("timeout", 10*time.Second, "Таймаут команды")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != outputTable && *format != outputJSON {
+		return errors.Errorf("unknown output format %q, expected table or json", *format)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if len(*server) != 0 && *server != cfg.Server {
+		// токен выдан другим сервером
+		cfg = config{Server: *server}
+	}
+	if len(cfg.Server) == 0 {
+		cfg.Server = defaultServer
+	}
+	c, err := client.InitClient(cfg.Server, cfg.Token, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	out := output{w: stdout, format: *format}
+	command, commandArgs := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "shorten":
+		err = shortenCommand(ctx, c, commandArgs, stdin, stderr, out)
+	case "list":
+		err = listCommand(ctx, c, out)
+	case "delete":
+		err = deleteCommand(ctx, c, commandArgs, out)
+	case "stats":
+		err = statsCommand(ctx, c, commandArgs, out)
+	default:
+		return errors.Errorf("unknown command %q, expected shorten, list, delete or stats", command)
+	}
+	// сервер мог выдать токен даже на неудачный запрос
+	if c.Token() != cfg.Token || len(*server) != 0 {
+		cfg.Token = c.Token()
+		if saveErr := saveConfig(*configPath, cfg); saveErr != nil {
+			return errors.Append(err, saveErr)
+		}
+	}
+	return err
+}
+
+// shortenRow - результат сокращения одной ссылки
+type shortenRow struct {
+	OriginalURL string `json:"original_url"`
+	ShortURL    string `json:"short_url,omitempty"`
+	// created, existing или invalid
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func shortenCommand(ctx context.Context, c *client.Client, args []string, stdin io.Reader, stderr io.Writer, out output) error {
+	flags := flag.NewFlagSet("shorten", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "Файл со ссылками по одной в строке, - для stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	urls := flags.Args()
+	if len(*file) != 0 {
+		fromFile, err := readURLs(*file, stdin)
+		if err != nil {
+			return err
+		}
+		urls = append(urls, fromFile...)
+	}
+	if len(urls) == 0 {
+		return errors.New("no urls to shorten")
+	}
+	rows := make([]shortenRow, len(urls))
+	if len(urls) == 1 && len(*file) == 0 {
+		res, err := c.Shorten(ctx, urls[0])
+		if err != nil {
+			return err
+		}
+		rows[0] = shortenRow{OriginalURL: urls[0], ShortURL: res.ShortURL, Status: "created"}
+		if res.Existing {
+			rows[0].Status = "existing"
+		}
+	} else {
+		results, err := c.ShortenBatch(ctx, urls)
+		if err != nil {
+			return err
+		}
+		for i, r := range results {
+			rows[i] = shortenRow{OriginalURL: urls[i], ShortURL: r.ShortURL, Status: r.Status, Error: r.Error}
+		}
+	}
+	table := make([][]string, len(rows))
+	invalid := 0
+	for i, r := range rows {
+		table[i] = []string{r.ShortURL, r.Status, r.OriginalURL}
+		if len(r.Error) != 0 {
+			invalid++
+			table[i][2] += ": " + r.Error
+		}
+	}
+	if err := out.print(rows, []string{"SHORT URL", "STATUS", "ORIGINAL URL"}, table); err != nil {
+		return err
+	}
+	if invalid != 0 {
+		return errors.WithMessagef(errInvalidURLs, "%d of %d", invalid, len(rows))
+	}
+	return nil
+}
+
+// readURLs читает ссылки по одной в строке, пустые строки и строки с # пропускаются
+func readURLs(path string, stdin io.Reader) ([]string, error) {
+	r := stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+func listCommand(ctx context.Context, c *client.Client, out output) error {
+	urls, err := c.UserURLs(ctx)
+	if err != nil {
+		return err
+	}
+	table := make([][]string, len(urls))
+	for i, u := range urls {
+		table[i] = []string{u.ShortURL, u.OriginalURL}
+	}
+	return out.print(urls, []string{"SHORT URL", "ORIGINAL URL"}, table)
+}
+
+func deleteCommand(ctx context.Context, c *client.Client, args []string, out output) error {
+	if len(args) == 0 {
+		return errors.New("no links to delete")
+	}
+	deleted := make([]string, 0, len(args))
+	table := make([][]string, 0, len(args))
+	var err error
+	for _, arg := range args {
+		hash := hashOf(arg)
+		if err = c.DeleteURL(ctx, hash); err != nil {
+			err = errors.WithMessage(err, hash)
+			break
+		}
+		deleted = append(deleted, hash)
+		table = append(table, []string{hash})
+	}
+	// удаленные до ошибки все равно показываются
+	if printErr := out.print(deleted, []string{"DELETED"}, table); printErr != nil {
+		return printErr
+	}
+	return err
+}
+
+func statsCommand(ctx context.Context, c *client.Client, args []string, out output) error {
+	if len(args) != 1 {
+		return errors.New("stats expects exactly one link")
+	}
+	stats, err := c.Stats(ctx, hashOf(args[0]))
+	if err != nil {
+		return err
+	}
+	limit := "unlimited"
+	if stats.MaxClicks != 0 {
+		limit = strconv.Itoa(stats.MaxClicks)
+	}
+	created := ""
+	if stats.CreatedAt != nil {
+		created = stats.CreatedAt.Format(time.RFC3339)
+	}
+	return out.print(stats, []string{"SHORT URL", "ORIGINAL URL", "CLICKS", "MAX CLICKS", "CREATED AT"}, [][]string{
+		{stats.ShortURL, stats.OriginalURL, strconv.Itoa(stats.Clicks), limit, created},
+	})
+}
+
+// hashOf достает ключ из короткой ссылки, ключ возвращается как есть
+func hashOf(arg string) string {
+	u, err := url.Parse(arg)
+	if err != nil || len(u.Scheme) == 0 {
+		return arg
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(u.Path, "/"), "+")
+}
+
+type output struct {
+	w      io.Writer
+	format string
+}
+
+// print выводит v в json или таблицу из header и rows
+func (o output) print(v any, header []string, rows [][]string) error {
+	if o.format == outputJSON {
+		enc := json.NewEncoder(o.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(o.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".shortenerctl.json"
+	}
+	return filepath.Join(dir, "shortenerctl", "config.json")
+}
+
+// loadConfig читает конфиг, отсутствующий файл - пустой конфиг
+func loadConfig(path string) (config, error) {
+	var cfg config
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, errors.WithMessage(err, path)
+	}
+	return cfg, nil
+}
+
+// saveConfig пишет конфиг через временный файл, чтобы оборванная запись не потеряла токен.
+// Токен дает доступ к ссылкам пользователя, поэтому файл читает только владелец
+func saveConfig(path string, cfg config) error {
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/controllers"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/router"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/token"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startServer поднимает сервер с хранилищем в памяти
+func startServer(t *testing.T) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	var handler http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	urlRepo, userRepo, err := repository.InitRepositories(context.Background(), repository.Config{}, nil)
+	require.NoError(t, err)
+	tb := token.InitTokenBuilder("secret key")
+	controller := controllers.InitController(srv.URL+"/", nil, tb, urlRepo, userRepo)
+	handler = router.Handler(router.InitAPI(controller, tb, router.Config{}))
+	return srv
+}
+
+type ctl struct {
+	t      *testing.T
+	config string
+	server string
+}
+
+func (c ctl) run(stdin string, args ...string) (string, error) {
+	stdout := &bytes.Buffer{}
+	args = append([]string{"-config", c.config, "-server", c.server}, args...)
+	err := run(context.Background(), args, strings.NewReader(stdin), stdout, &bytes.Buffer{})
+	return stdout.String(), err
+}
+
+func (c ctl) runJSON(v any, args ...string) {
+	out, err := c.run("", append([]string{"-o", "json"}, args...)...)
+	require.NoError(c.t, err, out)
+	require.NoError(c.t, json.Unmarshal([]byte(out), v), out)
+}
+
+func TestShortenerctl(t *testing.T) {
+	srv := startServer(t)
+	c := ctl{t: t, config: filepath.Join(t.TempDir(), "ctl", "config.json"), server: srv.URL}
+
+	out, err := c.run("", "shorten", "https://test.com/one")
+	require.NoError(t, err)
+	assert.Contains(t, out, "SHORT URL")
+	assert.Contains(t, out, "created")
+	assert.Contains(t, out, "https://test.com/one")
+
+	cfg, err := loadConfig(c.config)
+	require.NoError(t, err)
+	assert.Equal(t, srv.URL, cfg.Server)
+	require.NotEmpty(t, cfg.Token)
+	info, err := os.Stat(c.config)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	var shortened []shortenRow
+	c.runJSON(&shortened, "shorten", "https://test.com/five")
+	require.Len(t, shortened, 1)
+	assert.Equal(t, "https://test.com/five", shortened[0].OriginalURL)
+	require.True(t, strings.HasPrefix(shortened[0].ShortURL, srv.URL+"/"))
+	first := shortened[0].ShortURL
+
+	file := filepath.Join(t.TempDir(), "urls.txt")
+	require.NoError(t, os.WriteFile(file, []byte("# links\nhttps://test.com/two\n\nhttps://test.com/three\n"), 0o600))
+	c.runJSON(&shortened, "shorten", "-file", file)
+	require.Len(t, shortened, 2)
+	assert.Equal(t, "https://test.com/two", shortened[0].OriginalURL)
+	assert.Equal(t, "created", shortened[1].Status)
+
+	out, err = c.run("https://test.com/four\n%zz\n", "shorten", "-file", "-")
+	assert.ErrorIs(t, err, errInvalidURLs)
+	assert.Contains(t, out, "invalid")
+
+	// токен сохранен, поэтому все ссылки у одного пользователя
+	var urls []types.URLShorter
+	c.runJSON(&urls, "list")
+	assert.Len(t, urls, 5)
+	out, err = c.run("", "list")
+	require.NoError(t, err)
+	assert.Contains(t, out, "https://test.com/three")
+
+	var stats router.LinkStats
+	c.runJSON(&stats, "stats", first)
+	assert.Equal(t, "https://test.com/five", stats.OriginalURL)
+	assert.Equal(t, 0, stats.Clicks)
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(first)
+	require.NoError(t, err)
+	resp.Body.Close()
+	c.runJSON(&stats, "stats", first)
+	assert.Equal(t, 1, stats.Clicks)
+
+	var deleted []string
+	c.runJSON(&deleted, "delete", first)
+	assert.Equal(t, []string{hashOf(first)}, deleted)
+	c.runJSON(&urls, "list")
+	assert.Len(t, urls, 4)
+	_, err = c.run("", "delete", first)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+
+	// другой конфиг - другой пользователь
+	other := ctl{t: t, config: filepath.Join(t.TempDir(), "config.json"), server: srv.URL}
+	out, err = other.run("", "-o", "json", "list")
+	require.NoError(t, err)
+	assert.Equal(t, "[]\n", out)
+}
+
+func TestShortenerctl_Errors(t *testing.T) {
+	srv := startServer(t)
+	c := ctl{t: t, config: filepath.Join(t.TempDir(), "config.json"), server: srv.URL}
+	_, err := c.run("", "unknown")
+	assert.Error(t, err)
+	_, err = c.run("", "-o", "yaml", "list")
+	assert.Error(t, err)
+	_, err = c.run("", "shorten")
+	assert.Error(t, err)
+	_, err = c.run("", "stats", "missing")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+}
+
+func TestHashOf(t *testing.T) {
+	assert.Equal(t, "abc", hashOf("abc"))
+	assert.Equal(t, "abc", hashOf("http://localhost:8080/abc"))
+	assert.Equal(t, "abc", hashOf("http://localhost:8080/abc+"))
+}
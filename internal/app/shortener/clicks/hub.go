@@ -0,0 +1,129 @@
+// Package clicks раздает переходы по ссылкам подписчикам внутри процесса, например потокам событий пользователей
+package clicks
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultBuffer - сколько переходов ждет медленного подписчика, прежде чем он будет отключен
+const DefaultBuffer = 64
+
+// Click - засчитанный переход по ссылке
+type Click struct {
+	ID       string `json:"id"`
+	ShortURL string `json:"short_url"`
+	// переходов с учетом этого
+	Clicks    int       `json:"clicks"`
+	MaxClicks int       `json:"max_clicks,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Hub рассылает переходы подписчикам, которые следят за ссылкой. Публикация никогда не ждет подписчика:
+// тот, чей буфер переполнен, отключается, и его канал закрывается
+type Hub struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	buffer int
+}
+
+// InitHub создает хаб с буфером buffer переходов на подписчика, 0 - DefaultBuffer
+func InitHub(buffer int) *Hub {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	return &Hub{subs: map[*Subscription]struct{}{}, buffer: buffer}
+}
+
+// Subscription - подписка на переходы по набору ссылок
+type Subscription struct {
+	hub *Hub
+	c   chan Click
+	// меняется под mu подписки
+	links map[string]bool
+	mu    sync.RWMutex
+	// отключена за переполнение буфера, меняется под mu хаба
+	dropped bool
+}
+
+// Subscribe подписывается на переходы по ссылкам links. Подписку нужно закрыть через Close
+func (h *Hub) Subscribe(links []string) *Subscription {
+	s := &Subscription{hub: h, c: make(chan Click, h.buffer)}
+	s.SetLinks(links)
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Publish отправляет переход всем, кто следит за ссылкой
+func (h *Hub) Publish(c Click) {
+	var slow []*Subscription
+	h.mu.RLock()
+	for s := range h.subs {
+		if !s.watches(c.ID) {
+			continue
+		}
+		select {
+		case s.c <- c:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	h.mu.RUnlock()
+	for _, s := range slow {
+		h.remove(s, true)
+	}
+}
+
+// Len возвращает число подписчиков
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs)
+}
+
+func (h *Hub) remove(s *Subscription, dropped bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	s.dropped = dropped
+	close(s.c)
+}
+
+// C - канал переходов, закрывается после Close или отключения за переполнение
+func (s *Subscription) C() <-chan Click {
+	return s.c
+}
+
+// SetLinks заменяет набор ссылок, за которыми следит подписка
+func (s *Subscription) SetLinks(links []string) {
+	set := make(map[string]bool, len(links))
+	for _, id := range links {
+		set[id] = true
+	}
+	s.mu.Lock()
+	s.links = set
+	s.mu.Unlock()
+}
+
+func (s *Subscription) watches(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.links[id]
+}
+
+// Dropped сообщает, что подписка отключена, потому что не успевала читать переходы
+func (s *Subscription) Dropped() bool {
+	s.hub.mu.RLock()
+	defer s.hub.mu.RUnlock()
+	return s.dropped
+}
+
+// Close отписывается от переходов, повторный вызов ничего не делает
+func (s *Subscription) Close() {
+	s.hub.remove(s, false)
+}
@@ -0,0 +1,84 @@
+package clicks
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestHub(t *testing.T) {
+	h := InitHub(4)
+	a := h.Subscribe([]string{"1", "2"})
+	b := h.Subscribe([]string{"2"})
+	assert.Equal(t, 2, h.Len())
+
+	h.Publish(Click{ID: "1", Clicks: 1})
+	h.Publish(Click{ID: "2", Clicks: 1})
+	h.Publish(Click{ID: "3", Clicks: 1})
+	assert.Equal(t, "1", (<-a.C()).ID)
+	assert.Equal(t, "2", (<-a.C()).ID)
+	assert.Equal(t, "2", (<-b.C()).ID)
+	assert.Empty(t, a.C())
+	assert.Empty(t, b.C())
+
+	b.SetLinks([]string{"3"})
+	h.Publish(Click{ID: "3", Clicks: 2})
+	assert.Equal(t, 2, (<-b.C()).Clicks)
+
+	a.Close()
+	a.Close()
+	_, ok := <-a.C()
+	assert.False(t, ok)
+	assert.False(t, a.Dropped())
+	assert.Equal(t, 1, h.Len())
+}
+
+func TestHub_SlowConsumer(t *testing.T) {
+	h := InitHub(2)
+	slow := h.Subscribe([]string{"1"})
+	fast := h.Subscribe([]string{"1"})
+	for i := 1; i <= 3; i++ {
+		h.Publish(Click{ID: "1", Clicks: i})
+		require.Equal(t, i, (<-fast.C()).Clicks)
+	}
+	// медленный подписчик получает то, что успело попасть в буфер, и отключается
+	var got []int
+	for c := range slow.C() {
+		got = append(got, c.Clicks)
+	}
+	assert.Equal(t, []int{1, 2}, got)
+	assert.True(t, slow.Dropped())
+	assert.False(t, fast.Dropped())
+	assert.Equal(t, 1, h.Len())
+	slow.Close()
+}
+
+func TestHub_Concurrent(t *testing.T) {
+	h := InitHub(1)
+	subs := make([]*Subscription, 8)
+	var readers, publishers sync.WaitGroup
+	for i := range subs {
+		subs[i] = h.Subscribe([]string{"1"})
+		readers.Add(1)
+		go func(s *Subscription) {
+			defer readers.Done()
+			for range s.C() {
+			}
+		}(subs[i])
+		publishers.Add(1)
+		go func() {
+			defer publishers.Done()
+			for j := 0; j < 100; j++ {
+				h.Publish(Click{ID: "1"})
+			}
+		}()
+	}
+	publishers.Wait()
+	// закрытие уже отключенной подписки ничего не делает
+	for _, s := range subs {
+		s.Close()
+	}
+	readers.Wait()
+	assert.Zero(t, h.Len())
+}
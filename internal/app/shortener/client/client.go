@@ -0,0 +1,186 @@
+// Package client - клиент HTTP API сокращателя. Пользователь определяется cookie auth: клиент отправляет
+// сохраненный токен и запоминает новый, если сервер его выдал
+package client
+
+import (
+	"bytes"
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/router"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"golang.org/x/exp/slices"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+const authCookie = "auth"
+
+var ErrUnexpectedResponse = errors.New("unexpected response")
+
+// Error - ответ сервера с ошибкой
+type Error struct {
+	Status int
+	// пустой, если сервер ответил не problem+json
+	Problem router.Problem
+}
+
+func (e *Error) Error() string {
+	if len(e.Problem.Detail) != 0 {
+		return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Problem.Detail)
+	}
+	return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+}
+
+type Client struct {
+	baseURL    *url.URL
+	token      string
+	httpClient *http.Client
+}
+
+// InitClient создает клиент сервера baseURL. token - сохраненный токен пользователя, пусто - сервер заведет
+// нового пользователя. Если httpClient nil, используется http.DefaultClient
+func InitClient(baseURL string, token string, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, errors.Errorf("server url %q must be absolute", baseURL)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{baseURL: u, token: token, httpClient: httpClient}, nil
+}
+
+// Token возвращает текущий токен пользователя, в том числе выданный сервером за время работы клиента
+func (c *Client) Token() string {
+	return c.token
+}
+
+// ShortenResult - короткая ссылка и была ли она сокращена раньше
+type ShortenResult struct {
+	ShortURL string `json:"short_url"`
+	Existing bool   `json:"existing"`
+}
+
+// Shorten сокращает одну ссылку
+func (c *Client) Shorten(ctx context.Context, rawURL string) (ShortenResult, error) {
+	var resp router.ShortenerResponse
+	status, err := c.do(ctx, http.MethodPost, "/api/shorten", router.ShortenerRequest{URL: rawURL}, &resp, http.StatusCreated, http.StatusConflict)
+	if err != nil {
+		return ShortenResult{}, err
+	}
+	return ShortenResult{ShortURL: resp.Result, Existing: status == http.StatusConflict}, nil
+}
+
+// ShortenBatch сокращает ссылки одним запросом. Результаты идут в порядке urls, невалидные ссылки
+// получают статус invalid и не прерывают пакет
+func (c *Client) ShortenBatch(ctx context.Context, urls []string) ([]router.ShortenerResponseWithID, error) {
+	req := make([]router.ShortenerRequestWithID, len(urls))
+	for i, u := range urls {
+		req[i] = router.ShortenerRequestWithID{CorrelationID: fmt.Sprint(i), OriginalURL: u}
+	}
+	var resp []router.ShortenerResponseWithID
+	// 400 с массивом результатов - все ссылки невалидны
+	_, err := c.do(ctx, http.MethodPost, "/api/shorten/batch", req, &resp,
+		http.StatusCreated, http.StatusMultiStatus, http.StatusConflict, http.StatusBadRequest)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != len(urls) {
+		return nil, errors.WithMessagef(ErrUnexpectedResponse, "%d results for %d urls", len(resp), len(urls))
+	}
+	return resp, nil
+}
+
+// UserURLs возвращает ссылки пользователя
+func (c *Client) UserURLs(ctx context.Context) ([]types.URLShorter, error) {
+	var resp []types.URLShorter
+	status, err := c.do(ctx, http.MethodGet, "/api/user/urls", nil, &resp, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNoContent {
+		return []types.URLShorter{}, nil
+	}
+	return resp, nil
+}
+
+// DeleteURL убирает ссылку из ссылок пользователя
+func (c *Client) DeleteURL(ctx context.Context, hash string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/api/user/urls/"+url.PathEscape(hash), nil, nil, http.StatusNoContent)
+	return err
+}
+
+// Stats возвращает статистику переходов по ссылке
+func (c *Client) Stats(ctx context.Context, hash string) (router.LinkStats, error) {
+	var resp router.LinkStats
+	_, err := c.do(ctx, http.MethodGet, "/api/links/"+url.PathEscape(hash), nil, &resp, http.StatusOK)
+	return resp, err
+}
+
+// do отправляет body в json и разбирает ответ в out, если его код есть в expected. Остальные коды - *Error
+func (c *Client) do(ctx context.Context, method, path string, body any, out any, expected ...int) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL.ResolveReference(ref).String(), reqBody)
+	if err != nil {
+		return 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(c.token) != 0 {
+		req.AddCookie(&http.Cookie{Name: authCookie, Value: c.token})
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == authCookie && len(cookie.Value) != 0 {
+			c.token = cookie.Value
+		}
+	}
+	if !slices.Contains(expected, resp.StatusCode) || isProblem(resp) {
+		return resp.StatusCode, readError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return resp.StatusCode, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, errors.WithMessage(ErrUnexpectedResponse, err.Error())
+	}
+	return resp.StatusCode, nil
+}
+
+func isProblem(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "application/problem+json"
+}
+
+func readError(resp *http.Response) error {
+	e := &Error{Status: resp.StatusCode}
+	if isProblem(resp) {
+		// неразборчивое тело оставляет только код ответа
+		json.NewDecoder(resp.Body).Decode(&e.Problem)
+	}
+	return e
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"time"
+)
+
+var ErrInvalidDisableReason = errors.WithMessage(ErrInvalidLink, "disable reason must be legal or removed")
+
+// LinkInfo - ссылка глазами модератора: вместе с ключом и владельцами
+type LinkInfo struct {
+	ID       string
+	ShortURL string
+	Link     *types.Link
+	// id пользователей по возрастанию, nil - если запрашивались не владельцы, а поиск
+	Owners []string
+}
+
+// AdminGetLink возвращает ссылку с владельцами, в том числе отключенную
+func (c *Controller) AdminGetLink(ctx context.Context, id string) (*LinkInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	l, err := c.readLink(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	owners, ok := c.userRep.(repository.LinkOwners)
+	if !ok {
+		return nil, repository.ErrModerationNotSupported
+	}
+	ids, err := owners.Owners(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	return &LinkInfo{ID: id, ShortURL: c.ShortURL(id), Link: l, Owners: ids}, nil
+}
+
+// SetLinkDisabled отключает ссылку по причине reason, types.Enabled включает ее обратно
+func (c *Controller) SetLinkDisabled(ctx context.Context, id string, reason types.DisableReason) (*LinkInfo, error) {
+	switch reason {
+	case types.Enabled, types.DisabledLegal, types.DisabledRemoved:
+	default:
+		return nil, ErrInvalidDisableReason
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	disabler, ok := c.urlRep.(repository.LinkDisabler)
+	if !ok {
+		return nil, repository.ErrModerationNotSupported
+	}
+	// меняется только причина отключения, чтобы не затереть переходы, засчитанные за это время
+	if err := disabler.SetDisabled(ctx, id, reason); err != nil {
+		return nil, notFound(err, "link", id)
+	}
+	return c.AdminGetLink(ctx, id)
+}
+
+// TransferLink отдает ссылку пользователю to и забирает ее у остальных владельцев
+func (c *Controller) TransferLink(ctx context.Context, id, to string) (*LinkInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	if _, err := c.readLink(ctx, id); err != nil {
+		return nil, err
+	}
+	owners, ok := c.userRep.(repository.LinkOwners)
+	if !ok {
+		return nil, repository.ErrModerationNotSupported
+	}
+	if err := owners.Transfer(ctx, id, to); err != nil {
+		return nil, notFound(err, "user", to)
+	}
+	return c.AdminGetLink(ctx, id)
+}
+
+// SearchLinks ищет до limit ссылок на host и его поддомены, в том числе отключенные
+func (c *Controller) SearchLinks(ctx context.Context, host string, limit int) ([]LinkInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	searcher, ok := c.urlRep.(repository.HostSearcher)
+	if !ok {
+		return nil, repository.ErrModerationNotSupported
+	}
+	found, err := searcher.SearchByHost(ctx, host, limit)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]LinkInfo, len(found))
+	for i, f := range found {
+		res[i] = LinkInfo{ID: f.ID, ShortURL: c.ShortURL(f.ID), Link: f.Link}
+	}
+	return res, nil
+}
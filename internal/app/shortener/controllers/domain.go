@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrUnknownDomain = errors.WithMessage(ErrInvalidLink, "unknown short link domain")
+var ErrUserDomainsDisabled = errors.New("user domains are not configured")
+
+// SetDomains добавляет к домену по умолчанию из InitController другие домены коротких ссылок.
+// Домен, который пользователь выбрал по умолчанию, хранится в userDomains
+func (c *Controller) SetDomains(baseURLs []string, userDomains repository.DomainRepository) error {
+	for _, raw := range baseURLs {
+		u, err := url.Parse(raw)
+		if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return errors.WithMessage(ErrInvalidBaseURL, raw)
+		}
+		if c.domainIndex(u.Host) < 0 {
+			c.domains = append(c.domains, u)
+		}
+	}
+	c.userDomains = userDomains
+	return nil
+}
+
+// Domains возвращает хосты доменов коротких ссылок, первым - домен по умолчанию
+func (c *Controller) Domains() []string {
+	res := make([]string, len(c.domains))
+	for i, d := range c.domains {
+		res[i] = d.Host
+	}
+	return res
+}
+
+// LinkKey возвращает ключ ссылки id, запрошенной на хосте host. Хост, который не настроен как домен,
+// считается доменом по умолчанию
+func (c *Controller) LinkKey(host, id string) string {
+	if i := c.domainIndex(host); i > 0 {
+		return types.LinkKey(c.domains[i].Host, id)
+	}
+	return id
+}
+
+// UserDomain возвращает хост домена, на котором создаются ссылки пользователя, если он не выбрал другой
+func (c *Controller) UserDomain(ctx context.Context, userToken string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	domain, err := c.userDefaultDomain(ctx, userToken)
+	if err != nil {
+		return "", err
+	}
+	if len(domain) == 0 {
+		return c.domains[0].Host, nil
+	}
+	return domain, nil
+}
+
+// SetUserDomain выбирает домен для ссылок пользователя без явного домена, пусто - домен по умолчанию
+func (c *Controller) SetUserDomain(ctx context.Context, userToken, domain string) error {
+	if c.userDomains == nil {
+		return ErrUserDomainsDisabled
+	}
+	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
+	if err != nil {
+		return &UnauthorizedError{Err: err}
+	}
+	if domain, err = c.linkDomain(domain, ""); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	return c.userDomains.SetUserDomain(ctx, userID, domain)
+}
+
+// userDefaultDomain возвращает домен пользователя для ссылок без домена, пусто - домен по умолчанию
+func (c *Controller) userDefaultDomain(ctx context.Context, userToken string) (string, error) {
+	if c.userDomains == nil {
+		return "", nil
+	}
+	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
+	if err != nil {
+		return "", &UnauthorizedError{Err: err}
+	}
+	domain, err := c.userDomains.UserDomain(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	// домен могли убрать из конфига
+	if i := c.domainIndex(domain); i > 0 {
+		return c.domains[i].Host, nil
+	}
+	return "", nil
+}
+
+// linkDomain возвращает домен ссылки для ключа: requested, если он задан, иначе fallback.
+// Домен по умолчанию - пусто, ненастроенный домен - ErrUnknownDomain
+func (c *Controller) linkDomain(requested, fallback string) (string, error) {
+	if len(requested) == 0 {
+		return fallback, nil
+	}
+	switch i := c.domainIndex(requested); {
+	case i < 0:
+		return "", errors.WithMessagef(ErrUnknownDomain, "%q", requested)
+	case i == 0:
+		return "", nil
+	default:
+		return c.domains[i].Host, nil
+	}
+}
+
+func (c *Controller) domainIndex(host string) int {
+	for i, d := range c.domains {
+		if strings.EqualFold(d.Host, host) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ShortURL строит короткую ссылку из ключа ссылки
+func (c *Controller) ShortURL(key string) string {
+	domain, id := types.SplitLinkKey(key)
+	u := *c.domains[0]
+	if i := c.domainIndex(domain); i >= 0 {
+		u = *c.domains[i]
+	} else if len(domain) != 0 {
+		// домен убрали из конфига, ссылка строится на нем по схеме домена по умолчанию
+		u.Host = domain
+	}
+	u.Path, u.RawPath = id, ""
+	return u.String()
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+)
+
+// NotFoundError - ссылки или пользователя нет в хранилище. Ошибки самого хранилища сюда не попадают
+type NotFoundError struct {
+	// link или user
+	Resource string
+	ID       string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %q not found", e.Resource, e.ID)
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return repository.ErrNoSuchValue
+}
+
+// DuplicateError - ссылка уже была сокращена
+type DuplicateError struct {
+	ShortURL string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("link is already shortened as %s", e.ShortURL)
+}
+
+func (e *DuplicateError) Unwrap() error {
+	return repository.ErrDuplicate
+}
+
+// LinkDisabledError - ссылку отключил модератор
+type LinkDisabledError struct {
+	ID     string
+	Reason types.DisableReason
+}
+
+func (e *LinkDisabledError) Error() string {
+	return fmt.Sprintf("link %q is disabled: %s", e.ID, e.Reason)
+}
+
+func (e *LinkDisabledError) Unwrap() error {
+	return repository.ErrLinkDisabled
+}
+
+// InvalidURLError - урл, который нужно сократить, не разбирается
+type InvalidURLError struct {
+	Err error
+}
+
+func (e *InvalidURLError) Error() string {
+	return "invalid url: " + e.Err.Error()
+}
+
+func (e *InvalidURLError) Unwrap() error {
+	return e.Err
+}
+
+// UnauthorizedError - токен пользователя невалиден
+type UnauthorizedError struct {
+	Err error
+}
+
+func (e *UnauthorizedError) Error() string {
+	return "unauthorized: " + e.Err.Error()
+}
+
+func (e *UnauthorizedError) Unwrap() error {
+	return e.Err
+}
+
+// notFound заменяет отсутствие значения в хранилище на NotFoundError, остальные ошибки возвращает как есть
+func notFound(err error, resource, id string) error {
+	if errors.Is(err, repository.ErrNoSuchValue) {
+		return &NotFoundError{Resource: resource, ID: id}
+	}
+	return err
+}
+
+// linkDisabled заменяет repository.ErrLinkDisabled на LinkDisabledError с причиной из ссылки v
+func linkDisabled(err error, v any, id string) error {
+	if !errors.Is(err, repository.ErrLinkDisabled) {
+		return err
+	}
+	reason := types.DisabledRemoved
+	if l, ok := v.(*types.Link); ok && l.IsDisabled() {
+		reason = l.Disabled
+	}
+	return &LinkDisabledError{ID: id, Reason: reason}
+}
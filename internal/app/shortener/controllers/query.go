@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"golang.org/x/exp/slices"
+	"net/url"
+	"strings"
+)
+
+type queryParam struct {
+	key      string
+	value    string
+	hasValue bool
+	// исходный вид параметра из оригинального урла, чтобы не менять его кодирование
+	raw string
+}
+
+// BuildTarget собирает урл для редиректа из оригинального урла ссылки, ее utm параметров
+// и query параметров перехода. Приоритет по возрастанию: параметры оригинального урла,
+// utm параметры ссылки, параметры перехода (только в режиме QueryOverride,
+// в режиме QueryMerge они лишь дополняют недостающие ключи).
+// Параметры оригинального урла, которые ничем не перезаписаны, остаются в исходном виде и порядке.
+func BuildTarget(l *types.Link, rawQuery string) *url.URL {
+	var incoming []queryParam
+	if l.QueryMode != types.QueryDrop {
+		incoming = parseQuery(rawQuery)
+	}
+	if len(incoming) == 0 && len(l.UTM) == 0 {
+		return l.URL
+	}
+	target := *l.URL
+	own := parseQuery(target.RawQuery)
+	overriddenByIncoming := make(map[string]bool, len(incoming))
+	if l.QueryMode == types.QueryOverride {
+		for _, p := range incoming {
+			overriddenByIncoming[p.key] = true
+		}
+	}
+	present := make(map[string]bool, len(own)+len(l.UTM))
+	parts := make([]string, 0, len(own)+len(l.UTM)+len(incoming))
+	for _, p := range own {
+		if _, ok := l.UTM[p.key]; ok || overriddenByIncoming[p.key] {
+			continue
+		}
+		present[p.key] = true
+		parts = append(parts, p.raw)
+	}
+	utmKeys := make([]string, 0, len(l.UTM))
+	for k := range l.UTM {
+		utmKeys = append(utmKeys, k)
+	}
+	slices.Sort(utmKeys)
+	for _, k := range utmKeys {
+		if overriddenByIncoming[k] {
+			continue
+		}
+		present[k] = true
+		for _, v := range l.UTM[k] {
+			parts = append(parts, encodeParam(queryParam{key: k, value: v, hasValue: true}))
+		}
+	}
+	for _, p := range incoming {
+		if l.QueryMode == types.QueryMerge && present[p.key] {
+			continue
+		}
+		parts = append(parts, encodeParam(p))
+	}
+	target.RawQuery = strings.Join(parts, "&")
+	target.ForceQuery = false
+	return &target
+}
+
+// parseQuery разбирает query строку с сохранением порядка и повторяющихся ключей,
+// пустые и некорректно закодированные параметры пропускаются
+func parseQuery(rawQuery string) []queryParam {
+	var res []queryParam
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if len(raw) == 0 {
+			continue
+		}
+		key, value, hasValue := strings.Cut(raw, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil || len(key) == 0 {
+			continue
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+		res = append(res, queryParam{key: key, value: value, hasValue: hasValue, raw: raw})
+	}
+	return res
+}
+
+func encodeParam(p queryParam) string {
+	if !p.hasValue {
+		return url.QueryEscape(p.key)
+	}
+	return url.QueryEscape(p.key) + "=" + url.QueryEscape(p.value)
+}
@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"testing"
+)
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
+
+func TestBuildTarget(t *testing.T) {
+	type args struct {
+		target   string
+		mode     types.QueryPassthrough
+		utm      url.Values
+		rawQuery string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "Drop mode ignores incoming query",
+			args: args{target: "https://test.com/p?a=1", rawQuery: "b=2"},
+			want: "https://test.com/p?a=1",
+		},
+		{
+			name: "Merge keeps target params",
+			args: args{target: "https://test.com/p?a=1&b=2", mode: types.QueryMerge, rawQuery: "b=3&c=4"},
+			want: "https://test.com/p?a=1&b=2&c=4",
+		},
+		{
+			name: "Override replaces target params",
+			args: args{target: "https://test.com/p?a=1&b=2", mode: types.QueryOverride, rawQuery: "b=3&c=4"},
+			want: "https://test.com/p?a=1&b=3&c=4",
+		},
+		{
+			name: "Override replaces every value of repeated key",
+			args: args{target: "https://test.com/?a=1&a=2&b=0", mode: types.QueryOverride, rawQuery: "a=3"},
+			want: "https://test.com/?b=0&a=3",
+		},
+		{
+			name: "Repeated incoming keys are kept",
+			args: args{target: "https://test.com/", mode: types.QueryMerge, rawQuery: "a=1&a=2"},
+			want: "https://test.com/?a=1&a=2",
+		},
+		{
+			name: "Fixed utm params replace target ones",
+			args: args{
+				target: "https://test.com/?utm_source=old&x=1",
+				utm:    url.Values{"utm_source": {"news"}, "utm_medium": {"email"}},
+			},
+			want: "https://test.com/?x=1&utm_medium=email&utm_source=news",
+		},
+		{
+			name: "Merge does not override fixed utm",
+			args: args{
+				target:   "https://test.com/",
+				mode:     types.QueryMerge,
+				utm:      url.Values{"utm_source": {"news"}},
+				rawQuery: "utm_source=x&utm_term=y",
+			},
+			want: "https://test.com/?utm_source=news&utm_term=y",
+		},
+		{
+			name: "Override wins over fixed utm",
+			args: args{
+				target:   "https://test.com/",
+				mode:     types.QueryOverride,
+				utm:      url.Values{"utm_source": {"news"}},
+				rawQuery: "utm_source=x",
+			},
+			want: "https://test.com/?utm_source=x",
+		},
+		{
+			name: "Incoming values are re-encoded",
+			args: args{target: "https://test.com/", mode: types.QueryMerge, rawQuery: "q=a+b&r=%2F%26&s=a%20b"},
+			want: "https://test.com/?q=a+b&r=%2F%26&s=a+b",
+		},
+		{
+			name: "Unicode values survive",
+			args: args{target: "https://test.com/", mode: types.QueryMerge, rawQuery: "name=%D0%BF%D1%80%D0%B8%D0%B2%D0%B5%D1%82"},
+			want: "https://test.com/?name=%D0%BF%D1%80%D0%B8%D0%B2%D0%B5%D1%82",
+		},
+		{
+			name: "Target raw encoding is preserved",
+			args: args{target: "https://test.com/?z=%7e&a&sp=a%20b", mode: types.QueryMerge, rawQuery: "b=1"},
+			want: "https://test.com/?z=%7e&a&sp=a%20b&b=1",
+		},
+		{
+			name: "Malformed incoming params are skipped",
+			args: args{target: "https://test.com/", mode: types.QueryMerge, rawQuery: "a=%zz&%zz=1&b=1"},
+			want: "https://test.com/?b=1",
+		},
+		{
+			name: "Empty segments are skipped",
+			args: args{target: "https://test.com/", mode: types.QueryMerge, rawQuery: "&&a=1&&=2&"},
+			want: "https://test.com/?a=1",
+		},
+		{
+			name: "Key without value",
+			args: args{target: "https://test.com/", mode: types.QueryMerge, rawQuery: "flag&empty="},
+			want: "https://test.com/?flag&empty=",
+		},
+		{
+			name: "Keys with special characters",
+			args: args{target: "https://test.com/", mode: types.QueryMerge, rawQuery: "a+b=c&%26k%3D=v"},
+			want: "https://test.com/?a+b=c&%26k%3D=v",
+		},
+		{
+			name: "Fragment is kept",
+			args: args{target: "https://test.com/p#frag", mode: types.QueryMerge, rawQuery: "a=1"},
+			want: "https://test.com/p?a=1#frag",
+		},
+		{
+			name: "Empty incoming query leaves target intact",
+			args: args{target: "https://test.com/p?", mode: types.QueryOverride},
+			want: "https://test.com/p?",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &types.Link{URL: mustParse(t, tt.args.target), QueryMode: tt.args.mode, UTM: tt.args.utm}
+			got := BuildTarget(l, tt.args.rawQuery)
+			assert.Equal(t, tt.want, got.String())
+			assert.Equal(t, tt.args.target, l.URL.String())
+		})
+	}
+}
+
+func TestCheckLink(t *testing.T) {
+	u := &url.URL{Scheme: "https", Host: "test.com"}
+	tests := []struct {
+		name string
+		link *types.Link
+		err  error
+	}{
+		{
+			name: "Plain link",
+			link: &types.Link{URL: u},
+		},
+		{
+			name: "All options",
+			link: &types.Link{
+				URL:          u,
+				MaxClicks:    1,
+				RedirectCode: 301,
+				QueryMode:    types.QueryOverride,
+				UTM:          url.Values{"utm_source": {"x"}},
+			},
+		},
+		{
+			name: "Negative max clicks",
+			link: &types.Link{URL: u, MaxClicks: -1},
+			err:  ErrInvalidMaxClicks,
+		},
+		{
+			name: "Bad redirect code",
+			link: &types.Link{URL: u, RedirectCode: 200},
+			err:  ErrInvalidRedirectCode,
+		},
+		{
+			name: "Bad query mode",
+			link: &types.Link{URL: u, QueryMode: "append"},
+			err:  ErrInvalidQueryMode,
+		},
+		{
+			name: "Not utm param",
+			link: &types.Link{URL: u, UTM: url.Values{"source": {"x"}}},
+			err:  ErrInvalidUTM,
+		},
+		{
+			name: "Empty utm value",
+			link: &types.Link{URL: u, UTM: url.Values{"utm_source": {""}}},
+			err:  ErrInvalidUTM,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckLink(tt.link)
+			if tt.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.err)
+			assert.ErrorIs(t, err, ErrInvalidLink)
+		})
+	}
+}
@@ -6,85 +6,186 @@ import (
 	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
 	"github.com/SakuraBurst/urlshortener/internal/app/shortener/token"
 	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/webhook"
 	"github.com/jackc/pgx/v4"
 	"golang.org/x/exp/slices"
 	"log"
+	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
 type Controller struct {
-	urlRep       repository.Repository
+	urlRep       repository.URLRepository
 	userRep      repository.Repository
-	baseURL      string
 	db           *pgx.Conn
 	tokenBuilder *token.TokenBuilder
+	// домены коротких ссылок, первый - домен по умолчанию
+	domains []*url.URL
+	// nil, если вебхуки не настроены
+	webhooks *webhook.Dispatcher
+	// nil, если пользователи не выбирают домен
+	userDomains repository.DomainRepository
 }
 
 var ErrNoBaseURL = errors.New("there is no base url")
 var ErrInvalidBaseURL = errors.New("invalid base url")
+var ErrInvalidLink = errors.New("invalid link options")
+var ErrInvalidMaxClicks = errors.WithMessage(ErrInvalidLink, "max clicks must not be negative")
+var ErrInvalidRedirectCode = errors.WithMessage(ErrInvalidLink, "unsupported redirect status code")
+var ErrInvalidQueryMode = errors.WithMessage(ErrInvalidLink, "unsupported query passthrough mode")
+var ErrInvalidUTM = errors.WithMessage(ErrInvalidLink, "utm parameters must start with utm_ and have a value")
 
-func InitController(initBaseURL string, db *pgx.Conn, tb *token.TokenBuilder, urlRep, userRep repository.Repository) *Controller {
+func InitController(initBaseURL string, db *pgx.Conn, tb *token.TokenBuilder, urlRep repository.URLRepository, userRep repository.Repository) *Controller {
 	checkBaseURL(initBaseURL)
-	return &Controller{baseURL: initBaseURL, urlRep: urlRep, userRep: userRep, db: db, tokenBuilder: tb}
+	// initBaseURL уже проверен в checkBaseURL
+	base, _ := url.Parse(initBaseURL)
+	return &Controller{domains: []*url.URL{base}, urlRep: urlRep, userRep: userRep, db: db, tokenBuilder: tb}
 }
 
-func (c *Controller) GetURLFromID(ctx context.Context, id string) (*url.URL, error) {
+// GetURLFromID засчитывает переход по ссылке и возвращает ее.
+// Если ссылки нет, возвращает *NotFoundError, если лимит переходов исчерпан - repository.ErrClicksExhausted,
+// если ссылку отключил модератор - *LinkDisabledError, остальные ошибки - сбои хранилища
+func (c *Controller) GetURLFromID(ctx context.Context, id string) (*types.Link, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
+	v, err := c.urlRep.Click(ctx, id)
+	if err != nil {
+		return nil, notFound(linkDisabled(err, v, id), "link", id)
+	}
+	l, ok := v.(*types.Link)
+	if !ok {
+		return nil, repository.TypeError(v)
+	}
+	c.publishClick(ctx, id, l)
+	return l, nil
+}
+
+func (c *Controller) readLink(ctx context.Context, id string) (*types.Link, error) {
 	v, err := c.urlRep.Read(ctx, id)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "link", id)
 	}
-	u, ok := v.(*url.URL)
+	l, ok := v.(*types.Link)
 	if !ok {
-		return nil, repository.TypeError(u)
+		return nil, repository.TypeError(v)
 	}
-	return u, nil
+	return l, nil
 }
 
-func (c *Controller) WriteURL(ctx context.Context, unShortenURL *url.URL, userToken string) (string, bool, error) {
+// WriteURL сохраняет ссылку и возвращает короткую. Если ссылка уже была сокращена, вместе с существующей
+// короткой ссылкой возвращается *DuplicateError. link.Domain - хост домена короткой ссылки, пусто - домен,
+// выбранный пользователем
+func (c *Controller) WriteURL(ctx context.Context, link *types.Link, userToken string) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
-	id, err := c.urlRep.Create(ctx, unShortenURL)
-	hasConflicts := false
+	if err := CheckLink(link); err != nil {
+		return "", err
+	}
+	fallback, err := c.userDefaultDomain(ctx, userToken)
 	if err != nil {
-		if errors.Is(err, repository.ErrDuplicate) {
-			hasConflicts = true
-		} else {
-			return "", false, err
-		}
+		return "", err
+	}
+	if link.Domain, err = c.linkDomain(link.Domain, fallback); err != nil {
+		return "", err
+	}
+	id, err := c.urlRep.Create(ctx, link)
+	if err != nil && !errors.Is(err, repository.ErrDuplicate) {
+		return "", err
+	}
+	u := c.ShortURL(id)
+	if err := c.UpdateUser(ctx, userToken, id); err != nil {
+		return "", err
 	}
-	host, err := url.Parse(c.baseURL)
 	if err != nil {
-		log.Fatal("unexpected base url parse error")
+		return u, &DuplicateError{ShortURL: u}
 	}
-	host.Path = id
-	return host.String(), hasConflicts, c.UpdateUser(ctx, userToken, id)
+	c.publishLinkCreated(ctx, userToken, []string{id}, []*types.Link{link})
+	return u, nil
 }
 
-func (c *Controller) WriteArrayOfURL(ctx context.Context, unShortenURLs []*url.URL, userToken string) ([]string, bool, error) {
+// BatchStatus - чем закончилось сохранение одной ссылки из пакета
+type BatchStatus string
+
+const (
+	BatchCreated  BatchStatus = "created"
+	BatchExisting BatchStatus = "existing"
+	BatchInvalid  BatchStatus = "invalid"
+)
+
+type BatchResult struct {
+	// пусто для BatchInvalid
+	ShortURL string
+	Status   BatchStatus
+	// причина BatchInvalid
+	Err error
+}
+
+// WriteArrayOfURL сохраняет пакет ссылок и возвращает результат по каждой. Невалидные ссылки пропускаются,
+// а если atomic - не сохраняется ни одна ссылка и возвращается ErrInvalidLink вместе с результатами
+func (c *Controller) WriteArrayOfURL(ctx context.Context, links []*types.Link, userToken string, atomic bool) ([]BatchResult, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
 	defer cancel()
-	ids, err := c.urlRep.CreateArray(ctx, unShortenURLs)
-	hasConflicts := false
+	results := make([]BatchResult, len(links))
+	valid := make([]*types.Link, 0, len(links))
+	// номер ссылки в пакете для каждой валидной ссылки
+	positions := make([]int, 0, len(links))
+	fallback, err := c.userDefaultDomain(ctx, userToken)
 	if err != nil {
-		if errors.Is(err, repository.ErrDuplicate) {
-			hasConflicts = true
-		} else {
-			return nil, false, err
+		return nil, err
+	}
+	for i, l := range links {
+		err := CheckLink(l)
+		if err == nil {
+			l.Domain, err = c.linkDomain(l.Domain, fallback)
 		}
+		if err != nil {
+			results[i] = BatchResult{Status: BatchInvalid, Err: err}
+			continue
+		}
+		valid = append(valid, l)
+		positions = append(positions, i)
 	}
-	host, err := url.Parse(c.baseURL)
-	if err != nil {
-		return nil, false, err
+	if atomic && len(valid) != len(links) {
+		return results, ErrInvalidLink
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+	ids, err := c.urlRep.CreateArray(ctx, valid)
+	existing := make([]bool, len(valid))
+	var duplicates *repository.DuplicatesError
+	switch {
+	case errors.As(err, &duplicates):
+		for _, i := range duplicates.Indexes {
+			existing[i] = true
+		}
+	case errors.Is(err, repository.ErrDuplicate):
+		// хранилище не сообщает, какие именно ссылки уже были
+		for i := range existing {
+			existing[i] = true
+		}
+	case err != nil:
+		return nil, err
+	}
+	created := make([]string, 0, len(ids))
+	createdLinks := make([]*types.Link, 0, len(ids))
+	for i, id := range ids {
+		status := BatchCreated
+		if existing[i] {
+			status = BatchExisting
+		} else {
+			created = append(created, id)
+			createdLinks = append(createdLinks, valid[i])
+		}
+		results[positions[i]] = BatchResult{ShortURL: c.ShortURL(id), Status: status}
 	}
-	urls := make([]string, 0, len(ids))
-	for _, id := range ids {
-		host.Path = id
-		urls = append(urls, host.String())
+	if err := c.UpdateUser(ctx, userToken, ids...); err != nil {
+		return results, err
 	}
-	return urls, hasConflicts, c.UpdateUser(ctx, userToken, ids...)
+	c.publishLinkCreated(ctx, userToken, created, createdLinks)
+	return results, nil
 }
 
 func (c *Controller) CreateUser(ctx context.Context) (string, error) {
@@ -103,11 +204,11 @@ func (c *Controller) UpdateUser(ctx context.Context, userToken string, urlIDs ..
 	defer cancel()
 	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
 	if err != nil {
-		return err
+		return &UnauthorizedError{Err: err}
 	}
 	v, err := c.userRep.Read(ctx, userID)
 	if err != nil {
-		return err
+		return notFound(err, "user", userID)
 	}
 	u, ok := v.([]string)
 	if u != nil && !ok {
@@ -134,11 +235,11 @@ func (c *Controller) GetUser(ctx context.Context, userToken string) ([]*types.UR
 	defer cancel()
 	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
 	if err != nil {
-		return nil, err
+		return nil, &UnauthorizedError{Err: err}
 	}
 	v, err := c.userRep.Read(ctx, userID)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "user", userID)
 	}
 	u, ok := v.([]string)
 	if u != nil && !ok {
@@ -146,21 +247,139 @@ func (c *Controller) GetUser(ctx context.Context, userToken string) ([]*types.UR
 	}
 	res := make([]*types.URLShorter, 0, len(u))
 	for _, id := range u {
-		host, _ := url.Parse(c.baseURL)
-		host.Path = id
-		r, err := c.GetURLFromID(ctx, id)
+		l, err := c.readLink(ctx, id)
 		if err != nil {
 			return nil, err
 		}
 		res = append(res, &types.URLShorter{
-			ShortURL:    host.String(),
-			OriginalURL: r.String(),
+			ShortURL:    c.ShortURL(id),
+			OriginalURL: l.URL.String(),
 		})
 
 	}
 	return res, nil
 }
 
+// UserLinkIDs возвращает ключи ссылок пользователя, сами ссылки не читаются
+func (c *Controller) UserLinkIDs(ctx context.Context, userToken string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
+	if err != nil {
+		return nil, &UnauthorizedError{Err: err}
+	}
+	v, err := c.userRep.Read(ctx, userID)
+	if err != nil {
+		return nil, notFound(err, "user", userID)
+	}
+	u, ok := v.([]string)
+	if v != nil && !ok {
+		return nil, repository.TypeError(v)
+	}
+	return u, nil
+}
+
+// RemoveUserURL убирает ссылку из списка пользователя. Сама ссылка продолжает работать: ее могли
+// сократить и другие пользователи. Если у пользователя ссылки нет, возвращается *NotFoundError
+func (c *Controller) RemoveUserURL(ctx context.Context, userToken string, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
+	if err != nil {
+		return &UnauthorizedError{Err: err}
+	}
+	v, err := c.userRep.Read(ctx, userID)
+	if err != nil {
+		return notFound(err, "user", userID)
+	}
+	u, ok := v.([]string)
+	if u != nil && !ok {
+		return repository.TypeError(u)
+	}
+	i := slices.Index(u, id)
+	if i < 0 {
+		return &NotFoundError{Resource: "link", ID: id}
+	}
+	rest := make([]string, 0, len(u)-1)
+	if err := c.userRep.Update(ctx, userID, append(append(rest, u[:i]...), u[i+1:]...)); err != nil {
+		return err
+	}
+	if c.webhooks != nil {
+		l, err := c.readLink(ctx, id)
+		if err != nil {
+			log.Printf("webhook: read deleted link %s: %v", id, err)
+			return nil
+		}
+		c.publishLinkEvent(ctx, types.EventLinkDeleted, id, l, userID)
+	}
+	return nil
+}
+
+// GetLink возвращает ссылку вместе со статистикой, переход при этом не засчитывается.
+// Отключенная модератором ссылка не показывается, возвращается *LinkDisabledError
+func (c *Controller) GetLink(ctx context.Context, id string) (*types.Link, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	return c.readEnabledLink(ctx, id)
+}
+
+// GetShortURL возвращает короткую ссылку для существующего id, переход при этом не засчитывается
+func (c *Controller) GetShortURL(ctx context.Context, id string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	if _, err := c.readEnabledLink(ctx, id); err != nil {
+		return "", err
+	}
+	return c.ShortURL(id), nil
+}
+
+func (c *Controller) readEnabledLink(ctx context.Context, id string) (*types.Link, error) {
+	l, err := c.readLink(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if l.IsDisabled() {
+		return nil, &LinkDisabledError{ID: id, Reason: l.Disabled}
+	}
+	return l, nil
+}
+
+// CheckLink проверяет параметры ссылки, все ошибки оборачивают ErrInvalidLink
+func CheckLink(l *types.Link) error {
+	if l.MaxClicks < 0 {
+		return ErrInvalidMaxClicks
+	}
+	if l.RedirectCode != 0 {
+		if err := CheckRedirectCode(l.RedirectCode); err != nil {
+			return err
+		}
+	}
+	switch l.QueryMode {
+	case types.QueryDrop, types.QueryMerge, types.QueryOverride:
+	default:
+		return ErrInvalidQueryMode
+	}
+	for k, values := range l.UTM {
+		if !strings.HasPrefix(k, "utm_") || len(k) == len("utm_") {
+			return ErrInvalidUTM
+		}
+		for _, v := range values {
+			if len(v) == 0 {
+				return ErrInvalidUTM
+			}
+		}
+	}
+	return nil
+}
+
+func CheckRedirectCode(code int) error {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return nil
+	}
+	return ErrInvalidRedirectCode
+}
+
 func checkBaseURL(baseURL string) {
 	if len(baseURL) == 0 {
 		panic(ErrNoBaseURL)
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/webhook"
+	"golang.org/x/exp/slices"
+	"log"
+	"net/url"
+	"time"
+)
+
+var ErrWebhooksDisabled = errors.New("webhooks are not configured")
+var ErrInvalidWebhook = errors.New("invalid webhook options")
+var ErrInvalidWebhookURL = errors.WithMessage(ErrInvalidWebhook, "url must be an absolute http or https url")
+var ErrUnknownWebhookEvent = errors.WithMessage(ErrInvalidWebhook, "unknown event")
+var ErrInvalidClickThreshold = errors.WithMessage(ErrInvalidWebhook, "link.click_threshold needs a positive click threshold")
+
+// SetWebhooks включает события для вебхуков, без него эндпоинты вебхуков отвечают ErrWebhooksDisabled
+func (c *Controller) SetWebhooks(d *webhook.Dispatcher) {
+	c.webhooks = d
+}
+
+// CreateWebhook подписывает пользователя на события его ссылок. Пустой events - все события.
+// Ключ подписи возвращается только здесь
+func (c *Controller) CreateWebhook(ctx context.Context, userToken, rawURL string, events []types.WebhookEvent, threshold int) (*types.Webhook, error) {
+	if c.webhooks == nil {
+		return nil, ErrWebhooksDisabled
+	}
+	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
+	if err != nil {
+		return nil, &UnauthorizedError{Err: err}
+	}
+	w, err := checkWebhook(rawURL, events, threshold)
+	if err != nil {
+		return nil, err
+	}
+	w.UserID = userID
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	return c.webhooks.Subscribe(ctx, w)
+}
+
+// Webhooks возвращает подписки пользователя без ключей подписи
+func (c *Controller) Webhooks(ctx context.Context, userToken string) ([]*types.Webhook, error) {
+	if c.webhooks == nil {
+		return nil, ErrWebhooksDisabled
+	}
+	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
+	if err != nil {
+		return nil, &UnauthorizedError{Err: err}
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	hooks, err := c.webhooks.Subscriptions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range hooks {
+		w.Secret = ""
+	}
+	return hooks, nil
+}
+
+// DeleteWebhook удаляет подписку пользователя, чужая подписка - *NotFoundError
+func (c *Controller) DeleteWebhook(ctx context.Context, userToken, id string) error {
+	if c.webhooks == nil {
+		return ErrWebhooksDisabled
+	}
+	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
+	if err != nil {
+		return &UnauthorizedError{Err: err}
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	return notFound(c.webhooks.Unsubscribe(ctx, userID, id), "webhook", id)
+}
+
+// WebhookDeliveries возвращает до limit последних доставок подписки пользователя, новые первыми
+func (c *Controller) WebhookDeliveries(ctx context.Context, userToken, id string, limit int) ([]*types.WebhookDelivery, error) {
+	if c.webhooks == nil {
+		return nil, ErrWebhooksDisabled
+	}
+	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
+	if err != nil {
+		return nil, &UnauthorizedError{Err: err}
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*2)
+	defer cancel()
+	deliveries, err := c.webhooks.Deliveries(ctx, userID, id, limit)
+	if err != nil {
+		return nil, notFound(err, "webhook", id)
+	}
+	return deliveries, nil
+}
+
+// checkWebhook проверяет параметры подписки, все ошибки оборачивают ErrInvalidWebhook
+func checkWebhook(rawURL string, events []types.WebhookEvent, threshold int) (*types.Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, ErrInvalidWebhookURL
+	}
+	if len(events) == 0 {
+		events = types.WebhookEvents
+	}
+	w := &types.Webhook{URL: u.String(), Events: make([]types.WebhookEvent, 0, len(events))}
+	for _, e := range events {
+		if !slices.Contains(types.WebhookEvents, e) {
+			return nil, errors.WithMessagef(ErrUnknownWebhookEvent, "%q", e)
+		}
+		if !slices.Contains(w.Events, e) {
+			w.Events = append(w.Events, e)
+		}
+	}
+	if threshold < 0 || (threshold == 0 && slices.Contains(w.Events, types.EventClickThreshold)) {
+		return nil, ErrInvalidClickThreshold
+	}
+	w.ClickThreshold = threshold
+	return w, nil
+}
+
+// publishLinkEvent ставит событие по ссылке id в очередь вебхукам users. Вебхуки не должны ломать
+// работу со ссылками, поэтому ошибки только логируются
+func (c *Controller) publishLinkEvent(ctx context.Context, event types.WebhookEvent, id string, l *types.Link, users ...string) {
+	if c.webhooks == nil {
+		return
+	}
+	data := types.LinkEventData{ID: id, ShortURL: c.ShortURL(id), Clicks: l.Clicks, MaxClicks: l.MaxClicks}
+	if l.URL != nil {
+		data.OriginalURL = l.URL.String()
+	}
+	if err := c.webhooks.Publish(ctx, event, users, data); err != nil {
+		log.Printf("webhook: publish %s for link %s: %v", event, id, err)
+	}
+}
+
+// publishLinkCreated сообщает пользователю из userToken о созданных им ссылках
+func (c *Controller) publishLinkCreated(ctx context.Context, userToken string, ids []string, links []*types.Link) {
+	if c.webhooks == nil {
+		return
+	}
+	userID, err := c.tokenBuilder.GetIDFromToken(userToken)
+	if err != nil {
+		return
+	}
+	for i, id := range ids {
+		c.publishLinkEvent(ctx, types.EventLinkCreated, id, links[i], userID)
+	}
+}
+
+// publishClick сообщает владельцам ссылки об исчерпании лимита и достижении порога переходов.
+// Владельцы ищутся, только если событие кому-то может быть нужно
+func (c *Controller) publishClick(ctx context.Context, id string, l *types.Link) {
+	if c.webhooks == nil {
+		return
+	}
+	expired := l.MaxClicks > 0 && l.Clicks == l.MaxClicks
+	threshold := c.webhooks.ClickThresholdReached(l.Clicks)
+	if !expired && !threshold {
+		return
+	}
+	owners, ok := c.userRep.(repository.LinkOwners)
+	if !ok {
+		return
+	}
+	users, err := owners.Owners(ctx, id)
+	if err != nil {
+		log.Printf("webhook: owners of link %s: %v", id, err)
+		return
+	}
+	if expired {
+		c.publishLinkEvent(ctx, types.EventLinkExpired, id, l, users...)
+	}
+	if threshold {
+		c.publishLinkEvent(ctx, types.EventClickThreshold, id, l, users...)
+	}
+}
@@ -0,0 +1,399 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"emperror.dev/errors"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format - формат переносимого дампа
+type Format string
+
+const (
+	// FormatJSONL - по JSON объекту на строку
+	FormatJSONL Format = "jsonl"
+	// FormatCSV - CSV с заголовком, колонки перечислены в csvHeader
+	FormatCSV Format = "csv"
+)
+
+const (
+	recordLink = "link"
+	recordUser = "user"
+)
+
+// как часто вызывать Options.Progress
+const progressEvery = 1000
+
+var ErrUnknownFormat = errors.New("unknown dump format")
+var ErrInvalidRecord = errors.New("invalid dump record")
+
+var csvHeader = []string{"type", "id", "url", "max_clicks", "clicks", "created_at", "redirect_code", "query_passthrough", "utm", "links", "disabled"}
+
+// колонки, которые появились в csvHeader позже. Дампы без них импортируются
+const csvOptionalColumns = 1
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatJSONL, FormatCSV:
+		return f, nil
+	default:
+		return "", errors.WithMessage(ErrUnknownFormat, s)
+	}
+}
+
+type Options struct {
+	Format Format
+	// только для импорта
+	OnConflict repository.ConflictStrategy
+	// вызывается каждые progressEvery записей и по завершении, может быть nil
+	Progress func(Stats)
+}
+
+// Stats - сколько записей перенесено
+type Stats struct {
+	Links int
+	Users int
+	// записи, пропущенные при импорте из-за занятого ключа
+	Skipped int
+}
+
+func (s Stats) total() int {
+	return s.Links + s.Users + s.Skipped
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d links, %d users, %d skipped", s.Links, s.Users, s.Skipped)
+}
+
+// record - запись дампа: ссылка или пользователь со списком своих ссылок
+type record struct {
+	Type             string     `json:"type"`
+	ID               string     `json:"id"`
+	URL              string     `json:"url,omitempty"`
+	MaxClicks        int        `json:"max_clicks,omitempty"`
+	Clicks           int        `json:"clicks,omitempty"`
+	CreatedAt        *time.Time `json:"created_at,omitempty"`
+	RedirectCode     int        `json:"redirect_code,omitempty"`
+	QueryPassthrough string     `json:"query_passthrough,omitempty"`
+	UTM              url.Values `json:"utm,omitempty"`
+	Links            []string   `json:"links,omitempty"`
+	Disabled         string     `json:"disabled,omitempty"`
+}
+
+func linkRecord(id string, l *types.Link) record {
+	r := record{
+		Type:             recordLink,
+		ID:               id,
+		URL:              l.URL.String(),
+		MaxClicks:        l.MaxClicks,
+		Clicks:           l.Clicks,
+		RedirectCode:     l.RedirectCode,
+		QueryPassthrough: string(l.QueryMode),
+		UTM:              l.UTM,
+		Disabled:         string(l.Disabled),
+	}
+	if !l.CreatedAt.IsZero() {
+		createdAt := l.CreatedAt.UTC()
+		r.CreatedAt = &createdAt
+	}
+	return r
+}
+
+func (r record) link() (*types.Link, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, errors.WithMessagef(ErrInvalidRecord, "link %s has invalid url %q", r.ID, r.URL)
+	}
+	l := &types.Link{
+		URL:          u,
+		MaxClicks:    r.MaxClicks,
+		Clicks:       r.Clicks,
+		RedirectCode: r.RedirectCode,
+		QueryMode:    types.QueryPassthrough(r.QueryPassthrough),
+		UTM:          r.UTM,
+		Disabled:     types.DisableReason(r.Disabled),
+	}
+	if r.CreatedAt != nil {
+		l.CreatedAt = *r.CreatedAt
+	}
+	return l, nil
+}
+
+// Export выгружает сначала все ссылки, затем всех пользователей, чтобы при импорте
+// ссылки пользователя уже существовали
+func Export(ctx context.Context, w io.Writer, urlRepo, userRepo repository.Migratable, opts Options) (Stats, error) {
+	stats := Stats{}
+	writer, err := newRecordWriter(w, opts.Format)
+	if err != nil {
+		return stats, err
+	}
+	err = urlRepo.Each(ctx, func(id string, v any) error {
+		l, ok := v.(*types.Link)
+		if !ok {
+			return repository.ErrUnexpectedTypeInMap
+		}
+		stats.Links++
+		opts.report(stats)
+		return writer.write(linkRecord(id, l))
+	})
+	if err != nil {
+		return stats, err
+	}
+	err = userRepo.Each(ctx, func(id string, v any) error {
+		urls, ok := v.([]string)
+		if v != nil && !ok {
+			return repository.ErrUnexpectedTypeInMap
+		}
+		stats.Users++
+		opts.report(stats)
+		return writer.write(record{Type: recordUser, ID: id, Links: urls})
+	})
+	if err != nil {
+		return stats, err
+	}
+	if opts.Progress != nil {
+		opts.Progress(stats)
+	}
+	return stats, writer.flush()
+}
+
+// Import загружает дамп, сохраняя ключи ссылок и id пользователей
+func Import(ctx context.Context, r io.Reader, urlRepo, userRepo repository.Migratable, opts Options) (Stats, error) {
+	stats := Stats{}
+	if _, err := repository.ParseConflictStrategy(string(opts.OnConflict)); err != nil {
+		return stats, err
+	}
+	reader, err := newRecordReader(r, opts.Format)
+	if err != nil {
+		return stats, err
+	}
+	for n := 1; ; n++ {
+		rec, err := reader.read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, errors.WithMessagef(err, "record %d", n)
+		}
+		imported, isLink, err := importRecord(ctx, rec, urlRepo, userRepo, opts.OnConflict)
+		if err != nil {
+			return stats, errors.WithMessagef(err, "record %d", n)
+		}
+		switch {
+		case !imported:
+			stats.Skipped++
+		case isLink:
+			stats.Links++
+		default:
+			stats.Users++
+		}
+		opts.report(stats)
+	}
+	if opts.Progress != nil {
+		opts.Progress(stats)
+	}
+	return stats, nil
+}
+
+func importRecord(ctx context.Context, rec record, urlRepo, userRepo repository.Migratable, onConflict repository.ConflictStrategy) (imported bool, isLink bool, err error) {
+	if len(rec.ID) == 0 {
+		return false, false, errors.WithMessage(ErrInvalidRecord, "empty id")
+	}
+	switch rec.Type {
+	case recordLink:
+		l, err := rec.link()
+		if err != nil {
+			return false, true, err
+		}
+		imported, err = urlRepo.Put(ctx, rec.ID, l, onConflict)
+		return imported, true, err
+	case recordUser:
+		imported, err = userRepo.Put(ctx, rec.ID, rec.Links, onConflict)
+		return imported, false, err
+	default:
+		return false, false, errors.WithMessagef(ErrInvalidRecord, "unknown type %q", rec.Type)
+	}
+}
+
+func (opts Options) report(stats Stats) {
+	if opts.Progress != nil && stats.total()%progressEvery == 0 {
+		opts.Progress(stats)
+	}
+}
+
+type recordWriter interface {
+	write(record) error
+	flush() error
+}
+
+type recordReader interface {
+	// read возвращает io.EOF, когда записи закончились
+	read() (record, error)
+}
+
+func newRecordWriter(w io.Writer, f Format) (recordWriter, error) {
+	switch f {
+	case FormatJSONL:
+		buf := bufio.NewWriter(w)
+		return &jsonlWriter{buf: buf, encoder: json.NewEncoder(buf)}, nil
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(csvHeader); err != nil {
+			return nil, err
+		}
+		return &csvWriter{writer: writer}, nil
+	default:
+		return nil, errors.WithMessage(ErrUnknownFormat, string(f))
+	}
+}
+
+func newRecordReader(r io.Reader, f Format) (recordReader, error) {
+	switch f {
+	case FormatJSONL:
+		return &jsonlReader{decoder: json.NewDecoder(bufio.NewReader(r))}, nil
+	case FormatCSV:
+		reader := csv.NewReader(r)
+		// число колонок задает заголовок
+		reader.FieldsPerRecord = 0
+		header, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return &csvReader{reader: reader}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(header) < len(csvHeader)-csvOptionalColumns || len(header) > len(csvHeader) ||
+			strings.Join(header, ",") != strings.Join(csvHeader[:len(header)], ",") {
+			return nil, errors.WithMessagef(ErrInvalidRecord, "unexpected csv header %v", header)
+		}
+		return &csvReader{reader: reader}, nil
+	default:
+		return nil, errors.WithMessage(ErrUnknownFormat, string(f))
+	}
+}
+
+type jsonlWriter struct {
+	buf     *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (j *jsonlWriter) write(r record) error {
+	return j.encoder.Encode(r)
+}
+
+func (j *jsonlWriter) flush() error {
+	return j.buf.Flush()
+}
+
+type jsonlReader struct {
+	decoder *json.Decoder
+}
+
+func (j *jsonlReader) read() (record, error) {
+	r := record{}
+	err := j.decoder.Decode(&r)
+	return r, err
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func (c *csvWriter) write(r record) error {
+	createdAt := ""
+	if r.CreatedAt != nil {
+		createdAt = r.CreatedAt.Format(time.RFC3339Nano)
+	}
+	return c.writer.Write([]string{
+		r.Type,
+		r.ID,
+		r.URL,
+		formatInt(r.MaxClicks),
+		formatInt(r.Clicks),
+		createdAt,
+		formatInt(r.RedirectCode),
+		r.QueryPassthrough,
+		r.UTM.Encode(),
+		strings.Join(r.Links, " "),
+		r.Disabled,
+	})
+}
+
+func (c *csvWriter) flush() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+type csvReader struct {
+	reader *csv.Reader
+}
+
+func (c *csvReader) read() (record, error) {
+	fields, err := c.reader.Read()
+	if err != nil {
+		return record{}, err
+	}
+	r := record{
+		Type:             fields[0],
+		ID:               fields[1],
+		URL:              fields[2],
+		QueryPassthrough: fields[7],
+		Links:            strings.Fields(fields[9]),
+	}
+	if r.MaxClicks, err = parseInt(fields[3]); err != nil {
+		return r, err
+	}
+	if r.Clicks, err = parseInt(fields[4]); err != nil {
+		return r, err
+	}
+	if len(fields[5]) != 0 {
+		createdAt, err := time.Parse(time.RFC3339Nano, fields[5])
+		if err != nil {
+			return r, errors.WithMessage(ErrInvalidRecord, err.Error())
+		}
+		r.CreatedAt = &createdAt
+	}
+	if r.RedirectCode, err = parseInt(fields[6]); err != nil {
+		return r, err
+	}
+	if len(fields[8]) != 0 {
+		if r.UTM, err = url.ParseQuery(fields[8]); err != nil {
+			return r, errors.WithMessage(ErrInvalidRecord, err.Error())
+		}
+	}
+	if len(fields) > 10 {
+		r.Disabled = fields[10]
+	}
+	if len(r.Links) == 0 {
+		r.Links = nil
+	}
+	return r, nil
+}
+
+func formatInt(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.Itoa(i)
+}
+
+func parseInt(s string) (int, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.WithMessage(ErrInvalidRecord, err.Error())
+	}
+	return i, nil
+}
@@ -0,0 +1,177 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
+
+func initRepositories(t *testing.T, cfg repository.Config) (repository.URLRepository, repository.Repository) {
+	urlRepo, userRepo, err := repository.InitRepositories(context.Background(), cfg, nil)
+	require.NoError(t, err)
+	return urlRepo, userRepo
+}
+
+func migratable(t *testing.T, urlRepo repository.URLRepository, userRepo repository.Repository) (repository.Migratable, repository.Migratable) {
+	urlMigratable, ok := urlRepo.(repository.Migratable)
+	require.True(t, ok)
+	userMigratable, ok := userRepo.(repository.Migratable)
+	require.True(t, ok)
+	return urlMigratable, userMigratable
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []Format{FormatJSONL, FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			ctx := context.Background()
+			srcURLs, srcUsers := initRepositories(t, repository.Config{})
+			limited := &types.Link{
+				URL:          mustParseURL(t, "https://test.com/limited?a=b"),
+				MaxClicks:    3,
+				RedirectCode: 301,
+				QueryMode:    types.QueryMerge,
+				UTM:          url.Values{"utm_source": {"news, letter"}},
+			}
+			limitedID, err := srcURLs.Create(ctx, limited)
+			require.NoError(t, err)
+			clicked, err := srcURLs.Click(ctx, limitedID)
+			require.NoError(t, err)
+			disabled := *clicked.(*types.Link)
+			disabled.Disabled = types.DisabledLegal
+			require.NoError(t, srcURLs.Update(ctx, limitedID, &disabled))
+			plainID, err := srcURLs.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/plain")})
+			require.NoError(t, err)
+			ownerID, err := srcUsers.Create(ctx, []string{limitedID, plainID})
+			require.NoError(t, err)
+			emptyID, err := srcUsers.Create(ctx, []string(nil))
+			require.NoError(t, err)
+
+			dump := &bytes.Buffer{}
+			from, fromUsers := migratable(t, srcURLs, srcUsers)
+			stats, err := Export(ctx, dump, from, fromUsers, Options{Format: format})
+			require.NoError(t, err)
+			assert.Equal(t, Stats{Links: 2, Users: 2}, stats)
+
+			dstURLs, dstUsers := initRepositories(t, repository.Config{
+				Storage:    repository.StorageBolt,
+				BackUpPath: filepath.Join(t.TempDir(), "test.db"),
+			})
+			to, toUsers := migratable(t, dstURLs, dstUsers)
+			var progress []Stats
+			stats, err = Import(ctx, bytes.NewReader(dump.Bytes()), to, toUsers, Options{
+				Format:     format,
+				OnConflict: repository.ConflictFail,
+				Progress: func(s Stats) {
+					progress = append(progress, s)
+				},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, Stats{Links: 2, Users: 2}, stats)
+			assert.Equal(t, []Stats{stats}, progress)
+
+			v, err := dstURLs.Read(ctx, limitedID)
+			require.NoError(t, err)
+			got := v.(*types.Link)
+			assert.Equal(t, limited.URL.String(), got.URL.String())
+			assert.Equal(t, 3, got.MaxClicks)
+			assert.Equal(t, 1, got.Clicks)
+			assert.Equal(t, 301, got.RedirectCode)
+			assert.Equal(t, types.QueryMerge, got.QueryMode)
+			assert.Equal(t, limited.UTM, got.UTM)
+			assert.Equal(t, types.DisabledLegal, got.Disabled)
+			assert.WithinDuration(t, time.Now(), got.CreatedAt, time.Minute)
+			v, err = dstUsers.Read(ctx, ownerID)
+			require.NoError(t, err)
+			assert.Equal(t, []string{limitedID, plainID}, v)
+			v, err = dstUsers.Read(ctx, emptyID)
+			require.NoError(t, err)
+			assert.Empty(t, v)
+			newUserID, err := dstUsers.Create(ctx, []string(nil))
+			require.NoError(t, err)
+			assert.NotContains(t, []string{ownerID, emptyID}, newUserID)
+
+			stats, err = Import(ctx, bytes.NewReader(dump.Bytes()), to, toUsers, Options{Format: format, OnConflict: repository.ConflictSkip})
+			require.NoError(t, err)
+			assert.Equal(t, Stats{Skipped: 4}, stats)
+			_, err = Import(ctx, bytes.NewReader(dump.Bytes()), to, toUsers, Options{Format: format, OnConflict: repository.ConflictFail})
+			assert.ErrorIs(t, err, repository.ErrDuplicate)
+
+			require.NoError(t, dstUsers.Update(ctx, ownerID, []string{}))
+			stats, err = Import(ctx, bytes.NewReader(dump.Bytes()), to, toUsers, Options{Format: format, OnConflict: repository.ConflictOverwrite})
+			require.NoError(t, err)
+			assert.Equal(t, Stats{Links: 2, Users: 2}, stats)
+			v, err = dstUsers.Read(ctx, ownerID)
+			require.NoError(t, err)
+			assert.Equal(t, []string{limitedID, plainID}, v)
+		})
+	}
+}
+
+func TestImport_InvalidRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		dump   string
+	}{
+		{
+			name:   "Unknown type",
+			format: FormatJSONL,
+			dump:   `{"type":"group","id":"1"}`,
+		},
+		{
+			name:   "Link without url",
+			format: FormatJSONL,
+			dump:   `{"type":"link","id":"abc"}`,
+		},
+		{
+			name:   "Empty id",
+			format: FormatJSONL,
+			dump:   `{"type":"link","url":"https://test.com"}`,
+		},
+		{
+			name:   "Bad csv header",
+			format: FormatCSV,
+			dump:   "a,b,c,d,e,f,g,h,i,j\n",
+		},
+		{
+			name:   "Bad csv number",
+			format: FormatCSV,
+			dump:   strings.Join(csvHeader, ",") + "\nlink,abc,https://test.com,many,,,,,,,\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urlRepo, userRepo := initRepositories(t, repository.Config{})
+			to, toUsers := migratable(t, urlRepo, userRepo)
+			_, err := Import(context.Background(), strings.NewReader(tt.dump), to, toUsers, Options{Format: tt.format, OnConflict: repository.ConflictFail})
+			assert.ErrorIs(t, err, ErrInvalidRecord)
+		})
+	}
+}
+
+func TestImport_CSVWithoutDisabled(t *testing.T) {
+	header := strings.Join(csvHeader[:len(csvHeader)-csvOptionalColumns], ",")
+	dump := header + "\nlink,abc,https://test.com,,,,,,,\nuser,1,,,,,,,,abc\n"
+	urlRepo, userRepo := initRepositories(t, repository.Config{})
+	to, toUsers := migratable(t, urlRepo, userRepo)
+	stats, err := Import(context.Background(), strings.NewReader(dump), to, toUsers, Options{Format: FormatCSV, OnConflict: repository.ConflictFail})
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Links: 1, Users: 1}, stats)
+	v, err := urlRepo.Read(context.Background(), "abc")
+	require.NoError(t, err)
+	assert.False(t, v.(*types.Link).IsDisabled())
+}
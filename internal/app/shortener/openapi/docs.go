@@ -0,0 +1,28 @@
+package openapi
+
+import (
+	"bytes"
+	"embed"
+	swaggerFiles "github.com/swaggo/files"
+	"html/template"
+	"net/http"
+)
+
+//go:embed templates/docs.html
+var embedded embed.FS
+
+var docsTemplate = template.Must(template.ParseFS(embedded, "templates/docs.html"))
+
+// Assets - файлы Swagger UI, которые подключает страница документации
+var Assets http.FileSystem = swaggerFiles.HTTP
+
+// DocsPage рендерит страницу Swagger UI для спецификации по адресу specURL.
+// Страница подключает Assets относительными путями, поэтому отдавать ее нужно из того же каталога
+func DocsPage(title, specURL string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := docsTemplate.Execute(&buf, struct {
+		Title   string
+		SpecURL string
+	}{Title: title, SpecURL: specURL})
+	return buf.Bytes(), err
+}
@@ -0,0 +1,54 @@
+package openapi
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type inner struct {
+	Name string `json:"name"`
+}
+
+type outer struct {
+	ID        int               `json:"id"`
+	Tags      []string          `json:"tags,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Inner     *inner            `json:"inner"`
+	Items     []inner           `json:"items,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Skipped   string            `json:"-"`
+	hidden    string
+}
+
+func TestDocument_Schema(t *testing.T) {
+	d := New(Info{Title: "test", Version: "1"})
+	assert.Equal(t, &Schema{Type: "array", Items: &Schema{Ref: "#/components/schemas/outer"}}, d.Schema([]outer{}))
+	require.Contains(t, d.Components.Schemas, "outer")
+	require.Contains(t, d.Components.Schemas, "inner")
+	s := d.Components.Schemas["outer"]
+	assert.Equal(t, []string{"id", "inner", "created_at"}, s.Required)
+	assert.Len(t, s.Properties, 6)
+	assert.Equal(t, &Schema{Type: "integer"}, s.Properties["id"])
+	assert.Equal(t, &Schema{Type: "array", Items: &Schema{Type: "string"}}, s.Properties["tags"])
+	assert.Equal(t, &Schema{Type: "object", AdditionalProperties: &Schema{Type: "string"}}, s.Properties["labels"])
+	assert.Equal(t, &Schema{Ref: "#/components/schemas/inner"}, s.Properties["inner"])
+	assert.Equal(t, &Schema{Type: "string", Format: "date-time"}, s.Properties["created_at"])
+}
+
+func TestPath(t *testing.T) {
+	assert.Equal(t, "/", Path("/"))
+	assert.Equal(t, "/{hash}", Path("/:hash"))
+	assert.Equal(t, "/api/qr/{hash}", Path("/api/qr/:hash"))
+	assert.Equal(t, "/api/docs/{file}", Path("/api/docs/*file"))
+}
+
+func TestDocsPage(t *testing.T) {
+	page, err := DocsPage("title", "../openapi.json")
+	require.NoError(t, err)
+	assert.Contains(t, string(page), `url: "../openapi.json"`)
+	f, err := Assets.Open("/swagger-ui-bundle.js")
+	require.NoError(t, err)
+	f.Close()
+}
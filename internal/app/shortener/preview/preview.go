@@ -0,0 +1,41 @@
+package preview
+
+import (
+	"embed"
+	"html/template"
+	"path/filepath"
+	"time"
+)
+
+const TemplateName = "preview.html"
+
+//go:embed templates/*.html
+var embedded embed.FS
+
+type Page struct {
+	ShortURL    string
+	Destination string
+	CreatedAt   time.Time
+	Clicks      int
+	MaxClicks   int
+}
+
+// Load парсит встроенные шаблоны и поверх них шаблоны из dir,
+// так что в каталоге достаточно положить только те файлы, которые нужно переопределить
+func Load(dir string) (*template.Template, error) {
+	t, err := template.ParseFS(embedded, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if len(dir) == 0 {
+		return t, nil
+	}
+	overrides, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) == 0 {
+		return t, nil
+	}
+	return t.ParseFiles(overrides...)
+}
@@ -0,0 +1,54 @@
+package preview
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	page := Page{
+		ShortURL:    "http://localhost:8080/50334",
+		Destination: "https://test.com/?a=1&b=<2>",
+		CreatedAt:   time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC),
+		Clicks:      1,
+		MaxClicks:   3,
+	}
+	overrideDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(overrideDir, TemplateName), []byte(`custom {{.Destination}}`), 0o600))
+	tests := []struct {
+		name string
+		dir  string
+		want []string
+	}{
+		{
+			name: "Embedded template",
+			want: []string{"https://test.com/?a=1&amp;b=%3c2%3e", "2022-10-01 12:00:00 UTC", "1 of 3"},
+		},
+		{
+			name: "Empty override dir",
+			dir:  t.TempDir(),
+			want: []string{"2022-10-01 12:00:00 UTC"},
+		},
+		{
+			name: "Overridden template",
+			dir:  overrideDir,
+			want: []string{"custom https://test.com/?a=1&amp;b=&lt;2&gt;"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Load(tt.dir)
+			require.NoError(t, err)
+			buf := bytes.NewBuffer(nil)
+			require.NoError(t, tmpl.ExecuteTemplate(buf, TemplateName, page))
+			for _, w := range tt.want {
+				assert.Contains(t, buf.String(), w)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package qr
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"encoding/base64"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Format string
+
+const (
+	PNG Format = "png"
+	SVG Format = "svg"
+)
+
+const (
+	DefaultSize   = 256
+	DefaultMargin = 4
+	MinSize       = 32
+	MaxSize       = 2048
+	MaxMargin     = 32
+)
+
+var ErrInvalidFormat = errors.New("unsupported qr code format")
+var ErrInvalidSize = errors.New("invalid qr code size")
+var ErrInvalidMargin = errors.New("invalid qr code margin")
+var ErrInvalidLevel = errors.New("invalid qr code error correction level")
+
+type Options struct {
+	Format Format
+	Size   int
+	Margin int
+	Level  qrcode.RecoveryLevel
+}
+
+func DefaultOptions() Options {
+	return Options{Format: PNG, Size: DefaultSize, Margin: DefaultMargin, Level: qrcode.Medium}
+}
+
+// ParseOptions разбирает параметры запроса, пустые значения заменяются значениями по умолчанию
+func ParseOptions(format, size, margin, level string) (Options, error) {
+	opts := DefaultOptions()
+	var err error
+	switch Format(strings.ToLower(format)) {
+	case "", PNG:
+	case SVG:
+		opts.Format = SVG
+	default:
+		return opts, ErrInvalidFormat
+	}
+	if len(size) != 0 {
+		opts.Size, err = strconv.Atoi(size)
+		if err != nil || opts.Size < MinSize || opts.Size > MaxSize {
+			return opts, ErrInvalidSize
+		}
+	}
+	if len(margin) != 0 {
+		opts.Margin, err = strconv.Atoi(margin)
+		if err != nil || opts.Margin < 0 || opts.Margin > MaxMargin {
+			return opts, ErrInvalidMargin
+		}
+	}
+	if len(level) != 0 {
+		opts.Level, err = parseLevel(level)
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+func (f Format) ContentType() string {
+	if f == SVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+type cacheKey struct {
+	content string
+	opts    Options
+}
+
+// Generator строит qr коды и держит в памяти последние результаты,
+// при переполнении кеша вытесняется самая старая запись
+type Generator struct {
+	m          sync.Mutex
+	cache      map[cacheKey][]byte
+	order      []cacheKey
+	maxEntries int
+}
+
+func InitGenerator(maxEntries int) *Generator {
+	return &Generator{cache: make(map[cacheKey][]byte, maxEntries), maxEntries: maxEntries}
+}
+
+func (g *Generator) Encode(content string, opts Options) ([]byte, error) {
+	key := cacheKey{content: content, opts: opts}
+	g.m.Lock()
+	res, ok := g.cache[key]
+	g.m.Unlock()
+	if ok {
+		return res, nil
+	}
+	q, err := qrcode.New(content, opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	q.DisableBorder = true
+	bitmap := q.Bitmap()
+	switch opts.Format {
+	case SVG:
+		res = renderSVG(bitmap, opts)
+	default:
+		res, err = renderPNG(bitmap, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	g.store(key, res)
+	return res, nil
+}
+
+func (g *Generator) DataURL(content string, opts Options) (string, error) {
+	res, err := g.Encode(content, opts)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("data:%s;base64,%s", opts.Format.ContentType(), base64.StdEncoding.EncodeToString(res)), nil
+}
+
+func (g *Generator) store(key cacheKey, v []byte) {
+	if g.maxEntries <= 0 {
+		return
+	}
+	g.m.Lock()
+	defer g.m.Unlock()
+	if _, ok := g.cache[key]; ok {
+		return
+	}
+	if len(g.order) >= g.maxEntries {
+		delete(g.cache, g.order[0])
+		g.order = g.order[1:]
+	}
+	g.cache[key] = v
+	g.order = append(g.order, key)
+}
+
+func renderPNG(bitmap [][]bool, opts Options) ([]byte, error) {
+	total := len(bitmap) + opts.Margin*2
+	scale := opts.Size / total
+	if scale < 1 {
+		// размер проверяется в ParseOptions, но число модулей известно только после кодирования
+		return nil, errors.WithMessagef(ErrInvalidSize, "code needs at least %d pixels with margin %d", total, opts.Margin)
+	}
+	offset := (opts.Size-scale*total)/2 + opts.Margin*scale
+	img := image.NewPaletted(image.Rect(0, 0, opts.Size, opts.Size), color.Palette{color.White, color.Black})
+	for y, row := range bitmap {
+		for x, isSet := range row {
+			if !isSet {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func renderSVG(bitmap [][]bool, opts Options) []byte {
+	total := len(bitmap) + opts.Margin*2
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, opts.Size, opts.Size, total, total)
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="#ffffff"/><path fill="#000000" d="`, total, total)
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(buf, "M%d %dh%dv1h-%dz", start+opts.Margin, y+opts.Margin, x-start, x-start)
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+func parseLevel(level string) (qrcode.RecoveryLevel, error) {
+	switch strings.ToUpper(level) {
+	case "L":
+		return qrcode.Low, nil
+	case "M":
+		return qrcode.Medium, nil
+	case "Q":
+		return qrcode.High, nil
+	case "H":
+		return qrcode.Highest, nil
+	}
+	return 0, ErrInvalidLevel
+}
@@ -0,0 +1,89 @@
+package qr
+
+import (
+	"bytes"
+	"github.com/skip2/go-qrcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	type args struct {
+		format, size, margin, level string
+	}
+	tests := []struct {
+		name string
+		args args
+		want Options
+		err  error
+	}{
+		{
+			name: "Defaults",
+			want: DefaultOptions(),
+		},
+		{
+			name: "All params",
+			args: args{format: "SVG", size: "512", margin: "0", level: "h"},
+			want: Options{Format: SVG, Size: 512, Margin: 0, Level: qrcode.Highest},
+		},
+		{
+			name: "Bad format",
+			args: args{format: "gif"},
+			err:  ErrInvalidFormat,
+		},
+		{
+			name: "Too big",
+			args: args{size: "4096"},
+			err:  ErrInvalidSize,
+		},
+		{
+			name: "Negative margin",
+			args: args{margin: "-1"},
+			err:  ErrInvalidMargin,
+		},
+		{
+			name: "Bad level",
+			args: args{level: "X"},
+			err:  ErrInvalidLevel,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOptions(tt.args.format, tt.args.size, tt.args.margin, tt.args.level)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGenerator_Encode(t *testing.T) {
+	g := InitGenerator(1)
+	opts := DefaultOptions()
+	res, err := g.Encode("http://localhost:8080/50334", opts)
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(res))
+	require.NoError(t, err)
+	assert.Equal(t, opts.Size, img.Bounds().Dx())
+	assert.Equal(t, opts.Size, img.Bounds().Dy())
+
+	cached, err := g.Encode("http://localhost:8080/50334", opts)
+	require.NoError(t, err)
+	assert.Same(t, &res[0], &cached[0])
+
+	opts.Format = SVG
+	svg, err := g.Encode("http://localhost:8080/50334", opts)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(svg), "<svg"))
+	assert.Len(t, g.cache, 1)
+
+	dataURL, err := g.DataURL("http://localhost:8080/50334", opts)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(dataURL, "data:image/svg+xml;base64,"))
+}
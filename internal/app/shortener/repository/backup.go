@@ -0,0 +1,507 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrCorruptedRecord = errors.New("corrupted backup record")
+
+// userRecord - значение backUpValue.Kind для записей о пользователях, у ссылок Kind пустой
+const userRecord = "user"
+
+// BackUpReport - итог чтения бекап файла
+type BackUpReport struct {
+	// сколько записей удалось прочитать
+	Records int
+	// сколько записей пропущено из-за повреждений
+	Corrupted int
+	// сколько ссылок оказалось в хранилище после загрузки
+	Links int
+	// сколько пользователей оказалось в хранилище после загрузки
+	Users int
+}
+
+func (r BackUpReport) String() string {
+	return fmt.Sprintf("recovered %d records (%d links, %d users), skipped %d corrupted records", r.Records, r.Links, r.Users, r.Corrupted)
+}
+
+// backUp - журнал (WAL), в который in-memory репозитории ссылок и пользователей дописывают изменения,
+// и снапшот их состояния рядом с ним. При загрузке читается снапшот, а поверх него проигрывается журнал,
+// по каждому ключу побеждает последняя запись
+type backUp struct {
+	m    sync.Mutex
+	file *os.File
+	path string
+	// поколение журнала, снапшот того же поколения содержит все записи, сделанные до начала журнала
+	generation uint64
+	policy     SyncPolicy
+	// есть записи, не сброшенные на диск
+	dirty bool
+	// буфер кодирования, используется под m
+	buf  []byte
+	done chan struct{}
+	// репозитории пишут в журнал под блокировкой шарда, поэтому шарды блокируются раньше журнала
+	urls  *shardedMap
+	users *shardedMap
+}
+
+type rangeable interface {
+	Range(func(key, value any) bool)
+}
+
+func (b *backUp) write(v backUpValue) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.buf = appendRecord(b.buf[:0], v)
+	if _, err := b.file.Write(b.buf); err != nil {
+		return err
+	}
+	if b.policy == SyncAlways {
+		return b.file.Sync()
+	}
+	b.dirty = true
+	return nil
+}
+
+func (b *backUp) writeLink(key string, l *types.Link) error {
+	if b == nil {
+		return nil
+	}
+	return b.write(newBackUpValue(key, l))
+}
+
+func (b *backUp) writeUser(id string, urls []string) error {
+	if b == nil {
+		return nil
+	}
+	return b.write(backUpValue{Kind: userRecord, Key: id, URLs: urls})
+}
+
+func (b *backUp) sync() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if !b.dirty {
+		return nil
+	}
+	b.dirty = false
+	return b.file.Sync()
+}
+
+// close останавливает фоновые сброс на диск и снапшоты и закрывает журнал
+func (b *backUp) close() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	select {
+	case <-b.done:
+		return nil
+	default:
+	}
+	close(b.done)
+	var err error
+	if b.dirty {
+		err = b.file.Sync()
+	}
+	if closeErr := b.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func snapshotPath(path string) string {
+	return path + ".snapshot"
+}
+
+// corruptedPath - копия журнала до обрезки оборванной записи
+func corruptedPath(path string) string {
+	return path + ".corrupt"
+}
+
+// decodeLegacyRecord читает строку бекапа в старом текстовом формате "<crc32 json в hex> <json>".
+// Строки без контрольной суммы, записанные еще более старыми версиями, читаются как есть
+func decodeLegacyRecord(line []byte, v any) error {
+	if len(line) != 0 && line[0] == '{' {
+		return json.Unmarshal(line, v)
+	}
+	if len(line) < 10 || line[8] != ' ' {
+		return ErrCorruptedRecord
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil || crc32.ChecksumIEEE(line[9:]) != uint32(sum) {
+		return ErrCorruptedRecord
+	}
+	return json.Unmarshal(line[9:], v)
+}
+
+func initFileRepositories(cfg Config) (URLRepository, Repository, error) {
+	urlRepo, userRepo, report, err := openBackUp(cfg.BackUpPath)
+	if err != nil {
+		log.Println(err)
+		return nil, nil, err
+	}
+	log.Printf("backup %s: %s", cfg.BackUpPath, report)
+	b := urlRepo.backUp
+	b.policy = cfg.SyncPolicy
+	if cfg.SyncPolicy == SyncInterval && cfg.SyncInterval > 0 {
+		go b.every(cfg.SyncInterval, b.sync, "sync")
+	}
+	if cfg.CompactInterval > 0 {
+		go b.every(cfg.CompactInterval, b.compact, "snapshot")
+	}
+	return urlRepo, userRepo, nil
+}
+
+// openBackUp загружает снапшот и журнал в память. Оборванная или поврежденная запись в конце журнала
+// отрезается, дальнейшие записи дописываются после последней целой.
+// Бекап в старом текстовом формате читается построчно и сразу переводится в снапшот
+func openBackUp(path string) (*ShardedURLRepo, *ShardedUserRepo, BackUpReport, error) {
+	urlRepo := new(ShardedURLRepo)
+	userRepo := newShardedUserRepo()
+	report := BackUpReport{}
+	restore := func(v backUpValue) {
+		if restoreRecord(v, urlRepo, userRepo) {
+			report.Records++
+		} else {
+			report.Corrupted++
+		}
+	}
+	generation, err := loadSnapshot(snapshotPath(path), restore)
+	if err != nil {
+		return nil, nil, report, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return nil, nil, report, err
+	}
+	b := &backUp{
+		file:       file,
+		path:       path,
+		generation: generation,
+		policy:     SyncNever,
+		done:       make(chan struct{}),
+		urls:       &urlRepo.links,
+		users:      &userRepo.users,
+	}
+	if err := b.replay(restore, &report); err != nil {
+		file.Close()
+		return nil, nil, report, err
+	}
+	report.Links = urlRepo.links.Len()
+	report.Users = userRepo.users.Len()
+	urlRepo.backUp = b
+	userRepo.backUp = b
+	return urlRepo, userRepo, report, nil
+}
+
+// loadSnapshot читает снапшот и возвращает его поколение, отсутствие снапшота - нулевое поколение.
+// Снапшот пишется атомарно, поэтому повреждение в нем - ошибка, а не оборванная запись
+func loadSnapshot(path string, restore func(backUpValue)) (uint64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, 1<<16)
+	generation, err := readFileHeader(reader, snapshotMagic)
+	if err != nil {
+		return 0, errors.WithMessage(err, path)
+	}
+	var buf []byte
+	for {
+		payload, err := readRecord(reader, buf)
+		if errors.Is(err, io.EOF) {
+			return generation, nil
+		}
+		if err != nil {
+			return 0, errors.WithMessage(err, path)
+		}
+		v, err := decodeValue(payload)
+		if err != nil {
+			return 0, errors.WithMessage(err, path)
+		}
+		restore(v)
+		buf = payload
+	}
+}
+
+// replay проигрывает журнал поверх загруженного снапшота
+func (b *backUp) replay(restore func(backUpValue), report *BackUpReport) error {
+	info, err := b.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return b.resetWAL()
+	}
+	reader := bufio.NewReaderSize(b.file, 1<<16)
+	generation, err := readFileHeader(reader, walMagic)
+	if errors.Is(err, ErrUnknownFileFormat) {
+		if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		b.replayLegacy(restore, report)
+		return b.compact()
+	}
+	if err != nil {
+		return err
+	}
+	if generation < b.generation {
+		// процесс упал между записью снапшота и заменой журнала, все записи журнала уже есть в снапшоте
+		return b.resetWAL()
+	}
+	b.generation = generation
+	offset := int64(fileHeaderSize)
+	var buf []byte
+	for {
+		payload, err := readRecord(reader, buf)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, errTornRecord) {
+			// процесс упал посреди записи: новые записи не должны приклеиться к оборванной
+			report.Corrupted++
+			return b.truncateTail(offset)
+		}
+		if err == nil {
+			var v backUpValue
+			if v, err = decodeValue(payload); err == nil {
+				restore(v)
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, ErrCorruptedRecord) {
+				return err
+			}
+			// длина записи цела, поэтому следующие записи читаются дальше
+			log.Printf("backup %s: skip corrupted record at offset %d", b.path, offset)
+			report.Corrupted++
+		}
+		offset += int64(recordHeaderSize + len(payload))
+		buf = payload
+	}
+}
+
+// truncateTail обрезает журнал по offset, а перед этим копирует его целиком в corruptedPath
+func (b *backUp) truncateTail(offset int64) error {
+	info, err := b.file.Stat()
+	if err != nil {
+		return err
+	}
+	corrupted, err := os.Create(corruptedPath(b.path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(corrupted, io.NewSectionReader(b.file, 0, info.Size()))
+	if err == nil {
+		err = corrupted.Sync()
+	}
+	if closeErr := corrupted.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("backup %s: truncate corrupted tail at offset %d, original copied to %s", b.path, offset, corruptedPath(b.path))
+	return b.file.Truncate(offset)
+}
+
+// replayLegacy читает бекап в старом текстовом формате, поврежденные строки пропускаются
+func (b *backUp) replayLegacy(restore func(backUpValue), report *BackUpReport) {
+	reader := bufio.NewReader(b.file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) != 0 {
+			v := backUpValue{}
+			if decodeLegacyRecord(trimmed, &v) == nil {
+				restore(v)
+			} else {
+				log.Printf("backup %s: skip corrupted line %d", b.path, lineNumber)
+				report.Corrupted++
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// resetWAL начинает пустой журнал текущего поколения
+func (b *backUp) resetWAL() error {
+	if err := b.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := b.file.Write(appendFileHeader(nil, walMagic, b.generation)); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+// restoreRecord применяет запись бекапа к репозиториям и сообщает, удалось ли ее применить
+func restoreRecord(v backUpValue, urlRepo *ShardedURLRepo, userRepo *ShardedUserRepo) bool {
+	if len(v.Key) == 0 {
+		return false
+	}
+	switch v.Kind {
+	case "":
+		if v.Value == nil {
+			return false
+		}
+		urlRepo.links.Store(v.Key, v.link())
+	case userRecord:
+		id, err := strconv.ParseInt(v.Key, 10, 64)
+		if err != nil {
+			return false
+		}
+		userRepo.users.Store(v.Key, v.URLs)
+		userRepo.raiseLastID(id)
+	default:
+		return false
+	}
+	return true
+}
+
+// CompactBackUp записывает снапшот текущего состояния и начинает пустой журнал
+func CompactBackUp(path string) (BackUpReport, error) {
+	urlRepo, _, report, err := openBackUp(path)
+	if err != nil {
+		return report, err
+	}
+	defer urlRepo.backUp.close()
+	return report, urlRepo.backUp.compact()
+}
+
+// compact пишет снапшот следующего поколения и подменяет журнал пустым журналом того же поколения.
+// Изменения мапы и запись в журнал на это время блокируются, так что ни одна запись не теряется.
+// Шарды блокируются раньше журнала, в том же порядке, что и при записи.
+// Снапшот переименовывается раньше журнала: если процесс упадет между переименованиями,
+// при загрузке старый журнал окажется младше снапшота и будет отброшен
+func (b *backUp) compact() error {
+	defer b.urls.rlockAll()()
+	defer b.users.rlockAll()()
+	b.m.Lock()
+	defer b.m.Unlock()
+	next := b.generation + 1
+	walTmpPath := b.path + ".next"
+	wal, err := os.OpenFile(walTmpPath, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(walTmpPath)
+	_, err = wal.Write(appendFileHeader(nil, walMagic, next))
+	if err == nil {
+		err = wal.Sync()
+	}
+	if err == nil {
+		err = b.writeSnapshot(next)
+	}
+	if err == nil {
+		err = os.Rename(walTmpPath, b.path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(b.path))
+	}
+	if err != nil {
+		wal.Close()
+		return err
+	}
+	b.file.Close()
+	b.file = wal
+	b.generation = next
+	b.dirty = false
+	return nil
+}
+
+func (b *backUp) writeSnapshot(generation uint64) error {
+	tmpPath := snapshotPath(b.path) + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	writer := bufio.NewWriterSize(tmp, 1<<16)
+	_, err = writer.Write(appendFileHeader(nil, snapshotMagic, generation))
+	if err == nil {
+		err = b.snapshot(writer)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, snapshotPath(b.path))
+}
+
+func (b *backUp) snapshot(w io.Writer) error {
+	var rangeErr error
+	var buf []byte
+	writeRecord := func(v backUpValue) bool {
+		buf = appendRecord(buf[:0], v)
+		_, rangeErr = w.Write(buf)
+		return rangeErr == nil
+	}
+	b.urls.rangeLocked(func(key string, value any) bool {
+		l, ok := value.(*types.Link)
+		if !ok {
+			return true
+		}
+		return writeRecord(newBackUpValue(key, l))
+	})
+	if rangeErr != nil {
+		return rangeErr
+	}
+	b.users.rangeLocked(func(key string, value any) bool {
+		urls, ok := value.([]string)
+		if !ok {
+			return true
+		}
+		return writeRecord(backUpValue{Kind: userRecord, Key: key, URLs: urls})
+	})
+	return rangeErr
+}
+
+// every вызывает f с заданным интервалом, пока бекап не закрыт
+func (b *backUp) every(interval time.Duration, f func() error, name string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			if err := f(); err != nil {
+				log.Printf("backup %s: %s failed: %v", b.path, name, err)
+			}
+		}
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,376 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func writeBackUpFile(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "backup.json")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	for _, l := range lines {
+		_, err := f.WriteString(l)
+		require.NoError(t, err)
+	}
+	return path
+}
+
+// encodeLegacyRecord кодирует запись в старом текстовом формате "<crc32 json в hex> <json>\n"
+func encodeLegacyRecord(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(b)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(b))...)
+	line = append(line, b...)
+	return append(line, '\n'), nil
+}
+
+func encodedLine(t *testing.T, key string, l *types.Link) string {
+	line, err := encodeLegacyRecord(newBackUpValue(key, l))
+	require.NoError(t, err)
+	return string(line)
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Size()
+}
+
+func TestOpenBackUp(t *testing.T) {
+	first := encodedLine(t, "1", &types.Link{URL: mustParseURL(t, "https://test.com/1")})
+	second := encodedLine(t, "2", &types.Link{URL: mustParseURL(t, "https://test.com/2")})
+	tests := []struct {
+		name   string
+		lines  []string
+		want   BackUpReport
+		wantID []string
+	}{
+		{
+			name:   "Clean file",
+			lines:  []string{first, second},
+			want:   BackUpReport{Records: 2, Links: 2},
+			wantID: []string{"1", "2"},
+		},
+		{
+			name:   "Corrupted line in the middle",
+			lines:  []string{first, "0000beef {\"Key\":\"3\"}\n", "garbage\n", second},
+			want:   BackUpReport{Records: 2, Corrupted: 2, Links: 2},
+			wantID: []string{"1", "2"},
+		},
+		{
+			name:   "Flipped byte fails checksum",
+			lines:  []string{first[:20] + "X" + first[21:], second},
+			want:   BackUpReport{Records: 1, Corrupted: 1, Links: 1},
+			wantID: []string{"2"},
+		},
+		{
+			name:   "Legacy line without checksum",
+			lines:  []string{`{"Key":"1","Value":{"Scheme":"https","Host":"test.com","Path":"/1"}}` + "\n", second},
+			want:   BackUpReport{Records: 2, Links: 2},
+			wantID: []string{"1", "2"},
+		},
+		{
+			name:   "Truncated last line",
+			lines:  []string{first, second[:len(second)/2]},
+			want:   BackUpReport{Records: 1, Corrupted: 1, Links: 1},
+			wantID: []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeBackUpFile(t, tt.lines...)
+			smr, _, report, err := openBackUp(path)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, report)
+			for _, id := range tt.wantID {
+				_, err := smr.Read(context.Background(), id)
+				assert.NoError(t, err)
+			}
+			require.NoError(t, smr.backUp.close())
+
+			// старый формат переводится в снапшот при первой загрузке
+			assert.Equal(t, int64(fileHeaderSize), fileSize(t, path))
+			smr, _, report, err = openBackUp(path)
+			require.NoError(t, err)
+			defer smr.backUp.close()
+			assert.Equal(t, BackUpReport{Records: tt.want.Links, Links: tt.want.Links}, report)
+		})
+	}
+}
+
+func TestOpenBackUp_TornTail(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "backup.wal")
+	smr, _, _, err := openBackUp(path)
+	require.NoError(t, err)
+	first, err := smr.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/1")})
+	require.NoError(t, err)
+	require.NoError(t, smr.backUp.close())
+	record := appendRecord(nil, newBackUpValue("2", &types.Link{URL: mustParseURL(t, "https://test.com/2")}))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write(record[:len(record)/2])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	tornSize := fileSize(t, path)
+
+	smr, _, report, err := openBackUp(path)
+	require.NoError(t, err)
+	assert.Equal(t, BackUpReport{Records: 1, Corrupted: 1, Links: 1}, report)
+	// перед обрезкой журнал копируется как есть
+	assert.Equal(t, tornSize, fileSize(t, corruptedPath(path)))
+	assert.Less(t, fileSize(t, path), tornSize)
+	second, err := smr.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/3")})
+	require.NoError(t, err)
+	require.NoError(t, smr.backUp.close())
+
+	smr, _, report, err = openBackUp(path)
+	require.NoError(t, err)
+	defer smr.backUp.close()
+	assert.Equal(t, BackUpReport{Records: 2, Links: 2}, report)
+	for _, id := range []string{first, second} {
+		_, err = smr.Read(ctx, id)
+		assert.NoError(t, err)
+	}
+}
+
+func TestOpenBackUp_CorruptedMiddleRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "backup.wal")
+	smr, _, _, err := openBackUp(path)
+	require.NoError(t, err)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := smr.Create(ctx, &types.Link{URL: mustParseURL(t, fmt.Sprintf("https://test.com/%d", i))})
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	require.NoError(t, smr.backUp.close())
+
+	// портим последний байт payload второй записи, длина записи остается целой
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	recordSize := len(appendRecord(nil, newBackUpValue(ids[0], &types.Link{URL: mustParseURL(t, "https://test.com/0")})))
+	b[fileHeaderSize+2*recordSize-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+
+	smr, _, report, err := openBackUp(path)
+	require.NoError(t, err)
+	assert.Equal(t, BackUpReport{Records: 2, Corrupted: 1, Links: 2}, report)
+	for _, id := range []string{ids[0], ids[2]} {
+		_, err = smr.Read(ctx, id)
+		assert.NoError(t, err)
+	}
+	_, err = smr.Read(ctx, ids[1])
+	assert.ErrorIs(t, err, ErrNoSuchValue)
+	// журнал не обрезается, новые записи дописываются после поврежденной
+	assert.Equal(t, int64(len(b)), fileSize(t, path))
+	assert.NoFileExists(t, corruptedPath(path))
+	id, err := smr.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/3")})
+	require.NoError(t, err)
+	require.NoError(t, smr.backUp.close())
+
+	smr, _, report, err = openBackUp(path)
+	require.NoError(t, err)
+	defer smr.backUp.close()
+	assert.Equal(t, BackUpReport{Records: 3, Corrupted: 1, Links: 3}, report)
+	_, err = smr.Read(ctx, id)
+	assert.NoError(t, err)
+}
+
+func TestCompactBackUp(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "backup.wal")
+	smr, _, _, err := openBackUp(path)
+	require.NoError(t, err)
+	id, err := smr.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/"), MaxClicks: 5})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := smr.Click(ctx, id)
+		require.NoError(t, err)
+	}
+	require.NoError(t, smr.backUp.close())
+
+	report, err := CompactBackUp(path)
+	require.NoError(t, err)
+	assert.Equal(t, BackUpReport{Records: 6, Links: 1}, report)
+	assert.Equal(t, int64(fileHeaderSize), fileSize(t, path))
+
+	smr, _, report, err = openBackUp(path)
+	require.NoError(t, err)
+	defer smr.backUp.close()
+	assert.Equal(t, BackUpReport{Records: 1, Links: 1}, report)
+	_, err = smr.Click(ctx, id)
+	assert.ErrorIs(t, err, ErrClicksExhausted)
+	for _, tmp := range []string{path + ".next", snapshotPath(path) + ".tmp"} {
+		_, err = os.Stat(tmp)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestCompactBackUp_ConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "backup.wal")
+	smr, sur, _, err := openBackUp(path)
+	require.NoError(t, err)
+	id, err := smr.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/"), MaxClicks: 10000})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				_, err := smr.Click(ctx, id)
+				assert.NoError(t, err)
+				_, err = sur.Create(ctx, []string{id})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	// снапшоты во время записи не должны ни зависнуть, ни потерять записи
+	for i := 0; i < 20; i++ {
+		require.NoError(t, smr.backUp.compact())
+	}
+	wg.Wait()
+	require.NoError(t, smr.backUp.close())
+
+	smr, _, report, err := openBackUp(path)
+	require.NoError(t, err)
+	defer smr.backUp.close()
+	assert.Zero(t, report.Corrupted)
+	assert.Equal(t, 4*200, report.Users)
+	v, err := smr.Read(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, 4*200, v.(*types.Link).Clicks)
+}
+
+// TestOpenBackUp_ConcurrentClicksAndDisables проверяет, что порядок записей в журнале совпадает
+// с порядком изменений в памяти, когда переходы и отключения одной ссылки идут параллельно
+func TestOpenBackUp_ConcurrentClicksAndDisables(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "backup.wal")
+	smr, _, _, err := openBackUp(path)
+	require.NoError(t, err)
+	id, err := smr.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/"), MaxClicks: 10000})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				_, err := smr.Click(ctx, id)
+				// пока ссылка отключена, переход отклоняется
+				if err != nil {
+					assert.ErrorIs(t, err, ErrLinkDisabled)
+				}
+			}
+		}()
+	}
+	reasons := []types.DisableReason{types.DisabledLegal, types.Enabled, types.DisabledRemoved}
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				assert.NoError(t, smr.SetDisabled(ctx, id, reasons[(g+i)%len(reasons)]))
+			}
+		}(g)
+	}
+	wg.Wait()
+	v, err := smr.Read(ctx, id)
+	require.NoError(t, err)
+	want := v.(*types.Link)
+	require.NoError(t, smr.backUp.close())
+
+	smr, _, report, err := openBackUp(path)
+	require.NoError(t, err)
+	defer smr.backUp.close()
+	assert.Zero(t, report.Corrupted)
+	v, err = smr.Read(ctx, id)
+	require.NoError(t, err)
+	got := v.(*types.Link)
+	assert.Equal(t, want.Clicks, got.Clicks)
+	assert.Equal(t, want.Disabled, got.Disabled)
+}
+
+func TestOpenBackUp_WALOlderThanSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "backup.wal")
+	smr, _, _, err := openBackUp(path)
+	require.NoError(t, err)
+	id, err := smr.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/"), MaxClicks: 1})
+	require.NoError(t, err)
+	_, err = smr.Click(ctx, id)
+	require.NoError(t, err)
+	staleWAL, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, smr.backUp.compact())
+	require.NoError(t, smr.backUp.close())
+	// падение между переименованием снапшота и журнала оставляет журнал прошлого поколения
+	require.NoError(t, os.WriteFile(path, staleWAL, os.ModePerm))
+
+	smr, _, report, err := openBackUp(path)
+	require.NoError(t, err)
+	defer smr.backUp.close()
+	assert.Equal(t, BackUpReport{Records: 1, Links: 1}, report)
+	assert.Equal(t, int64(fileHeaderSize), fileSize(t, path))
+	_, err = smr.Click(ctx, id)
+	assert.ErrorIs(t, err, ErrClicksExhausted)
+}
+
+func TestOpenBackUp_Users(t *testing.T) {
+	ctx := context.Background()
+	path := writeBackUpFile(t)
+	urlRepo, userRepo, _, err := openBackUp(path)
+	require.NoError(t, err)
+	linkID, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/")})
+	require.NoError(t, err)
+	firstUser, err := userRepo.Create(ctx, []string(nil))
+	require.NoError(t, err)
+	secondUser, err := userRepo.Create(ctx, []string(nil))
+	require.NoError(t, err)
+	require.NoError(t, userRepo.Update(ctx, firstUser, []string{linkID}))
+	require.NoError(t, urlRepo.backUp.close())
+
+	urlRepo, userRepo, report, err := openBackUp(path)
+	require.NoError(t, err)
+	assert.Equal(t, BackUpReport{Records: 4, Links: 1, Users: 2}, report)
+	v, err := userRepo.Read(ctx, firstUser)
+	require.NoError(t, err)
+	assert.Equal(t, []string{linkID}, v)
+	v, err = userRepo.Read(ctx, secondUser)
+	require.NoError(t, err)
+	assert.Empty(t, v)
+	nextUser, err := userRepo.Create(ctx, []string(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "3", nextUser)
+
+	require.NoError(t, urlRepo.backUp.compact())
+	require.NoError(t, urlRepo.backUp.close())
+	assert.Equal(t, int64(fileHeaderSize), fileSize(t, path))
+	_, userRepo, report, err = openBackUp(path)
+	require.NoError(t, err)
+	defer userRepo.backUp.close()
+	assert.Equal(t, BackUpReport{Records: 4, Links: 1, Users: 3}, report)
+	v, err = userRepo.Read(ctx, firstUser)
+	require.NoError(t, err)
+	assert.Equal(t, []string{linkID}, v)
+}
@@ -0,0 +1,275 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+	"time"
+)
+
+var urlBucket = []byte("url")
+var usersBucket = []byte("users")
+
+// BoltURLRepo хранит ссылки во встроенном B+tree хранилище. Каждая операция выполняется
+// в своей транзакции bolt, поэтому после падения процесса файл остается в согласованном состоянии
+type BoltURLRepo struct {
+	db *bolt.DB
+}
+
+type BoltUserRepo struct {
+	db *bolt.DB
+}
+
+func initBoltRepositories(db *bolt.DB) (URLRepository, Repository, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(urlBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &BoltURLRepo{db: db}, &BoltUserRepo{db: db}, nil
+}
+
+func (b *BoltURLRepo) Create(ctx context.Context, v any) (string, error) {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return "", TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var key string
+	isDuplicate := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		key, isDuplicate, err = putLink(tx.Bucket(urlBucket), l)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if isDuplicate {
+		return key, ErrDuplicate
+	}
+	return key, nil
+}
+
+// CreateArray записывает все ссылки одной транзакцией: либо сохраняются все, либо ни одна
+func (b *BoltURLRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
+	links, ok := v.([]*types.Link)
+	if !ok {
+		return nil, TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(links))
+	var duplicates []int
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(urlBucket)
+		for i, l := range links {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			key, duplicate, err := putLink(bucket, l)
+			if err != nil {
+				return err
+			}
+			if duplicate {
+				duplicates = append(duplicates, i)
+			}
+			result = append(result, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, duplicatesError(duplicates)
+}
+
+func (b *BoltURLRepo) Read(ctx context.Context, id string) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var l *types.Link
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		l, err = getLink(tx.Bucket(urlBucket), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (b *BoltURLRepo) Update(ctx context.Context, id string, v any) error {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(urlBucket), id, newBackUpValue(id, l))
+	})
+}
+
+// Click выполняется в пишущей транзакции, а bolt допускает только одну такую транзакцию за раз,
+// так что проверка лимита и инкремент счетчика атомарны
+func (b *BoltURLRepo) Click(ctx context.Context, id string) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var l *types.Link
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(urlBucket)
+		var err error
+		l, err = getLink(bucket, id)
+		if err != nil {
+			return err
+		}
+		if l.IsDisabled() {
+			return ErrLinkDisabled
+		}
+		if l.IsExhausted() {
+			return ErrClicksExhausted
+		}
+		l.Clicks++
+		return putJSON(bucket, id, newBackUpValue(id, l))
+	})
+	if err != nil {
+		return l, err
+	}
+	return l, nil
+}
+
+func (b *BoltUserRepo) Create(ctx context.Context, v any) (string, error) {
+	u, ok := v.([]string)
+	if u != nil && !ok {
+		return "", TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var id string
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		id, err = putUser(tx.Bucket(usersBucket), u)
+		return err
+	})
+	return id, err
+}
+
+func (b *BoltUserRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
+	usersURLs, ok := v.([][]string)
+	if !ok {
+		return nil, TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(usersURLs))
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		for _, u := range usersURLs {
+			id, err := putUser(bucket, u)
+			if err != nil {
+				return err
+			}
+			result = append(result, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (b *BoltUserRepo) Read(ctx context.Context, id string) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var u []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(usersBucket).Get([]byte(id))
+		if v == nil {
+			return ErrNoSuchValue
+		}
+		return json.Unmarshal(v, &u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (b *BoltUserRepo) Update(ctx context.Context, id string, v any) error {
+	u, ok := v.([]string)
+	if !ok {
+		return TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(usersBucket), id, u)
+	})
+}
+
+func putLink(bucket *bolt.Bucket, l *types.Link) (string, bool, error) {
+	stored := *l
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now()
+	}
+	for attempt := 1; ; attempt++ {
+		key, err := createLinkHash(l)
+		if err != nil {
+			return "", false, err
+		}
+		if bucket.Get([]byte(key)) == nil {
+			return key, false, putJSON(bucket, key, newBackUpValue(key, &stored))
+		}
+		if l.MaxClicks == 0 || attempt == maxKeyAttempts {
+			return key, true, nil
+		}
+	}
+}
+
+func getLink(bucket *bolt.Bucket, id string) (*types.Link, error) {
+	v := bucket.Get([]byte(id))
+	if v == nil {
+		return nil, ErrNoSuchValue
+	}
+	var record backUpValue
+	if err := json.Unmarshal(v, &record); err != nil {
+		return nil, err
+	}
+	return record.link(), nil
+}
+
+func putUser(bucket *bolt.Bucket, u []string) (string, error) {
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return "", err
+	}
+	id := strconv.FormatUint(seq, 10)
+	return id, putJSON(bucket, id, u)
+}
+
+func putJSON(bucket *bolt.Bucket, key string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), b)
+}
@@ -0,0 +1,269 @@
+package repository
+
+import (
+	"container/list"
+	"context"
+	"emperror.dev/errors"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// сколько переходов по закешированным ссылкам может ждать записи в хранилище
+const pendingClicksSize = 1024
+
+var ErrMigrationNotSupported = errors.New("repository does not support migration")
+
+// CacheStats - счетчики кеша ссылок
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// переходы, которые не удалось засчитать в хранилище, потому что очередь была переполнена
+	DroppedClicks uint64
+	Size          int
+}
+
+// CachedURLRepo - декоратор репозитория ссылок с ограниченным LRU кешем.
+// Кешируются и найденные ссылки, и отсутствующие ключи. Переходы по ссылкам без лимита
+// обслуживаются из кеша, а счетчик в хранилище увеличивается асинхронно. Переходы по ссылкам
+// с лимитом всегда идут в хранилище, чтобы лимит проверялся атомарно
+type CachedURLRepo struct {
+	// счетчики в начале структуры, чтобы атомарные операции с ними были выровнены и на 32-битных платформах
+	hits          uint64
+	misses        uint64
+	droppedClicks uint64
+
+	repo URLRepository
+	size int
+	// 0 - записи не устаревают
+	ttl time.Duration
+	now func() time.Time
+
+	m     sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	// увеличивается при каждой инвалидации, чтобы промах, начавшийся до нее, не положил в кеш старое значение
+	version uint64
+
+	pendingClicks chan string
+}
+
+type cacheEntry struct {
+	id string
+	// nil для отсутствующего ключа
+	link    *types.Link
+	expires time.Time
+}
+
+func InitCachedURLRepo(repo URLRepository, size int, ttl time.Duration) *CachedURLRepo {
+	c := &CachedURLRepo{
+		repo:          repo,
+		size:          size,
+		ttl:           ttl,
+		now:           time.Now,
+		ll:            list.New(),
+		items:         make(map[string]*list.Element, size),
+		pendingClicks: make(chan string, pendingClicksSize),
+	}
+	go c.countClicks()
+	return c
+}
+
+func (c *CachedURLRepo) Create(ctx context.Context, v any) (string, error) {
+	id, err := c.repo.Create(ctx, v)
+	if len(id) != 0 {
+		c.invalidate(id)
+	}
+	return id, err
+}
+
+func (c *CachedURLRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
+	ids, err := c.repo.CreateArray(ctx, v)
+	c.invalidate(ids...)
+	return ids, err
+}
+
+func (c *CachedURLRepo) Read(ctx context.Context, id string) (any, error) {
+	if l, ok := c.get(id); ok {
+		atomic.AddUint64(&c.hits, 1)
+		if l == nil {
+			return nil, ErrNoSuchValue
+		}
+		return l, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+	version := c.currentVersion()
+	v, err := c.repo.Read(ctx, id)
+	c.remember(id, v, err, version)
+	return v, err
+}
+
+func (c *CachedURLRepo) Update(ctx context.Context, id string, v any) error {
+	err := c.repo.Update(ctx, id, v)
+	c.invalidate(id)
+	return err
+}
+
+func (c *CachedURLRepo) Click(ctx context.Context, id string) (any, error) {
+	if l, ok := c.get(id); ok && (l == nil || l.MaxClicks == 0 || l.IsExhausted() || l.IsDisabled()) {
+		atomic.AddUint64(&c.hits, 1)
+		switch {
+		case l == nil:
+			return nil, ErrNoSuchValue
+		case l.IsDisabled():
+			return l, ErrLinkDisabled
+		case l.IsExhausted():
+			return l, ErrClicksExhausted
+		default:
+			c.countClickLater(id)
+			return c.countCachedClick(id, l), nil
+		}
+	}
+	atomic.AddUint64(&c.misses, 1)
+	version := c.currentVersion()
+	v, err := c.repo.Click(ctx, id)
+	cacheErr := err
+	if errors.Is(err, ErrClicksExhausted) || errors.Is(err, ErrLinkDisabled) {
+		cacheErr = nil
+	}
+	c.remember(id, v, cacheErr, version)
+	return v, err
+}
+
+func (c *CachedURLRepo) Each(ctx context.Context, f func(id string, v any) error) error {
+	m, ok := c.repo.(Migratable)
+	if !ok {
+		return ErrMigrationNotSupported
+	}
+	return m.Each(ctx, f)
+}
+
+func (c *CachedURLRepo) Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error) {
+	m, ok := c.repo.(Migratable)
+	if !ok {
+		return false, ErrMigrationNotSupported
+	}
+	imported, err := m.Put(ctx, id, v, onConflict)
+	c.invalidate(id)
+	return imported, err
+}
+
+func (c *CachedURLRepo) Stats() CacheStats {
+	c.m.Lock()
+	size := c.ll.Len()
+	c.m.Unlock()
+	return CacheStats{
+		Hits:          atomic.LoadUint64(&c.hits),
+		Misses:        atomic.LoadUint64(&c.misses),
+		DroppedClicks: atomic.LoadUint64(&c.droppedClicks),
+		Size:          size,
+	}
+}
+
+// get возвращает ссылку из кеша, ok == false - промах. Ссылка nil означает закешированное отсутствие ключа
+func (c *CachedURLRepo) get(id string) (*types.Link, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if c.ttl != 0 && !c.now().Before(entry.expires) {
+		c.ll.Remove(e)
+		delete(c.items, id)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.link, true
+}
+
+func (c *CachedURLRepo) currentVersion() uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.version
+}
+
+// remember кладет в кеш результат обращения к хранилищу. Ошибки, кроме ErrNoSuchValue, не кешируются
+func (c *CachedURLRepo) remember(id string, v any, err error, version uint64) {
+	var l *types.Link
+	if err == nil {
+		var ok bool
+		if l, ok = v.(*types.Link); !ok {
+			return
+		}
+	} else if !errors.Is(err, ErrNoSuchValue) {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.version != version {
+		return
+	}
+	entry := &cacheEntry{id: id, link: l, expires: c.now().Add(c.ttl)}
+	if e, ok := c.items[id]; ok {
+		e.Value = entry
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[id] = c.ll.PushFront(entry)
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).id)
+	}
+}
+
+func (c *CachedURLRepo) invalidate(ids ...string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.version++
+	for _, id := range ids {
+		if e, ok := c.items[id]; ok {
+			c.ll.Remove(e)
+			delete(c.items, id)
+		}
+	}
+}
+
+// countCachedClick увеличивает счетчик закешированной ссылки без лимита и возвращает ее, чтобы события
+// о переходах получали актуальное число переходов. Запись подменяется копией, ссылку из кеша могут читать.
+// Если запись перечитают из хранилища раньше, чем туда дойдут отложенные переходы, счетчик отстанет на них
+func (c *CachedURLRepo) countCachedClick(id string, l *types.Link) *types.Link {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var entry *cacheEntry
+	if e, ok := c.items[id]; ok {
+		entry = e.Value.(*cacheEntry)
+		// за время без блокировки запись могли уже подменить
+		if entry.link != nil && entry.link.MaxClicks == 0 {
+			l = entry.link
+		} else {
+			entry = nil
+		}
+	}
+	clicked := *l
+	clicked.Clicks++
+	if entry != nil {
+		entry.link = &clicked
+	}
+	return &clicked
+}
+
+func (c *CachedURLRepo) countClickLater(id string) {
+	select {
+	case c.pendingClicks <- id:
+	default:
+		atomic.AddUint64(&c.droppedClicks, 1)
+	}
+}
+
+func (c *CachedURLRepo) countClicks() {
+	for id := range c.pendingClicks {
+		if _, err := c.repo.Click(context.Background(), id); err != nil {
+			log.Printf("cache: count click for %s: %v", id, err)
+		}
+	}
+}
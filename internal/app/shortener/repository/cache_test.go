@@ -0,0 +1,188 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingURLRepo считает обращения к хранилищу за кешем
+type countingURLRepo struct {
+	URLRepository
+	reads  int64
+	clicks int64
+}
+
+func (c *countingURLRepo) Read(ctx context.Context, id string) (any, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.URLRepository.Read(ctx, id)
+}
+
+func (c *countingURLRepo) Click(ctx context.Context, id string) (any, error) {
+	atomic.AddInt64(&c.clicks, 1)
+	return c.URLRepository.Click(ctx, id)
+}
+
+func initTestCache(size int, ttl time.Duration) (*CachedURLRepo, *countingURLRepo) {
+	counting := &countingURLRepo{URLRepository: new(SyncMapURLRepo)}
+	return InitCachedURLRepo(counting, size, ttl), counting
+}
+
+func TestCachedURLRepo_Read(t *testing.T) {
+	ctx := context.Background()
+	cache, counting := initTestCache(10, 0)
+	id, err := cache.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/")})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		v, err := cache.Read(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, "https://test.com/", v.(*types.Link).URL.String())
+	}
+	assert.Equal(t, int64(1), counting.reads)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Size: 1}, cache.Stats())
+}
+
+func TestCachedURLRepo_NegativeCaching(t *testing.T) {
+	ctx := context.Background()
+	cache, counting := initTestCache(10, 0)
+	link := &types.Link{URL: mustParseURL(t, "https://test.com/")}
+	id, err := createURLHash(link.URL)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := cache.Read(ctx, id)
+		assert.ErrorIs(t, err, ErrNoSuchValue)
+		_, err = cache.Click(ctx, id)
+		assert.ErrorIs(t, err, ErrNoSuchValue)
+	}
+	assert.Equal(t, int64(1), counting.reads)
+	assert.Equal(t, int64(0), counting.clicks)
+
+	// созданная ссылка не должна прятаться за закешированным отсутствием
+	created, err := cache.Create(ctx, link)
+	require.NoError(t, err)
+	require.Equal(t, id, created)
+	_, err = cache.Read(ctx, id)
+	assert.NoError(t, err)
+}
+
+func TestCachedURLRepo_Update(t *testing.T) {
+	ctx := context.Background()
+	cache, _ := initTestCache(10, 0)
+	id, err := cache.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/old")})
+	require.NoError(t, err)
+	_, err = cache.Read(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, cache.Update(ctx, id, &types.Link{URL: mustParseURL(t, "https://test.com/new")}))
+	v, err := cache.Read(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://test.com/new", v.(*types.Link).URL.String())
+}
+
+func TestCachedURLRepo_EvictionAndTTL(t *testing.T) {
+	ctx := context.Background()
+	cache, counting := initTestCache(2, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time {
+		return now
+	}
+	ids := make([]string, 3)
+	for i := range ids {
+		id, err := cache.Create(ctx, &types.Link{URL: mustParseURL(t, fmt.Sprintf("https://test.com/%d", i))})
+		require.NoError(t, err)
+		ids[i] = id
+	}
+	for _, id := range []string{ids[0], ids[1], ids[0], ids[2]} {
+		_, err := cache.Read(ctx, id)
+		require.NoError(t, err)
+	}
+	// ids[1] реже всего использовался и вытеснен
+	assert.Equal(t, 2, cache.Stats().Size)
+	reads := counting.reads
+	_, err := cache.Read(ctx, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, reads, counting.reads)
+	_, err = cache.Read(ctx, ids[1])
+	require.NoError(t, err)
+	assert.Equal(t, reads+1, counting.reads)
+
+	now = now.Add(time.Minute)
+	_, err = cache.Read(ctx, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, reads+2, counting.reads)
+}
+
+func TestCachedURLRepo_Click(t *testing.T) {
+	ctx := context.Background()
+	cache, counting := initTestCache(10, 0)
+	plain, err := cache.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/plain")})
+	require.NoError(t, err)
+	limited, err := cache.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/limited"), MaxClicks: 2})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		v, err := cache.Click(ctx, plain)
+		require.NoError(t, err)
+		// переход из кеша возвращает ссылку с уже засчитанным переходом
+		assert.Equal(t, i+1, v.(*types.Link).Clicks)
+	}
+	// переходы по ссылке без лимита засчитываются в хранилище асинхронно
+	assert.Eventually(t, func() bool {
+		v, err := counting.URLRepository.Read(ctx, plain)
+		return err == nil && v.(*types.Link).Clicks == 5
+	}, time.Second, time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.Click(ctx, limited)
+		require.NoError(t, err)
+	}
+	clicks := atomic.LoadInt64(&counting.clicks)
+	for i := 0; i < 3; i++ {
+		_, err := cache.Click(ctx, limited)
+		assert.ErrorIs(t, err, ErrClicksExhausted)
+	}
+	// последний успешный переход закешировал исчерпанную ссылку, дальше хранилище не нужно
+	assert.Equal(t, clicks, atomic.LoadInt64(&counting.clicks))
+}
+
+func TestCachedURLRepo_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	cache, _ := initTestCache(8, time.Millisecond)
+	ids := make([]string, 16)
+	for i := range ids {
+		id, err := cache.Create(ctx, &types.Link{URL: mustParseURL(t, fmt.Sprintf("https://test.com/%d", i)), MaxClicks: i % 2 * 50})
+		require.NoError(t, err)
+		ids[i] = id
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				id := ids[(g+i)%len(ids)]
+				switch i % 4 {
+				case 0:
+					_, err := cache.Click(ctx, id)
+					if err != nil {
+						assert.ErrorIs(t, err, ErrClicksExhausted)
+					}
+				case 1:
+					assert.NoError(t, cache.Update(ctx, id, &types.Link{URL: mustParseURL(t, fmt.Sprintf("https://test.com/%d", (g+i)%len(ids)))}))
+				default:
+					_, err := cache.Read(ctx, id)
+					assert.NoError(t, err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	stats := cache.Stats()
+	assert.LessOrEqual(t, stats.Size, 8)
+	assert.NotZero(t, stats.Hits+stats.Misses)
+}
@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/jackc/pgx/v4"
+	"sync"
+)
+
+// DomainRepository хранит домен коротких ссылок, который пользователь выбрал по умолчанию
+type DomainRepository interface {
+	// UserDomain возвращает хост домена пользователя, пусто - пользователь домен не выбирал
+	UserDomain(ctx context.Context, userID string) (string, error)
+	// SetUserDomain выбирает домен пользователя, пусто - сбросить выбор
+	SetUserDomain(ctx context.Context, userID, domain string) error
+}
+
+// InitDomainRepository создает хранилище доменов пользователей в postgres, если есть подключение, иначе в памяти
+func InitDomainRepository(c context.Context, db *pgx.Conn) (DomainRepository, error) {
+	if db == nil {
+		return &MemoryDomainRepo{domains: map[string]string{}}, nil
+	}
+	_, err := db.Exec(c, "create table if not exists user_domains (user_id text primary key, domain text not null)")
+	if err != nil {
+		return nil, err
+	}
+	return &DBDomainRepo{db: db}, nil
+}
+
+type MemoryDomainRepo struct {
+	mu      sync.RWMutex
+	domains map[string]string
+}
+
+func (m *MemoryDomainRepo) UserDomain(ctx context.Context, userID string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.domains[userID], nil
+}
+
+func (m *MemoryDomainRepo) SetUserDomain(ctx context.Context, userID, domain string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(domain) == 0 {
+		delete(m.domains, userID)
+	} else {
+		m.domains[userID] = domain
+	}
+	return nil
+}
+
+type DBDomainRepo struct {
+	db *pgx.Conn
+}
+
+func (d *DBDomainRepo) UserDomain(ctx context.Context, userID string) (string, error) {
+	domain := ""
+	err := d.db.QueryRow(ctx, "SELECT domain from user_domains where user_id = $1", userID).Scan(&domain)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return domain, err
+}
+
+func (d *DBDomainRepo) SetUserDomain(ctx context.Context, userID, domain string) error {
+	if len(domain) == 0 {
+		_, err := d.db.Exec(ctx, "DELETE FROM user_domains where user_id = $1", userID)
+		return err
+	}
+	_, err := d.db.Exec(ctx, `INSERT INTO user_domains (user_id, domain) VALUES ($1, $2)
+		on conflict (user_id) do update set domain = excluded.domain`, userID, domain)
+	return err
+}
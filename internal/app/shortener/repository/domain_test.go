@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDomainRepository(t *testing.T) {
+	factories := []struct {
+		name string
+		init func(t *testing.T) DomainRepository
+	}{
+		{
+			name: "memory",
+			init: func(t *testing.T) DomainRepository {
+				repo, err := InitDomainRepository(context.Background(), nil)
+				require.NoError(t, err)
+				return repo
+			},
+		},
+		{
+			name: "postgres",
+			init: func(t *testing.T) DomainRepository {
+				repo, err := InitDomainRepository(context.Background(), openTestDB(t).db)
+				require.NoError(t, err)
+				return repo
+			},
+		},
+	}
+	for _, f := range factories {
+		t.Run(f.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := f.init(t)
+			user := fmt.Sprint(time.Now().UnixNano())
+			domain, err := repo.UserDomain(ctx, user)
+			require.NoError(t, err)
+			assert.Empty(t, domain)
+
+			require.NoError(t, repo.SetUserDomain(ctx, user, "a.co"))
+			require.NoError(t, repo.SetUserDomain(ctx, user, "b.co"))
+			domain, err = repo.UserDomain(ctx, user)
+			require.NoError(t, err)
+			assert.Equal(t, "b.co", domain)
+			domain, err = repo.UserDomain(ctx, user+"-other")
+			require.NoError(t, err)
+			assert.Empty(t, domain)
+
+			require.NoError(t, repo.SetUserDomain(ctx, user, ""))
+			domain, err = repo.UserDomain(ctx, user)
+			require.NoError(t, err)
+			assert.Empty(t, domain)
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package repository
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"time"
+)
+
+// IdempotencyRecord - ответ на запрос с ключом идемпотентности, который отдается повторно на ретраи
+type IdempotencyRecord struct {
+	// хеш запроса, чтобы отличить ретрай от другого запроса с тем же ключом
+	RequestHash string
+	// 0, пока первый запрос еще выполняется
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// Pending - первый запрос с этим ключом еще не получил ответ
+func (r *IdempotencyRecord) Pending() bool {
+	return r.StatusCode == 0
+}
+
+// IdempotencyRepository хранит ответы на запросы по паре пользователь и ключ идемпотентности.
+// Записи старше окна хранения считаются отсутствующими
+type IdempotencyRepository interface {
+	// Begin занимает ключ под новый запрос и возвращает nil, либо возвращает уже сохраненную запись
+	Begin(ctx context.Context, user, key, requestHash string) (*IdempotencyRecord, error)
+	// Complete сохраняет ответ на запрос, занявший ключ
+	Complete(ctx context.Context, user, key string, r *IdempotencyRecord) error
+	// Release освобождает ключ, если запрос не получил ответа, чтобы ретрай выполнился заново
+	Release(ctx context.Context, user, key string) error
+	// DeleteExpired удаляет записи старше окна хранения
+	DeleteExpired(ctx context.Context) error
+}
+
+var ErrInvalidIdempotencyTTL = errors.New("idempotency ttl must not be negative")
+
+// InitIdempotencyRepository создает хранилище ответов в postgres, если есть подключение, иначе в памяти,
+// и раз в окно хранения удаляет устаревшие записи. ttl 0 отключает идемпотентность: хранилище nil,
+// и заголовок Idempotency-Key игнорируется
+func InitIdempotencyRepository(c context.Context, db *pgx.Conn, ttl time.Duration) (IdempotencyRepository, error) {
+	if ttl < 0 {
+		return nil, errors.WithMessage(ErrInvalidIdempotencyTTL, ttl.String())
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+	var repo IdempotencyRepository = newMemoryIdempotencyRepo(ttl)
+	if db != nil {
+		_, err := db.Exec(c, `create table if not exists idempotency (user_id text not null, key text not null,
+			request_hash text not null, status_code integer not null default 0, content_type text not null default '',
+			body bytea, created_at timestamptz not null default now(), primary key (user_id, key))`)
+		if err != nil {
+			return nil, err
+		}
+		repo = &DBIdempotencyRepo{db: db, ttl: ttl}
+	}
+	go deleteExpiredEvery(repo, ttl)
+	return repo, nil
+}
+
+func deleteExpiredEvery(repo IdempotencyRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := repo.DeleteExpired(context.Background()); err != nil {
+			log.Printf("idempotency: delete expired: %v", err)
+		}
+	}
+}
+
+// MemoryIdempotencyRepo хранит ответы в шардированной мапе
+type MemoryIdempotencyRepo struct {
+	records shardedMap
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+func newMemoryIdempotencyRepo(ttl time.Duration) *MemoryIdempotencyRepo {
+	return &MemoryIdempotencyRepo{ttl: ttl, now: time.Now}
+}
+
+func idempotencyMapKey(user, key string) string {
+	return user + "\x00" + key
+}
+
+func (m *MemoryIdempotencyRepo) expired(r *IdempotencyRecord) bool {
+	return !m.now().Before(r.CreatedAt.Add(m.ttl))
+}
+
+func (m *MemoryIdempotencyRepo) Begin(ctx context.Context, user, key, requestHash string) (*IdempotencyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var existing *IdempotencyRecord
+	m.records.compute(idempotencyMapKey(user, key), func(old any, loaded bool) (any, bool) {
+		if loaded && !m.expired(old.(*IdempotencyRecord)) {
+			// копия, чтобы Complete не менял запись под читателем
+			r := *old.(*IdempotencyRecord)
+			existing = &r
+			return nil, false
+		}
+		return &IdempotencyRecord{RequestHash: requestHash, CreatedAt: m.now()}, true
+	})
+	return existing, nil
+}
+
+func (m *MemoryIdempotencyRepo) Complete(ctx context.Context, user, key string, r *IdempotencyRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.records.compute(idempotencyMapKey(user, key), func(old any, loaded bool) (any, bool) {
+		if !loaded {
+			return nil, false
+		}
+		completed := *r
+		completed.RequestHash, completed.CreatedAt = old.(*IdempotencyRecord).RequestHash, old.(*IdempotencyRecord).CreatedAt
+		return &completed, true
+	})
+	return nil
+}
+
+func (m *MemoryIdempotencyRepo) Release(ctx context.Context, user, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.records.delete(idempotencyMapKey(user, key), func(v any) bool {
+		return v.(*IdempotencyRecord).Pending()
+	})
+	return nil
+}
+
+func (m *MemoryIdempotencyRepo) DeleteExpired(ctx context.Context) error {
+	return eachInMap(ctx, &m.records, func(id string, v any) error {
+		m.records.delete(id, func(v any) bool {
+			return m.expired(v.(*IdempotencyRecord))
+		})
+		return nil
+	})
+}
+
+// DBIdempotencyRepo хранит ответы в таблице idempotency
+type DBIdempotencyRepo struct {
+	db  *pgx.Conn
+	ttl time.Duration
+}
+
+// Begin вставляет запись или занимает место устаревшей одним запросом, так что из конкурентных
+// запросов с одним ключом выполнится только один
+func (d *DBIdempotencyRepo) Begin(ctx context.Context, user, key, requestHash string) (*IdempotencyRecord, error) {
+	r := d.db.QueryRow(ctx, `INSERT INTO idempotency (user_id, key, request_hash, created_at) VALUES ($1, $2, $3, now())
+		on conflict (user_id, key) do update set request_hash = excluded.request_hash, status_code = 0, content_type = '',
+			body = null, created_at = excluded.created_at
+		where idempotency.created_at <= now() - $4::interval
+		RETURNING true`, user, key, requestHash, d.ttl)
+	reserved := false
+	err := r.Scan(&reserved)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	existing := &IdempotencyRecord{}
+	r = d.db.QueryRow(ctx, "SELECT request_hash, status_code, content_type, body, created_at from idempotency where user_id = $1 and key = $2",
+		user, key)
+	err = r.Scan(&existing.RequestHash, &existing.StatusCode, &existing.ContentType, &existing.Body, &existing.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// запись удалили между запросами, пробуем занять ключ заново
+		return d.Begin(ctx, user, key, requestHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (d *DBIdempotencyRepo) Complete(ctx context.Context, user, key string, r *IdempotencyRecord) error {
+	_, err := d.db.Exec(ctx, "UPDATE idempotency SET status_code = $3, content_type = $4, body = $5 where user_id = $1 and key = $2",
+		user, key, r.StatusCode, r.ContentType, r.Body)
+	return err
+}
+
+func (d *DBIdempotencyRepo) Release(ctx context.Context, user, key string) error {
+	_, err := d.db.Exec(ctx, "DELETE FROM idempotency where user_id = $1 and key = $2 and status_code = 0", user, key)
+	return err
+}
+
+func (d *DBIdempotencyRepo) DeleteExpired(ctx context.Context) error {
+	_, err := d.db.Exec(ctx, "DELETE FROM idempotency where created_at <= now() - $1::interval", d.ttl)
+	return err
+}
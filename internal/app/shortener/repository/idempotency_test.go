@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyRepository(t *testing.T) {
+	factories := []struct {
+		name string
+		init func(t *testing.T) IdempotencyRepository
+	}{
+		{
+			name: "memory",
+			init: func(t *testing.T) IdempotencyRepository {
+				return newMemoryIdempotencyRepo(time.Hour)
+			},
+		},
+		{
+			name: "postgres",
+			init: func(t *testing.T) IdempotencyRepository {
+				repo, err := InitIdempotencyRepository(context.Background(), openTestDB(t).db, time.Hour)
+				require.NoError(t, err)
+				return repo
+			},
+		},
+	}
+	for _, f := range factories {
+		t.Run(f.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := f.init(t)
+			user, key := fmt.Sprint(time.Now().UnixNano()), "key"
+			existing, err := repo.Begin(ctx, user, key, "hash")
+			require.NoError(t, err)
+			assert.Nil(t, existing)
+
+			existing, err = repo.Begin(ctx, user, key, "hash")
+			require.NoError(t, err)
+			require.NotNil(t, existing)
+			assert.True(t, existing.Pending())
+
+			// освобожденный ключ занимается заново
+			require.NoError(t, repo.Release(ctx, user, key))
+			existing, err = repo.Begin(ctx, user, key, "other hash")
+			require.NoError(t, err)
+			assert.Nil(t, existing)
+
+			require.NoError(t, repo.Complete(ctx, user, key, &IdempotencyRecord{StatusCode: 201, ContentType: "text/plain", Body: []byte("body")}))
+			// завершенный ответ Release не удаляет
+			require.NoError(t, repo.Release(ctx, user, key))
+			existing, err = repo.Begin(ctx, user, key, "hash")
+			require.NoError(t, err)
+			require.NotNil(t, existing)
+			assert.Equal(t, "other hash", existing.RequestHash)
+			assert.Equal(t, 201, existing.StatusCode)
+			assert.Equal(t, "text/plain", existing.ContentType)
+			assert.Equal(t, []byte("body"), existing.Body)
+
+			// ключи разных пользователей не пересекаются
+			existing, err = repo.Begin(ctx, user+"-other", key, "hash")
+			require.NoError(t, err)
+			assert.Nil(t, existing)
+		})
+	}
+}
+
+func TestMemoryIdempotencyRepo_Expiry(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryIdempotencyRepo(time.Minute)
+	now := time.Now()
+	repo.now = func() time.Time {
+		return now
+	}
+	_, err := repo.Begin(ctx, "1", "a", "hash")
+	require.NoError(t, err)
+	_, err = repo.Begin(ctx, "1", "b", "hash")
+	require.NoError(t, err)
+	require.NoError(t, repo.Complete(ctx, "1", "a", &IdempotencyRecord{StatusCode: 201}))
+
+	now = now.Add(time.Minute)
+	existing, err := repo.Begin(ctx, "1", "a", "new hash")
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+	require.NoError(t, repo.DeleteExpired(ctx))
+	assert.Equal(t, 1, repo.records.Len())
+}
+
+func TestInitIdempotencyRepository_TTL(t *testing.T) {
+	repo, err := InitIdempotencyRepository(context.Background(), nil, 0)
+	require.NoError(t, err)
+	assert.Nil(t, repo)
+
+	_, err = InitIdempotencyRepository(context.Background(), nil, -time.Second)
+	assert.ErrorIs(t, err, ErrInvalidIdempotencyTTL)
+}
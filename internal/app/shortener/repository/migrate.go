@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/jackc/pgx/v4"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+	"time"
+)
+
+// ConflictStrategy - что делать при импорте записи, ключ которой уже занят
+type ConflictStrategy string
+
+const (
+	// ConflictSkip - оставить существующую запись
+	ConflictSkip ConflictStrategy = "skip"
+	// ConflictOverwrite - заменить существующую запись импортируемой
+	ConflictOverwrite ConflictStrategy = "overwrite"
+	// ConflictFail - прервать импорт с ErrDuplicate
+	ConflictFail ConflictStrategy = "fail"
+)
+
+var ErrUnknownConflictStrategy = errors.New("unknown conflict strategy")
+
+func ParseConflictStrategy(s string) (ConflictStrategy, error) {
+	switch c := ConflictStrategy(s); c {
+	case ConflictSkip, ConflictOverwrite, ConflictFail:
+		return c, nil
+	default:
+		return "", errors.WithMessage(ErrUnknownConflictStrategy, s)
+	}
+}
+
+// Migratable - репозиторий, все записи которого можно выгрузить и загрузить обратно с сохранением ключей.
+// Репозитории ссылок работают с *types.Link, репозитории пользователей - с []string
+type Migratable interface {
+	// Each вызывает f для каждой записи, ошибка f прерывает перебор
+	Each(ctx context.Context, f func(id string, v any) error) error
+	// Put записывает значение под заданным ключом и возвращает false, если запись пропущена из-за конфликта
+	Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error)
+}
+
+// resolveConflict решает судьбу записи с занятым ключом: true - перезаписать, false - пропустить
+func resolveConflict(onConflict ConflictStrategy) (bool, error) {
+	switch onConflict {
+	case ConflictOverwrite:
+		return true, nil
+	case ConflictSkip:
+		return false, nil
+	default:
+		return false, ErrDuplicate
+	}
+}
+
+func eachInMap(ctx context.Context, sMap rangeable, f func(id string, v any) error) error {
+	var err error
+	sMap.Range(func(key, value any) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		err = f(key.(string), value)
+		return err == nil
+	})
+	return err
+}
+
+func (d *DBURLRepo) Each(ctx context.Context, f func(id string, v any) error) error {
+	rows, err := d.db.Query(ctx, "SELECT shortenhash, "+linkColumns+" from url order by shortenhash")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		id := ""
+		l, err := scanLink(rows, &id)
+		if err != nil {
+			return err
+		}
+		if err := f(id, l); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (d *DBURLRepo) Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error) {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return false, TypeError(v)
+	}
+	onConflictSQL := "do nothing"
+	if onConflict == ConflictOverwrite {
+		onConflictSQL = `(shortenhash) do update set unshortenurl = excluded.unshortenurl, max_clicks = excluded.max_clicks,
+			clicks = excluded.clicks, created_at = excluded.created_at, redirect_code = excluded.redirect_code,
+			query_mode = excluded.query_mode, utm = excluded.utm, disabled = excluded.disabled`
+	}
+	createdAt := l.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	r := d.db.QueryRow(ctx, `INSERT INTO url (shortenhash, `+linkColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) on conflict `+onConflictSQL+` RETURNING shortenhash`,
+		id, l.URL.String(), l.MaxClicks, l.Clicks, createdAt, l.RedirectCode, string(l.QueryMode), l.UTM.Encode(), string(l.Disabled))
+	return scanPut(r, onConflict)
+}
+
+func (d *DBUserRepo) Each(ctx context.Context, f func(id string, v any) error) error {
+	rows, err := d.db.Query(ctx, "select id, urls from users order by id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		id := 0
+		urls := make([]string, 0)
+		if err := rows.Scan(&id, &urls); err != nil {
+			return err
+		}
+		if err := f(strconv.Itoa(id), urls); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (d *DBUserRepo) Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error) {
+	u, ok := v.([]string)
+	if u != nil && !ok {
+		return false, TypeError(v)
+	}
+	numericID, err := strconv.Atoi(id)
+	if err != nil {
+		return false, err
+	}
+	onConflictSQL := "do nothing"
+	if onConflict == ConflictOverwrite {
+		onConflictSQL = "(id) do update set urls = excluded.urls"
+	}
+	r := d.db.QueryRow(ctx, "INSERT INTO users (id, urls) VALUES ($1, $2) on conflict "+onConflictSQL+" RETURNING id", numericID, u)
+	imported, err := scanPut(r, onConflict)
+	if err != nil || !imported {
+		return imported, err
+	}
+	// serial должен выдавать новым пользователям id больше импортированных
+	_, err = d.db.Exec(ctx, "SELECT setval(pg_get_serial_sequence('users', 'id'), (SELECT max(id) FROM users))")
+	return true, err
+}
+
+// scanPut разбирает результат INSERT ... RETURNING: отсутствие строки означает, что ключ занят
+func scanPut(r pgx.Row, onConflict ConflictStrategy) (bool, error) {
+	var id any
+	err := r.Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return resolveConflict(onConflict)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *BoltURLRepo) Each(ctx context.Context, f func(id string, v any) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(urlBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var record backUpValue
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			return f(string(k), record.link())
+		})
+	})
+}
+
+func (b *BoltURLRepo) Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error) {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return false, TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	stored := *l
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now()
+	}
+	imported := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(urlBucket)
+		if bucket.Get([]byte(id)) != nil {
+			overwrite, err := resolveConflict(onConflict)
+			if !overwrite {
+				return err
+			}
+		}
+		imported = true
+		return putJSON(bucket, id, newBackUpValue(id, &stored))
+	})
+	return imported, err
+}
+
+func (b *BoltUserRepo) Each(ctx context.Context, f func(id string, v any) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var u []string
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			return f(string(k), u)
+		})
+	})
+}
+
+func (b *BoltUserRepo) Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error) {
+	u, ok := v.([]string)
+	if u != nil && !ok {
+		return false, TypeError(v)
+	}
+	numericID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	imported := false
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket.Get([]byte(id)) != nil {
+			overwrite, err := resolveConflict(onConflict)
+			if !overwrite {
+				return err
+			}
+		}
+		imported = true
+		if numericID > bucket.Sequence() {
+			if err := bucket.SetSequence(numericID); err != nil {
+				return err
+			}
+		}
+		return putJSON(bucket, id, u)
+	})
+	return imported, err
+}
@@ -0,0 +1,334 @@
+package repository
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v4"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/exp/slices"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrModerationNotSupported = errors.New("repository does not support moderation")
+
+// FoundLink - ссылка, найденная поиском, вместе с ключом
+type FoundLink struct {
+	ID   string
+	Link *types.Link
+}
+
+// HostSearcher - репозиторий ссылок, который ищет ссылки по хосту оригинального урла
+type HostSearcher interface {
+	// SearchByHost возвращает до limit ссылок на host и его поддомены по возрастанию ключа
+	SearchByHost(ctx context.Context, host string, limit int) ([]FoundLink, error)
+}
+
+// LinkOwners - репозиторий пользователей, который находит владельцев ссылки и передает ее другому пользователю
+type LinkOwners interface {
+	// Owners возвращает id пользователей, у которых есть ссылка, по возрастанию
+	Owners(ctx context.Context, linkID string) ([]string, error)
+	// Transfer забирает ссылку у всех владельцев и отдает пользователю to. Если пользователя нет - ErrNoSuchValue
+	Transfer(ctx context.Context, linkID, to string) error
+}
+
+// LinkDisabler - репозиторий ссылок, который меняет причину отключения ссылки, не трогая остальные поля,
+// чтобы конкурентные переходы не терялись
+type LinkDisabler interface {
+	// SetDisabled отключает ссылку по причине reason, types.Enabled включает ее. Если ссылки нет - ErrNoSuchValue
+	SetDisabled(ctx context.Context, id string, reason types.DisableReason) error
+}
+
+// MatchHost проверяет, ведет ли урл на host или его поддомен. Регистр и точка в конце имени не важны
+func MatchHost(u *url.URL, host string) bool {
+	if u == nil {
+		return false
+	}
+	h := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return len(host) != 0 && (h == host || strings.HasSuffix(h, "."+host))
+}
+
+func (s *ShardedURLRepo) SearchByHost(ctx context.Context, host string, limit int) ([]FoundLink, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var found []FoundLink
+	s.links.Range(func(key, value any) bool {
+		if l, ok := value.(*types.Link); ok && MatchHost(l.URL, host) {
+			found = append(found, FoundLink{ID: key.(string), Link: l})
+		}
+		return true
+	})
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].ID < found[j].ID
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+// SetDisabled подменяет ссылку копией под блокировкой шарда, как Click, поэтому переходы не теряются,
+// а запись в журнал не обгоняет запись конкурентного перехода
+func (s *ShardedURLRepo) SetDisabled(ctx context.Context, id string, reason types.DisableReason) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	s.links.compute(id, func(old any, loaded bool) (any, bool) {
+		if !loaded {
+			err = ErrNoSuchValue
+			return nil, false
+		}
+		l, ok := old.(*types.Link)
+		if !ok {
+			err = ErrUnexpectedTypeInMap
+			return nil, false
+		}
+		c := *l
+		c.Disabled = reason
+		if err = s.backUp.writeLink(id, &c); err != nil {
+			return nil, false
+		}
+		return &c, true
+	})
+	return err
+}
+
+func (s *ShardedUserRepo) Owners(ctx context.Context, linkID string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var owners []string
+	s.users.Range(func(key, value any) bool {
+		if u, ok := value.([]string); ok && slices.Contains(u, linkID) {
+			owners = append(owners, key.(string))
+		}
+		return true
+	})
+	sortIDs(owners)
+	return owners, nil
+}
+
+// Transfer меняет списки ссылок каждого пользователя под блокировкой его шарда,
+// так что конкурентное добавление ссылок не теряется
+func (s *ShardedUserRepo) Transfer(ctx context.Context, linkID, to string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, ok := s.users.Load(to); !ok {
+		return ErrNoSuchValue
+	}
+	owners, err := s.Owners(ctx, linkID)
+	if err != nil {
+		return err
+	}
+	for _, id := range owners {
+		if id == to {
+			continue
+		}
+		if err := s.updateURLs(id, func(u []string) ([]string, bool) {
+			i := slices.Index(u, linkID)
+			if i < 0 {
+				return nil, false
+			}
+			rest := make([]string, 0, len(u)-1)
+			return append(append(rest, u[:i]...), u[i+1:]...), true
+		}); err != nil {
+			return err
+		}
+	}
+	return s.updateURLs(to, func(u []string) ([]string, bool) {
+		if slices.Contains(u, linkID) {
+			return nil, false
+		}
+		return append(append(make([]string, 0, len(u)+1), u...), linkID), true
+	})
+}
+
+// updateURLs заменяет список ссылок пользователя результатом f, если f вернула true
+func (s *ShardedUserRepo) updateURLs(id string, f func(u []string) ([]string, bool)) error {
+	var err error
+	s.users.compute(id, func(old any, loaded bool) (any, bool) {
+		u, _ := old.([]string)
+		updated, changed := f(u)
+		if !changed {
+			return nil, false
+		}
+		if err = s.backUp.writeUser(id, updated); err != nil {
+			return nil, false
+		}
+		return updated, true
+	})
+	return err
+}
+
+// SearchByHost отбирает кандидатов по подстроке в базе, а хост сверяет уже по разобранному урлу
+func (d *DBURLRepo) SearchByHost(ctx context.Context, host string, limit int) ([]FoundLink, error) {
+	rows, err := d.db.Query(ctx, `SELECT shortenhash, `+linkColumns+` from url
+		where unshortenurl ILIKE '%' || $1 || '%' ESCAPE '\' order by shortenhash`, escapeLike(host))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []FoundLink
+	for rows.Next() && len(found) < limit {
+		id := ""
+		l, err := scanLink(rows, &id)
+		if err != nil {
+			return nil, err
+		}
+		if MatchHost(l.URL, host) {
+			found = append(found, FoundLink{ID: id, Link: l})
+		}
+	}
+	return found, rows.Err()
+}
+
+func (d *DBURLRepo) SetDisabled(ctx context.Context, id string, reason types.DisableReason) error {
+	tag, err := d.db.Exec(ctx, "UPDATE url set disabled = $1 where shortenhash = $2", string(reason), id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchValue
+	}
+	return nil
+}
+
+func (d *DBUserRepo) Owners(ctx context.Context, linkID string) ([]string, error) {
+	rows, err := d.db.Query(ctx, "select id from users where $1 = ANY(urls) order by id", linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var owners []string
+	for rows.Next() {
+		id := 0
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		owners = append(owners, strconv.Itoa(id))
+	}
+	return owners, rows.Err()
+}
+
+func (d *DBUserRepo) Transfer(ctx context.Context, linkID, to string) error {
+	tx, err := d.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tx.Rollback(ctx)
+		if err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Println(err)
+		}
+	}()
+	var exists bool
+	if err := tx.QueryRow(ctx, "select true from users where id = $1 for update", to).Scan(&exists); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNoSuchValue
+		}
+		return err
+	}
+	_, err = tx.Exec(ctx, "UPDATE users set urls = array_remove(urls, $1) where $1 = ANY(urls) and id <> $2", linkID, to)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE users set urls = array_append(coalesce(urls, '{}'), $1)
+		where id = $2 and not $1 = ANY(coalesce(urls, '{}'))`, linkID, to)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (c *CachedURLRepo) SearchByHost(ctx context.Context, host string, limit int) ([]FoundLink, error) {
+	s, ok := c.repo.(HostSearcher)
+	if !ok {
+		return nil, ErrModerationNotSupported
+	}
+	return s.SearchByHost(ctx, host, limit)
+}
+
+func (c *CachedURLRepo) SetDisabled(ctx context.Context, id string, reason types.DisableReason) error {
+	d, ok := c.repo.(LinkDisabler)
+	if !ok {
+		return ErrModerationNotSupported
+	}
+	err := d.SetDisabled(ctx, id, reason)
+	c.invalidate(id)
+	return err
+}
+
+// SetDisabled меняет ссылку в пишущей транзакции, которая в bolt одна за раз, так что переходы не теряются
+func (b *BoltURLRepo) SetDisabled(ctx context.Context, id string, reason types.DisableReason) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(urlBucket)
+		l, err := getLink(bucket, id)
+		if err != nil {
+			return err
+		}
+		l.Disabled = reason
+		return putJSON(bucket, id, newBackUpValue(id, l))
+	})
+}
+
+// SetDisabled переписывает ссылку оптимистичной транзакцией. Счетчик переходов лежит отдельным ключом
+// и не меняется
+func (r *RedisURLRepo) SetDisabled(ctx context.Context, id string, reason types.DisableReason) error {
+	key := redisLinkPrefix + id
+	for {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			raw, err := tx.Get(ctx, key).Result()
+			if errors.Is(err, redis.Nil) {
+				return ErrNoSuchValue
+			}
+			if err != nil {
+				return err
+			}
+			var record backUpValue
+			if err := json.Unmarshal([]byte(raw), &record); err != nil {
+				return err
+			}
+			record.Disabled = string(reason)
+			b, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetXX(ctx, key, b, redis.KeepTTL)
+				return nil
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+}
+
+// escapeLike экранирует спецсимволы шаблона LIKE
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// sortIDs сортирует числовые id пользователей по значению
+func sortIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		if len(ids[i]) != len(ids[j]) {
+			return len(ids[i]) < len(ids[j])
+		}
+		return ids[i] < ids[j]
+	})
+}
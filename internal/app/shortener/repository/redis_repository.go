@@ -0,0 +1,468 @@
+package repository
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Раскладка ключей: ссылка хранится JSON-ом в link:<id>, счетчик переходов - отдельным числом в clicks:<id>,
+// чтобы переход засчитывался атомарным INCR. Пользователи лежат в user:<id>, их id выдает счетчик users:seq
+const (
+	redisLinkPrefix   = "link:"
+	redisClicksPrefix = "clicks:"
+	redisUserPrefix   = "user:"
+	redisUserSeq      = "users:seq"
+	// сколько ключей запрашивать за один SCAN
+	redisScanCount = 256
+)
+
+// RedisURLRepo хранит ссылки в redis или совместимом с ним сервере. Ключ ссылки занимается командой
+// SET NX, поэтому несколько инстансов сервиса не могут выдать один ключ разным ссылкам
+type RedisURLRepo struct {
+	client *redis.Client
+	// время жизни ссылки, 0 - бессрочно
+	ttl time.Duration
+}
+
+type RedisUserRepo struct {
+	client *redis.Client
+}
+
+func initRedisRepositories(c context.Context, rawURL string, ttl time.Duration) (URLRepository, Repository, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(c).Err(); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return &RedisURLRepo{client: client, ttl: ttl}, &RedisUserRepo{client: client}, nil
+}
+
+func (r *RedisURLRepo) Create(ctx context.Context, v any) (string, error) {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return "", TypeError(v)
+	}
+	stored, value, err := r.encodeNewLink(l)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 1; ; attempt++ {
+		key, err := createLinkHash(l)
+		if err != nil {
+			return "", err
+		}
+		reserved, err := r.client.SetNX(ctx, redisLinkPrefix+key, value, r.ttl).Result()
+		if err != nil {
+			return "", err
+		}
+		if reserved {
+			return key, r.initClicks(ctx, r.client, key, stored.Clicks).Err()
+		}
+		if l.MaxClicks == 0 || attempt == maxKeyAttempts {
+			return key, ErrDuplicate
+		}
+	}
+}
+
+// CreateArray занимает ключи всех ссылок одним пайплайном. Ссылкам с лимитом переходов, чей случайный
+// ключ оказался занят, ключ подбирается заново по одной
+func (r *RedisURLRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
+	links, ok := v.([]*types.Link)
+	if !ok {
+		return nil, TypeError(v)
+	}
+	result := make([]string, len(links))
+	values := make([]string, len(links))
+	reservations := make([]*redis.BoolCmd, len(links))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, l := range links {
+			_, value, err := r.encodeNewLink(l)
+			if err != nil {
+				return err
+			}
+			if result[i], err = createLinkHash(l); err != nil {
+				return err
+			}
+			values[i] = value
+			reservations[i] = pipe.SetNX(ctx, redisLinkPrefix+result[i], value, r.ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var duplicates []int
+	reserved := make([]string, 0, len(links))
+	for i, l := range links {
+		if reservations[i].Val() {
+			reserved = append(reserved, result[i])
+			continue
+		}
+		if l.MaxClicks == 0 {
+			duplicates = append(duplicates, i)
+			continue
+		}
+		id, err := r.Create(ctx, l)
+		if errors.Is(err, ErrDuplicate) {
+			duplicates = append(duplicates, i)
+		} else if err != nil {
+			return nil, err
+		}
+		result[i] = id
+	}
+	if r.ttl > 0 && len(reserved) != 0 {
+		_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range reserved {
+				r.initClicks(ctx, pipe, key, 0)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, duplicatesError(duplicates)
+}
+
+func (r *RedisURLRepo) Read(ctx context.Context, id string) (any, error) {
+	values, err := r.client.MGet(ctx, redisLinkPrefix+id, redisClicksPrefix+id).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeRedisLink(values[0], values[1])
+}
+
+// Update заменяет ссылку, сохраняя время жизни ключа
+func (r *RedisURLRepo) Update(ctx context.Context, id string, v any) error {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return TypeError(v)
+	}
+	value, err := encodeRedisLink(id, l)
+	if err != nil {
+		return err
+	}
+	updated, err := r.client.SetXX(ctx, redisLinkPrefix+id, value, redis.KeepTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return ErrNoSuchValue
+	}
+	return r.client.Set(ctx, redisClicksPrefix+id, l.Clicks, redis.KeepTTL).Err()
+}
+
+// Click засчитывает переход атомарным INCR: переход разрешен, только если INCR вернул значение
+// не больше лимита, так что конкурентные переходы не превышают max_clicks
+func (r *RedisURLRepo) Click(ctx context.Context, id string) (any, error) {
+	v, err := r.Read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	l := v.(*types.Link)
+	if l.IsDisabled() {
+		return l, ErrLinkDisabled
+	}
+	if l.IsExhausted() {
+		return l, ErrClicksExhausted
+	}
+	clicks, err := r.client.Incr(ctx, redisClicksPrefix+id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if l.MaxClicks > 0 && clicks > int64(l.MaxClicks) {
+		// переход проиграл гонку за последний разрешенный клик, возвращаем счетчик к лимиту
+		r.client.Decr(ctx, redisClicksPrefix+id)
+		l.Clicks = l.MaxClicks
+		return l, ErrClicksExhausted
+	}
+	l.Clicks = int(clicks)
+	return l, nil
+}
+
+func (r *RedisURLRepo) Each(ctx context.Context, f func(id string, v any) error) error {
+	return scanRedis(ctx, r.client, redisLinkPrefix, func(ids []string) error {
+		keys := make([]string, 0, 2*len(ids))
+		for _, id := range ids {
+			keys = append(keys, redisLinkPrefix+id, redisClicksPrefix+id)
+		}
+		values, err := r.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			l, err := decodeRedisLink(values[2*i], values[2*i+1])
+			if errors.Is(err, ErrNoSuchValue) {
+				// ключ истек между SCAN и MGET
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := f(id, l); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *RedisURLRepo) Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error) {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return false, TypeError(v)
+	}
+	stored, value, err := r.encodeNewLink(l)
+	if err != nil {
+		return false, err
+	}
+	if onConflict == ConflictOverwrite {
+		err = r.client.Set(ctx, redisLinkPrefix+id, value, r.ttl).Err()
+	} else {
+		var reserved bool
+		reserved, err = r.client.SetNX(ctx, redisLinkPrefix+id, value, r.ttl).Result()
+		if err == nil && !reserved {
+			return resolveConflict(onConflict)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, r.initClicks(ctx, r.client, id, stored.Clicks).Err()
+}
+
+// encodeNewLink проставляет дату создания новой ссылки и кодирует ее
+func (r *RedisURLRepo) encodeNewLink(l *types.Link) (*types.Link, string, error) {
+	stored := *l
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now()
+	}
+	value, err := encodeRedisLink("", &stored)
+	return &stored, value, err
+}
+
+// initClicks создает счетчик переходов с тем же временем жизни, что и ссылка.
+// Для бессрочных ссылок без переходов счетчик не нужен: INCR создаст его сам
+func (r *RedisURLRepo) initClicks(ctx context.Context, c redis.Cmdable, id string, clicks int) *redis.StatusCmd {
+	if r.ttl == 0 && clicks == 0 {
+		return redis.NewStatusResult("OK", nil)
+	}
+	return c.Set(ctx, redisClicksPrefix+id, clicks, r.ttl)
+}
+
+func encodeRedisLink(id string, l *types.Link) (string, error) {
+	record := newBackUpValue(id, l)
+	// счетчик хранится отдельным ключом
+	record.Clicks = 0
+	b, err := json.Marshal(record)
+	return string(b), err
+}
+
+func decodeRedisLink(rawLink, rawClicks any) (*types.Link, error) {
+	s, ok := rawLink.(string)
+	if !ok {
+		return nil, ErrNoSuchValue
+	}
+	var record backUpValue
+	if err := json.Unmarshal([]byte(s), &record); err != nil {
+		return nil, err
+	}
+	l := record.link()
+	if c, ok := rawClicks.(string); ok {
+		clicks, err := strconv.Atoi(c)
+		if err != nil {
+			return nil, err
+		}
+		l.Clicks = clicks
+	}
+	if l.MaxClicks > 0 && l.Clicks > l.MaxClicks {
+		l.Clicks = l.MaxClicks
+	}
+	return l, nil
+}
+
+func (r *RedisUserRepo) Create(ctx context.Context, v any) (string, error) {
+	u, ok := v.([]string)
+	if u != nil && !ok {
+		return "", TypeError(v)
+	}
+	ids, err := r.createUsers(ctx, [][]string{u})
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+func (r *RedisUserRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
+	usersURLs, ok := v.([][]string)
+	if !ok {
+		return nil, TypeError(v)
+	}
+	return r.createUsers(ctx, usersURLs)
+}
+
+// createUsers выделяет id всем пользователям одним INCRBY и записывает их одним пайплайном
+func (r *RedisUserRepo) createUsers(ctx context.Context, usersURLs [][]string) ([]string, error) {
+	if len(usersURLs) == 0 {
+		return []string{}, nil
+	}
+	last, err := r.client.IncrBy(ctx, redisUserSeq, int64(len(usersURLs))).Result()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(usersURLs))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, u := range usersURLs {
+			ids[i] = strconv.FormatInt(last-int64(len(usersURLs)-1-i), 10)
+			b, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			pipe.Set(ctx, redisUserPrefix+ids[i], b, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (r *RedisUserRepo) Read(ctx context.Context, id string) (any, error) {
+	b, err := r.client.Get(ctx, redisUserPrefix+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNoSuchValue
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u []string
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (r *RedisUserRepo) Update(ctx context.Context, id string, v any) error {
+	u, ok := v.([]string)
+	if !ok {
+		return TypeError(v)
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, redisUserPrefix+id, b, 0).Err()
+}
+
+func (r *RedisUserRepo) Each(ctx context.Context, f func(id string, v any) error) error {
+	return scanRedis(ctx, r.client, redisUserPrefix, func(ids []string) error {
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = redisUserPrefix + id
+		}
+		values, err := r.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			s, ok := values[i].(string)
+			if !ok {
+				continue
+			}
+			var u []string
+			if err := json.Unmarshal([]byte(s), &u); err != nil {
+				return err
+			}
+			if err := f(id, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *RedisUserRepo) Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error) {
+	u, ok := v.([]string)
+	if u != nil && !ok {
+		return false, TypeError(v)
+	}
+	numericID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	b, err := json.Marshal(u)
+	if err != nil {
+		return false, err
+	}
+	if onConflict == ConflictOverwrite {
+		err = r.client.Set(ctx, redisUserPrefix+id, b, 0).Err()
+	} else {
+		var reserved bool
+		reserved, err = r.client.SetNX(ctx, redisUserPrefix+id, b, 0).Result()
+		if err == nil && !reserved {
+			return resolveConflict(onConflict)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, r.raiseSeq(ctx, numericID)
+}
+
+// raiseSeq поднимает счетчик id до id импортированного пользователя оптимистичной транзакцией
+func (r *RedisUserRepo) raiseSeq(ctx context.Context, id int64) error {
+	for {
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			last, err := tx.Get(ctx, redisUserSeq).Int64()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			if last >= id {
+				return nil
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, redisUserSeq, id, 0)
+				return nil
+			})
+			return err
+		}, redisUserSeq)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+}
+
+// scanRedis перебирает ключи с префиксом через SCAN и передает f их id пачками
+func scanRedis(ctx context.Context, client *redis.Client, prefix string, f func(ids []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, prefix+"*", redisScanCount).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) != 0 {
+			ids := make([]string, len(keys))
+			for i, k := range keys {
+				ids[i] = strings.TrimPrefix(k, prefix)
+			}
+			if err := f(ids); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func openTestRedis(tb testing.TB, ttl time.Duration) (URLRepository, Repository, *miniredis.Miniredis) {
+	server := miniredis.RunT(tb)
+	urlRepo, userRepo, err := initRedisRepositories(context.Background(), "redis://"+server.Addr(), ttl)
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		urlRepo.(*RedisURLRepo).client.Close()
+	})
+	return urlRepo, userRepo, server
+}
+
+func TestRedisURLRepo_TTL(t *testing.T) {
+	ctx := context.Background()
+	urlRepo, _, server := openTestRedis(t, time.Hour)
+	id, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/"), MaxClicks: 5})
+	require.NoError(t, err)
+	_, err = urlRepo.Click(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, server.TTL(redisLinkPrefix+id))
+	assert.Equal(t, time.Hour, server.TTL(redisClicksPrefix+id))
+
+	// обновление ссылки не продлевает ей жизнь
+	server.FastForward(30 * time.Minute)
+	require.NoError(t, urlRepo.Update(ctx, id, &types.Link{URL: mustParseURL(t, "https://test.com/new"), MaxClicks: 5, Clicks: 1}))
+	assert.Equal(t, 30*time.Minute, server.TTL(redisLinkPrefix+id))
+
+	server.FastForward(30 * time.Minute)
+	_, err = urlRepo.Read(ctx, id)
+	assert.ErrorIs(t, err, ErrNoSuchValue)
+	_, err = urlRepo.Click(ctx, id)
+	assert.ErrorIs(t, err, ErrNoSuchValue)
+	assert.ErrorIs(t, urlRepo.Update(ctx, id, &types.Link{URL: mustParseURL(t, "https://test.com/")}), ErrNoSuchValue)
+}
+
+func TestRedisURLRepo_CreateArrayDuplicates(t *testing.T) {
+	ctx := context.Background()
+	urlRepo, _, _ := openTestRedis(t, 0)
+	existing, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/1")})
+	require.NoError(t, err)
+	links := []*types.Link{
+		{URL: mustParseURL(t, "https://test.com/1")},
+		{URL: mustParseURL(t, "https://test.com/2")},
+		{URL: mustParseURL(t, "https://test.com/1"), MaxClicks: 1},
+	}
+	ids, err := urlRepo.CreateArray(ctx, links)
+	var duplicates *DuplicatesError
+	require.ErrorAs(t, err, &duplicates)
+	assert.Equal(t, []int{0}, duplicates.Indexes)
+	require.Len(t, ids, len(links))
+	assert.Equal(t, existing, ids[0])
+	// ссылка с лимитом получает собственный ключ
+	assert.NotEqual(t, existing, ids[2])
+	for i, id := range ids {
+		v, err := urlRepo.Read(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, links[i].URL.String(), v.(*types.Link).URL.String())
+	}
+}
+
+func TestRedisRepositories_Migrate(t *testing.T) {
+	ctx := context.Background()
+	urlRepo, userRepo, _ := openTestRedis(t, 0)
+	migratableURLs := urlRepo.(Migratable)
+	imported, err := migratableURLs.Put(ctx, "abc", &types.Link{URL: mustParseURL(t, "https://test.com/"), MaxClicks: 3, Clicks: 2}, ConflictFail)
+	require.NoError(t, err)
+	assert.True(t, imported)
+	_, err = migratableURLs.Put(ctx, "abc", &types.Link{URL: mustParseURL(t, "https://test.com/other")}, ConflictFail)
+	assert.ErrorIs(t, err, ErrDuplicate)
+	imported, err = migratableURLs.Put(ctx, "abc", &types.Link{URL: mustParseURL(t, "https://test.com/other")}, ConflictSkip)
+	require.NoError(t, err)
+	assert.False(t, imported)
+
+	links := map[string]*types.Link{}
+	require.NoError(t, migratableURLs.Each(ctx, func(id string, v any) error {
+		links[id] = v.(*types.Link)
+		return nil
+	}))
+	require.Len(t, links, 1)
+	assert.Equal(t, 2, links["abc"].Clicks)
+	assert.Equal(t, "https://test.com/", links["abc"].URL.String())
+
+	imported, err = userRepo.(Migratable).Put(ctx, "41", []string{"abc"}, ConflictFail)
+	require.NoError(t, err)
+	assert.True(t, imported)
+	// новые пользователи не должны получить id импортированных
+	id, err := userRepo.Create(ctx, []string(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "42", id)
+}
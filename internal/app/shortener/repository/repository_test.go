@@ -0,0 +1,285 @@
+package repository
+
+import (
+	"context"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type repositoryFactory struct {
+	name string
+	init func(tb testing.TB) (URLRepository, Repository)
+}
+
+// repositoryFactories - все реализации, на которых гоняются общие тесты поведения и бенчмарки
+func repositoryFactories() []repositoryFactory {
+	return []repositoryFactory{
+		{
+			name: "sync map",
+			init: func(testing.TB) (URLRepository, Repository) {
+				return new(SyncMapURLRepo), &SyncMapUserRepo{lastID: 1}
+			},
+		},
+		{
+			name: "sharded",
+			init: func(testing.TB) (URLRepository, Repository) {
+				return new(ShardedURLRepo), newShardedUserRepo()
+			},
+		},
+		{
+			name: "bolt",
+			init: func(tb testing.TB) (URLRepository, Repository) {
+				urlRepo, userRepo, _ := openTestBolt(tb, filepath.Join(tb.TempDir(), "test.db"))
+				return urlRepo, userRepo
+			},
+		},
+		{
+			name: "redis",
+			init: func(tb testing.TB) (URLRepository, Repository) {
+				urlRepo, userRepo, _ := openTestRedis(tb, 0)
+				return urlRepo, userRepo
+			},
+		},
+	}
+}
+
+func openTestBolt(tb testing.TB, path string) (URLRepository, Repository, *bolt.DB) {
+	db, err := bolt.Open(path, 0o600, nil)
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		db.Close()
+	})
+	urlRepo, userRepo, err := initBoltRepositories(db)
+	require.NoError(tb, err)
+	return urlRepo, userRepo, db
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
+
+func TestURLRepository_Behaviour(t *testing.T) {
+	for _, f := range repositoryFactories() {
+		t.Run(f.name, func(t *testing.T) {
+			ctx := context.Background()
+			t.Run("Create and read", func(t *testing.T) {
+				urlRepo, _ := f.init(t)
+				link := &types.Link{
+					URL:          mustParseURL(t, "https://test.com/a?b=c"),
+					RedirectCode: 301,
+					QueryMode:    types.QueryMerge,
+					UTM:          url.Values{"utm_source": {"x"}},
+				}
+				id, err := urlRepo.Create(ctx, link)
+				require.NoError(t, err)
+				v, err := urlRepo.Read(ctx, id)
+				require.NoError(t, err)
+				got := v.(*types.Link)
+				assert.Equal(t, link.URL.String(), got.URL.String())
+				assert.Equal(t, link.RedirectCode, got.RedirectCode)
+				assert.Equal(t, link.QueryMode, got.QueryMode)
+				assert.Equal(t, link.UTM, got.UTM)
+				assert.False(t, got.CreatedAt.IsZero())
+
+				again, err := urlRepo.Create(ctx, link)
+				if err != nil {
+					assert.ErrorIs(t, err, ErrDuplicate)
+				}
+				assert.Equal(t, id, again)
+			})
+			t.Run("Read missing", func(t *testing.T) {
+				urlRepo, _ := f.init(t)
+				_, err := urlRepo.Read(ctx, "none")
+				assert.ErrorIs(t, err, ErrNoSuchValue)
+				_, err = urlRepo.Click(ctx, "none")
+				assert.ErrorIs(t, err, ErrNoSuchValue)
+			})
+			t.Run("Update", func(t *testing.T) {
+				urlRepo, _ := f.init(t)
+				id, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/old")})
+				require.NoError(t, err)
+				require.NoError(t, urlRepo.Update(ctx, id, &types.Link{URL: mustParseURL(t, "https://test.com/new")}))
+				v, err := urlRepo.Read(ctx, id)
+				require.NoError(t, err)
+				assert.Equal(t, "https://test.com/new", v.(*types.Link).URL.String())
+			})
+			t.Run("Disabled link is not clicked", func(t *testing.T) {
+				urlRepo, _ := f.init(t)
+				id, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/disabled")})
+				require.NoError(t, err)
+				require.NoError(t, urlRepo.Update(ctx, id, &types.Link{URL: mustParseURL(t, "https://test.com/disabled"), Disabled: types.DisabledLegal}))
+				v, err := urlRepo.Click(ctx, id)
+				assert.ErrorIs(t, err, ErrLinkDisabled)
+				require.NotNil(t, v)
+				assert.Equal(t, types.DisabledLegal, v.(*types.Link).Disabled)
+				v, err = urlRepo.Read(ctx, id)
+				require.NoError(t, err)
+				assert.Equal(t, 0, v.(*types.Link).Clicks)
+
+				require.NoError(t, urlRepo.Update(ctx, id, &types.Link{URL: mustParseURL(t, "https://test.com/disabled")}))
+				_, err = urlRepo.Click(ctx, id)
+				assert.NoError(t, err)
+			})
+			t.Run("Set disabled keeps clicks", func(t *testing.T) {
+				urlRepo, _ := f.init(t)
+				disabler, ok := urlRepo.(LinkDisabler)
+				if !ok {
+					t.Skip("repository does not support moderation")
+				}
+				id, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/moderated"), MaxClicks: 5})
+				require.NoError(t, err)
+				for i := 0; i < 2; i++ {
+					_, err = urlRepo.Click(ctx, id)
+					require.NoError(t, err)
+				}
+				require.NoError(t, disabler.SetDisabled(ctx, id, types.DisabledRemoved))
+				v, err := urlRepo.Read(ctx, id)
+				require.NoError(t, err)
+				assert.Equal(t, types.DisabledRemoved, v.(*types.Link).Disabled)
+				assert.Equal(t, 2, v.(*types.Link).Clicks)
+				assert.Equal(t, 5, v.(*types.Link).MaxClicks)
+				_, err = urlRepo.Click(ctx, id)
+				assert.ErrorIs(t, err, ErrLinkDisabled)
+
+				require.NoError(t, disabler.SetDisabled(ctx, id, types.Enabled))
+				v, err = urlRepo.Click(ctx, id)
+				require.NoError(t, err)
+				assert.Equal(t, 3, v.(*types.Link).Clicks)
+				assert.ErrorIs(t, disabler.SetDisabled(ctx, "none", types.DisabledLegal), ErrNoSuchValue)
+			})
+			t.Run("Create array keeps order", func(t *testing.T) {
+				urlRepo, _ := f.init(t)
+				links := []*types.Link{
+					{URL: mustParseURL(t, "https://test.com/1")},
+					{URL: mustParseURL(t, "https://test.com/2")},
+					{URL: mustParseURL(t, "https://test.com/3"), MaxClicks: 1},
+				}
+				ids, err := urlRepo.CreateArray(ctx, links)
+				require.NoError(t, err)
+				require.Len(t, ids, len(links))
+				for i, id := range ids {
+					v, err := urlRepo.Read(ctx, id)
+					require.NoError(t, err)
+					assert.Equal(t, links[i].URL.String(), v.(*types.Link).URL.String())
+				}
+			})
+			t.Run("Concurrent clicks respect limit", func(t *testing.T) {
+				urlRepo, _ := f.init(t)
+				id, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/"), MaxClicks: 3})
+				require.NoError(t, err)
+				var wg sync.WaitGroup
+				var mu sync.Mutex
+				ok := 0
+				for i := 0; i < 30; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := urlRepo.Click(ctx, id)
+						mu.Lock()
+						defer mu.Unlock()
+						if err == nil {
+							ok++
+							return
+						}
+						assert.ErrorIs(t, err, ErrClicksExhausted)
+					}()
+				}
+				wg.Wait()
+				assert.Equal(t, 3, ok)
+				v, err := urlRepo.Read(ctx, id)
+				require.NoError(t, err)
+				assert.Equal(t, 3, v.(*types.Link).Clicks)
+			})
+		})
+	}
+}
+
+func TestUserRepository_Behaviour(t *testing.T) {
+	for _, f := range repositoryFactories() {
+		t.Run(f.name, func(t *testing.T) {
+			ctx := context.Background()
+			_, userRepo := f.init(t)
+			id, err := userRepo.Create(ctx, []string(nil))
+			require.NoError(t, err)
+			v, err := userRepo.Read(ctx, id)
+			require.NoError(t, err)
+			assert.Empty(t, v)
+
+			require.NoError(t, userRepo.Update(ctx, id, []string{"a", "b"}))
+			v, err = userRepo.Read(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"a", "b"}, v)
+
+			ids, err := userRepo.CreateArray(ctx, [][]string{{"c"}, {"d"}})
+			require.NoError(t, err)
+			require.Len(t, ids, 2)
+			assert.NotEqual(t, id, ids[0])
+			assert.NotEqual(t, ids[0], ids[1])
+			v, err = userRepo.Read(ctx, ids[1])
+			require.NoError(t, err)
+			assert.Equal(t, []string{"d"}, v)
+
+			_, err = userRepo.Read(ctx, "100500")
+			assert.ErrorIs(t, err, ErrNoSuchValue)
+		})
+	}
+}
+
+// countdownContext отменяется после заданного количества вызовов Err
+type countdownContext struct {
+	context.Context
+	left int
+}
+
+func (c *countdownContext) Err() error {
+	if c.left == 0 {
+		return context.Canceled
+	}
+	c.left--
+	return nil
+}
+
+func TestBoltURLRepo_CreateArrayIsAtomic(t *testing.T) {
+	urlRepo, _, _ := openTestBolt(t, filepath.Join(t.TempDir(), "test.db"))
+	links := []*types.Link{
+		{URL: mustParseURL(t, "https://test.com/1")},
+		{URL: mustParseURL(t, "https://test.com/2")},
+	}
+	_, err := urlRepo.CreateArray(&countdownContext{Context: context.Background(), left: 2}, links)
+	require.ErrorIs(t, err, context.Canceled)
+	key, err := createURLHash(links[0].URL)
+	require.NoError(t, err)
+	_, err = urlRepo.Read(context.Background(), key)
+	assert.ErrorIs(t, err, ErrNoSuchValue)
+}
+
+func TestBoltRepositories_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	urlRepo, userRepo, db := openTestBolt(t, path)
+	ctx := context.Background()
+	id, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://test.com/"), MaxClicks: 1})
+	require.NoError(t, err)
+	_, err = urlRepo.Click(ctx, id)
+	require.NoError(t, err)
+	userID, err := userRepo.Create(ctx, []string{id})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	urlRepo, userRepo, _ = openTestBolt(t, path)
+	_, err = urlRepo.Click(ctx, id)
+	assert.ErrorIs(t, err, ErrClicksExhausted)
+	v, err := userRepo.Read(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{id}, v)
+	nextID, err := userRepo.Create(ctx, []string(nil))
+	require.NoError(t, err)
+	assert.NotEqual(t, userID, nextID)
+}
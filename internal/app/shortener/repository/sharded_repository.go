@@ -0,0 +1,467 @@
+package repository
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// количество шардов, степень двойки, чтобы номер шарда брался маской
+const shardCount = 32
+
+type shard struct {
+	m     sync.RWMutex
+	items map[string]any
+}
+
+// shardedMap - мапа, разбитая на шарды со своими блокировками, чтобы конкурентные обращения
+// к разным ключам не ждали друг друга. Нулевое значение готово к использованию
+type shardedMap struct {
+	shards [shardCount]shard
+}
+
+func (s *shardedMap) shard(key string) *shard {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &s.shards[h&(shardCount-1)]
+}
+
+func (s *shardedMap) Load(key string) (any, bool) {
+	sh := s.shard(key)
+	sh.m.RLock()
+	defer sh.m.RUnlock()
+	v, ok := sh.items[key]
+	return v, ok
+}
+
+func (s *shardedMap) Store(key string, v any) {
+	s.compute(key, func(any, bool) (any, bool) {
+		return v, true
+	})
+}
+
+func (s *shardedMap) LoadOrStore(key string, v any) (actual any, loaded bool) {
+	s.compute(key, func(old any, ok bool) (any, bool) {
+		actual, loaded = old, ok
+		if ok {
+			return nil, false
+		}
+		actual = v
+		return v, true
+	})
+	return actual, loaded
+}
+
+// compute вызывает f под блокировкой шарда ключа. f получает текущее значение и возвращает новое
+// и признак, нужно ли его сохранить
+func (s *shardedMap) compute(key string, f func(old any, loaded bool) (any, bool)) {
+	sh := s.shard(key)
+	sh.m.Lock()
+	defer sh.m.Unlock()
+	old, loaded := sh.items[key]
+	v, store := f(old, loaded)
+	if !store {
+		return
+	}
+	if sh.items == nil {
+		sh.items = make(map[string]any)
+	}
+	sh.items[key] = v
+}
+
+// storeLogged сохраняет v, если log вернула nil. log вызывается под блокировкой шарда, поэтому записи
+// в журнал по одному ключу идут в том же порядке, что и изменения мапы
+func (s *shardedMap) storeLogged(key string, v any, log func() error) error {
+	var err error
+	s.compute(key, func(any, bool) (any, bool) {
+		err = log()
+		return v, err == nil
+	})
+	return err
+}
+
+// delete удаляет ключ, если его значение удовлетворяет cond
+func (s *shardedMap) delete(key string, cond func(v any) bool) {
+	sh := s.shard(key)
+	sh.m.Lock()
+	defer sh.m.Unlock()
+	if v, ok := sh.items[key]; ok && cond(v) {
+		delete(sh.items, key)
+	}
+}
+
+// Range перебирает мапу по шардам. Шард копируется под блокировкой, а f вызывается уже без нее,
+// так что f может обращаться к мапе
+func (s *shardedMap) Range(f func(key, value any) bool) {
+	type item struct {
+		key   string
+		value any
+	}
+	var items []item
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.m.RLock()
+		items = items[:0]
+		for k, v := range sh.items {
+			items = append(items, item{key: k, value: v})
+		}
+		sh.m.RUnlock()
+		for _, it := range items {
+			if !f(it.key, it.value) {
+				return
+			}
+		}
+	}
+}
+
+// rlockAll блокирует все шарды на чтение, пока не будет вызвана возвращенная функция.
+// Шарды блокируются по порядку, так что несколько rlockAll не мешают друг другу
+func (s *shardedMap) rlockAll() func() {
+	for i := range s.shards {
+		s.shards[i].m.RLock()
+	}
+	return func() {
+		for i := range s.shards {
+			s.shards[i].m.RUnlock()
+		}
+	}
+}
+
+// rangeLocked перебирает мапу без блокировок, вызывающий должен держать rlockAll
+func (s *shardedMap) rangeLocked(f func(key string, value any) bool) {
+	for i := range s.shards {
+		for k, v := range s.shards[i].items {
+			if !f(k, v) {
+				return
+			}
+		}
+	}
+}
+
+func (s *shardedMap) Len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.m.RLock()
+		n += len(sh.items)
+		sh.m.RUnlock()
+	}
+	return n
+}
+
+// ShardedURLRepo - in-memory репозиторий ссылок на шардированной мапе. Операции выполняются
+// прямо в вызывающей горутине, контекст проверяется перед началом операции.
+// Изменение пишется в журнал бекапа под блокировкой шарда до того, как попадет в мапу
+type ShardedURLRepo struct {
+	links shardedMap
+	// nil, если бекап файл не используется
+	backUp *backUp
+}
+
+func (s *ShardedURLRepo) Create(ctx context.Context, v any) (string, error) {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return "", TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return s.create(l)
+}
+
+func (s *ShardedURLRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
+	links, ok := v.([]*types.Link)
+	if !ok {
+		return nil, TypeError(v)
+	}
+	result := make([]string, len(links))
+	var duplicates []int
+	for i, l := range links {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		id, err := s.create(l)
+		if errors.Is(err, ErrDuplicate) {
+			duplicates = append(duplicates, i)
+		} else if err != nil {
+			return nil, err
+		}
+		result[i] = id
+	}
+	return result, duplicatesError(duplicates)
+}
+
+func (s *ShardedURLRepo) create(l *types.Link) (string, error) {
+	stored := *l
+	// домен уже в ключе
+	stored.Domain = ""
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now()
+	}
+	for attempt := 1; ; attempt++ {
+		key, err := createLinkHash(l)
+		if err != nil {
+			return "", err
+		}
+		loaded := false
+		s.links.compute(key, func(_ any, ok bool) (any, bool) {
+			if loaded = ok; ok {
+				return nil, false
+			}
+			if err = s.backUp.writeLink(key, &stored); err != nil {
+				return nil, false
+			}
+			return &stored, true
+		})
+		if err != nil {
+			return "", err
+		}
+		if loaded && l.MaxClicks > 0 && attempt < maxKeyAttempts {
+			continue
+		}
+		if loaded {
+			return key, ErrDuplicate
+		}
+		return key, nil
+	}
+}
+
+func (s *ShardedURLRepo) Read(ctx context.Context, id string) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	v, ok := s.links.Load(id)
+	if !ok {
+		return nil, ErrNoSuchValue
+	}
+	l, ok := v.(*types.Link)
+	if !ok {
+		return nil, ErrUnexpectedTypeInMap
+	}
+	return l, nil
+}
+
+func (s *ShardedURLRepo) Update(ctx context.Context, id string, v any) error {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.links.storeLogged(id, l, func() error {
+		return s.backUp.writeLink(id, l)
+	})
+}
+
+// Click проверяет лимит и увеличивает счетчик под блокировкой шарда, подменяя значение копией,
+// чтобы читатели никогда не видели частично обновленную ссылку
+func (s *ShardedURLRepo) Click(ctx context.Context, id string) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var clicked *types.Link
+	var err error
+	s.links.compute(id, func(old any, loaded bool) (any, bool) {
+		if !loaded {
+			err = ErrNoSuchValue
+			return nil, false
+		}
+		l, ok := old.(*types.Link)
+		if !ok {
+			err = ErrUnexpectedTypeInMap
+			return nil, false
+		}
+		if l.IsDisabled() {
+			clicked, err = l, ErrLinkDisabled
+			return nil, false
+		}
+		if l.IsExhausted() {
+			clicked, err = l, ErrClicksExhausted
+			return nil, false
+		}
+		c := *l
+		c.Clicks++
+		// счетчик переходов без лимита не бекапим, чтобы не писать в файл на каждый редирект
+		if c.MaxClicks > 0 {
+			if err = s.backUp.writeLink(id, &c); err != nil {
+				return nil, false
+			}
+		}
+		clicked = &c
+		return clicked, true
+	})
+	if err != nil {
+		return clicked, err
+	}
+	return clicked, nil
+}
+
+func (s *ShardedURLRepo) Each(ctx context.Context, f func(id string, v any) error) error {
+	return eachInMap(ctx, &s.links, f)
+}
+
+func (s *ShardedURLRepo) Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error) {
+	l, ok := v.(*types.Link)
+	if !ok {
+		return false, TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	stored := *l
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now()
+	}
+	imported := false
+	var err error
+	s.links.compute(id, func(_ any, loaded bool) (any, bool) {
+		if loaded {
+			if imported, err = resolveConflict(onConflict); !imported {
+				return nil, false
+			}
+		}
+		if err = s.backUp.writeLink(id, &stored); err != nil {
+			imported = false
+			return nil, false
+		}
+		imported = true
+		return &stored, true
+	})
+	return imported, err
+}
+
+// ShardedUserRepo - in-memory репозиторий пользователей на шардированной мапе
+type ShardedUserRepo struct {
+	// id следующего пользователя, в начале структуры для выравнивания атомарных операций
+	lastID int64
+	users  shardedMap
+	// nil, если бекап файл не используется
+	backUp *backUp
+}
+
+func newShardedUserRepo() *ShardedUserRepo {
+	return &ShardedUserRepo{lastID: 1}
+}
+
+func (s *ShardedUserRepo) Create(ctx context.Context, v any) (string, error) {
+	u, ok := v.([]string)
+	if u != nil && !ok {
+		return "", TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return s.create(u)
+}
+
+func (s *ShardedUserRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
+	usersURLs, ok := v.([][]string)
+	if !ok {
+		return nil, TypeError(v)
+	}
+	result := make([]string, len(usersURLs))
+	for i, u := range usersURLs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		id, err := s.create(u)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = id
+	}
+	return result, nil
+}
+
+func (s *ShardedUserRepo) create(u []string) (string, error) {
+	id := strconv.FormatInt(atomic.AddInt64(&s.lastID, 1)-1, 10)
+	err := s.users.storeLogged(id, u, func() error {
+		return s.backUp.writeUser(id, u)
+	})
+	return id, err
+}
+
+func (s *ShardedUserRepo) Read(ctx context.Context, id string) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	v, ok := s.users.Load(id)
+	if !ok {
+		return nil, ErrNoSuchValue
+	}
+	u, ok := v.([]string)
+	if v != nil && !ok {
+		return nil, ErrUnexpectedTypeInMap
+	}
+	return u, nil
+}
+
+func (s *ShardedUserRepo) Update(ctx context.Context, id string, v any) error {
+	u, ok := v.([]string)
+	if !ok {
+		return TypeError(v)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.users.storeLogged(id, u, func() error {
+		return s.backUp.writeUser(id, u)
+	})
+}
+
+func (s *ShardedUserRepo) Each(ctx context.Context, f func(id string, v any) error) error {
+	return eachInMap(ctx, &s.users, f)
+}
+
+func (s *ShardedUserRepo) Put(ctx context.Context, id string, v any, onConflict ConflictStrategy) (bool, error) {
+	u, ok := v.([]string)
+	if u != nil && !ok {
+		return false, TypeError(v)
+	}
+	numericID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	imported := false
+	s.users.compute(id, func(_ any, loaded bool) (any, bool) {
+		if loaded {
+			if imported, err = resolveConflict(onConflict); !imported {
+				return nil, false
+			}
+		}
+		if err = s.backUp.writeUser(id, u); err != nil {
+			imported = false
+			return nil, false
+		}
+		imported = true
+		return u, true
+	})
+	if !imported {
+		return false, err
+	}
+	// новые пользователи не должны получить id импортированных
+	s.raiseLastID(numericID)
+	return true, nil
+}
+
+// raiseLastID сдвигает счетчик так, чтобы следующий id был больше id
+func (s *ShardedUserRepo) raiseLastID(id int64) {
+	for {
+		last := atomic.LoadInt64(&s.lastID)
+		if id < last || atomic.CompareAndSwapInt64(&s.lastID, last, id+1) {
+			return
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package repository
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestShardedMap(t *testing.T) {
+	m := shardedMap{}
+	_, ok := m.Load("a")
+	assert.False(t, ok)
+	actual, loaded := m.LoadOrStore("a", 1)
+	assert.Equal(t, 1, actual)
+	assert.False(t, loaded)
+	actual, loaded = m.LoadOrStore("a", 2)
+	assert.Equal(t, 1, actual)
+	assert.True(t, loaded)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m.Store(fmt.Sprint(g, "-", i), i)
+				m.compute("counter", func(old any, loaded bool) (any, bool) {
+					if !loaded {
+						return 1, true
+					}
+					return old.(int) + 1, true
+				})
+			}
+		}(g)
+	}
+	// перебор во время записи не должен блокировать запись в мапу из f
+	m.Range(func(key, value any) bool {
+		m.Store("from range", true)
+		return true
+	})
+	wg.Wait()
+	v, ok := m.Load("counter")
+	require.True(t, ok)
+	assert.Equal(t, 800, v)
+	assert.Equal(t, 8*100+3, m.Len())
+	n := 0
+	m.Range(func(key, value any) bool {
+		n++
+		return n < 10
+	})
+	assert.Equal(t, 10, n)
+}
+
+func benchmarkLinks(n int) []*types.Link {
+	links := make([]*types.Link, n)
+	for i := range links {
+		u, _ := url.Parse(fmt.Sprintf("https://example.com/%d", i))
+		links[i] = &types.Link{URL: u}
+	}
+	return links
+}
+
+// BenchmarkInMemoryURLRepository сравнивает репозиторий на sync.Map с горутиной на операцию
+// и шардированный репозиторий с прямыми вызовами, для сравнения - и остальные хранилища
+func BenchmarkInMemoryURLRepository(b *testing.B) {
+	ctx := context.Background()
+	links := benchmarkLinks(1024)
+	for _, f := range repositoryFactories() {
+		b.Run(f.name, func(b *testing.B) {
+			repo, _ := f.init(b)
+			// короткие хеши разных урлов могут совпасть, а повторные Create - всегда повторы
+			ids, err := repo.CreateArray(ctx, links)
+			if !errors.Is(err, ErrDuplicate) {
+				require.NoError(b, err)
+			}
+			require.Len(b, ids, len(links))
+			b.Run("Create", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := repo.Create(ctx, links[i%len(links)]); err != nil && !errors.Is(err, ErrDuplicate) {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("CreateArray 100", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := repo.CreateArray(ctx, links[:100]); err != nil && !errors.Is(err, ErrDuplicate) {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("Read", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := repo.Read(ctx, ids[i%len(ids)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("Click parallel", func(b *testing.B) {
+				b.ReportAllocs()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						if _, err := repo.Click(ctx, ids[i%len(ids)]); err != nil {
+							b.Fatal(err)
+						}
+						i++
+					}
+				})
+			})
+			b.Run("Read parallel", func(b *testing.B) {
+				b.ReportAllocs()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						if _, err := repo.Read(ctx, ids[i%len(ids)]); err != nil {
+							b.Fatal(err)
+						}
+						i++
+					}
+				})
+			})
+		})
+	}
+}
+
+func TestShardedRepo_Moderation(t *testing.T) {
+	ctx := context.Background()
+	urlRepo := new(ShardedURLRepo)
+	userRepo := newShardedUserRepo()
+	links := []*types.Link{
+		{URL: mustParseURL(t, "https://Example.com/a")},
+		{URL: mustParseURL(t, "https://news.example.com./b")},
+		{URL: mustParseURL(t, "https://notexample.com/c")},
+	}
+	ids, err := urlRepo.CreateArray(ctx, links)
+	require.NoError(t, err)
+
+	found, err := urlRepo.SearchByHost(ctx, "example.COM", 10)
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+	assert.ElementsMatch(t, ids[:2], []string{found[0].ID, found[1].ID})
+	assert.Less(t, found[0].ID, found[1].ID)
+	found, err = urlRepo.SearchByHost(ctx, "example.com", 1)
+	require.NoError(t, err)
+	assert.Len(t, found, 1)
+
+	alice, err := userRepo.Create(ctx, []string{ids[0], ids[1]})
+	require.NoError(t, err)
+	bob, err := userRepo.Create(ctx, []string{ids[0]})
+	require.NoError(t, err)
+	carol, err := userRepo.Create(ctx, []string(nil))
+	require.NoError(t, err)
+	owners, err := userRepo.Owners(ctx, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, []string{alice, bob}, owners)
+
+	require.NoError(t, userRepo.Transfer(ctx, ids[0], carol))
+	owners, err = userRepo.Owners(ctx, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, []string{carol}, owners)
+	v, err := userRepo.Read(ctx, alice)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ids[1]}, v)
+	v, err = userRepo.Read(ctx, bob)
+	require.NoError(t, err)
+	assert.Empty(t, v)
+
+	assert.ErrorIs(t, userRepo.Transfer(ctx, ids[0], "100"), ErrNoSuchValue)
+}
+
+func TestShardedRepo_SetDisabledConcurrentClicks(t *testing.T) {
+	ctx := context.Background()
+	repo := new(ShardedURLRepo)
+	u, _ := url.Parse("https://example.com/page")
+	id, err := repo.Create(ctx, &types.Link{URL: u})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			_, err := repo.Click(ctx, id)
+			assert.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// причина, которая не отключает ссылку, чтобы переходы продолжали засчитываться
+		for i := 0; i < 1000; i++ {
+			assert.NoError(t, repo.SetDisabled(ctx, id, types.Enabled))
+		}
+	}()
+	wg.Wait()
+	v, err := repo.Read(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, 1000, v.(*types.Link).Clicks)
+}
+
+func TestMatchHost(t *testing.T) {
+	assert.True(t, MatchHost(mustParseURL(t, "https://a.b.example.com:8080/"), "example.com"))
+	assert.True(t, MatchHost(mustParseURL(t, "https://example.com/"), "Example.com."))
+	assert.False(t, MatchHost(mustParseURL(t, "https://badexample.com/"), "example.com"))
+	assert.False(t, MatchHost(mustParseURL(t, "https://example.com/"), ""))
+}
+
+func TestShardedRepo_DomainKeys(t *testing.T) {
+	ctx := context.Background()
+	repo := new(ShardedURLRepo)
+	target, err := url.Parse("https://test.com/domains")
+	require.NoError(t, err)
+	plain, err := repo.Create(ctx, &types.Link{URL: target})
+	require.NoError(t, err)
+	scoped, err := repo.Create(ctx, &types.Link{URL: target, Domain: "b.co"})
+	require.NoError(t, err)
+
+	// тот же урл на другом домене - другая ссылка с тем же id
+	assert.Equal(t, "b.co/"+plain, scoped)
+	domain, id := types.SplitLinkKey(scoped)
+	assert.Equal(t, "b.co", domain)
+	assert.Equal(t, plain, id)
+	v, err := repo.Read(ctx, scoped)
+	require.NoError(t, err)
+	assert.Empty(t, v.(*types.Link).Domain)
+	_, err = repo.Click(ctx, scoped)
+	require.NoError(t, err)
+	v, err = repo.Read(ctx, plain)
+	require.NoError(t, err)
+	assert.Zero(t, v.(*types.Link).Clicks)
+}
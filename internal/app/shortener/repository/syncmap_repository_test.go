@@ -0,0 +1,305 @@
+package repository
+
+import (
+	"context"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SyncMapURLRepo и SyncMapUserRepo - прежние in-memory репозитории на sync.Map с горутиной на каждую операцию.
+// В сервисе их заменили шардированные репозитории, а здесь они остались базой для сравнения в бенчмарках
+// и в общих тестах поведения
+
+type valueTransfer struct {
+	value any
+	err   error
+}
+
+type resultIDTransfer struct {
+	id    string
+	index int
+	err   error
+}
+
+type SyncMapURLRepo struct {
+	sMap   sync.Map
+	clickM sync.Mutex
+}
+
+func (smr *SyncMapURLRepo) Read(ctx context.Context, id string) (any, error) {
+	valueChan := make(chan *valueTransfer, 1)
+	go smr.getFromDB(valueChan, id)
+	select {
+	case urlTransfer := <-valueChan:
+		return urlTransfer.value, urlTransfer.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (smr *SyncMapURLRepo) Create(ctx context.Context, v any) (string, error) {
+	resultChan := make(chan *resultIDTransfer, 1)
+	l, ok := v.(*types.Link)
+	if !ok {
+		return "", TypeError(v)
+	}
+	go smr.writeToDB(resultChan, l, 0)
+	select {
+	case res := <-resultChan:
+		return res.id, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (smr *SyncMapURLRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
+	links, ok := v.([]*types.Link)
+	if !ok {
+		return nil, TypeError(v)
+	}
+	resultChan := make(chan *resultIDTransfer, len(links))
+	for i, l := range links {
+		go smr.writeToDB(resultChan, l, i)
+	}
+	result := make([]string, len(links))
+	for range result {
+		select {
+		case res := <-resultChan:
+			if res.err != nil {
+				return nil, res.err
+			}
+			result[res.index] = res.id
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return result, nil
+}
+
+func (smr *SyncMapURLRepo) Update(ctx context.Context, id string, v any) error {
+	resultChan := make(chan *resultIDTransfer, 1)
+	l, ok := v.(*types.Link)
+	if !ok {
+		return TypeError(v)
+	}
+	go smr.updateInDB(resultChan, id, l)
+	select {
+	case res := <-resultChan:
+		return res.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (smr *SyncMapURLRepo) Click(ctx context.Context, id string) (any, error) {
+	valueChan := make(chan *valueTransfer, 1)
+	go smr.clickInDB(valueChan, id)
+	select {
+	case clickTransfer := <-valueChan:
+		return clickTransfer.value, clickTransfer.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (smr *SyncMapURLRepo) getFromDB(valueChan chan<- *valueTransfer, id string) {
+	var err error = nil
+	untypedLink, ok := smr.sMap.Load(id)
+	if !ok {
+		valueChan <- &valueTransfer{
+			value: nil,
+			err:   ErrNoSuchValue,
+		}
+		return
+	}
+	link, ok := untypedLink.(*types.Link)
+	if !ok {
+		valueChan <- &valueTransfer{
+			value: nil,
+			err:   ErrUnexpectedTypeInMap,
+		}
+		return
+	}
+	valueChan <- &valueTransfer{
+		value: link,
+		err:   err,
+	}
+
+}
+
+func (smr *SyncMapURLRepo) writeToDB(resultChan chan<- *resultIDTransfer, l *types.Link, index int) {
+	stored := *l
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now()
+	}
+	for attempt := 1; ; attempt++ {
+		key, err := createLinkHash(l)
+		if err != nil {
+			resultChan <- &resultIDTransfer{err: err, index: index}
+			return
+		}
+		_, loaded := smr.sMap.LoadOrStore(key, &stored)
+		if loaded && l.MaxClicks > 0 {
+			if attempt < maxKeyAttempts {
+				continue
+			}
+			resultChan <- &resultIDTransfer{id: key, index: index, err: ErrDuplicate}
+			return
+		}
+		resultChan <- &resultIDTransfer{id: key, index: index}
+		return
+	}
+}
+
+func (smr *SyncMapURLRepo) updateInDB(resultChan chan<- *resultIDTransfer, id string, u any) {
+	smr.sMap.Store(id, u)
+	resultChan <- &resultIDTransfer{
+		id: id,
+	}
+}
+
+// clickInDB проверяет лимит и увеличивает счетчик под мьютексом, подменяя значение в мапе копией,
+// чтобы читатели никогда не видели частично обновленную ссылку
+func (smr *SyncMapURLRepo) clickInDB(valueChan chan<- *valueTransfer, id string) {
+	smr.clickM.Lock()
+	defer smr.clickM.Unlock()
+	untypedLink, ok := smr.sMap.Load(id)
+	if !ok {
+		valueChan <- &valueTransfer{err: ErrNoSuchValue}
+		return
+	}
+	link, ok := untypedLink.(*types.Link)
+	if !ok {
+		valueChan <- &valueTransfer{err: ErrUnexpectedTypeInMap}
+		return
+	}
+	if link.IsDisabled() {
+		valueChan <- &valueTransfer{value: link, err: ErrLinkDisabled}
+		return
+	}
+	if link.IsExhausted() {
+		valueChan <- &valueTransfer{value: link, err: ErrClicksExhausted}
+		return
+	}
+	clicked := *link
+	clicked.Clicks++
+	smr.sMap.Store(id, &clicked)
+	valueChan <- &valueTransfer{value: &clicked}
+}
+
+type SyncMapUserRepo struct {
+	sMap   sync.Map
+	m      sync.Mutex
+	lastID int
+}
+
+func (smr *SyncMapUserRepo) Read(ctx context.Context, id string) (any, error) {
+	valueChan := make(chan *valueTransfer, 1)
+	go smr.getFromDB(valueChan, id)
+	select {
+	case urlTransfer := <-valueChan:
+		return urlTransfer.value, urlTransfer.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (smr *SyncMapUserRepo) Create(ctx context.Context, v any) (string, error) {
+	resultChan := make(chan *resultIDTransfer, 1)
+	u, ok := v.([]string)
+	if u != nil && !ok {
+		return "", TypeError(v)
+	}
+	go smr.writeToDB(resultChan, u, 0)
+	select {
+	case res := <-resultChan:
+		return res.id, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (smr *SyncMapUserRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
+	usersURLs, ok := v.([][]string)
+	if !ok {
+		return nil, TypeError(v)
+	}
+	resultChan := make(chan *resultIDTransfer, len(usersURLs))
+	for i, u := range usersURLs {
+		go smr.writeToDB(resultChan, u, i)
+	}
+	result := make([]string, len(usersURLs))
+	for range result {
+		select {
+		case res := <-resultChan:
+			if res.err != nil {
+				return nil, res.err
+			}
+			result[res.index] = res.id
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return result, nil
+}
+
+func (smr *SyncMapUserRepo) Update(ctx context.Context, id string, v any) error {
+	resultChan := make(chan *resultIDTransfer, 1)
+	u, ok := v.([]string)
+	if !ok {
+		return TypeError(v)
+	}
+	go smr.updateInDB(resultChan, id, u)
+	select {
+	case res := <-resultChan:
+		return res.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (smr *SyncMapUserRepo) getFromDB(urlChan chan<- *valueTransfer, id string) {
+	var err error
+	sliceOfURL, ok := smr.sMap.Load(id)
+	if !ok {
+		urlChan <- &valueTransfer{
+			value: nil,
+			err:   ErrNoSuchValue,
+		}
+		return
+	}
+	typedSliceOfURL, ok := sliceOfURL.([]string)
+	if !ok {
+		urlChan <- &valueTransfer{
+			value: nil,
+			err:   ErrUnexpectedTypeInMap,
+		}
+		return
+	}
+	urlChan <- &valueTransfer{
+		value: typedSliceOfURL,
+		err:   err,
+	}
+
+}
+
+func (smr *SyncMapUserRepo) writeToDB(resultChan chan<- *resultIDTransfer, v []string, index int) {
+	smr.m.Lock()
+	id := strconv.Itoa(smr.lastID)
+	smr.lastID++
+	smr.m.Unlock()
+	smr.sMap.Store(id, v)
+
+	resultChan <- &resultIDTransfer{
+		id:    id,
+		index: index,
+	}
+}
+func (smr *SyncMapUserRepo) updateInDB(resultChan chan<- *resultIDTransfer, id string, u []string) {
+	smr.sMap.Store(id, u)
+	resultChan <- &resultIDTransfer{
+		id: id,
+	}
+}
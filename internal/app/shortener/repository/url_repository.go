@@ -2,25 +2,37 @@ package repository
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha1"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"io"
 	"log"
 	"net/url"
-	"os"
-	"sync"
 )
 
+// сколько раз пытаемся подобрать свободный случайный ключ для ссылки с лимитом переходов
+const maxKeyAttempts = 5
+
+// с какого размера пакет ссылок вставляется в postgres через COPY
+const copyThreshold = 256
+
+// колонки ссылки в порядке, в котором их читает scanLink
+const linkColumns = "unshortenurl, max_clicks, clicks, created_at, redirect_code, query_mode, utm, disabled"
+
 type DBURLRepo struct {
 	db         *pgx.Conn
 	insertStmt *pgconn.StatementDescription
 }
 
-func initURLRepository(c context.Context, backUpPath string, db *pgx.Conn) (Repository, error) {
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func initURLRepository(c context.Context, db *pgx.Conn) (URLRepository, error) {
 	if db != nil {
 		r := db.QueryRow(c, "SELECT EXISTS (SELECT FROM pg_tables WHERE schemaname = 'public' AND tablename  = 'url')")
 		var isExist bool
@@ -34,58 +46,44 @@ func initURLRepository(c context.Context, backUpPath string, db *pgx.Conn) (Repo
 				return nil, err
 			}
 		}
-		stmt, err := db.Prepare(c, "insert url", "INSERT INTO url (shortenhash, unshortenurl) VALUES ($1, $2) on conflict do nothing RETURNING shortenHash")
+		_, err = db.Exec(c, `alter table url add column if not exists max_clicks integer not null default 0,
+			add column if not exists clicks integer not null default 0,
+			add column if not exists created_at timestamptz not null default now(),
+			add column if not exists redirect_code integer not null default 0,
+			add column if not exists query_mode text not null default '',
+			add column if not exists utm text not null default '',
+			add column if not exists disabled text not null default ''`)
 		if err != nil {
 			return nil, err
 		}
-		return &DBURLRepo{db: db, insertStmt: stmt}, nil
-	}
-	smr := new(SyncMapURLRepo)
-	if len(backUpPath) != 0 {
-		file, err := os.OpenFile(backUpPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, os.ModePerm)
+		stmt, err := db.Prepare(c, "insert url", "INSERT INTO url (shortenhash, unshortenurl, max_clicks, redirect_code, query_mode, utm) VALUES ($1, $2, $3, $4, $5, $6) on conflict do nothing RETURNING shortenHash")
 		if err != nil {
-			log.Println(err)
 			return nil, err
 		}
-		decoder := json.NewDecoder(file)
-		backUpVal := backUpValue{}
-		var decoderError error
-		for decoderError = decoder.Decode(&backUpVal); decoderError == nil; decoderError = decoder.Decode(&backUpVal) {
-			smr.sMap.Store(backUpVal.Key, backUpVal.Value)
-			backUpVal = backUpValue{}
-		}
-		if errors.Is(err, io.EOF) {
-			log.Println(err)
-		}
-
-		smr.backUpEncoder = json.NewEncoder(file)
+		return &DBURLRepo{db: db, insertStmt: stmt}, nil
 	}
-	return smr, nil
+	return new(ShardedURLRepo), nil
 }
 
 func (d *DBURLRepo) Create(ctx context.Context, v any) (string, error) {
-	u, ok := v.(*url.URL)
+	l, ok := v.(*types.Link)
 	if !ok {
 		return "", TypeError(v)
 	}
-	key, err := createURLHash(u)
+	key, isDuplicate, err := insertLink(ctx, d.db, d.insertStmt.SQL, l)
 	if err != nil {
 		return "", err
 	}
-	r := d.db.QueryRow(ctx, d.insertStmt.SQL, key, u.String())
-	hash := ""
-	err = r.Scan(&hash)
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
-		return "", err
-	}
-	if errors.Is(err, pgx.ErrNoRows) {
+	if isDuplicate {
 		return key, ErrDuplicate
 	}
-	return key, err
+	return key, nil
 }
 
+// CreateArray вставляет пакет одной транзакцией: небольшие пакеты одним pgx.Batch, большие - через COPY
+// во временную таблицу. Ошибка *DuplicatesError перечисляет ссылки, которые уже были в базе
 func (d *DBURLRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
-	urls, ok := v.([]*url.URL)
+	links, ok := v.([]*types.Link)
 	if !ok {
 		return nil, TypeError(v)
 	}
@@ -95,182 +93,226 @@ func (d *DBURLRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
 	}
 	defer func() {
 		err := tx.Rollback(ctx)
-		if err != nil {
+		if err != nil && !errors.Is(err, pgx.ErrTxClosed) {
 			log.Println(err)
 		}
 	}()
-	stmt, err := tx.Prepare(ctx, "inset url tx", d.insertStmt.SQL)
+	insert := insertLinksBatch
+	if len(links) >= copyThreshold {
+		insert = insertLinksCopy
+	}
+	result, duplicates, err := insert(ctx, tx, d.insertStmt.SQL, links)
 	if err != nil {
 		return nil, err
 	}
-	result := make([]string, 0, len(urls))
-	isDuplicate := false
-	for _, u := range urls {
-		key, err := createURLHash(u)
-		if err != nil {
-			return nil, err
-		}
-		r := tx.QueryRow(ctx, stmt.SQL, key, u.String())
-		hash := ""
-		err = r.Scan(&hash)
-		if errors.Is(err, pgx.ErrNoRows) {
-			isDuplicate = true
-		}
-		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
-			return nil, err
-		}
-		result = append(result, key)
-	}
 	if err = tx.Commit(ctx); err != nil {
 		return nil, err
 	}
-	if isDuplicate {
-		return result, ErrDuplicate
-	}
-	return result, err
+	return result, duplicatesError(duplicates)
 }
 
-func (d *DBURLRepo) Read(ctx context.Context, id string) (any, error) {
-	r := d.db.QueryRow(ctx, "SELECT unshortenurl from url where shortenhash = $1", id)
-	s := ""
-	err := r.Scan(&s)
+// insertLinksBatch отправляет вставки всех ссылок одним pgx.Batch
+func insertLinksBatch(ctx context.Context, tx pgx.Tx, sql string, links []*types.Link) ([]string, []int, error) {
+	keys, err := linkKeys(links)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	batch := &pgx.Batch{}
+	for i, l := range links {
+		batch.Queue(sql, keys[i], l.URL.String(), l.MaxClicks, l.RedirectCode, string(l.QueryMode), l.UTM.Encode())
+	}
+	br := tx.SendBatch(ctx, batch)
+	inserted := make([]bool, len(links))
+	for i := range links {
+		hash := ""
+		err := br.QueryRow().Scan(&hash)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			br.Close()
+			return nil, nil, err
+		}
+		inserted[i] = err == nil
 	}
-	return url.Parse(s)
+	if err := br.Close(); err != nil {
+		return nil, nil, err
+	}
+	duplicates, err := retryConflicts(ctx, tx, sql, links, keys, inserted)
+	return keys, duplicates, err
 }
 
-func (d *DBURLRepo) Update(ctx context.Context, s string, v any) error {
-	u, ok := v.(*url.URL)
-	if !ok {
-		return TypeError(v)
+// insertLinksCopy копирует пакет во временную таблицу и переносит его в url одним INSERT ... SELECT.
+// Из ссылок с одинаковым ключом вставляется первая по порядку
+func insertLinksCopy(ctx context.Context, tx pgx.Tx, sql string, links []*types.Link) ([]string, []int, error) {
+	keys, err := linkKeys(links)
+	if err != nil {
+		return nil, nil, err
 	}
-	_, err := d.db.Exec(ctx, "UPDATE url set unshortenurl = $1 where shortenhash = $2", u.String(), s)
-	return err
+	_, err = tx.Exec(ctx, `CREATE TEMP TABLE url_batch (idx integer, shortenhash text, unshortenurl text, max_clicks integer,
+		redirect_code integer, query_mode text, utm text) ON COMMIT DROP`)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"url_batch"},
+		[]string{"idx", "shortenhash", "unshortenurl", "max_clicks", "redirect_code", "query_mode", "utm"},
+		pgx.CopyFromSlice(len(links), func(i int) ([]any, error) {
+			l := links[i]
+			return []any{i, keys[i], l.URL.String(), l.MaxClicks, l.RedirectCode, string(l.QueryMode), l.UTM.Encode()}, nil
+		}))
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := tx.Query(ctx, `INSERT INTO url (shortenhash, unshortenurl, max_clicks, redirect_code, query_mode, utm)
+		SELECT DISTINCT ON (shortenhash) shortenhash, unshortenurl, max_clicks, redirect_code, query_mode, utm
+		FROM url_batch ORDER BY shortenhash, idx
+		ON CONFLICT DO NOTHING RETURNING shortenhash`)
+	if err != nil {
+		return nil, nil, err
+	}
+	insertedKeys := make(map[string]bool, len(links))
+	for rows.Next() {
+		hash := ""
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		insertedKeys[hash] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	inserted := make([]bool, len(links))
+	for i, key := range keys {
+		inserted[i] = insertedKeys[key]
+		// повторы ключа дальше по пакету не вставлялись
+		delete(insertedKeys, key)
+	}
+	duplicates, err := retryConflicts(ctx, tx, sql, links, keys, inserted)
+	return keys, duplicates, err
 }
 
-type SyncMapURLRepo struct {
-	sMap          sync.Map
-	m             sync.Mutex
-	backUpEncoder *json.Encoder
+func linkKeys(links []*types.Link) ([]string, error) {
+	keys := make([]string, len(links))
+	for i, l := range links {
+		key, err := createLinkHash(l)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
 }
 
-func (smr *SyncMapURLRepo) Read(ctx context.Context, id string) (any, error) {
-	valueChan := make(chan *valueTransfer, 1)
-	go smr.getFromDB(valueChan, id)
-	select {
-	case urlTransfer := <-valueChan:
-		return urlTransfer.value, urlTransfer.err
-	case <-ctx.Done():
-		return nil, ctx.Err()
+// retryConflicts подбирает новые ключи ссылкам с лимитом переходов, чей случайный ключ оказался занят,
+// и возвращает номера остальных не вставленных ссылок - дубликатов
+func retryConflicts(ctx context.Context, tx pgx.Tx, sql string, links []*types.Link, keys []string, inserted []bool) ([]int, error) {
+	var duplicates []int
+	for i, l := range links {
+		if inserted[i] {
+			continue
+		}
+		if l.MaxClicks > 0 {
+			key, duplicate, err := insertLink(ctx, tx, sql, l)
+			if err != nil {
+				return nil, err
+			}
+			keys[i] = key
+			if !duplicate {
+				continue
+			}
+		}
+		duplicates = append(duplicates, i)
 	}
+	return duplicates, nil
 }
 
-func (smr *SyncMapURLRepo) Create(ctx context.Context, v any) (string, error) {
-	resultChan := make(chan *resultIDTransfer, 1)
-	u, ok := v.(*url.URL)
-	if !ok {
-		return "", TypeError(v)
+func (d *DBURLRepo) Read(ctx context.Context, id string) (any, error) {
+	r := d.db.QueryRow(ctx, "SELECT "+linkColumns+" from url where shortenhash = $1", id)
+	l, err := scanLink(r)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchValue
 	}
-	go smr.writeToDB(resultChan, u, 0)
-	select {
-	case res := <-resultChan:
-		return res.id, res.err
-	case <-ctx.Done():
-		return "", ctx.Err()
+	if err != nil {
+		return nil, err
 	}
+	return l, nil
 }
 
-func (smr *SyncMapURLRepo) CreateArray(ctx context.Context, v any) ([]string, error) {
-	urls, ok := v.([]*url.URL)
-	if !ok {
-		return nil, TypeError(v)
-	}
-	resultChan := make(chan *resultIDTransfer, len(urls))
-	for i, u := range urls {
-		go smr.writeToDB(resultChan, u, i)
-	}
-	result := make([]string, len(urls))
-	for range result {
-		select {
-		case res := <-resultChan:
-			if res.err != nil {
-				return nil, res.err
-			}
-			result[res.index] = res.id
-		case <-ctx.Done():
-			return nil, ctx.Err()
+// Click засчитывает переход по ссылке. Проверка лимита и инкремент счетчика выполняются одним UPDATE,
+// поэтому конкурентные переходы не могут превысить max_clicks
+func (d *DBURLRepo) Click(ctx context.Context, id string) (any, error) {
+	r := d.db.QueryRow(ctx, `UPDATE url SET clicks = clicks + 1
+		WHERE shortenhash = $1 AND (max_clicks = 0 OR clicks < max_clicks) AND disabled = ''
+		RETURNING `+linkColumns, id)
+	l, err := scanLink(r)
+	if errors.Is(err, pgx.ErrNoRows) {
+		v, err := d.Read(ctx, id)
+		if err != nil {
+			return nil, err
 		}
+		if l := v.(*types.Link); l.IsDisabled() {
+			return l, ErrLinkDisabled
+		}
+		return v, ErrClicksExhausted
+	}
+	if err != nil {
+		return nil, err
 	}
-	return result, nil
+	return l, nil
 }
 
-func (smr *SyncMapURLRepo) Update(ctx context.Context, id string, v any) error {
-	resultChan := make(chan *resultIDTransfer, 1)
-	u, ok := v.(*url.URL)
+func (d *DBURLRepo) Update(ctx context.Context, s string, v any) error {
+	l, ok := v.(*types.Link)
 	if !ok {
 		return TypeError(v)
 	}
-	go smr.updateInDB(resultChan, id, u)
-	select {
-	case res := <-resultChan:
-		return res.err
-	case <-ctx.Done():
-		return ctx.Err()
-	}
+	_, err := d.db.Exec(ctx, `UPDATE url set unshortenurl = $1, max_clicks = $2, redirect_code = $3, query_mode = $4, utm = $5,
+		disabled = $6 where shortenhash = $7`, l.URL.String(), l.MaxClicks, l.RedirectCode, string(l.QueryMode), l.UTM.Encode(),
+		string(l.Disabled), s)
+	return err
 }
 
-func (smr *SyncMapURLRepo) getFromDB(valueChan chan<- *valueTransfer, id string) {
-	var err error = nil
-	untypedURL, ok := smr.sMap.Load(id)
-	if !ok {
-		valueChan <- &valueTransfer{
-			value: nil,
-			err:   ErrNoSuchValue,
+func insertLink(ctx context.Context, q rowQuerier, sql string, l *types.Link) (string, bool, error) {
+	for attempt := 1; ; attempt++ {
+		key, err := createLinkHash(l)
+		if err != nil {
+			return "", false, err
 		}
-		return
-	}
-	unShorterURL, ok := untypedURL.(*url.URL)
-	if !ok {
-		valueChan <- &valueTransfer{
-			value: nil,
-			err:   ErrUnexpectedTypeInMap,
+		r := q.QueryRow(ctx, sql, key, l.URL.String(), l.MaxClicks, l.RedirectCode, string(l.QueryMode), l.UTM.Encode())
+		hash := ""
+		err = r.Scan(&hash)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return "", false, err
+		}
+		if err == nil {
+			return key, false, nil
+		}
+		if l.MaxClicks == 0 || attempt == maxKeyAttempts {
+			return key, true, nil
 		}
-		return
-	}
-	valueChan <- &valueTransfer{
-		value: unShorterURL,
-		err:   err,
 	}
-
 }
 
-func (smr *SyncMapURLRepo) writeToDB(resultChan chan<- *resultIDTransfer, unShortenURL *url.URL, index int) {
-	key, err := createURLHash(unShortenURL)
+// scanLink читает ссылку из строки результата, dest - колонки, выбранные перед колонками ссылки
+func scanLink(r pgx.Row, dest ...any) (*types.Link, error) {
+	s, queryMode, utm, disabled := "", "", "", ""
+	l := &types.Link{}
+	err := r.Scan(append(dest, &s, &l.MaxClicks, &l.Clicks, &l.CreatedAt, &l.RedirectCode, &queryMode, &utm, &disabled)...)
 	if err != nil {
-		resultChan <- &resultIDTransfer{err: err}
-		return
-	}
-	_, ok := smr.sMap.LoadOrStore(key, unShortenURL)
-	if !ok && smr.backUpEncoder != nil {
-		smr.m.Lock()
-		defer smr.m.Unlock()
-		err := smr.backUpEncoder.Encode(backUpValue{
-			Key:   key,
-			Value: unShortenURL,
-		})
+		return nil, err
+	}
+	l.QueryMode = types.QueryPassthrough(queryMode)
+	l.Disabled = types.DisableReason(disabled)
+	if len(utm) != 0 {
+		l.UTM, err = url.ParseQuery(utm)
 		if err != nil {
-			resultChan <- &resultIDTransfer{err: err}
-			return
+			return nil, err
 		}
 	}
-	resultChan <- &resultIDTransfer{id: key, index: index}
-}
-func (smr *SyncMapURLRepo) updateInDB(resultChan chan<- *resultIDTransfer, id string, u any) {
-	smr.sMap.Store(id, u)
-	resultChan <- &resultIDTransfer{
-		id: id,
+	l.URL, err = url.Parse(s)
+	if err != nil {
+		return nil, err
 	}
+	return l, nil
 }
 
 func createURLHash(u *url.URL) (string, error) {
@@ -279,5 +321,39 @@ func createURLHash(u *url.URL) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%x", h.Sum(nil))[:5], nil
+	return fmt.Sprintf("%x", h.Sum(nil))[:urlHashLen], nil
+}
+
+// длина ключа обычной ссылки и ссылки с лимитом переходов. Длины разные, чтобы случайный ключ
+// одноразовой ссылки не совпал с хешем урла и не достался обычной ссылке как уже сокращенная
+const (
+	urlHashLen   = 5
+	randomKeyLen = 6
+)
+
+// createLinkHash возвращает ключ ссылки на ее домене. Для обычных ссылок это хеш урла, а ссылкам
+// с лимитом переходов выдается случайный ключ, чтобы каждая одноразовая ссылка была отдельной
+func createLinkHash(l *types.Link) (string, error) {
+	id, err := createLinkID(l)
+	if err != nil {
+		return "", err
+	}
+	return types.LinkKey(l.Domain, id), nil
+}
+
+func createLinkID(l *types.Link) (string, error) {
+	if l.MaxClicks == 0 {
+		return createURLHash(l.URL)
+	}
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	_, err := io.WriteString(h, l.URL.String())
+	if err != nil {
+		return "", err
+	}
+	h.Write(salt)
+	return fmt.Sprintf("%x", h.Sum(nil))[:randomKeyLen], nil
 }
@@ -2,10 +2,17 @@ package repository
 
 import (
 	"context"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net/url"
+	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 var UnShorterURL = &url.URL{
@@ -13,10 +20,12 @@ var UnShorterURL = &url.URL{
 	Path:   "test.com",
 }
 
+var UnShorterLink = &types.Link{URL: UnShorterURL}
+
 func TestMapBd_ReadFromBd(t *testing.T) {
 	type field struct {
 		key   string
-		value *url.URL
+		value *types.Link
 	}
 	type preset struct {
 		Map    *SyncMapURLRepo
@@ -37,14 +46,14 @@ func TestMapBd_ReadFromBd(t *testing.T) {
 			name: "Positive test",
 			preset: preset{
 				Map:    &SyncMapURLRepo{},
-				fields: []field{{key: "1", value: UnShorterURL}},
+				fields: []field{{key: "1", value: UnShorterLink}},
 			},
 			args: args{
 				ctx: context.Background(),
 				id:  "1",
 			},
 			want: &valueTransfer{
-				value: UnShorterURL,
+				value: UnShorterLink,
 				err:   nil,
 			},
 			positiveTest: true,
@@ -110,7 +119,7 @@ func TestMapBd_WriteToBd(t *testing.T) {
 	}
 	type args struct {
 		ctx context.Context
-		u   *url.URL
+		u   *types.Link
 	}
 	tests := []struct {
 		name         string
@@ -124,7 +133,7 @@ func TestMapBd_WriteToBd(t *testing.T) {
 			preset: preset{Map: &SyncMapURLRepo{}},
 			args: args{
 				ctx: context.Background(),
-				u:   UnShorterURL,
+				u:   UnShorterLink,
 			},
 			want: &resultIDTransfer{
 				id:  "50334",
@@ -141,7 +150,7 @@ func TestMapBd_WriteToBd(t *testing.T) {
 					cancel()
 					return ctx
 				}(),
-				u: UnShorterURL,
+				u: UnShorterLink,
 			},
 			want: &resultIDTransfer{
 				id:  "",
@@ -160,7 +169,7 @@ func TestMapBd_WriteToBd(t *testing.T) {
 			if tt.positiveTest {
 				u, ok := m.sMap.Load(res)
 				require.True(t, ok)
-				require.Equal(t, tt.args.u, u)
+				require.Equal(t, tt.args.u.URL, u.(*types.Link).URL)
 			}
 			if !tt.positiveTest {
 				assert.Error(t, err)
@@ -194,7 +203,7 @@ func TestMapBd_getFromBd(t *testing.T) {
 			name: "Positive test",
 			preset: preset{
 				Map:    &SyncMapURLRepo{},
-				fields: []field{{key: "1", value: UnShorterURL}},
+				fields: []field{{key: "1", value: UnShorterLink}},
 			},
 			args: args{
 				urlChan: make(chan *valueTransfer),
@@ -202,7 +211,7 @@ func TestMapBd_getFromBd(t *testing.T) {
 			},
 			positiveTest: true,
 			want: &valueTransfer{
-				value: UnShorterURL,
+				value: UnShorterLink,
 				err:   nil,
 			},
 		},
@@ -263,7 +272,7 @@ func TestMapBd_writeToBd(t *testing.T) {
 	}
 	type args struct {
 		resultChan chan *resultIDTransfer
-		u          *url.URL
+		u          *types.Link
 	}
 	tests := []struct {
 		name         string
@@ -277,7 +286,7 @@ func TestMapBd_writeToBd(t *testing.T) {
 			preset: preset{Map: &SyncMapURLRepo{}},
 			args: args{
 				resultChan: make(chan *resultIDTransfer),
-				u:          UnShorterURL,
+				u:          UnShorterLink,
 			},
 			want: &resultIDTransfer{
 				id:  "50334",
@@ -298,7 +307,7 @@ func TestMapBd_writeToBd(t *testing.T) {
 			if tt.positiveTest {
 				u, ok := m.sMap.Load(got.id)
 				require.True(t, ok)
-				require.Equal(t, tt.args.u, u)
+				require.Equal(t, tt.args.u.URL, u.(*types.Link).URL)
 			}
 			if !tt.positiveTest {
 				assert.Error(t, got.err)
@@ -307,3 +316,224 @@ func TestMapBd_writeToBd(t *testing.T) {
 		})
 	}
 }
+
+func TestMapBd_Click(t *testing.T) {
+	tests := []struct {
+		name      string
+		link      *types.Link
+		clicks    int
+		wantOK    int
+		wantTotal int
+	}{
+		{
+			name:      "Unlimited link",
+			link:      &types.Link{URL: UnShorterURL},
+			clicks:    20,
+			wantOK:    20,
+			wantTotal: 20,
+		},
+		{
+			name:      "Burn after reading",
+			link:      &types.Link{URL: UnShorterURL, MaxClicks: 1},
+			clicks:    20,
+			wantOK:    1,
+			wantTotal: 1,
+		},
+		{
+			name:      "Limited link",
+			link:      &types.Link{URL: UnShorterURL, MaxClicks: 5},
+			clicks:    50,
+			wantOK:    5,
+			wantTotal: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &SyncMapURLRepo{}
+			m.sMap.Store("1", tt.link)
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			ok, exhausted := 0, 0
+			for i := 0; i < tt.clicks; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := m.Click(context.Background(), "1")
+					mu.Lock()
+					defer mu.Unlock()
+					if err == nil {
+						ok++
+						return
+					}
+					assert.ErrorIs(t, err, ErrClicksExhausted)
+					exhausted++
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.clicks-tt.wantOK, exhausted)
+			v, err := m.Read(context.Background(), "1")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantTotal, v.(*types.Link).Clicks)
+		})
+	}
+	t.Run("Not found", func(t *testing.T) {
+		m := &SyncMapURLRepo{}
+		_, err := m.Click(context.Background(), "1")
+		assert.ErrorIs(t, err, ErrNoSuchValue)
+	})
+}
+
+// openTestPool - пул подключений к postgres из TEST_DATABASE_DSN, без нее тест пропускается
+func openTestPool(tb testing.TB) *pgxpool.Pool {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if len(dsn) == 0 {
+		tb.Skip("TEST_DATABASE_DSN is not set")
+	}
+	pool, err := pgxpool.Connect(context.Background(), dsn)
+	require.NoError(tb, err)
+	tb.Cleanup(pool.Close)
+	return pool
+}
+
+// openTestDB подключается к postgres из TEST_DATABASE_DSN, без нее тест пропускается
+func openTestDB(tb testing.TB) *DBURLRepo {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if len(dsn) == 0 {
+		tb.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ctx := context.Background()
+	db, err := pgx.Connect(ctx, dsn)
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		db.Close(ctx)
+	})
+	repo, err := initURLRepository(ctx, db)
+	require.NoError(tb, err)
+	return repo.(*DBURLRepo)
+}
+
+func TestDBRepo_ReadMissing(t *testing.T) {
+	urlRepo := openTestDB(t)
+	ctx := context.Background()
+	_, err := urlRepo.Read(ctx, "none")
+	assert.ErrorIs(t, err, ErrNoSuchValue)
+	_, err = urlRepo.Click(ctx, "none")
+	assert.ErrorIs(t, err, ErrNoSuchValue)
+	userRepo, err := initUserRepository(ctx, urlRepo.db)
+	require.NoError(t, err)
+	_, err = userRepo.Read(ctx, "0")
+	assert.ErrorIs(t, err, ErrNoSuchValue)
+}
+
+func TestCreateLinkHash_Keyspaces(t *testing.T) {
+	u := mustParseURL(t, "https://test.com/page")
+	hash, err := createLinkHash(&types.Link{URL: u})
+	require.NoError(t, err)
+	assert.Len(t, hash, urlHashLen)
+	for i := 0; i < 100; i++ {
+		// случайный ключ одноразовой ссылки никогда не совпадет с хешем урла обычной ссылки
+		key, err := createLinkHash(&types.Link{URL: u, MaxClicks: 1})
+		require.NoError(t, err)
+		assert.Len(t, key, randomKeyLen)
+	}
+	key, err := createLinkHash(&types.Link{URL: u, MaxClicks: 1, Domain: "short.test"})
+	require.NoError(t, err)
+	_, id := types.SplitLinkKey(key)
+	assert.Len(t, id, randomKeyLen)
+}
+
+// uniqueLinks - ссылки, которых еще нет в базе
+func uniqueLinks(n int) []*types.Link {
+	prefix := time.Now().UnixNano()
+	links := make([]*types.Link, n)
+	for i := range links {
+		links[i] = &types.Link{URL: &url.URL{Scheme: "https", Host: "example.com", Path: fmt.Sprintf("/%d/%d", prefix, i)}}
+	}
+	return links
+}
+
+func TestDBURLRepo_CreateArrayDuplicates(t *testing.T) {
+	repo := openTestDB(t)
+	ctx := context.Background()
+	for _, size := range []int{4, copyThreshold} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			links := uniqueLinks(size)
+			existing, err := repo.Create(ctx, links[1])
+			require.NoError(t, err)
+			// повтор внутри пакета и ссылка с лимитом на тот же адрес
+			links[2] = links[0]
+			links[3] = &types.Link{URL: links[1].URL, MaxClicks: 1}
+			ids, err := repo.CreateArray(ctx, links)
+			var duplicates *DuplicatesError
+			require.ErrorAs(t, err, &duplicates)
+			assert.ErrorIs(t, err, ErrDuplicate)
+			assert.Equal(t, []int{1, 2}, duplicates.Indexes)
+			require.Len(t, ids, size)
+			assert.Equal(t, existing, ids[1])
+			assert.Equal(t, ids[0], ids[2])
+			assert.NotEqual(t, existing, ids[3])
+			for i, id := range ids {
+				v, err := repo.Read(ctx, id)
+				require.NoError(t, err)
+				assert.Equal(t, links[i].URL.String(), v.(*types.Link).URL.String())
+			}
+		})
+	}
+}
+
+func TestDBURLRepo_SetDisabled(t *testing.T) {
+	repo := openTestDB(t)
+	ctx := context.Background()
+	id, err := repo.Create(ctx, uniqueLinks(1)[0])
+	require.NoError(t, err)
+	_, err = repo.Click(ctx, id)
+	require.NoError(t, err)
+	require.NoError(t, repo.SetDisabled(ctx, id, types.DisabledLegal))
+	v, err := repo.Read(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, types.DisabledLegal, v.(*types.Link).Disabled)
+	assert.Equal(t, 1, v.(*types.Link).Clicks)
+	assert.ErrorIs(t, repo.SetDisabled(ctx, "none", types.Enabled), ErrNoSuchValue)
+}
+
+// BenchmarkDBURLRepo_CreateArray сравнивает вставку пакета по строке, одним pgx.Batch и через COPY
+func BenchmarkDBURLRepo_CreateArray(b *testing.B) {
+	repo := openTestDB(b)
+	ctx := context.Background()
+	rowByRow := func(ctx context.Context, tx pgx.Tx, sql string, links []*types.Link) ([]string, []int, error) {
+		keys := make([]string, len(links))
+		for i, l := range links {
+			key, _, err := insertLink(ctx, tx, sql, l)
+			if err != nil {
+				return nil, nil, err
+			}
+			keys[i] = key
+		}
+		return keys, nil, nil
+	}
+	strategies := []struct {
+		name   string
+		insert func(context.Context, pgx.Tx, string, []*types.Link) ([]string, []int, error)
+	}{
+		{name: "row by row", insert: rowByRow},
+		{name: "batch", insert: insertLinksBatch},
+		{name: "copy", insert: insertLinksCopy},
+	}
+	for _, size := range []int{100, 1000, 10000} {
+		for _, s := range strategies {
+			b.Run(fmt.Sprintf("%s %d", s.name, size), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					links := uniqueLinks(size)
+					b.StartTimer()
+					tx, err := repo.db.Begin(ctx)
+					require.NoError(b, err)
+					_, _, err = s.insert(ctx, tx, repo.insertStmt.SQL, links)
+					require.NoError(b, err)
+					require.NoError(b, tx.Commit(ctx))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package repository
+
+import (
+	"bufio"
+	"emperror.dev/errors"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"time"
+)
+
+// Формат WAL и снапшота: заголовок из 8 байт magic и 8 байт номера поколения (uint64 little endian),
+// за ним записи вида <длина payload uint32><crc32c payload uint32><payload>.
+// Payload - бинарно закодированный backUpValue
+const (
+	walMagic       = "URLSWAL1"
+	snapshotMagic  = "URLSSNP1"
+	fileHeaderSize = 16
+	// заголовок записи: длина и контрольная сумма
+	recordHeaderSize = 8
+	// запись больше этого размера считается поврежденной, чтобы мусорная длина не съела всю память
+	maxRecordSize = 16 << 20
+)
+
+// Вид записи - первый байт payload. Новые поля ссылки добавляются новой версией записи,
+// старые версии продолжают читаться из журналов и снапшотов, записанных до обновления
+const (
+	kindLink byte = iota
+	kindUser
+	// kindLinkV2 - ссылка с причиной отключения модератором
+	kindLinkV2
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrUnknownFileFormat = errors.New("unknown backup file format")
+
+// errTornRecord - запись оборвана или у нее испорчена длина, следующую запись за ней не найти
+var errTornRecord = errors.WithMessage(ErrCorruptedRecord, "torn record")
+
+// SyncPolicy - когда записи WAL сбрасываются на диск через fsync
+type SyncPolicy string
+
+const (
+	// SyncNever - fsync не вызывается, сброс на диск остается на усмотрение ОС
+	SyncNever SyncPolicy = "never"
+	// SyncInterval - fsync раз в Config.SyncInterval, при падении ОС теряется не больше интервала записей
+	SyncInterval SyncPolicy = "interval"
+	// SyncAlways - fsync после каждой записи
+	SyncAlways SyncPolicy = "always"
+)
+
+var ErrUnknownSyncPolicy = errors.New("unknown sync policy")
+
+// ParseSyncPolicy проверяет политику сброса на диск, пустая строка означает SyncNever
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case "":
+		return SyncNever, nil
+	case SyncNever, SyncInterval, SyncAlways:
+		return p, nil
+	default:
+		return "", errors.WithMessage(ErrUnknownSyncPolicy, s)
+	}
+}
+
+func appendFileHeader(dst []byte, magic string, generation uint64) []byte {
+	dst = append(dst, magic...)
+	var gen [8]byte
+	binary.LittleEndian.PutUint64(gen[:], generation)
+	return append(dst, gen[:]...)
+}
+
+// readFileHeader читает заголовок файла. Если magic не совпал, возвращается ErrUnknownFileFormat
+func readFileHeader(r io.Reader, magic string) (uint64, error) {
+	var header [fileHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, ErrUnknownFileFormat
+		}
+		return 0, err
+	}
+	if string(header[:len(magic)]) != magic {
+		return 0, ErrUnknownFileFormat
+	}
+	return binary.LittleEndian.Uint64(header[len(magic):]), nil
+}
+
+// appendRecord дописывает в dst запись целиком, вместе с длиной и контрольной суммой
+func appendRecord(dst []byte, v backUpValue) []byte {
+	start := len(dst)
+	dst = append(dst, make([]byte, recordHeaderSize)...)
+	dst = appendValue(dst, v)
+	payload := dst[start+recordHeaderSize:]
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(dst[start+4:], crc32.Checksum(payload, crcTable))
+	return dst
+}
+
+// readRecord читает следующую запись в buf и возвращает ее payload.
+// io.EOF означает, что файл закончился ровно на границе записи, errTornRecord - что запись оборвана
+// или ее длина испорчена. Если не сходится контрольная сумма, возвращается прочитанный payload
+// вместе с ErrCorruptedRecord: длина цела, и следующая запись начинается сразу за ним
+func readRecord(r *bufio.Reader, buf []byte) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:4])
+	if size > maxRecordSize {
+		return nil, errTornRecord
+	}
+	if cap(buf) < int(size) {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	if crc32.Checksum(buf, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return buf, ErrCorruptedRecord
+	}
+	return buf, nil
+}
+
+func appendValue(dst []byte, v backUpValue) []byte {
+	if v.Kind == userRecord {
+		dst = append(dst, kindUser)
+		dst = appendString(dst, v.Key)
+		dst = appendUvarint(dst, uint64(len(v.URLs)))
+		for _, u := range v.URLs {
+			dst = appendString(dst, u)
+		}
+		return dst
+	}
+	dst = append(dst, kindLinkV2)
+	dst = appendString(dst, v.Key)
+	rawURL := ""
+	if v.Value != nil {
+		rawURL = v.Value.String()
+	}
+	dst = appendString(dst, rawURL)
+	dst = appendVarint(dst, int64(v.MaxClicks))
+	dst = appendVarint(dst, int64(v.Clicks))
+	createdAt := int64(0)
+	if !v.CreatedAt.IsZero() {
+		createdAt = v.CreatedAt.UnixNano()
+	}
+	dst = appendVarint(dst, createdAt)
+	dst = appendVarint(dst, int64(v.RedirectCode))
+	dst = appendString(dst, v.QueryMode)
+	dst = appendString(dst, v.UTM.Encode())
+	return appendString(dst, v.Disabled)
+}
+
+func decodeValue(payload []byte) (backUpValue, error) {
+	d := recordDecoder{b: payload}
+	v := backUpValue{}
+	kind := d.byte()
+	v.Key = d.string()
+	switch kind {
+	case kindUser:
+		v.Kind = userRecord
+		n := d.uvarint()
+		if n > uint64(len(d.b)) {
+			return v, ErrCorruptedRecord
+		}
+		if n > 0 {
+			v.URLs = make([]string, 0, n)
+		}
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			v.URLs = append(v.URLs, d.string())
+		}
+	case kindLink, kindLinkV2:
+		rawURL := d.string()
+		v.MaxClicks = int(d.varint())
+		v.Clicks = int(d.varint())
+		if createdAt := d.varint(); createdAt != 0 {
+			v.CreatedAt = time.Unix(0, createdAt)
+		}
+		v.RedirectCode = int(d.varint())
+		v.QueryMode = d.string()
+		rawUTM := d.string()
+		if kind == kindLinkV2 {
+			v.Disabled = d.string()
+		}
+		if d.err != nil {
+			return v, d.err
+		}
+		var err error
+		if len(rawURL) != 0 {
+			if v.Value, err = url.Parse(rawURL); err != nil {
+				return v, ErrCorruptedRecord
+			}
+		}
+		if len(rawUTM) != 0 {
+			if v.UTM, err = url.ParseQuery(rawUTM); err != nil {
+				return v, ErrCorruptedRecord
+			}
+		}
+	default:
+		return v, ErrCorruptedRecord
+	}
+	if d.err == nil && len(d.b) != 0 {
+		return v, ErrCorruptedRecord
+	}
+	return v, d.err
+}
+
+func appendUvarint(dst []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+func appendVarint(dst []byte, x int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutVarint(buf[:], x)]...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// recordDecoder читает поля payload по порядку, первая ошибка запоминается и прерывает чтение
+type recordDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *recordDecoder) byte() byte {
+	if d.err != nil || len(d.b) == 0 {
+		d.err = ErrCorruptedRecord
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = ErrCorruptedRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *recordDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = ErrCorruptedRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *recordDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if n > uint64(len(d.b)) {
+		d.err = ErrCorruptedRecord
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
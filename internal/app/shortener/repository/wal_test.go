@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALRecord(t *testing.T) {
+	createdAt := time.Unix(1650000000, 123)
+	tests := []struct {
+		name  string
+		value backUpValue
+	}{
+		{
+			name: "Link",
+			value: newBackUpValue("abc", &types.Link{
+				URL:          mustParseURL(t, "https://test.com/a?b=c#d"),
+				MaxClicks:    10,
+				Clicks:       3,
+				CreatedAt:    createdAt,
+				RedirectCode: 308,
+				QueryMode:    types.QueryOverride,
+				UTM:          url.Values{"utm_source": {"x"}, "utm_medium": {"y", "z"}},
+				Disabled:     types.DisabledLegal,
+			}),
+		},
+		{
+			name:  "Plain link",
+			value: newBackUpValue("abc", &types.Link{URL: mustParseURL(t, "https://test.com/")}),
+		},
+		{
+			name:  "User",
+			value: backUpValue{Kind: userRecord, Key: "42", URLs: []string{"abc", "def"}},
+		},
+		{
+			name:  "User without links",
+			value: backUpValue{Kind: userRecord, Key: "42"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := appendRecord(nil, tt.value)
+			payload, err := readRecord(bufio.NewReader(bytes.NewReader(record)), nil)
+			require.NoError(t, err)
+			got, err := decodeValue(payload)
+			require.NoError(t, err)
+			if tt.value.Value != nil {
+				require.NotNil(t, got.Value)
+				assert.Equal(t, tt.value.Value.String(), got.Value.String())
+				got.Value, tt.value.Value = nil, nil
+			}
+			assert.True(t, tt.value.CreatedAt.Equal(got.CreatedAt))
+			got.CreatedAt, tt.value.CreatedAt = time.Time{}, time.Time{}
+			assert.Equal(t, tt.value, got)
+
+			for _, broken := range [][]byte{record[:len(record)-1], record[:recordHeaderSize-1]} {
+				_, err = readRecord(bufio.NewReader(bytes.NewReader(broken)), nil)
+				assert.ErrorIs(t, err, errTornRecord)
+			}
+			flipped := append([]byte(nil), record...)
+			flipped[len(flipped)-1] ^= 0xff
+			payload, err = readRecord(bufio.NewReader(bytes.NewReader(flipped)), nil)
+			assert.ErrorIs(t, err, ErrCorruptedRecord)
+			assert.NotErrorIs(t, err, errTornRecord)
+			assert.Len(t, payload, len(record)-recordHeaderSize)
+			_, err = readRecord(bufio.NewReader(bytes.NewReader(nil)), nil)
+			assert.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
+// TestWALRecord_LinkV1 проверяет, что ссылки из журналов до появления причины отключения читаются
+func TestWALRecord_LinkV1(t *testing.T) {
+	payload := appendValue(nil, newBackUpValue("abc", &types.Link{URL: mustParseURL(t, "https://test.com/"), MaxClicks: 2, Clicks: 1}))
+	require.Equal(t, kindLinkV2, payload[0])
+	// запись первой версии - та же запись без последнего поля, пустая строка занимает один байт длины
+	v1 := append([]byte{kindLink}, payload[1:len(payload)-1]...)
+	got, err := decodeValue(v1)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", got.Key)
+	assert.Equal(t, "https://test.com/", got.Value.String())
+	assert.Equal(t, 2, got.MaxClicks)
+	assert.Equal(t, 1, got.Clicks)
+	assert.Empty(t, got.Disabled)
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for in, want := range map[string]SyncPolicy{"": SyncNever, "never": SyncNever, "interval": SyncInterval, "always": SyncAlways} {
+		got, err := ParseSyncPolicy(in)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := ParseSyncPolicy("sometimes")
+	assert.ErrorIs(t, err, ErrUnknownSyncPolicy)
+}
+
+func benchmarkLink(i int) *types.Link {
+	u, _ := url.Parse(fmt.Sprintf("https://example.com/some/long/path/%d?query=value", i))
+	return &types.Link{URL: u, CreatedAt: time.Now()}
+}
+
+// BenchmarkBackUpWrite сравнивает запись одной ссылки в старом текстовом формате и в журнале
+func BenchmarkBackUpWrite(b *testing.B) {
+	b.Run("json lines", func(b *testing.B) {
+		f, err := os.Create(filepath.Join(b.TempDir(), "backup.json"))
+		require.NoError(b, err)
+		defer f.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			line, err := encodeLegacyRecord(newBackUpValue("key", benchmarkLink(i)))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := f.Write(line); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, policy := range []SyncPolicy{SyncNever, SyncAlways} {
+		b.Run("wal "+string(policy), func(b *testing.B) {
+			smr, _, _, err := openBackUp(filepath.Join(b.TempDir(), "backup.wal"))
+			require.NoError(b, err)
+			defer smr.backUp.close()
+			smr.backUp.policy = policy
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := smr.backUp.writeLink("key", benchmarkLink(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkBackUpStartup сравнивает загрузку бекапа в старом текстовом формате и снапшота с хвостом журнала
+func BenchmarkBackUpStartup(b *testing.B) {
+	const links = 100000
+	dir := b.TempDir()
+
+	legacyPath := filepath.Join(dir, "backup.json")
+	f, err := os.Create(legacyPath)
+	require.NoError(b, err)
+	writer := bufio.NewWriter(f)
+	for i := 0; i < links; i++ {
+		line, err := encodeLegacyRecord(newBackUpValue(fmt.Sprint(i), benchmarkLink(i)))
+		require.NoError(b, err)
+		_, err = writer.Write(line)
+		require.NoError(b, err)
+	}
+	require.NoError(b, writer.Flush())
+	require.NoError(b, f.Close())
+
+	walPath := filepath.Join(dir, "backup.wal")
+	smr, _, _, err := openBackUp(walPath)
+	require.NoError(b, err)
+	for i := 0; i < links; i++ {
+		require.NoError(b, smr.backUp.writeLink(fmt.Sprint(i), benchmarkLink(i)))
+		smr.links.Store(fmt.Sprint(i), benchmarkLink(i))
+		// последние 10% записей остаются в хвосте журнала
+		if i == links*9/10 {
+			require.NoError(b, smr.backUp.compact())
+		}
+	}
+	require.NoError(b, smr.backUp.close())
+
+	b.Run("json lines", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			smr := new(ShardedURLRepo)
+			userRepo := newShardedUserRepo()
+			file, err := os.Open(legacyPath)
+			require.NoError(b, err)
+			legacy := &backUp{file: file, path: legacyPath}
+			legacy.replayLegacy(func(v backUpValue) {
+				restoreRecord(v, smr, userRepo)
+			}, &BackUpReport{})
+			file.Close()
+		}
+	})
+	b.Run("snapshot and wal", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			smr, _, report, err := openBackUp(walPath)
+			require.NoError(b, err)
+			if report.Links != links {
+				b.Fatalf("loaded %d links", report.Links)
+			}
+			smr.backUp.close()
+		}
+	})
+}
@@ -0,0 +1,459 @@
+package repository
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/exp/slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WebhookRepository хранит подписки пользователей и исходящую очередь доставок. Событие сначала
+// записывается в очередь, а отправляется потом, поэтому перезапуск сервера не теряет события
+type WebhookRepository interface {
+	// CreateWebhook сохраняет подписку и возвращает ее id
+	CreateWebhook(ctx context.Context, w *types.Webhook) (string, error)
+	// Webhook возвращает подписку по id, если ее нет - ErrNoSuchValue
+	Webhook(ctx context.Context, id string) (*types.Webhook, error)
+	// Webhooks возвращает подписки пользователей по возрастанию id
+	Webhooks(ctx context.Context, userIDs ...string) ([]*types.Webhook, error)
+	// DeleteWebhook удаляет подписку пользователя вместе с ее доставками. Чужая подписка - ErrNoSuchValue
+	DeleteWebhook(ctx context.Context, userID, id string) error
+	// ClickThresholds возвращает пороги переходов всех подписок на types.EventClickThreshold
+	ClickThresholds(ctx context.Context) ([]int, error)
+	// Enqueue ставит доставки в очередь и проставляет им id
+	Enqueue(ctx context.Context, deliveries []*types.WebhookDelivery) error
+	// ClaimDue забирает до limit доставок, время попытки которых пришло, и откладывает их на lease,
+	// чтобы их не забрал другой экземпляр сервера. Если попытка не сохранится, доставка вернется через lease
+	ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]*types.WebhookDelivery, error)
+	// SaveAttempt сохраняет итог попытки: статус, число попыток, ответ и время следующей попытки
+	SaveAttempt(ctx context.Context, d *types.WebhookDelivery) error
+	// Deliveries возвращает до limit последних доставок подписки, новые первыми
+	Deliveries(ctx context.Context, webhookID string, limit int) ([]*types.WebhookDelivery, error)
+}
+
+// InitWebhookRepository создает хранилище вебхуков в postgres, если есть пул подключений, иначе в памяти.
+// Очередь читает фоновый Dispatcher одновременно с обработчиками запросов, а pgx.Conn не допускает
+// конкурентных запросов, поэтому хранилищу нужен свой пул
+func InitWebhookRepository(c context.Context, db *pgxpool.Pool) (WebhookRepository, error) {
+	if db == nil {
+		return newMemoryWebhookRepo(), nil
+	}
+	_, err := db.Exec(c, `create table if not exists webhooks (id serial primary key, user_id text not null,
+			url text not null, secret text not null, events text[] not null, click_threshold integer not null default 0,
+			created_at timestamptz not null default now());
+		create index if not exists webhooks_user_id on webhooks (user_id);
+		create table if not exists webhook_deliveries (id bigserial primary key,
+			webhook_id integer not null references webhooks (id) on delete cascade, event text not null,
+			payload bytea not null, status text not null, attempts integer not null default 0,
+			last_status_code integer not null default 0, last_error text not null default '',
+			next_attempt_at timestamptz not null default now(), created_at timestamptz not null default now(),
+			delivered_at timestamptz);
+		create index if not exists webhook_deliveries_due on webhook_deliveries (next_attempt_at) where status = 'pending';
+		create index if not exists webhook_deliveries_webhook_id on webhook_deliveries (webhook_id, id)`)
+	if err != nil {
+		return nil, err
+	}
+	return &DBWebhookRepo{db: db}, nil
+}
+
+// MemoryWebhookRepo хранит подписки и очередь в памяти, наружу отдаются копии
+type MemoryWebhookRepo struct {
+	mu            sync.Mutex
+	lastWebhookID int
+	webhooks      map[string]*types.Webhook
+	lastDelivery  int
+	// по возрастанию id
+	deliveries []*types.WebhookDelivery
+	now        func() time.Time
+}
+
+func newMemoryWebhookRepo() *MemoryWebhookRepo {
+	return &MemoryWebhookRepo{webhooks: map[string]*types.Webhook{}, now: time.Now}
+}
+
+func copyWebhook(w *types.Webhook) *types.Webhook {
+	c := *w
+	c.Events = append([]types.WebhookEvent(nil), w.Events...)
+	return &c
+}
+
+func copyDelivery(d *types.WebhookDelivery) *types.WebhookDelivery {
+	c := *d
+	return &c
+}
+
+func (m *MemoryWebhookRepo) CreateWebhook(ctx context.Context, w *types.Webhook) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastWebhookID++
+	stored := copyWebhook(w)
+	stored.ID = strconv.Itoa(m.lastWebhookID)
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = m.now()
+	}
+	m.webhooks[stored.ID] = stored
+	return stored.ID, nil
+}
+
+func (m *MemoryWebhookRepo) Webhook(ctx context.Context, id string) (*types.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.webhooks[id]
+	if !ok {
+		return nil, ErrNoSuchValue
+	}
+	return copyWebhook(w), nil
+}
+
+func (m *MemoryWebhookRepo) Webhooks(ctx context.Context, userIDs ...string) ([]*types.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []*types.Webhook
+	for _, w := range m.webhooks {
+		if slices.Contains(userIDs, w.UserID) {
+			res = append(res, copyWebhook(w))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return webhookIDLess(res[i].ID, res[j].ID)
+	})
+	return res, nil
+}
+
+func (m *MemoryWebhookRepo) DeleteWebhook(ctx context.Context, userID, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.webhooks[id]
+	if !ok || w.UserID != userID {
+		return ErrNoSuchValue
+	}
+	delete(m.webhooks, id)
+	kept := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if d.WebhookID != id {
+			kept = append(kept, d)
+		}
+	}
+	m.deliveries = kept
+	return nil
+}
+
+func (m *MemoryWebhookRepo) ClickThresholds(ctx context.Context) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []int
+	for _, w := range m.webhooks {
+		if slices.Contains(w.Events, types.EventClickThreshold) && !slices.Contains(res, w.ClickThreshold) {
+			res = append(res, w.ClickThreshold)
+		}
+	}
+	return res, nil
+}
+
+func (m *MemoryWebhookRepo) Enqueue(ctx context.Context, deliveries []*types.WebhookDelivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for _, d := range deliveries {
+		m.lastDelivery++
+		d.ID = strconv.Itoa(m.lastDelivery)
+		if d.CreatedAt.IsZero() {
+			d.CreatedAt = now
+		}
+		if d.NextAttemptAt.IsZero() {
+			d.NextAttemptAt = now
+		}
+		m.deliveries = append(m.deliveries, copyDelivery(d))
+	}
+	return nil
+}
+
+func (m *MemoryWebhookRepo) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]*types.WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	var due []*types.WebhookDelivery
+	for _, d := range m.deliveries {
+		if len(due) == limit {
+			break
+		}
+		if d.Status != types.DeliveryPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+		d.NextAttemptAt = now.Add(lease)
+		due = append(due, copyDelivery(d))
+	}
+	return due, nil
+}
+
+func (m *MemoryWebhookRepo) SaveAttempt(ctx context.Context, d *types.WebhookDelivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, stored := range m.deliveries {
+		if stored.ID == d.ID {
+			m.deliveries[i] = copyDelivery(d)
+			return nil
+		}
+	}
+	// подписку удалили, пока шла попытка
+	return ErrNoSuchValue
+}
+
+func (m *MemoryWebhookRepo) Deliveries(ctx context.Context, webhookID string, limit int) ([]*types.WebhookDelivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []*types.WebhookDelivery
+	for i := len(m.deliveries) - 1; i >= 0 && len(res) < limit; i-- {
+		if m.deliveries[i].WebhookID == webhookID {
+			res = append(res, copyDelivery(m.deliveries[i]))
+		}
+	}
+	return res, nil
+}
+
+// webhookIDLess сравнивает числовые id по значению
+func webhookIDLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// DBWebhookRepo хранит подписки в таблице webhooks, а очередь - в webhook_deliveries
+type DBWebhookRepo struct {
+	db *pgxpool.Pool
+}
+
+const webhookColumns = "id, user_id, url, secret, events, click_threshold, created_at"
+
+const deliveryColumns = `id, webhook_id, event, payload, status, attempts, last_status_code, last_error,
+	next_attempt_at, created_at, coalesce(delivered_at, 'epoch')`
+
+func scanWebhook(row pgx.Row) (*types.Webhook, error) {
+	w := &types.Webhook{}
+	id := 0
+	var events []string
+	if err := row.Scan(&id, &w.UserID, &w.URL, &w.Secret, &events, &w.ClickThreshold, &w.CreatedAt); err != nil {
+		return nil, err
+	}
+	w.ID = strconv.Itoa(id)
+	for _, e := range events {
+		w.Events = append(w.Events, types.WebhookEvent(e))
+	}
+	return w, nil
+}
+
+func scanDelivery(row pgx.Row) (*types.WebhookDelivery, error) {
+	d := &types.WebhookDelivery{}
+	var id int64
+	webhookID := 0
+	event, status := "", ""
+	if err := row.Scan(&id, &webhookID, &event, &d.Payload, &status, &d.Attempts, &d.LastStatusCode, &d.LastError,
+		&d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt); err != nil {
+		return nil, err
+	}
+	d.ID, d.WebhookID = strconv.FormatInt(id, 10), strconv.Itoa(webhookID)
+	d.Event, d.Status = types.WebhookEvent(event), types.DeliveryStatus(status)
+	if d.DeliveredAt.Equal(time.Unix(0, 0)) {
+		d.DeliveredAt = time.Time{}
+	}
+	return d, nil
+}
+
+func (d *DBWebhookRepo) CreateWebhook(ctx context.Context, w *types.Webhook) (string, error) {
+	events := make([]string, len(w.Events))
+	for i, e := range w.Events {
+		events[i] = string(e)
+	}
+	id := 0
+	err := d.db.QueryRow(ctx, `INSERT INTO webhooks (user_id, url, secret, events, click_threshold) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`, w.UserID, w.URL, w.Secret, events, w.ClickThreshold).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(id), nil
+}
+
+// webhookDBID переводит id из запроса в ключ таблицы, нечисловой id - ErrNoSuchValue
+func webhookDBID(id string) (int, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, ErrNoSuchValue
+	}
+	return n, nil
+}
+
+func (d *DBWebhookRepo) Webhook(ctx context.Context, id string) (*types.Webhook, error) {
+	n, err := webhookDBID(id)
+	if err != nil {
+		return nil, err
+	}
+	w, err := scanWebhook(d.db.QueryRow(ctx, "SELECT "+webhookColumns+" from webhooks where id = $1", n))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchValue
+	}
+	return w, err
+}
+
+func (d *DBWebhookRepo) Webhooks(ctx context.Context, userIDs ...string) ([]*types.Webhook, error) {
+	rows, err := d.db.Query(ctx, "SELECT "+webhookColumns+" from webhooks where user_id = ANY($1) order by id", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*types.Webhook
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, w)
+	}
+	return res, rows.Err()
+}
+
+func (d *DBWebhookRepo) DeleteWebhook(ctx context.Context, userID, id string) error {
+	n, err := webhookDBID(id)
+	if err != nil {
+		return err
+	}
+	tag, err := d.db.Exec(ctx, "DELETE FROM webhooks where id = $1 and user_id = $2", n, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchValue
+	}
+	return nil
+}
+
+func (d *DBWebhookRepo) ClickThresholds(ctx context.Context) ([]int, error) {
+	rows, err := d.db.Query(ctx, "SELECT distinct click_threshold from webhooks where $1 = ANY(events)", string(types.EventClickThreshold))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []int
+	for rows.Next() {
+		threshold := 0
+		if err := rows.Scan(&threshold); err != nil {
+			return nil, err
+		}
+		res = append(res, threshold)
+	}
+	return res, rows.Err()
+}
+
+func (d *DBWebhookRepo) Enqueue(ctx context.Context, deliveries []*types.WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	batch := &pgx.Batch{}
+	for _, del := range deliveries {
+		batch.Queue(`INSERT INTO webhook_deliveries (webhook_id, event, payload, status) VALUES ($1, $2, $3, $4)
+			RETURNING id, next_attempt_at, created_at`, del.WebhookID, string(del.Event), del.Payload, string(del.Status))
+	}
+	results := d.db.SendBatch(ctx, batch)
+	defer results.Close()
+	for _, del := range deliveries {
+		var id int64
+		if err := results.QueryRow().Scan(&id, &del.NextAttemptAt, &del.CreatedAt); err != nil {
+			return err
+		}
+		del.ID = strconv.FormatInt(id, 10)
+	}
+	return results.Close()
+}
+
+// ClaimDue откладывает доставки одним запросом, skip locked не дает двум экземплярам забрать одну доставку
+func (d *DBWebhookRepo) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]*types.WebhookDelivery, error) {
+	rows, err := d.db.Query(ctx, `UPDATE webhook_deliveries set next_attempt_at = now() + $2::interval
+		where id in (SELECT id from webhook_deliveries where status = $3 and next_attempt_at <= now()
+			order by next_attempt_at limit $1 for update skip locked)
+		RETURNING `+deliveryColumns, limit, lease, string(types.DeliveryPending))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*types.WebhookDelivery
+	for rows.Next() {
+		del, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, del)
+	}
+	return res, rows.Err()
+}
+
+func (d *DBWebhookRepo) SaveAttempt(ctx context.Context, del *types.WebhookDelivery) error {
+	var deliveredAt *time.Time
+	if !del.DeliveredAt.IsZero() {
+		deliveredAt = &del.DeliveredAt
+	}
+	tag, err := d.db.Exec(ctx, `UPDATE webhook_deliveries set status = $2, attempts = $3, last_status_code = $4,
+		last_error = $5, next_attempt_at = $6, delivered_at = $7 where id = $1`,
+		del.ID, string(del.Status), del.Attempts, del.LastStatusCode, del.LastError, del.NextAttemptAt, deliveredAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchValue
+	}
+	return nil
+}
+
+func (d *DBWebhookRepo) Deliveries(ctx context.Context, webhookID string, limit int) ([]*types.WebhookDelivery, error) {
+	n, err := webhookDBID(webhookID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := d.db.Query(ctx, "SELECT "+deliveryColumns+" from webhook_deliveries where webhook_id = $1 order by id desc limit $2",
+		n, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*types.WebhookDelivery
+	for rows.Next() {
+		del, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, del)
+	}
+	return res, rows.Err()
+}
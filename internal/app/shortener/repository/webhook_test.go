@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestWebhookRepository(t *testing.T) {
+	factories := []struct {
+		name string
+		init func(t *testing.T) WebhookRepository
+	}{
+		{
+			name: "memory",
+			init: func(t *testing.T) WebhookRepository {
+				return newMemoryWebhookRepo()
+			},
+		},
+		{
+			name: "postgres",
+			init: func(t *testing.T) WebhookRepository {
+				repo, err := InitWebhookRepository(context.Background(), openTestPool(t))
+				require.NoError(t, err)
+				return repo
+			},
+		},
+	}
+	for _, f := range factories {
+		t.Run(f.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := f.init(t)
+			user := fmt.Sprint(time.Now().UnixNano())
+			id, err := repo.CreateWebhook(ctx, &types.Webhook{
+				UserID: user, URL: "https://hooks.test/a", Secret: "secret",
+				Events: []types.WebhookEvent{types.EventLinkCreated, types.EventClickThreshold}, ClickThreshold: 7,
+			})
+			require.NoError(t, err)
+			otherID, err := repo.CreateWebhook(ctx, &types.Webhook{UserID: user + "-other", URL: "https://hooks.test/b", Events: types.WebhookEvents, ClickThreshold: 3})
+			require.NoError(t, err)
+
+			w, err := repo.Webhook(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, "https://hooks.test/a", w.URL)
+			assert.Equal(t, "secret", w.Secret)
+			assert.Equal(t, []types.WebhookEvent{types.EventLinkCreated, types.EventClickThreshold}, w.Events)
+			assert.False(t, w.CreatedAt.IsZero())
+			_, err = repo.Webhook(ctx, "none")
+			assert.ErrorIs(t, err, ErrNoSuchValue)
+
+			hooks, err := repo.Webhooks(ctx, user, user+"-other")
+			require.NoError(t, err)
+			require.Len(t, hooks, 2)
+			assert.Equal(t, id, hooks[0].ID)
+			assert.Equal(t, otherID, hooks[1].ID)
+			thresholds, err := repo.ClickThresholds(ctx)
+			require.NoError(t, err)
+			assert.Subset(t, thresholds, []int{3, 7})
+
+			deliveries := []*types.WebhookDelivery{
+				{WebhookID: id, Event: types.EventLinkCreated, Payload: []byte(`{"n":1}`), Status: types.DeliveryPending},
+				{WebhookID: id, Event: types.EventLinkCreated, Payload: []byte(`{"n":2}`), Status: types.DeliveryPending},
+			}
+			require.NoError(t, repo.Enqueue(ctx, deliveries))
+			require.NotEmpty(t, deliveries[0].ID)
+			require.NotEqual(t, deliveries[0].ID, deliveries[1].ID)
+
+			// забранные доставки не отдаются повторно, пока не истечет аренда
+			due, err := repo.ClaimDue(ctx, 1, time.Hour)
+			require.NoError(t, err)
+			require.Len(t, due, 1)
+			claimed := due[0]
+			assert.Equal(t, []byte(`{"n":1}`), claimed.Payload)
+			due, err = repo.ClaimDue(ctx, 10, time.Hour)
+			require.NoError(t, err)
+			require.Len(t, due, 1)
+			assert.Equal(t, deliveries[1].ID, due[0].ID)
+			due, err = repo.ClaimDue(ctx, 10, time.Hour)
+			require.NoError(t, err)
+			assert.Empty(t, due)
+
+			claimed.Attempts = 1
+			claimed.Status = types.DeliveryDelivered
+			claimed.LastStatusCode = 204
+			claimed.DeliveredAt = time.Now()
+			require.NoError(t, repo.SaveAttempt(ctx, claimed))
+			history, err := repo.Deliveries(ctx, id, 10)
+			require.NoError(t, err)
+			require.Len(t, history, 2)
+			assert.Equal(t, deliveries[1].ID, history[0].ID)
+			assert.Equal(t, types.DeliveryPending, history[0].Status)
+			assert.True(t, history[0].DeliveredAt.IsZero())
+			assert.Equal(t, types.DeliveryDelivered, history[1].Status)
+			assert.Equal(t, 1, history[1].Attempts)
+			assert.Equal(t, 204, history[1].LastStatusCode)
+			assert.False(t, history[1].DeliveredAt.IsZero())
+			history, err = repo.Deliveries(ctx, id, 1)
+			require.NoError(t, err)
+			assert.Len(t, history, 1)
+
+			// чужую подписку не удалить, удаление уносит доставки
+			assert.ErrorIs(t, repo.DeleteWebhook(ctx, user, otherID), ErrNoSuchValue)
+			require.NoError(t, repo.DeleteWebhook(ctx, user, id))
+			assert.ErrorIs(t, repo.DeleteWebhook(ctx, user, id), ErrNoSuchValue)
+			assert.ErrorIs(t, repo.SaveAttempt(ctx, claimed), ErrNoSuchValue)
+			history, err = repo.Deliveries(ctx, id, 10)
+			require.NoError(t, err)
+			assert.Empty(t, history)
+		})
+	}
+}
+
+func TestMemoryWebhookRepo_ClaimDue(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryWebhookRepo()
+	now := time.Now()
+	repo.now = func() time.Time {
+		return now
+	}
+	d := &types.WebhookDelivery{WebhookID: "1", Status: types.DeliveryPending, NextAttemptAt: now.Add(time.Minute)}
+	require.NoError(t, repo.Enqueue(ctx, []*types.WebhookDelivery{d}))
+	due, err := repo.ClaimDue(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	now = now.Add(time.Minute)
+	due, err = repo.ClaimDue(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	// аренда истекла, попытка не сохранилась
+	now = now.Add(time.Minute)
+	due, err = repo.ClaimDue(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+
+	due[0].Status = types.DeliveryFailed
+	require.NoError(t, repo.SaveAttempt(ctx, due[0]))
+	now = now.Add(time.Hour)
+	due, err = repo.ClaimDue(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+}
@@ -0,0 +1,178 @@
+package router
+
+import (
+	"crypto/subtle"
+	"emperror.dev/errors"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/controllers"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// маршруты модерации, на них не заводятся пользователи
+const adminPath = "/api/admin"
+
+const (
+	defaultAdminSearchLimit = 100
+	maxAdminSearchLimit     = 1000
+)
+
+var errAdminDisabled = errors.New("admin API is disabled")
+var errInvalidAdminToken = errors.New("invalid admin token")
+
+// AdminLink - ссылка глазами модератора
+type AdminLink struct {
+	ID               string            `json:"id"`
+	ShortURL         string            `json:"short_url"`
+	OriginalURL      string            `json:"original_url"`
+	MaxClicks        int               `json:"max_clicks,omitempty"`
+	Clicks           int               `json:"clicks"`
+	CreatedAt        *time.Time        `json:"created_at,omitempty"`
+	RedirectCode     int               `json:"redirect_code,omitempty"`
+	QueryPassthrough string            `json:"query_passthrough,omitempty"`
+	UTM              map[string]string `json:"utm,omitempty"`
+	// legal или removed, пусто - ссылка работает
+	Disabled string `json:"disabled,omitempty"`
+	// id владельцев, только в ответах по одной ссылке
+	Owners []string `json:"owners,omitempty"`
+}
+
+type AdminDisableRequest struct {
+	// legal - переход отвечает 451, removed - 410
+	Reason string `json:"reason"`
+}
+
+type AdminTransferRequest struct {
+	UserID string `json:"user_id"`
+}
+
+func adminLink(info controllers.LinkInfo) AdminLink {
+	l := info.Link
+	res := AdminLink{
+		ID:               info.ID,
+		ShortURL:         info.ShortURL,
+		OriginalURL:      l.URL.String(),
+		MaxClicks:        l.MaxClicks,
+		Clicks:           l.Clicks,
+		RedirectCode:     l.RedirectCode,
+		QueryPassthrough: string(l.QueryMode),
+		UTM:              utmMap(l.UTM),
+		Disabled:         string(l.Disabled),
+		Owners:           info.Owners,
+	}
+	if !l.CreatedAt.IsZero() {
+		createdAt := l.CreatedAt.UTC()
+		res.CreatedAt = &createdAt
+	}
+	return res
+}
+
+func utmMap(utm url.Values) map[string]string {
+	if len(utm) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(utm))
+	for k := range utm {
+		res[k] = utm.Get(k)
+	}
+	return res
+}
+
+// adminHandler пускает только запросы с токеном модератора в заголовке Authorization: Bearer.
+// Без настроенного токена маршрутов модерации как будто нет
+func (r *router) adminHandler(c *gin.Context) {
+	if len(r.adminToken) == 0 {
+		abortWithStatusProblem(c, http.StatusNotFound, errAdminDisabled)
+		return
+	}
+	scheme, t, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(t)), []byte(r.adminToken)) != 1 {
+		c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+		abortWithProblem(c, &controllers.UnauthorizedError{Err: errInvalidAdminToken})
+		return
+	}
+	c.Next()
+}
+
+func (r *router) SearchAdminLinks(c *gin.Context) {
+	host := strings.TrimSpace(c.Query("host"))
+	if len(host) == 0 {
+		abortWithStatusProblem(c, http.StatusBadRequest, errors.New("host is required"))
+		return
+	}
+	limit, err := intFromQuery(c, "limit")
+	if err != nil || limit < 0 || limit > maxAdminSearchLimit {
+		abortWithStatusProblem(c, http.StatusBadRequest, errors.Errorf("limit must be between 1 and %d", maxAdminSearchLimit))
+		return
+	}
+	if limit == 0 {
+		limit = defaultAdminSearchLimit
+	}
+	found, err := r.controller.SearchLinks(c, host, limit)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	res := make([]AdminLink, len(found))
+	for i, info := range found {
+		res[i] = adminLink(info)
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func (r *router) GetAdminLink(c *gin.Context) {
+	info, err := r.controller.AdminGetLink(c, r.linkKey(c))
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, adminLink(*info))
+}
+
+func (r *router) DisableAdminLink(c *gin.Context) {
+	var req AdminDisableRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithStatusProblem(c, http.StatusBadRequest, err)
+		return
+	}
+	// пустая причина включила бы ссылку, для этого есть DELETE
+	if len(req.Reason) == 0 {
+		abortWithProblem(c, controllers.ErrInvalidDisableReason)
+		return
+	}
+	r.setAdminLinkDisabled(c, types.DisableReason(req.Reason))
+}
+
+func (r *router) EnableAdminLink(c *gin.Context) {
+	r.setAdminLinkDisabled(c, types.Enabled)
+}
+
+func (r *router) setAdminLinkDisabled(c *gin.Context, reason types.DisableReason) {
+	info, err := r.controller.SetLinkDisabled(c, r.linkKey(c), reason)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, adminLink(*info))
+}
+
+func (r *router) TransferAdminLink(c *gin.Context) {
+	var req AdminTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithStatusProblem(c, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.UserID) == 0 {
+		abortWithStatusProblem(c, http.StatusBadRequest, errors.New("user_id is required"))
+		return
+	}
+	info, err := r.controller.TransferLink(c, r.linkKey(c), req.UserID)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, adminLink(*info))
+}
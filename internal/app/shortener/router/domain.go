@@ -0,0 +1,79 @@
+package router
+
+import (
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/openapi"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// UserDomain - домен, на котором создаются ссылки пользователя без явного домена
+type UserDomain struct {
+	// хост домена, пусто в запросе - домен по умолчанию
+	Domain string `json:"domain"`
+	// настроенные домены, первым - домен по умолчанию. В запросе не нужны
+	Domains []string `json:"domains,omitempty"`
+}
+
+// linkKey - ключ ссылки :hash в маршрутах API. Домен ссылки задается ?domain=, без него - хост запроса
+func (r *router) linkKey(c *gin.Context) string {
+	domain := c.Query("domain")
+	if len(domain) == 0 {
+		domain = c.Request.Host
+	}
+	return r.controller.LinkKey(domain, c.Param("hash"))
+}
+
+func (r *router) GetUserDomain(c *gin.Context) {
+	domain, err := r.controller.UserDomain(c, c.GetHeader("auth"))
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, UserDomain{Domain: domain, Domains: r.controller.Domains()})
+}
+
+func (r *router) SetUserDomain(c *gin.Context) {
+	var req UserDomain
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithStatusProblem(c, http.StatusBadRequest, err)
+		return
+	}
+	userToken := c.GetHeader("auth")
+	if err := r.controller.SetUserDomain(c, userToken, req.Domain); err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	r.GetUserDomain(c)
+}
+
+// addDomainOperations описывает маршруты домена пользователя /api/user/domain
+func addDomainOperations(d *openapi.Document, errorResponse func(string) *openapi.Response) {
+	domain := &openapi.Response{Description: "домен пользователя и настроенные домены", Content: d.JSON(UserDomain{})}
+	unauthorized := errorResponse("токен пользователя невалиден")
+	serverError := errorResponse("ошибка хранилища")
+
+	d.Add(http.MethodGet, "/api/user/domain", &openapi.Operation{
+		Summary:     "Домен ссылок текущего пользователя",
+		OperationID: "userDomain",
+		Tags:        []string{"users"},
+		Responses: map[string]*openapi.Response{
+			"200": domain,
+			"401": unauthorized,
+			"500": serverError,
+		},
+	})
+	d.Add(http.MethodPut, "/api/user/domain", &openapi.Operation{
+		Summary:     "Выбрать домен ссылок текущего пользователя",
+		Description: "На нем создаются ссылки, в запросе которых домен не задан. Пустой domain - домен по умолчанию",
+		OperationID: "setUserDomain",
+		Tags:        []string{"users"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: d.JSON(UserDomain{})},
+		Responses: map[string]*openapi.Response{
+			"200": domain,
+			"400": errorResponse("домен не настроен на сервере"),
+			"401": unauthorized,
+			"500": serverError,
+			"501": errorResponse("выбор домена не настроен на сервере"),
+		},
+	})
+}
@@ -0,0 +1,33 @@
+package router
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+var errFullDuplexUnsupported = errors.New("full duplex is not supported")
+
+type rawWriterKey struct{}
+
+// Handler оборачивает роутер для запуска в http.Server. gin не отдает исходный http.ResponseWriter,
+// а потоковым ручкам он нужен, чтобы читать запрос и писать ответ одновременно
+func Handler(engine *gin.Engine) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		engine.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), rawWriterKey{}, w)))
+	})
+}
+
+// enableFullDuplex разрешает писать ответ до того, как прочитано тело запроса. По умолчанию HTTP/1 сервер
+// дочитывает и выбрасывает тело запроса, как только начинается ответ. HTTP/2 дуплексный сам по себе
+func enableFullDuplex(req *http.Request) error {
+	if req.ProtoMajor >= 2 {
+		return nil
+	}
+	w, ok := req.Context().Value(rawWriterKey{}).(http.ResponseWriter)
+	if !ok {
+		return errFullDuplexUnsupported
+	}
+	return enableWriterFullDuplex(w)
+}
@@ -0,0 +1,9 @@
+//go:build go1.21
+
+package router
+
+import "net/http"
+
+func enableWriterFullDuplex(w http.ResponseWriter) error {
+	return http.NewResponseController(w).EnableFullDuplex()
+}
@@ -0,0 +1,392 @@
+package router
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"emperror.dev/errors"
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ответы меньше не сжимаются: заголовки кодировки и служебные байты формата съедают выигрыш
+const defaultCompressMinSize = 1024
+
+// типы ответов, которые сжимаются по умолчанию. /* в конце - любой подтип
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/problem+json",
+	"application/x-ndjson",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// уровень brotli, при котором он сжимает быстрее gzip по умолчанию и не хуже
+const brotliLevel = 4
+
+// окно zstd, которое рекомендуется для HTTP, больше браузеры не принимают
+const zstdWindowSize = 8 << 20
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// encoder - потоковый кодировщик, который переиспользуется после Reset
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+type codec struct {
+	// значение Content-Encoding
+	name      string
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	newWriter func() encoder
+	writers   sync.Pool
+}
+
+func (c *codec) writer(w io.Writer) encoder {
+	e, ok := c.writers.Get().(encoder)
+	if !ok {
+		e = c.newWriter()
+	}
+	e.Reset(w)
+	return e
+}
+
+func (c *codec) release(e encoder) {
+	// кодировщик в пуле не должен держать ответ
+	e.Reset(io.Discard)
+	c.writers.Put(e)
+}
+
+// codecs в порядке предпочтения сервера, если клиент принимает несколько кодировок с одинаковым q
+var codecs = []*codec{
+	{
+		name: "br",
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(brotli.NewReader(r)), nil
+		},
+		newWriter: func() encoder {
+			return brotli.NewWriterLevel(nil, brotliLevel)
+		},
+	},
+	{
+		name: "zstd",
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdWindowSize))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		newWriter: func() encoder {
+			// ошибка возможна только при неверных опциях
+			e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdWindowSize))
+			return e
+		},
+	},
+	{
+		name: "gzip",
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		newWriter: func() encoder {
+			e, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+			return e
+		},
+	},
+	{
+		// deflate в HTTP - это поток zlib, а не голый deflate
+		name:      "deflate",
+		newReader: zlib.NewReader,
+		newWriter: func() encoder {
+			e, _ := zlib.NewWriterLevel(nil, zlib.BestSpeed)
+			return e
+		},
+	},
+}
+
+func codecByName(name string) *codec {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "x-gzip" {
+		name = "gzip"
+	}
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// supportedEncodings - значение Accept-Encoding для ответа на запрос в неизвестной кодировке
+func supportedEncodings() string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// negotiateEncoding выбирает кодировку ответа по Accept-Encoding с учетом q. При равных q выигрывает
+// кодировка, которая раньше в codecs, и любая кодировка выигрывает у identity. nil - ответ не сжимается
+func negotiateEncoding(header string) *codec {
+	if len(strings.TrimSpace(header)) == 0 {
+		return nil
+	}
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		weights[name] = qValue(params)
+	}
+	anyQ, hasAny := weights["*"]
+	var best *codec
+	bestQ := 0.0
+	for _, c := range codecs {
+		q, ok := weights[c.name]
+		if !ok {
+			q = anyQ
+		}
+		if q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+	// identity подходит всегда, если не запрещена явно
+	identityQ, ok := weights["identity"]
+	if !ok {
+		identityQ = 1
+		if hasAny {
+			identityQ = anyQ
+		}
+	}
+	if identityQ > bestQ {
+		return nil
+	}
+	return best
+}
+
+// qValue достает q из параметров кодировки, неразборчивый q считается нулем
+func qValue(params string) float64 {
+	for _, p := range strings.Split(params, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+// decodedBody - тело запроса со снятыми кодировками, Close закрывает декодеры и исходное тело
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	var err error
+	for i := len(b.closers) - 1; i >= 0; i-- {
+		err = errors.Append(err, b.closers[i].Close())
+	}
+	return err
+}
+
+// decodeBody снимает кодировки из Content-Encoding. Они перечислены в порядке применения,
+// поэтому снимаются с конца
+func decodeBody(body io.ReadCloser, header string) (io.ReadCloser, error) {
+	decoded := &decodedBody{Reader: body, closers: []io.Closer{body}}
+	names := strings.Split(header, ",")
+	for i := len(names) - 1; i >= 0; i-- {
+		name := strings.TrimSpace(names[i])
+		if len(name) == 0 || strings.EqualFold(name, "identity") {
+			continue
+		}
+		c := codecByName(name)
+		if c == nil {
+			decoded.Close()
+			return nil, errors.WithMessage(errUnsupportedEncoding, name)
+		}
+		r, err := c.newReader(decoded.Reader)
+		if err != nil {
+			decoded.Close()
+			return nil, err
+		}
+		decoded.Reader = r
+		decoded.closers = append(decoded.closers, r)
+	}
+	return decoded, nil
+}
+
+// encodingHandler снимает кодировку с тела запроса и сжимает ответ кодировкой, выбранной по Accept-Encoding.
+// Сжимаются ответы типов из types размером от minSize байт
+func encodingHandler(minSize int, types []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if header := c.GetHeader("Content-Encoding"); len(header) != 0 {
+			body, err := decodeBody(c.Request.Body, header)
+			if errors.Is(err, errUnsupportedEncoding) {
+				c.Header("Accept-Encoding", supportedEncodings())
+				abortWithStatusProblem(c, http.StatusUnsupportedMediaType, err)
+				return
+			}
+			if err != nil {
+				abortWithProblem(c, err)
+				return
+			}
+			defer body.Close()
+			c.Request.Body = body
+			c.Request.ContentLength = -1
+			c.Request.Header.Del("Content-Encoding")
+			c.Request.Header.Del("Content-Length")
+		}
+		// ответ зависит от Accept-Encoding, даже если в этот раз не сжат
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		cd := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+		if cd == nil || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		w := &compressWriter{ResponseWriter: c.Writer, codec: cd, minSize: minSize, types: types}
+		c.Writer = w
+		defer w.close()
+		c.Next()
+	}
+}
+
+// compressWriter копит начало ответа, пока не станет ясно, сжимать ли его. Ответ сжимается, если его тип
+// есть в types и он набрал minSize байт или его сбрасывают клиенту раньше, как потоковые ответы
+type compressWriter struct {
+	gin.ResponseWriter
+	codec   *codec
+	minSize int
+	types   []string
+	buf     []byte
+	decided bool
+	// nil, если ответ идет без сжатия
+	enc encoder
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		return w.out().Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < w.minSize {
+		return len(p), nil
+	}
+	if err := w.decide(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) WriteHeaderNow() {
+	if !w.decided {
+		w.decide(false)
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// close дописывает ответ, который не дошел до порога, и закрывает кодировщик
+func (w *compressWriter) close() error {
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.enc == nil {
+		return nil
+	}
+	err := w.enc.Close()
+	w.codec.release(w.enc)
+	w.enc = nil
+	return err
+}
+
+func (w *compressWriter) out() io.Writer {
+	if w.enc != nil {
+		return w.enc
+	}
+	return w.ResponseWriter
+}
+
+// decide выбирает, сжимать ли ответ, и пишет накопленное начало
+func (w *compressWriter) decide(flushing bool) error {
+	w.decided = true
+	if w.compressible(flushing) {
+		h := w.Header()
+		h.Set("Content-Encoding", w.codec.name)
+		h.Del("Content-Length")
+		w.enc = w.codec.writer(w.ResponseWriter)
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.out().Write(buf)
+	return err
+}
+
+func (w *compressWriter) compressible(flushing bool) bool {
+	if !flushing && len(w.buf) < w.minSize {
+		return false
+	}
+	switch status := w.Status(); {
+	case status < http.StatusOK, status == http.StatusNoContent, status == http.StatusNotModified,
+		status == http.StatusPartialContent:
+		return false
+	}
+	h := w.Header()
+	// уже закодированный ответ и куски файла по Range не трогаем
+	if len(h.Get("Content-Encoding")) != 0 || len(h.Get("Content-Range")) != 0 {
+		return false
+	}
+	return typeAllowed(h.Get("Content-Type"), w.types)
+}
+
+func typeAllowed(contentType string, types []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if len(mediaType) == 0 {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) || mediaType == t {
+			return true
+		}
+	}
+	return false
+}
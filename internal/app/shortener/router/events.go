@@ -0,0 +1,67 @@
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+const eventStreamContentType = "text/event-stream"
+
+const defaultStreamHeartbeat = 15 * time.Second
+
+// события потока переходов
+const (
+	eventClick = "click"
+	// последнее событие потока: клиент не успевал читать, нужно переподключиться
+	eventOverflow = "overflow"
+)
+
+// StreamUserClicks отдает переходы по ссылкам пользователя в виде Server-Sent Events. Ссылки, сокращенные
+// после подключения, попадают в поток с задержкой до StreamHeartbeat
+func (r *router) StreamUserClicks(c *gin.Context) {
+	userToken := c.GetHeader("auth")
+	links, err := r.controller.UserLinkIDs(c, userToken)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	sub := r.clicks.Subscribe(links)
+	defer sub.Close()
+	c.Header("Content-Type", eventStreamContentType)
+	c.Header("Cache-Control", "no-cache")
+	// nginx не должен копить поток
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(r.streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case click, ok := <-sub.C():
+			if !ok {
+				if sub.Dropped() {
+					c.SSEvent(eventOverflow, gin.H{"error": "client is too slow, reconnect"})
+					c.Writer.Flush()
+				}
+				return
+			}
+			c.SSEvent(eventClick, click)
+		case <-heartbeat.C:
+			if _, err := c.Writer.WriteString(": heartbeat\n\n"); err != nil {
+				return
+			}
+			links, err := r.controller.UserLinkIDs(c, userToken)
+			if err != nil {
+				log.Printf("click stream: refresh user links: %v", err)
+			} else {
+				sub.SetLinks(links)
+			}
+		}
+		c.Writer.Flush()
+	}
+}
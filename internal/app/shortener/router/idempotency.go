@@ -0,0 +1,115 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// максимальная длина ключа идемпотентности
+const maxIdempotencyKeyLen = 255
+
+var errIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+var errIdempotencyKeyInProgress = errors.New("request with this idempotency key is still in progress")
+
+// captureWriter запоминает тело ответа, чтобы сохранить его для повторов
+type captureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotencyHandler отдает сохраненный ответ на повтор запроса с тем же Idempotency-Key от того же пользователя.
+// Тот же ключ с другим запросом - 422, пока первый запрос выполняется - 409.
+// Ответы с кодом 5xx не сохраняются, чтобы ретрай выполнился заново
+func (r *router) idempotencyHandler(c *gin.Context) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if r.idempotency == nil || len(key) == 0 {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		abortWithStatusProblem(c, http.StatusBadRequest, errors.Errorf("%s is longer than %d", idempotencyKeyHeader, maxIdempotencyKeyLen))
+		return
+	}
+	user, err := r.tokenBuilder.GetIDFromToken(c.GetHeader("auth"))
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	hash := sha256.New()
+	hash.Write([]byte(c.Request.Method + " " + c.Request.URL.RequestURI() + "\n"))
+	hash.Write(body)
+	requestHash := hex.EncodeToString(hash.Sum(nil))
+
+	existing, err := r.idempotency.Begin(c, user, key, requestHash)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	if existing != nil {
+		switch {
+		case existing.RequestHash != requestHash:
+			abortWithProblem(c, errIdempotencyKeyReused)
+		case existing.Pending():
+			abortWithProblem(c, errIdempotencyKeyInProgress)
+		default:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(existing.StatusCode, existing.ContentType, existing.Body)
+			c.Abort()
+		}
+		return
+	}
+
+	w := &captureWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	defer func() {
+		// Recovery стоит снаружи: если обработчик запаниковал, ключ освобождается здесь,
+		// иначе ретраи получали бы 409 до конца окна хранения
+		if p := recover(); p != nil {
+			c.Writer = w.ResponseWriter
+			if err := r.idempotency.Release(c, user, key); err != nil {
+				c.Error(err)
+			}
+			panic(p)
+		}
+	}()
+	c.Next()
+	c.Writer = w.ResponseWriter
+	if status := w.Status(); status >= http.StatusInternalServerError {
+		if err := r.idempotency.Release(c, user, key); err != nil {
+			c.Error(err)
+		}
+		return
+	}
+	err = r.idempotency.Complete(c, user, key, &repository.IdempotencyRecord{
+		StatusCode:  w.Status(),
+		ContentType: w.Header().Get("Content-Type"),
+		Body:        w.body.Bytes(),
+	})
+	if err != nil {
+		c.Error(err)
+	}
+}
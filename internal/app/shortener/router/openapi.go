@@ -0,0 +1,374 @@
+package router
+
+import (
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/clicks"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/controllers"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/openapi"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/qr"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+const docsTitle = "URL shortener API"
+
+// OpenAPI описывает все маршруты, которые регистрирует InitAPI. Тест сверяет описание с маршрутами,
+// поэтому новый маршрут нужно добавить и сюда
+func OpenAPI() *openapi.Document {
+	d := openapi.New(openapi.Info{
+		Title:       docsTitle,
+		Description: "Сокращатель ссылок. Пользователь определяется подписанной cookie auth, без нее создается новый пользователь",
+		Version:     "1.0.0",
+	})
+	hash := &openapi.Parameter{Name: "hash", In: "path", Required: true, Description: "ключ короткой ссылки", Schema: &openapi.Schema{Type: "string"}}
+	domain := &openapi.Parameter{Name: "domain", In: "query", Description: "домен короткой ссылки, по умолчанию - хост запроса", Schema: &openapi.Schema{Type: "string"}}
+	idempotencyKey := &openapi.Parameter{
+		Name:        idempotencyKeyHeader,
+		In:          "header",
+		Description: "повтор запроса с тем же ключом от того же пользователя получает сохраненный ответ",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+	linkOptions := []*openapi.Parameter{
+		{Name: "max_clicks", In: "query", Description: "лимит переходов, 0 - без лимита", Schema: &openapi.Schema{Type: "integer", Minimum: openapi.Int(0)}},
+		{Name: "redirect_code", In: "query", Description: "код редиректа", Schema: redirectCodeSchema()},
+		{Name: "query_passthrough", In: "query", Description: "что делать с query параметрами перехода", Schema: queryModeSchema()},
+		{Name: "utm_*", In: "query", Description: "utm параметры, добавляемые к оригинальному урлу", Schema: &openapi.Schema{Type: "string"}},
+		{Name: "domain", In: "query", Description: "домен короткой ссылки, по умолчанию - домен пользователя", Schema: &openapi.Schema{Type: "string"}},
+	}
+	text := map[string]*openapi.MediaType{"text/plain": {Schema: &openapi.Schema{Type: "string"}}}
+	// все ошибки отдаются в application/problem+json
+	problem := d.Content(problemContentType, Problem{})
+	errorResponse := func(description string) *openapi.Response {
+		return &openapi.Response{Description: description, Content: problem}
+	}
+	badRequest := errorResponse("невалидный запрос")
+	keyReused := errorResponse("Idempotency-Key уже использован с другим запросом")
+	serverError := errorResponse("ошибка хранилища")
+	notFound := errorResponse("ссылки нет")
+	// ответ, который кроме content может быть и problem+json, например 409 на запрос с занятым Idempotency-Key
+	orProblem := func(description string, content map[string]*openapi.MediaType) *openapi.Response {
+		content[problemContentType] = problem[problemContentType]
+		return &openapi.Response{Description: description, Content: content}
+	}
+	const keyInProgress = ", или запрос с этим Idempotency-Key еще выполняется"
+	removed := errorResponse("ссылка удалена модератором")
+	legal := errorResponse("ссылка заблокирована по требованию закона")
+
+	d.Add(http.MethodGet, "/:hash", &openapi.Operation{
+		Summary: "Переход по короткой ссылке",
+		Description: "Засчитывает переход и редиректит на оригинальный урл. Ссылка ищется на домене из хоста запроса. " +
+			"/{hash}+ или ?preview=true показывают страницу предпросмотра без перехода",
+		OperationID: "redirect",
+		Tags:        []string{"links"},
+		Parameters: []*openapi.Parameter{hash,
+			{Name: "preview", In: "query", Description: "показать страницу предпросмотра", Schema: &openapi.Schema{Type: "boolean"}},
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "страница предпросмотра", Content: map[string]*openapi.MediaType{"text/html": {Schema: &openapi.Schema{Type: "string"}}}},
+			"3XX": {Description: "редирект на оригинальный урл, код задается ссылкой или конфигом сервера"},
+			"404": notFound,
+			"410": errorResponse("лимит переходов исчерпан или ссылка удалена модератором"),
+			"451": legal,
+			"500": serverError,
+		},
+	})
+	d.Add(http.MethodPost, "/", &openapi.Operation{
+		Summary:     "Сократить ссылку из тела запроса",
+		OperationID: "shortenRaw",
+		Tags:        []string{"links"},
+		Parameters:  append([]*openapi.Parameter{idempotencyKey}, linkOptions...),
+		RequestBody: &openapi.RequestBody{Required: true, Content: text},
+		Responses: map[string]*openapi.Response{
+			"201": {Description: "короткая ссылка", Content: text},
+			"409": orProblem("ссылка уже была сокращена, в ответе существующая короткая ссылка"+keyInProgress, d.Content("text/plain", "")),
+			"400": badRequest,
+			"422": keyReused,
+			"500": serverError,
+		},
+	})
+	d.Add(http.MethodGet, "/ping", &openapi.Operation{
+		Summary:     "Проверить подключение к базе данных",
+		OperationID: "ping",
+		Tags:        []string{"service"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "база данных доступна"},
+			"500": errorResponse("база данных недоступна"),
+		},
+	})
+	d.Add(http.MethodPost, "/api/shorten", &openapi.Operation{
+		Summary:     "Сократить ссылку",
+		OperationID: "shorten",
+		Tags:        []string{"links"},
+		Parameters:  []*openapi.Parameter{idempotencyKey},
+		RequestBody: &openapi.RequestBody{Required: true, Content: d.JSON(ShortenerRequest{})},
+		Responses: map[string]*openapi.Response{
+			"201": {Description: "короткая ссылка", Content: d.JSON(ShortenerResponse{})},
+			"409": orProblem("ссылка уже была сокращена, в ответе существующая короткая ссылка"+keyInProgress, d.JSON(ShortenerResponse{})),
+			"400": badRequest,
+			"422": keyReused,
+			"500": serverError,
+		},
+	})
+	batch := d.JSON([]ShortenerResponseWithID{})
+	d.Add(http.MethodPost, "/api/shorten/batch", &openapi.Operation{
+		Summary:     "Сократить пакет ссылок",
+		Description: "Результат по каждой ссылке в порядке запроса",
+		OperationID: "shortenBatch",
+		Tags:        []string{"links"},
+		Parameters: []*openapi.Parameter{idempotencyKey,
+			{Name: "atomic", In: "query", Description: "одна невалидная ссылка отменяет весь пакет", Schema: &openapi.Schema{Type: "boolean"}},
+		},
+		RequestBody: &openapi.RequestBody{Required: true, Content: d.JSON([]ShortenerRequestWithID{})},
+		Responses: map[string]*openapi.Response{
+			"201": {Description: "все ссылки созданы", Content: batch},
+			"207": {Description: "результаты по ссылкам разные", Content: batch},
+			"409": orProblem("все ссылки уже были"+keyInProgress, d.JSON([]ShortenerResponseWithID{})),
+			"400": orProblem("все ссылки невалидны или пакет отменен с atomic=true, problem+json - тело не разбирается", d.JSON([]ShortenerResponseWithID{})),
+			"422": keyReused,
+			"500": serverError,
+		},
+	})
+	d.Add(http.MethodPost, "/api/shorten/stream", &openapi.Operation{
+		Summary:     "Сократить поток ссылок",
+		Description: "Ссылки по одной в строке NDJSON, результаты отдаются в том же порядке по мере сохранения. Ошибка посреди потока приходит последней строкой {\"error\": \"...\"}",
+		OperationID: "shortenStream",
+		Tags:        []string{"links"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: d.Content(ndjsonContentType, ShortenerRequestWithID{})},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "результаты по ссылкам", Content: d.Content(ndjsonContentType, ShortenerResponseWithID{})},
+			"415": errorResponse("тело не в NDJSON"),
+		},
+	})
+	d.Add(http.MethodGet, "/api/qr/:hash", &openapi.Operation{
+		Summary:     "QR код короткой ссылки",
+		OperationID: "qr",
+		Tags:        []string{"links"},
+		Parameters: []*openapi.Parameter{hash, domain,
+			{Name: "format", In: "query", Schema: &openapi.Schema{Type: "string", Enum: []any{qr.PNG, qr.SVG}}},
+			{Name: "size", In: "query", Description: "размер png в пикселях, должен вмещать все модули кода с отступом", Schema: &openapi.Schema{Type: "integer", Minimum: openapi.Int(qr.MinSize), Maximum: openapi.Int(qr.MaxSize)}},
+			{Name: "margin", In: "query", Description: "отступ в модулях", Schema: &openapi.Schema{Type: "integer", Minimum: openapi.Int(0), Maximum: openapi.Int(qr.MaxMargin)}},
+			{Name: "level", In: "query", Description: "уровень коррекции ошибок", Schema: &openapi.Schema{Type: "string", Enum: []any{"L", "M", "Q", "H"}}},
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "QR код", Content: map[string]*openapi.MediaType{
+				qr.PNG.ContentType(): {Schema: &openapi.Schema{Type: "string", Format: "binary"}},
+				qr.SVG.ContentType(): {Schema: &openapi.Schema{Type: "string"}},
+			}},
+			"400": badRequest,
+			"404": notFound,
+			"410": removed,
+			"451": legal,
+			"500": serverError,
+		},
+	})
+	d.Add(http.MethodGet, "/api/links/:hash", &openapi.Operation{
+		Summary:     "Статистика переходов по ссылке",
+		Description: "Переход при этом не засчитывается",
+		OperationID: "linkStats",
+		Tags:        []string{"links"},
+		Parameters:  []*openapi.Parameter{hash, domain},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "статистика", Content: d.JSON(LinkStats{})},
+			"404": notFound,
+			"410": removed,
+			"451": legal,
+			"500": serverError,
+		},
+	})
+	d.Add(http.MethodGet, "/api/user/urls", &openapi.Operation{
+		Summary:     "Ссылки текущего пользователя",
+		OperationID: "userURLs",
+		Tags:        []string{"users"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "ссылки пользователя", Content: d.JSON([]types.URLShorter{})},
+			"204": {Description: "у пользователя нет ссылок"},
+			"401": errorResponse("токен пользователя невалиден"),
+			"500": serverError,
+		},
+	})
+	d.Add(http.MethodGet, "/api/user/urls/events", &openapi.Operation{
+		Summary: "Поток переходов по ссылкам текущего пользователя",
+		Description: "Server-Sent Events: событие click с переходом в data, комментарий heartbeat раз в 15 секунд. " +
+			"Если клиент не успевает читать, приходит событие overflow и поток закрывается. " +
+			"Ссылки, сокращенные после подключения, попадают в поток не сразу",
+		OperationID: "userClickEvents",
+		Tags:        []string{"users"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "поток событий", Content: d.Content(eventStreamContentType, clicks.Click{})},
+			"401": errorResponse("токен пользователя невалиден"),
+			"500": serverError,
+		},
+	})
+	d.Add(http.MethodDelete, "/api/user/urls/:hash", &openapi.Operation{
+		Summary:     "Убрать ссылку из ссылок текущего пользователя",
+		Description: "Короткая ссылка продолжает работать, ее могли сократить и другие пользователи",
+		OperationID: "deleteUserURL",
+		Tags:        []string{"users"},
+		Parameters:  []*openapi.Parameter{hash, domain},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "ссылка убрана"},
+			"401": errorResponse("токен пользователя невалиден"),
+			"404": errorResponse("у пользователя нет такой ссылки"),
+			"500": serverError,
+		},
+	})
+	d.Add(http.MethodGet, "/api/openapi.json", &openapi.Operation{
+		Summary:     "Это описание API",
+		OperationID: "openAPI",
+		Tags:        []string{"service"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "описание в OpenAPI 3", Content: map[string]*openapi.MediaType{"application/json": {Schema: &openapi.Schema{Type: "object"}}}},
+		},
+	})
+	d.Add(http.MethodGet, "/api/docs", &openapi.Operation{
+		Summary:     "Документация API в Swagger UI",
+		OperationID: "docsRedirect",
+		Tags:        []string{"service"},
+		Responses: map[string]*openapi.Response{
+			"301": {Description: "редирект на /api/docs/"},
+		},
+	})
+	d.Add(http.MethodGet, "/api/docs/*file", &openapi.Operation{
+		Summary:     "Документация API в Swagger UI",
+		Description: "/api/docs/ - страница документации, остальные пути - ее файлы",
+		OperationID: "docs",
+		Tags:        []string{"service"},
+		Parameters:  []*openapi.Parameter{{Name: "file", In: "path", Required: true, Schema: &openapi.Schema{Type: "string"}}},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "страница или файл Swagger UI"},
+			"404": {Description: "файла нет"},
+			"500": serverError,
+		},
+	})
+	addDomainOperations(d, errorResponse)
+	addWebhookOperations(d, errorResponse)
+	addAdminOperations(d, errorResponse, hash, domain)
+	// ограничения, которые не видны из json тегов
+	for _, name := range []string{"ShortenerRequest", "ShortenerRequestWithID"} {
+		props := d.Components.Schemas[name].Properties
+		props["max_clicks"] = &openapi.Schema{Type: "integer", Minimum: openapi.Int(0)}
+		props["redirect_code"] = redirectCodeSchema()
+		props["query_passthrough"] = queryModeSchema()
+	}
+	d.Components.Schemas["ShortenerResponseWithID"].Properties["status"] = &openapi.Schema{Type: "string", Enum: []any{
+		controllers.BatchCreated, controllers.BatchExisting, controllers.BatchInvalid,
+	}}
+	return d
+}
+
+// addAdminOperations описывает маршруты модерации /api/admin
+func addAdminOperations(d *openapi.Document, errorResponse func(string) *openapi.Response, hash, domain *openapi.Parameter) {
+	authorization := &openapi.Parameter{
+		Name:        "Authorization",
+		In:          "header",
+		Required:    true,
+		Description: "Bearer и токен модератора",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+	link := &openapi.Response{Description: "ссылка с владельцами", Content: d.JSON(AdminLink{})}
+	// общие ответы всех маршрутов модерации
+	responses := func(extra map[string]*openapi.Response) map[string]*openapi.Response {
+		res := map[string]*openapi.Response{
+			"401": errorResponse("токен модератора невалиден"),
+			"404": errorResponse("ссылки нет или API модерации выключено"),
+			"500": errorResponse("ошибка хранилища"),
+			"501": errorResponse("хранилище не поддерживает модерацию"),
+		}
+		for code, r := range extra {
+			res[code] = r
+		}
+		return res
+	}
+
+	d.Add(http.MethodGet, adminPath+"/links", &openapi.Operation{
+		Summary:     "Найти ссылки по хосту",
+		Description: "Ссылки на хост и его поддомены, включая отключенные, по возрастанию ключа",
+		OperationID: "adminSearchLinks",
+		Tags:        []string{"admin"},
+		Parameters: []*openapi.Parameter{authorization,
+			{Name: "host", In: "query", Required: true, Description: "хост оригинального урла", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "limit", In: "query", Description: "сколько ссылок вернуть, по умолчанию 100", Schema: &openapi.Schema{
+				Type: "integer", Minimum: openapi.Int(1), Maximum: openapi.Int(maxAdminSearchLimit),
+			}},
+		},
+		Responses: responses(map[string]*openapi.Response{
+			"200": {Description: "найденные ссылки без владельцев", Content: d.JSON([]AdminLink{})},
+			"400": errorResponse("не задан host или невалиден limit"),
+		}),
+	})
+	d.Add(http.MethodGet, adminPath+"/links/:hash", &openapi.Operation{
+		Summary:     "Ссылка с владельцами",
+		Description: "Переход при этом не засчитывается",
+		OperationID: "adminGetLink",
+		Tags:        []string{"admin"},
+		Parameters:  []*openapi.Parameter{authorization, hash, domain},
+		Responses:   responses(map[string]*openapi.Response{"200": link}),
+	})
+	d.Add(http.MethodPut, adminPath+"/links/:hash/disabled", &openapi.Operation{
+		Summary:     "Отключить ссылку",
+		Description: "Переход по отключенной ссылке отвечает 451 для legal и 410 для removed",
+		OperationID: "adminDisableLink",
+		Tags:        []string{"admin"},
+		Parameters:  []*openapi.Parameter{authorization, hash, domain},
+		RequestBody: &openapi.RequestBody{Required: true, Content: d.JSON(AdminDisableRequest{})},
+		Responses: responses(map[string]*openapi.Response{
+			"200": link,
+			"400": errorResponse("неизвестная причина"),
+		}),
+	})
+	d.Add(http.MethodDelete, adminPath+"/links/:hash/disabled", &openapi.Operation{
+		Summary:     "Включить ссылку",
+		OperationID: "adminEnableLink",
+		Tags:        []string{"admin"},
+		Parameters:  []*openapi.Parameter{authorization, hash, domain},
+		Responses:   responses(map[string]*openapi.Response{"200": link}),
+	})
+	d.Add(http.MethodPut, adminPath+"/links/:hash/owner", &openapi.Operation{
+		Summary:     "Передать ссылку пользователю",
+		Description: "Ссылка пропадает из списков остальных владельцев",
+		OperationID: "adminTransferLink",
+		Tags:        []string{"admin"},
+		Parameters:  []*openapi.Parameter{authorization, hash, domain},
+		RequestBody: &openapi.RequestBody{Required: true, Content: d.JSON(AdminTransferRequest{})},
+		Responses: responses(map[string]*openapi.Response{
+			"200": link,
+			"400": errorResponse("не задан user_id"),
+		}),
+	})
+	d.Components.Schemas["AdminDisableRequest"].Properties["reason"] = &openapi.Schema{Type: "string", Enum: []any{
+		types.DisabledLegal, types.DisabledRemoved,
+	}}
+}
+
+func redirectCodeSchema() *openapi.Schema {
+	return &openapi.Schema{Type: "integer", Enum: []any{
+		http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect,
+	}}
+}
+
+func queryModeSchema() *openapi.Schema {
+	return &openapi.Schema{Type: "string", Enum: []any{types.QueryDrop, types.QueryMerge, types.QueryOverride}}
+}
+
+func (r *router) GetOpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", r.spec)
+}
+
+func (r *router) GetDocs(c *gin.Context) {
+	file := c.Param("file")
+	if len(file) == 0 {
+		// страница подключает файлы относительными путями, поэтому открывается только из каталога
+		c.Redirect(http.StatusMovedPermanently, c.Request.URL.Path+"/")
+		return
+	}
+	if file != "/" {
+		c.FileFromFS(file, openapi.Assets)
+		return
+	}
+	page, err := openapi.DocsPage(docsTitle, "../openapi.json")
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
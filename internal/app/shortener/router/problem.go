@@ -0,0 +1,116 @@
+package router
+
+import (
+	"emperror.dev/errors"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/controllers"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/qr"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem - тело ответа с ошибкой по RFC 7807
+type Problem struct {
+	// тип ошибки, about:blank - без уточнения, только код ответа
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// путь запроса, на который пришла ошибка
+	Instance string `json:"instance,omitempty"`
+}
+
+// типы ошибок предметной области
+const (
+	problemBlank           = "about:blank"
+	problemNotFound        = "urn:problem:not-found"
+	problemClicksExhausted = "urn:problem:clicks-exhausted"
+	problemDuplicate       = "urn:problem:duplicate"
+	problemInvalidURL      = "urn:problem:invalid-url"
+	problemInvalidLink     = "urn:problem:invalid-link"
+	problemUnauthorized    = "urn:problem:unauthorized"
+	problemKeyReused       = "urn:problem:idempotency-key-reused"
+	problemKeyInProgress   = "urn:problem:idempotency-key-in-progress"
+	problemLegal           = "urn:problem:unavailable-for-legal-reasons"
+	problemLinkRemoved     = "urn:problem:link-removed"
+	problemInvalidWebhook  = "urn:problem:invalid-webhook"
+)
+
+// problemOf сопоставляет ошибке код ответа и тип. Все, что не относится к предметной области, - сбой сервера
+func problemOf(err error) (int, string) {
+	var notFound *controllers.NotFoundError
+	var duplicate *controllers.DuplicateError
+	var invalidURL *controllers.InvalidURLError
+	var unauthorized *controllers.UnauthorizedError
+	var disabled *controllers.LinkDisabledError
+	switch {
+	case errors.As(err, &notFound):
+		return http.StatusNotFound, problemNotFound
+	case errors.As(err, &disabled) && disabled.Reason == types.DisabledLegal:
+		return http.StatusUnavailableForLegalReasons, problemLegal
+	case errors.As(err, &disabled):
+		return http.StatusGone, problemLinkRemoved
+	case errors.Is(err, repository.ErrClicksExhausted):
+		return http.StatusGone, problemClicksExhausted
+	case errors.As(err, &duplicate):
+		return http.StatusConflict, problemDuplicate
+	case errors.As(err, &invalidURL):
+		return http.StatusBadRequest, problemInvalidURL
+	case errors.Is(err, controllers.ErrInvalidLink):
+		return http.StatusBadRequest, problemInvalidLink
+	case errors.Is(err, qr.ErrInvalidSize):
+		return http.StatusBadRequest, problemBlank
+	case errors.Is(err, controllers.ErrInvalidWebhook):
+		return http.StatusBadRequest, problemInvalidWebhook
+	case errors.As(err, &unauthorized):
+		return http.StatusUnauthorized, problemUnauthorized
+	case errors.Is(err, errIdempotencyKeyReused):
+		return http.StatusUnprocessableEntity, problemKeyReused
+	case errors.Is(err, errIdempotencyKeyInProgress):
+		return http.StatusConflict, problemKeyInProgress
+	case errors.Is(err, repository.ErrModerationNotSupported), errors.Is(err, controllers.ErrWebhooksDisabled),
+		errors.Is(err, controllers.ErrUserDomainsDisabled):
+		return http.StatusNotImplemented, problemBlank
+	default:
+		return http.StatusInternalServerError, problemBlank
+	}
+}
+
+// abortWithProblem прерывает обработку запроса и отвечает problem+json с кодом, который определяется по ошибке
+func abortWithProblem(c *gin.Context, err error) {
+	status, problemType := problemOf(err)
+	writeProblem(c, status, problemType, err)
+}
+
+// abortWithStatusProblem - то же для ошибок разбора запроса и прочих, код которых известен на месте
+func abortWithStatusProblem(c *gin.Context, status int, err error) {
+	problemType := problemBlank
+	if mapped, mappedType := problemOf(err); mapped == status {
+		problemType = mappedType
+	}
+	writeProblem(c, status, problemType, err)
+}
+
+func writeProblem(c *gin.Context, status int, problemType string, err error) {
+	c.Error(err)
+	p := Problem{
+		Type:     problemType,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Instance: c.Request.URL.Path,
+	}
+	// подробности сбоев сервера остаются в логе
+	if status < http.StatusInternalServerError {
+		p.Detail = err.Error()
+	}
+	c.Header("Content-Type", problemContentType)
+	c.AbortWithStatusJSON(status, p)
+}
+
+// notFoundHandler отвечает problem+json на запросы к неизвестным маршрутам
+func notFoundHandler(c *gin.Context) {
+	abortWithStatusProblem(c, http.StatusNotFound, errors.Errorf("no route for %s %s", c.Request.Method, c.Request.URL.Path))
+}
@@ -1,123 +1,314 @@
 package router
 
 import (
-	"compress/gzip"
+	"bufio"
+	"bytes"
+	"context"
 	"emperror.dev/errors"
 	"encoding/json"
 	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/clicks"
 	"github.com/SakuraBurst/urlshortener/internal/app/shortener/controllers"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/preview"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/qr"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
 	"github.com/SakuraBurst/urlshortener/internal/app/shortener/token"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
 	"github.com/gin-gonic/gin"
+	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
-type router struct {
-	controller   *controllers.Controller
-	tokenBuilder *token.TokenBuilder
-}
+// сколько qr кодов держим в памяти
+const qrCacheSize = 1024
 
-type encodeResponseWriter struct {
-	gin.ResponseWriter
-	Writer io.Writer
-}
-
-func (w encodeResponseWriter) Write(p []byte) (n int, err error) {
-	return w.Writer.Write(p)
+type router struct {
+	controller          *controllers.Controller
+	tokenBuilder        *token.TokenBuilder
+	qrGenerator         *qr.Generator
+	defaultRedirectCode int
+	idempotency         repository.IdempotencyRepository
+	adminToken          string
+	clicks              *clicks.Hub
+	streamHeartbeat     time.Duration
+	// описание API в OpenAPI 3
+	spec []byte
 }
 
-func (w encodeResponseWriter) WriteString(s string) (n int, err error) {
-	return w.Writer.Write([]byte(s))
+// Config - настройки роутера, нулевое значение дает поведение по умолчанию
+type Config struct {
+	// шаблоны страницы предпросмотра, если nil - используются встроенные
+	PreviewTemplates *template.Template
+	// код редиректа для ссылок, у которых он не задан, по умолчанию 307
+	DefaultRedirectCode int
+	// хранилище ответов для заголовка Idempotency-Key, если nil - заголовок игнорируется
+	Idempotency repository.IdempotencyRepository
+	// ответы меньше не сжимаются, по умолчанию 1024 байта
+	CompressMinSize int
+	// типы ответов, которые сжимаются, /* в конце - любой подтип. Если nil - текст, json, javascript, xml и svg
+	CompressTypes []string
+	// токен модератора для /api/admin, если пусто - маршруты модерации отвечают 404
+	AdminToken string
+	// куда публикуются переходы для потоков событий, если nil - создается свой хаб
+	Clicks *clicks.Hub
+	// как часто поток событий шлет комментарий, чтобы прокси не закрыли соединение, по умолчанию 15 секунд.
+	// Заодно обновляется список ссылок пользователя
+	StreamHeartbeat time.Duration
 }
 
-func InitAPI(controller *controllers.Controller, tb *token.TokenBuilder) *gin.Engine {
-	router := &router{controller: controller, tokenBuilder: tb}
+func InitAPI(controller *controllers.Controller, tb *token.TokenBuilder, cfg Config) *gin.Engine {
+	if cfg.DefaultRedirectCode == 0 {
+		cfg.DefaultRedirectCode = http.StatusTemporaryRedirect
+	}
+	if cfg.CompressMinSize == 0 {
+		cfg.CompressMinSize = defaultCompressMinSize
+	}
+	if cfg.CompressTypes == nil {
+		cfg.CompressTypes = defaultCompressTypes
+	}
+	if cfg.Clicks == nil {
+		cfg.Clicks = clicks.InitHub(clicks.DefaultBuffer)
+	}
+	if cfg.StreamHeartbeat == 0 {
+		cfg.StreamHeartbeat = defaultStreamHeartbeat
+	}
+	router := &router{
+		controller:          controller,
+		tokenBuilder:        tb,
+		qrGenerator:         qr.InitGenerator(qrCacheSize),
+		defaultRedirectCode: cfg.DefaultRedirectCode,
+		idempotency:         cfg.Idempotency,
+		adminToken:          cfg.AdminToken,
+		clicks:              cfg.Clicks,
+		streamHeartbeat:     cfg.StreamHeartbeat,
+	}
+	spec, err := json.Marshal(OpenAPI())
+	if err != nil {
+		panic(err)
+	}
+	router.spec = spec
 	engine := gin.Default()
+	if cfg.PreviewTemplates == nil {
+		cfg.PreviewTemplates, err = preview.Load("")
+		if err != nil {
+			panic(err)
+		}
+	}
+	engine.SetHTMLTemplate(cfg.PreviewTemplates)
+	engine.NoRoute(notFoundHandler)
 	engine.Use(errorHandler)
-	engine.Use(encodingHandler)
+	engine.Use(encodingHandler(cfg.CompressMinSize, cfg.CompressTypes))
 	engine.Use(router.authHandler)
 	engine.GET("/:hash", router.RedirectURL)
-	engine.POST("/", router.CreateShortenerURLRaw)
+	engine.POST("/", router.idempotencyHandler, router.CreateShortenerURLRaw)
 	engine.GET("/ping", router.PingDataBase)
 	v1Api := engine.Group("/api")
 	{
 		shortenGroup := v1Api.Group("/shorten")
 		{
-			shortenGroup.POST("", router.CreateShortenerURLJson)
-			shortenGroup.POST("/batch", router.CreateArrayOfShortenerURLJson)
+			shortenGroup.POST("", router.idempotencyHandler, router.CreateShortenerURLJson)
+			shortenGroup.POST("/batch", router.idempotencyHandler, router.CreateArrayOfShortenerURLJson)
+			shortenGroup.POST("/stream", router.CreateStreamOfShortenerURLNdjson)
 		}
 
+		v1Api.GET("/qr/:hash", router.GetQRCode)
+		v1Api.GET("/links/:hash", router.GetLinkStats)
+		v1Api.GET("/openapi.json", router.GetOpenAPI)
+		v1Api.GET("/docs", router.GetDocs)
+		v1Api.GET("/docs/*file", router.GetDocs)
+
 		userGroup := v1Api.Group("/user")
 		{
 			userGroup.GET("/urls", router.GetUserURLS)
+			userGroup.GET("/urls/events", router.StreamUserClicks)
+			userGroup.DELETE("/urls/:hash", router.DeleteUserURL)
+			userGroup.GET("/domain", router.GetUserDomain)
+			userGroup.PUT("/domain", router.SetUserDomain)
+			userGroup.POST("/webhooks", router.CreateWebhook)
+			userGroup.GET("/webhooks", router.GetWebhooks)
+			userGroup.DELETE("/webhooks/:id", router.DeleteWebhook)
+			userGroup.GET("/webhooks/:id/deliveries", router.GetWebhookDeliveries)
+		}
+
+		adminGroup := v1Api.Group("/admin", router.adminHandler)
+		{
+			adminGroup.GET("/links", router.SearchAdminLinks)
+			adminGroup.GET("/links/:hash", router.GetAdminLink)
+			adminGroup.PUT("/links/:hash/disabled", router.DisableAdminLink)
+			adminGroup.DELETE("/links/:hash/disabled", router.EnableAdminLink)
+			adminGroup.PUT("/links/:hash/owner", router.TransferAdminLink)
 		}
 	}
 	return engine
 }
 
 type ShortenerRequest struct {
-	URL string `json:"url"`
+	URL          string            `json:"url"`
+	MaxClicks    int               `json:"max_clicks,omitempty"`
+	RedirectCode int               `json:"redirect_code,omitempty"`
+	QueryMode    string            `json:"query_passthrough,omitempty"`
+	UTM          map[string]string `json:"utm,omitempty"`
+	QR           bool              `json:"qr,omitempty"`
+	// хост домена короткой ссылки, пусто - домен пользователя
+	Domain string `json:"domain,omitempty"`
 }
 
 type ShortenerResponse struct {
 	Result string `json:"result"`
+	QR     string `json:"qr,omitempty"`
 }
 
 type ShortenerRequestWithID struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string            `json:"correlation_id"`
+	OriginalURL   string            `json:"original_url"`
+	MaxClicks     int               `json:"max_clicks,omitempty"`
+	RedirectCode  int               `json:"redirect_code,omitempty"`
+	QueryMode     string            `json:"query_passthrough,omitempty"`
+	UTM           map[string]string `json:"utm,omitempty"`
+	Domain        string            `json:"domain,omitempty"`
+}
+
+func (r ShortenerRequestWithID) link() (*types.Link, error) {
+	unShortenURL, err := url.Parse(r.OriginalURL)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Link{
+		URL:          unShortenURL,
+		MaxClicks:    r.MaxClicks,
+		RedirectCode: r.RedirectCode,
+		QueryMode:    types.QueryPassthrough(r.QueryMode),
+		UTM:          utmValues(r.UTM),
+		Domain:       r.Domain,
+	}, nil
+}
+
+// LinkStats - статистика переходов по ссылке
+type LinkStats struct {
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	Clicks      int        `json:"clicks"`
+	MaxClicks   int        `json:"max_clicks,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
 }
 
 type ShortenerResponseWithID struct {
 	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	ShortURL      string `json:"short_url,omitempty"`
+	// created, existing или invalid
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
 }
 
+// RedirectURL ищет ссылку на домене, с которого пришел запрос: a.co/x и b.co/x - разные ссылки
 func (r *router) RedirectURL(c *gin.Context) {
-	id := c.Param("hash")
+	hash := c.Param("hash")
+	if strings.HasSuffix(hash, "+") {
+		r.previewURL(c, r.controller.LinkKey(c.Request.Host, strings.TrimSuffix(hash, "+")))
+		return
+	}
+	id := r.controller.LinkKey(c.Request.Host, hash)
+	if isPreview, _ := strconv.ParseBool(c.Query("preview")); isPreview {
+		r.previewURL(c, id)
+		return
+	}
+
+	l, err := r.controller.GetURLFromID(c, id)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	r.clicks.Publish(clicks.Click{ID: id, ShortURL: r.controller.ShortURL(id), Clicks: l.Clicks, MaxClicks: l.MaxClicks, At: time.Now().UTC()})
+	code := l.RedirectCode
+	if code == 0 {
+		code = r.defaultRedirectCode
+	}
+	c.Redirect(code, controllers.BuildTarget(l, c.Request.URL.RawQuery).String())
+}
 
-	unShortenURL, err := r.controller.GetURLFromID(c, id)
+// previewURL показывает страницу с информацией о ссылке вместо редиректа, переход при этом не засчитывается
+func (r *router) previewURL(c *gin.Context, id string) {
+	l, err := r.controller.GetLink(c, id)
 	if err != nil {
-		c.AbortWithError(http.StatusNotFound, err)
+		abortWithProblem(c, err)
 		return
 	}
-	c.Redirect(http.StatusTemporaryRedirect, unShortenURL.String())
+	c.HTML(http.StatusOK, preview.TemplateName, preview.Page{
+		ShortURL:    r.controller.ShortURL(id),
+		Destination: l.URL.String(),
+		CreatedAt:   l.CreatedAt,
+		Clicks:      l.Clicks,
+		MaxClicks:   l.MaxClicks,
+	})
 }
 
 func (r *router) CreateShortenerURLRaw(c *gin.Context) {
 	body, err := c.GetRawData()
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithProblem(c, err)
 		return
 	}
 	if len(body) == 0 {
-		c.AbortWithError(http.StatusBadRequest, errors.New("request body is empty"))
+		abortWithStatusProblem(c, http.StatusBadRequest, errors.New("request body is empty"))
 		return
 	}
 	unShortenURL, err := url.Parse(string(body))
 	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+		abortWithProblem(c, &controllers.InvalidURLError{Err: err})
 		return
 	}
-	u, hasConflicts, err := r.controller.WriteURL(c, unShortenURL, c.GetHeader("auth"))
+	maxClicks, err := intFromQuery(c, "max_clicks")
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithStatusProblem(c, http.StatusBadRequest, err)
 		return
 	}
-	if hasConflicts {
+	redirectCode, err := intFromQuery(c, "redirect_code")
+	if err != nil {
+		abortWithStatusProblem(c, http.StatusBadRequest, err)
+		return
+	}
+	var utm url.Values
+	for k, v := range c.Request.URL.Query() {
+		if !strings.HasPrefix(k, "utm_") {
+			continue
+		}
+		if utm == nil {
+			utm = url.Values{}
+		}
+		utm[k] = v
+	}
+	link := &types.Link{
+		URL:          unShortenURL,
+		MaxClicks:    maxClicks,
+		RedirectCode: redirectCode,
+		QueryMode:    types.QueryPassthrough(c.Query("query_passthrough")),
+		UTM:          utm,
+		Domain:       c.Query("domain"),
+	}
+	u, err := r.controller.WriteURL(c, link, c.GetHeader("auth"))
+	// на повтор клиент получает существующую короткую ссылку в том же формате, что и новую
+	var duplicate *controllers.DuplicateError
+	if errors.As(err, &duplicate) {
 		c.String(http.StatusConflict, u)
 		return
 	}
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
 	c.String(http.StatusCreated, u)
 }
 
 func (r *router) GetUserURLS(c *gin.Context) {
 	u, err := r.controller.GetUser(c, c.GetHeader("auth"))
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithProblem(c, err)
 		return
 	}
 	if len(u) == 0 {
@@ -127,108 +318,341 @@ func (r *router) GetUserURLS(c *gin.Context) {
 	c.JSON(http.StatusOK, u)
 }
 
+func (r *router) DeleteUserURL(c *gin.Context) {
+	if err := r.controller.RemoveUserURL(c, c.GetHeader("auth"), r.linkKey(c)); err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetLinkStats отдает статистику ссылки, переход при этом не засчитывается
+func (r *router) GetLinkStats(c *gin.Context) {
+	id := r.linkKey(c)
+	l, err := r.controller.GetLink(c, id)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	stats := LinkStats{
+		ShortURL:    r.controller.ShortURL(id),
+		OriginalURL: l.URL.String(),
+		Clicks:      l.Clicks,
+		MaxClicks:   l.MaxClicks,
+	}
+	if !l.CreatedAt.IsZero() {
+		createdAt := l.CreatedAt.UTC()
+		stats.CreatedAt = &createdAt
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
 func (r *router) CreateShortenerURLJson(c *gin.Context) {
-	// просто чтобы пройти тесты, мне кажется, что джиновские байнды тут выглядят чище
-	decoder := json.NewDecoder(nil)
-	fmt.Println(decoder)
 	var req ShortenerRequest
-	if err := c.BindJSON(&req); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithStatusProblem(c, http.StatusBadRequest, err)
 		return
 	}
 	unShortenURL, err := url.Parse(req.URL)
 	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+		abortWithProblem(c, &controllers.InvalidURLError{Err: err})
 		return
 	}
-	u, hasConflicts, err := r.controller.WriteURL(c, unShortenURL, c.GetHeader("auth"))
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	link := &types.Link{
+		URL:          unShortenURL,
+		MaxClicks:    req.MaxClicks,
+		RedirectCode: req.RedirectCode,
+		QueryMode:    types.QueryPassthrough(req.QueryMode),
+		UTM:          utmValues(req.UTM),
+		Domain:       req.Domain,
+	}
+	u, err := r.controller.WriteURL(c, link, c.GetHeader("auth"))
+	var duplicate *controllers.DuplicateError
+	if err != nil && !errors.As(err, &duplicate) {
+		abortWithProblem(c, err)
 		return
 	}
 	resp := ShortenerResponse{Result: u}
-	if hasConflicts {
+	if req.QR {
+		var qrErr error
+		resp.QR, qrErr = r.qrGenerator.DataURL(u, qr.DefaultOptions())
+		if qrErr != nil {
+			abortWithProblem(c, qrErr)
+			return
+		}
+	}
+	if duplicate != nil {
 		c.JSON(http.StatusConflict, resp)
 		return
 	}
 	c.JSON(http.StatusCreated, resp)
 }
 
+// CreateArrayOfShortenerURLJson возвращает результат по каждой ссылке пакета. Код ответа: 201 - все ссылки созданы,
+// 409 - все уже были, 400 - все невалидны, 207 - результаты разные.
+// С ?atomic=true одна невалидная ссылка отменяет весь пакет с кодом 400
 func (r *router) CreateArrayOfShortenerURLJson(c *gin.Context) {
 	var req []ShortenerRequestWithID
-	if err := c.BindJSON(&req); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithStatusProblem(c, http.StatusBadRequest, err)
 		return
 	}
-	u := make([]*url.URL, 0, len(req))
-	for _, v := range req {
-		unShortenURL, err := url.Parse(v.OriginalURL)
-		if err != nil {
-			c.AbortWithError(http.StatusBadRequest, err)
+	atomic := false
+	if raw, ok := c.GetQuery("atomic"); ok {
+		var err error
+		if atomic, err = strconv.ParseBool(raw); err != nil {
+			abortWithStatusProblem(c, http.StatusBadRequest, err)
 			return
 		}
-		u = append(u, unShortenURL)
+	}
+	resp := make([]ShortenerResponseWithID, len(req))
+	links := make([]*types.Link, 0, len(req))
+	// номер элемента запроса для каждой разобранной ссылки
+	positions := make([]int, 0, len(req))
+	for i, v := range req {
+		resp[i].CorrelationID = v.CorrelationID
+		link, err := v.link()
+		if err != nil {
+			resp[i].Status, resp[i].Error = string(controllers.BatchInvalid), err.Error()
+			continue
+		}
+		links = append(links, link)
+		positions = append(positions, i)
+	}
+	if atomic && len(links) != len(req) {
+		c.JSON(http.StatusBadRequest, resp)
+		return
 	}
 
-	res, hasConflicts, err := r.controller.WriteArrayOfURL(c, u, c.GetHeader("auth"))
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	results, err := r.controller.WriteArrayOfURL(c, links, c.GetHeader("auth"), atomic)
+	if err != nil && !errors.Is(err, controllers.ErrInvalidLink) {
+		abortWithProblem(c, err)
 		return
 	}
-	resp := make([]ShortenerResponseWithID, 0, len(res))
-	for i, re := range res {
-		resp = append(resp, ShortenerResponseWithID{
-			CorrelationID: req[i].CorrelationID,
-			ShortURL:      re,
-		})
+	for i, res := range results {
+		resp[positions[i]].setResult(res)
 	}
-	if hasConflicts {
-		c.JSON(http.StatusConflict, resp)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, resp)
 		return
 	}
-	c.JSON(http.StatusCreated, resp)
+	c.JSON(batchStatusCode(resp), resp)
 }
 
-func (r *router) PingDataBase(c *gin.Context) {
-	err := r.controller.PingDataBase(c)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+func batchStatusCode(resp []ShortenerResponseWithID) int {
+	codes := map[string]int{
+		string(controllers.BatchCreated):  http.StatusCreated,
+		string(controllers.BatchExisting): http.StatusConflict,
+		string(controllers.BatchInvalid):  http.StatusBadRequest,
+	}
+	code := http.StatusCreated
+	for i, item := range resp {
+		if i == 0 {
+			code = codes[item.Status]
+		} else if codes[item.Status] != code {
+			return http.StatusMultiStatus
+		}
+	}
+	return code
+}
+
+func (r *ShortenerResponseWithID) setResult(res controllers.BatchResult) {
+	r.ShortURL, r.Status = res.ShortURL, string(res.Status)
+	if res.Err != nil {
+		r.Error = res.Err.Error()
+	}
+}
+
+// CreateStreamOfShortenerURLNdjson принимает ссылки в NDJSON по одной в строке и отдает результаты в том же
+// порядке, тоже в NDJSON, по мере сохранения. Следующие строки читаются только после сохранения предыдущих,
+// поэтому память ограничена пакетом, а медленное хранилище притормаживает клиента
+func (r *router) CreateStreamOfShortenerURLNdjson(c *gin.Context) {
+	if c.ContentType() != ndjsonContentType {
+		abortWithStatusProblem(c, http.StatusUnsupportedMediaType, errors.Errorf("expected %s body", ndjsonContentType))
 		return
 	}
+	var out io.Writer = c.Writer
+	var buffered *bytes.Buffer
+	if err := enableFullDuplex(c.Request); err != nil {
+		// без дуплекса начало ответа потеряет непрочитанный запрос, поэтому ответ копится до конца запроса
+		buffered = new(bytes.Buffer)
+		out = buffered
+	}
+	c.Header("Content-Type", ndjsonContentType)
 	c.Status(http.StatusOK)
+	s := &shortenStream{
+		router: r,
+		ctx:    c,
+		token:  c.GetHeader("auth"),
+		enc:    json.NewEncoder(out),
+		flush:  buffered == nil,
+		writer: c.Writer,
+	}
+	err := s.run(bufio.NewReaderSize(c.Request.Body, maxStreamLineSize))
+	if err != nil {
+		c.Error(err)
+		s.enc.Encode(streamError{Error: err.Error()})
+	}
+	if buffered != nil {
+		c.Writer.Write(buffered.Bytes())
+	}
 }
 
-func encodingHandler(c *gin.Context) {
-	if c.GetHeader("Content-Encoding") == "gzip" {
-		gz, err := gzip.NewReader(c.Request.Body)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
+const ndjsonContentType = "application/x-ndjson"
+
+// сколько ссылок потока сохраняется одним пакетом
+const streamChunkSize = 128
+
+// максимальная длина строки потока
+const maxStreamLineSize = 64 * 1024
+
+// streamError - последняя строка ответа, если поток прерван ошибкой
+type streamError struct {
+	Error string `json:"error"`
+}
+
+type shortenStream struct {
+	router *router
+	ctx    context.Context
+	token  string
+	enc    *json.Encoder
+	// сбрасывать ли ответ клиенту после каждого пакета
+	flush  bool
+	writer http.Flusher
+	resp   []ShortenerResponseWithID
+	links  []*types.Link
+	// номер элемента resp для каждой ссылки links
+	positions []int
+}
+
+func (s *shortenStream) run(body *bufio.Reader) error {
+	for {
+		line, err := body.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return errors.Errorf("line is longer than %d bytes", maxStreamLineSize)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
 		}
-		c.Request.Body = gz
+		if line = bytes.TrimSpace(line); len(line) != 0 {
+			s.add(line)
+		}
+		if errors.Is(err, io.EOF) {
+			return s.store()
+		}
+		// сохраняем пакет, когда он набран или клиент пока больше ничего не прислал
+		if len(s.resp) == streamChunkSize || body.Buffered() == 0 {
+			if err := s.store(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *shortenStream) add(line []byte) {
+	var req ShortenerRequestWithID
+	item := ShortenerResponseWithID{Status: string(controllers.BatchInvalid)}
+	if err := json.Unmarshal(line, &req); err != nil {
+		item.Error = err.Error()
+		s.resp = append(s.resp, item)
+		return
+	}
+	item.CorrelationID = req.CorrelationID
+	link, err := req.link()
+	if err != nil {
+		item.Error = err.Error()
+		s.resp = append(s.resp, item)
+		return
+	}
+	s.links = append(s.links, link)
+	s.positions = append(s.positions, len(s.resp))
+	s.resp = append(s.resp, item)
+}
 
-		defer gz.Close()
+// store сохраняет накопленный пакет и пишет его результаты
+func (s *shortenStream) store() error {
+	if len(s.resp) == 0 {
+		return nil
 	}
-	if c.GetHeader("Accept-Encoding") == "gzip" {
-		gz, err := gzip.NewWriterLevel(c.Writer, gzip.BestSpeed)
+	if len(s.links) != 0 {
+		results, err := s.router.controller.WriteArrayOfURL(s.ctx, s.links, s.token, false)
 		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
+			return err
 		}
-		c.Writer = encodeResponseWriter{
-			ResponseWriter: c.Writer,
-			Writer:         gz,
+		for i, res := range results {
+			s.resp[s.positions[i]].setResult(res)
 		}
-		defer gz.Close()
-		c.Header("Content-Encoding", "gzip")
 	}
-	c.Next()
+	for _, item := range s.resp {
+		if err := s.enc.Encode(item); err != nil {
+			return err
+		}
+	}
+	if s.flush {
+		s.writer.Flush()
+	}
+	s.resp, s.links, s.positions = s.resp[:0], s.links[:0], s.positions[:0]
+	return nil
+}
+
+func (r *router) GetQRCode(c *gin.Context) {
+	opts, err := qr.ParseOptions(c.Query("format"), c.Query("size"), c.Query("margin"), c.Query("level"))
+	if err != nil {
+		abortWithStatusProblem(c, http.StatusBadRequest, err)
+		return
+	}
+	u, err := r.controller.GetShortURL(c, r.linkKey(c))
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	code, err := r.qrGenerator.Encode(u, opts)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.Data(http.StatusOK, opts.Format.ContentType(), code)
+}
+
+func (r *router) PingDataBase(c *gin.Context) {
+	err := r.controller.PingDataBase(c)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func utmValues(utm map[string]string) url.Values {
+	if len(utm) == 0 {
+		return nil
+	}
+	res := make(url.Values, len(utm))
+	for k, v := range utm {
+		res.Set(k, v)
+	}
+	return res
+}
+
+func intFromQuery(c *gin.Context, key string) (int, error) {
+	raw, ok := c.GetQuery(key)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(raw)
 }
 
 func (r *router) authHandler(c *gin.Context) {
+	// модератор не пользователь, заводить его незачем
+	if strings.HasPrefix(c.FullPath(), adminPath+"/") {
+		c.Next()
+		return
+	}
 	t, err := c.Cookie("auth")
 	if err != nil || !r.tokenBuilder.IsTokenValid(t) {
 		t, err = r.controller.CreateUser(c)
 		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
+			abortWithProblem(c, err)
 			return
 		}
 		c.SetCookie("auth", t, time.Now().Add(time.Hour*24).Nanosecond(), "", "", false, true)
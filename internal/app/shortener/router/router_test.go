@@ -1,13 +1,20 @@
 package router
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
+	"emperror.dev/errors"
+	"encoding/json"
 	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/clicks"
 	"github.com/SakuraBurst/urlshortener/internal/app/shortener/controllers"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/openapi"
 	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
 	"github.com/SakuraBurst/urlshortener/internal/app/shortener/token"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/webhook"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -15,7 +22,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 const localhost = "http://localhost:8080"
@@ -41,7 +51,9 @@ func (r *mockDataBase) Create(ctx context.Context, val any) (string, error) {
 }
 
 func (r *mockDataBase) CreateArray(ctx context.Context, val any) ([]string, error) {
-	panic("not implemented")
+	args := r.Called(val)
+	ids, _ := args.Get(0).([]string)
+	return ids, args.Error(1)
 }
 
 func (r *mockDataBase) Update(ctx context.Context, id string, val any) error {
@@ -49,6 +61,11 @@ func (r *mockDataBase) Update(ctx context.Context, id string, val any) error {
 	return args.Error(0)
 }
 
+func (r *mockDataBase) Click(ctx context.Context, s string) (any, error) {
+	args := r.Called(s)
+	return args.Get(0), args.Error(1)
+}
+
 var MockURLRaw = "https://test.com/"
 
 var hashURL = "1"
@@ -57,6 +74,8 @@ var MockURLShorten = localhost + "/" + hashURL
 
 var MockURL, _ = url.Parse(MockURLRaw)
 
+var MockLink = &types.Link{URL: MockURL}
+
 func TestCreateShortenerURLRaw(t *testing.T) {
 	type want struct {
 		statusCode  int
@@ -92,7 +111,7 @@ func TestCreateShortenerURLRaw(t *testing.T) {
 			},
 			want: want{
 				statusCode:  http.StatusBadRequest,
-				contentType: "",
+				contentType: problemContentType,
 			},
 			positiveTest: false,
 		},
@@ -104,14 +123,14 @@ func TestCreateShortenerURLRaw(t *testing.T) {
 			},
 			want: want{
 				statusCode:  http.StatusBadRequest,
-				contentType: "",
+				contentType: problemContentType,
 			},
 			positiveTest: false,
 		},
 	}
 	urlDB := new(mockDataBase)
 	userDB := new(mockDataBase)
-	urlDB.On("Create", MockURL).Return("1", nil).Once()
+	urlDB.On("Create", MockLink).Return("1", nil).Once()
 	userDB.On("Create", []string(nil)).Return("1", nil).Times(len(tests))
 	userDB.On("Read", "1").Return([]string(nil), nil).Once()
 	userDB.On("Update", "1", []string{hashURL}).Return(nil).Once()
@@ -119,7 +138,7 @@ func TestCreateShortenerURLRaw(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb)
+			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})
 			router.ServeHTTP(tt.args.writer, tt.args.request)
 			result := tt.args.writer.Result()
 			assert.Equal(t, tt.want.contentType, result.Header.Get("content-type"))
@@ -169,7 +188,31 @@ func TestCreateShortenerURLJson(t *testing.T) {
 			},
 			want: want{
 				statusCode:  http.StatusBadRequest,
-				contentType: "",
+				contentType: problemContentType,
+			},
+			positiveTest: false,
+		},
+		{
+			name: "bad redirect code test",
+			args: args{
+				writer:  httptest.NewRecorder(),
+				request: createRequest(t, http.MethodPost, "/api/shorten", bytes.NewBuffer([]byte(fmt.Sprintf(`{"url": "%s", "redirect_code": 200}`, MockURLRaw)))),
+			},
+			want: want{
+				statusCode:  http.StatusBadRequest,
+				contentType: problemContentType,
+			},
+			positiveTest: false,
+		},
+		{
+			name: "negative max clicks test",
+			args: args{
+				writer:  httptest.NewRecorder(),
+				request: createRequest(t, http.MethodPost, "/api/shorten", bytes.NewBuffer([]byte(fmt.Sprintf(`{"url": "%s", "max_clicks": -1}`, MockURLRaw)))),
+			},
+			want: want{
+				statusCode:  http.StatusBadRequest,
+				contentType: problemContentType,
 			},
 			positiveTest: false,
 		},
@@ -181,21 +224,21 @@ func TestCreateShortenerURLJson(t *testing.T) {
 			},
 			want: want{
 				statusCode:  http.StatusBadRequest,
-				contentType: "",
+				contentType: problemContentType,
 			},
 			positiveTest: false,
 		},
 	}
 	urlDB := new(mockDataBase)
 	userDB := new(mockDataBase)
-	urlDB.On("Create", MockURL).Return("1", nil).Once()
+	urlDB.On("Create", MockLink).Return("1", nil).Once()
 	userDB.On("Create", []string(nil)).Return("1", nil).Times(len(tests))
 	userDB.On("Read", "1").Return([]string(nil), nil).Once()
 	userDB.On("Update", "1", []string{hashURL}).Return(nil).Once()
 	tb := token.InitTokenBuilder("secret key")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb)
+			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})
 			router.ServeHTTP(tt.args.writer, tt.args.request)
 			result := tt.args.writer.Result()
 			assert.Equal(t, tt.want.contentType, result.Header.Get("content-type"))
@@ -210,6 +253,366 @@ func TestCreateShortenerURLJson(t *testing.T) {
 	userDB.AssertExpectations(t)
 }
 
+func TestCreateArrayOfShortenerURLJson(t *testing.T) {
+	batch := `[{"correlation_id": "a", "original_url": "https://test.com/a"}, {"correlation_id": "b", "original_url": "https://test.com/b"},
+		{"correlation_id": "c", "original_url": "https://test.com/c", "max_clicks": -1}, {"correlation_id": "d", "original_url": "\n"}]`
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		ids        []string
+		storageErr error
+		want       []ShortenerResponseWithID
+		statusCode int
+	}{
+		{
+			name:       "all created",
+			target:     "/api/shorten/batch",
+			body:       `[{"correlation_id": "a", "original_url": "https://test.com/a"}, {"correlation_id": "b", "original_url": "https://test.com/b"}]`,
+			ids:        []string{"1", "2"},
+			statusCode: http.StatusCreated,
+			want: []ShortenerResponseWithID{
+				{CorrelationID: "a", ShortURL: localhost + "/1", Status: "created"},
+				{CorrelationID: "b", ShortURL: localhost + "/2", Status: "created"},
+			},
+		},
+		{
+			name:       "all existing",
+			target:     "/api/shorten/batch",
+			body:       `[{"correlation_id": "a", "original_url": "https://test.com/a"}]`,
+			ids:        []string{"1"},
+			storageErr: &repository.DuplicatesError{Indexes: []int{0}},
+			statusCode: http.StatusConflict,
+			want: []ShortenerResponseWithID{
+				{CorrelationID: "a", ShortURL: localhost + "/1", Status: "existing"},
+			},
+		},
+		{
+			name:       "mixed",
+			target:     "/api/shorten/batch",
+			body:       batch,
+			ids:        []string{"1", "2"},
+			storageErr: &repository.DuplicatesError{Indexes: []int{1}},
+			statusCode: http.StatusMultiStatus,
+			want: []ShortenerResponseWithID{
+				{CorrelationID: "a", ShortURL: localhost + "/1", Status: "created"},
+				{CorrelationID: "b", ShortURL: localhost + "/2", Status: "existing"},
+				{CorrelationID: "c", Status: "invalid", Error: controllers.ErrInvalidMaxClicks.Error()},
+				{CorrelationID: "d", Status: "invalid", Error: "parse \"\\n\": net/url: invalid control character in URL"},
+			},
+		},
+		{
+			name:       "atomic",
+			target:     "/api/shorten/batch?atomic=true",
+			body:       `[{"correlation_id": "a", "original_url": "https://test.com/a"}, {"correlation_id": "c", "original_url": "https://test.com/c", "max_clicks": -1}]`,
+			statusCode: http.StatusBadRequest,
+			want: []ShortenerResponseWithID{
+				{CorrelationID: "a"},
+				{CorrelationID: "c", Status: "invalid", Error: controllers.ErrInvalidMaxClicks.Error()},
+			},
+		},
+		{
+			name:       "bad atomic flag",
+			target:     "/api/shorten/batch?atomic=maybe",
+			body:       `[]`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	tb := token.InitTokenBuilder("secret key")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urlDB := new(mockDataBase)
+			userDB := new(mockDataBase)
+			userDB.On("Create", []string(nil)).Return("1", nil).Once()
+			if tt.ids != nil {
+				urlDB.On("CreateArray", mock.Anything).Return(tt.ids, tt.storageErr).Once()
+				userDB.On("Read", "1").Return([]string(nil), nil).Once()
+				userDB.On("Update", "1", tt.ids).Return(nil).Once()
+			}
+			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})
+			writer := httptest.NewRecorder()
+			router.ServeHTTP(writer, createRequest(t, http.MethodPost, tt.target, bytes.NewBufferString(tt.body)))
+			result := writer.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.statusCode, result.StatusCode)
+			if tt.want != nil {
+				var got []ShortenerResponseWithID
+				require.NoError(t, json.NewDecoder(result.Body).Decode(&got))
+				assert.Equal(t, tt.want, got)
+			}
+			urlDB.AssertExpectations(t)
+			userDB.AssertExpectations(t)
+		})
+	}
+}
+
+func TestCreateArrayOfShortenerURLJson_Duplicates(t *testing.T) {
+	urlRepo, userRepo, err := repository.InitRepositories(context.Background(), repository.Config{}, nil)
+	require.NoError(t, err)
+	tb := token.InitTokenBuilder("secret key")
+	router := InitAPI(controllers.InitController(localhost, nil, tb, urlRepo, userRepo), tb, Config{})
+	send := func(target, contentType, body string) *httptest.ResponseRecorder {
+		request := createRequest(t, http.MethodPost, target, strings.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+	statuses := func(body []byte, ndjson bool) []string {
+		var resp []ShortenerResponseWithID
+		if ndjson {
+			for _, line := range bytes.Split(bytes.TrimSpace(body), []byte("\n")) {
+				var item ShortenerResponseWithID
+				require.NoError(t, json.Unmarshal(line, &item))
+				resp = append(resp, item)
+			}
+		} else {
+			require.NoError(t, json.Unmarshal(body, &resp))
+		}
+		res := make([]string, len(resp))
+		for i, item := range resp {
+			res[i] = item.Status
+		}
+		return res
+	}
+
+	writer := send("/api/shorten", "application/json", `{"url": "https://first.test"}`)
+	require.Equal(t, http.StatusCreated, writer.Code)
+	writer = send("/api/shorten", "application/json", `{"url": "https://first.test"}`)
+	assert.Equal(t, http.StatusConflict, writer.Code)
+
+	batch := `[{"correlation_id": "1", "original_url": "https://first.test"}, {"correlation_id": "2", "original_url": "https://second.test"}]`
+	writer = send("/api/shorten/batch", "application/json", batch)
+	require.Equal(t, http.StatusMultiStatus, writer.Code, writer.Body.String())
+	assert.Equal(t, []string{"existing", "created"}, statuses(writer.Body.Bytes(), false))
+	writer = send("/api/shorten/batch", "application/json", batch)
+	assert.Equal(t, http.StatusConflict, writer.Code, writer.Body.String())
+	assert.Equal(t, []string{"existing", "existing"}, statuses(writer.Body.Bytes(), false))
+
+	writer = send("/api/shorten/stream", ndjsonContentType, `{"correlation_id": "1", "original_url": "https://second.test"}
+{"correlation_id": "2", "original_url": "https://third.test"}`)
+	require.Equal(t, http.StatusOK, writer.Code)
+	assert.Equal(t, []string{"existing", "created"}, statuses(writer.Body.Bytes(), true))
+}
+
+func TestCreateStreamOfShortenerURLNdjson(t *testing.T) {
+	urlDB := new(mockDataBase)
+	userDB := new(mockDataBase)
+	userDB.On("Create", []string(nil)).Return("1", nil).Twice()
+	urlDB.On("CreateArray", mock.Anything).Return([]string{"1", "2"}, &repository.DuplicatesError{Indexes: []int{1}}).Once()
+	userDB.On("Read", "1").Return([]string(nil), nil).Once()
+	userDB.On("Update", "1", []string{"1", "2"}).Return(nil).Once()
+	tb := token.InitTokenBuilder("secret key")
+	router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})
+
+	body := `{"correlation_id": "a", "original_url": "https://test.com/a"}
+not json
+
+{"correlation_id": "b", "original_url": "https://test.com/b"}
+{"correlation_id": "c", "original_url": "https://test.com/c", "redirect_code": 200}
+`
+	request := createRequest(t, http.MethodPost, "/api/shorten/stream", bytes.NewBufferString(body))
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	result := writer.Result()
+	defer result.Body.Close()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "application/x-ndjson", result.Header.Get("Content-Type"))
+	dec := json.NewDecoder(result.Body)
+	var got []ShortenerResponseWithID
+	for dec.More() {
+		var item ShortenerResponseWithID
+		require.NoError(t, dec.Decode(&item))
+		got = append(got, item)
+	}
+	require.Len(t, got, 4)
+	assert.Equal(t, ShortenerResponseWithID{CorrelationID: "a", ShortURL: localhost + "/1", Status: "created"}, got[0])
+	assert.Equal(t, "invalid", got[1].Status)
+	assert.NotEmpty(t, got[1].Error)
+	assert.Equal(t, ShortenerResponseWithID{CorrelationID: "b", ShortURL: localhost + "/2", Status: "existing"}, got[2])
+	assert.Equal(t, ShortenerResponseWithID{CorrelationID: "c", Status: "invalid", Error: controllers.ErrInvalidRedirectCode.Error()}, got[3])
+
+	request = createRequest(t, http.MethodPost, "/api/shorten/stream", bytes.NewBufferString(body))
+	request.Header.Set("Content-Type", "application/json")
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	assert.Equal(t, http.StatusUnsupportedMediaType, writer.Code)
+	urlDB.AssertExpectations(t)
+	userDB.AssertExpectations(t)
+}
+
+// ответ на строку должен приходить до того, как клиент закончил отправлять поток
+func TestCreateStreamOfShortenerURLNdjson_FullDuplex(t *testing.T) {
+	urlDB := new(mockDataBase)
+	userDB := new(mockDataBase)
+	userDB.On("Create", []string(nil)).Return("1", nil).Once()
+	urlDB.On("CreateArray", mock.Anything).Return([]string{"1"}, nil).Once()
+	urlDB.On("CreateArray", mock.Anything).Return([]string{"2"}, nil).Once()
+	userDB.On("Read", "1").Return([]string(nil), nil)
+	userDB.On("Update", "1", mock.Anything).Return(nil)
+	tb := token.InitTokenBuilder("secret key")
+	server := httptest.NewServer(Handler(InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})))
+	defer server.Close()
+
+	pr, pw := io.Pipe()
+	request := createRequest(t, http.MethodPost, server.URL+"/api/shorten/stream", pr)
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := server.Client().Do(request)
+		assert.NoError(t, err)
+		responses <- resp
+	}()
+	_, err := io.WriteString(pw, `{"correlation_id": "a", "original_url": "https://test.com/a"}`+"\n")
+	require.NoError(t, err)
+	resp := <-responses
+	require.NotNil(t, resp)
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	var item ShortenerResponseWithID
+	require.NoError(t, dec.Decode(&item))
+	assert.Equal(t, ShortenerResponseWithID{CorrelationID: "a", ShortURL: localhost + "/1", Status: "created"}, item)
+
+	_, err = io.WriteString(pw, `{"correlation_id": "b", "original_url": "https://test.com/b"}`+"\n")
+	require.NoError(t, err)
+	require.NoError(t, dec.Decode(&item))
+	assert.Equal(t, ShortenerResponseWithID{CorrelationID: "b", ShortURL: localhost + "/2", Status: "created"}, item)
+	require.NoError(t, pw.Close())
+	assert.False(t, dec.More())
+	urlDB.AssertExpectations(t)
+}
+
+// memoryIdempotency - простое хранилище ответов для тестов
+type memoryIdempotency struct {
+	records map[string]*repository.IdempotencyRecord
+}
+
+func (m *memoryIdempotency) Begin(ctx context.Context, user, key, requestHash string) (*repository.IdempotencyRecord, error) {
+	if r, ok := m.records[user+key]; ok {
+		return r, nil
+	}
+	m.records[user+key] = &repository.IdempotencyRecord{RequestHash: requestHash}
+	return nil, nil
+}
+
+func (m *memoryIdempotency) Complete(ctx context.Context, user, key string, r *repository.IdempotencyRecord) error {
+	r.RequestHash = m.records[user+key].RequestHash
+	m.records[user+key] = r
+	return nil
+}
+
+func (m *memoryIdempotency) Release(ctx context.Context, user, key string) error {
+	delete(m.records, user+key)
+	return nil
+}
+
+func (m *memoryIdempotency) DeleteExpired(ctx context.Context) error {
+	return nil
+}
+
+func TestIdempotencyHandler(t *testing.T) {
+	urlDB := new(mockDataBase)
+	userDB := new(mockDataBase)
+	urlDB.On("Create", MockLink).Return("1", nil).Once()
+	urlDB.On("Create", &types.Link{URL: mustParseURL(t, "https://test.com/fails")}).Return("", errors.New("storage is down")).Twice()
+	urlDB.On("Create", &types.Link{URL: mustParseURL(t, "https://test.com/panics")}).Run(func(mock.Arguments) {
+		panic("storage driver bug")
+	}).Twice()
+	userDB.On("Read", "1").Return([]string(nil), nil).Once()
+	userDB.On("Update", "1", []string{hashURL}).Return(nil).Once()
+	tb := token.InitTokenBuilder("secret key")
+	auth, err := tb.CreateToken("1")
+	require.NoError(t, err)
+	router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{
+		Idempotency: &memoryIdempotency{records: map[string]*repository.IdempotencyRecord{}},
+	})
+	send := func(key, body string) *httptest.ResponseRecorder {
+		request := createRequest(t, http.MethodPost, "/api/shorten", bytes.NewBufferString(body))
+		request.Header.Set("Idempotency-Key", key)
+		request.AddCookie(&http.Cookie{Name: "auth", Value: auth})
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+	body := fmt.Sprintf(`{"url": "%s"}`, MockURLRaw)
+	first := send("a", body)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	retry := send("a", body)
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, send("a", `{"url": "https://test.com/other"}`).Code)
+	// ответ с ошибкой сервера не сохраняется, ретрай выполняется заново
+	assert.Equal(t, http.StatusInternalServerError, send("b", `{"url": "https://test.com/fails"}`).Code)
+	assert.Equal(t, http.StatusInternalServerError, send("b", `{"url": "https://test.com/fails"}`).Code)
+	// после паники обработчика ключ освобождается, и ретрай выполняется заново, а не получает 409
+	assert.Equal(t, http.StatusInternalServerError, send("c", `{"url": "https://test.com/panics"}`).Code)
+	assert.Equal(t, http.StatusInternalServerError, send("c", `{"url": "https://test.com/panics"}`).Code)
+	urlDB.AssertExpectations(t)
+	userDB.AssertExpectations(t)
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
+
+// TestOpenAPI_Routes падает, если маршруты роутера и описание API разошлись
+func TestOpenAPI_Routes(t *testing.T) {
+	tb := token.InitTokenBuilder("secret key")
+	engine := InitAPI(controllers.InitController(localhost, nil, tb, new(mockDataBase), new(mockDataBase)), tb, Config{})
+	registered := map[string]bool{}
+	for _, route := range engine.Routes() {
+		registered[route.Method+" "+openapi.Path(route.Path)] = true
+	}
+	documented := map[string]bool{}
+	for path, item := range OpenAPI().Paths {
+		for method, op := range *item {
+			documented[strings.ToUpper(method)+" "+path] = true
+			assert.NotEmpty(t, op.Responses, "%s %s", method, path)
+		}
+	}
+	assert.Equal(t, registered, documented)
+}
+
+func TestOpenAPI_Served(t *testing.T) {
+	userDB := new(mockDataBase)
+	userDB.On("Create", []string(nil)).Return("1", nil)
+	tb := token.InitTokenBuilder("secret key")
+	router := InitAPI(controllers.InitController(localhost, nil, tb, new(mockDataBase), userDB), tb, Config{})
+
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, createRequest(t, http.MethodGet, "/api/openapi.json", nil))
+	require.Equal(t, http.StatusOK, writer.Code)
+	var spec openapi.Document
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &spec))
+	assert.Equal(t, openapi.Version, spec.OpenAPI)
+	assert.Contains(t, spec.Components.Schemas, "ShortenerRequest")
+	assert.Contains(t, spec.Components.Schemas, "URLShorter")
+
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, createRequest(t, http.MethodGet, "/api/docs", nil))
+	assert.Equal(t, http.StatusMovedPermanently, writer.Code)
+	assert.Equal(t, "/api/docs/", writer.Header().Get("Location"))
+
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, createRequest(t, http.MethodGet, "/api/docs/", nil))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, writer.Body.String(), "swagger-ui-bundle.js")
+
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, createRequest(t, http.MethodGet, "/api/docs/swagger-ui.css", nil))
+	assert.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, writer.Header().Get("Content-Type"), "text/css")
+
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, createRequest(t, http.MethodGet, "/api/docs/missing.js", nil))
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+}
+
 func TestRedirectURL(t *testing.T) {
 	type want struct {
 		statusCode int
@@ -248,6 +651,52 @@ func TestRedirectURL(t *testing.T) {
 			},
 			positiveTest: false,
 		},
+		{
+			name: "permanent redirect test",
+			args: args{
+				writer:  httptest.NewRecorder(),
+				request: createRequest(t, http.MethodGet, "/4", nil),
+			},
+			want: want{
+				statusCode: http.StatusMovedPermanently,
+				location:   MockURLRaw,
+			},
+			positiveTest: true,
+		},
+		{
+			name: "query passthrough test",
+			args: args{
+				writer:  httptest.NewRecorder(),
+				request: createRequest(t, http.MethodGet, "/5?utm_source=x&q=a+b", nil),
+			},
+			want: want{
+				statusCode: http.StatusTemporaryRedirect,
+				location:   MockURLRaw + "?utm_campaign=sale&utm_source=x&q=a+b",
+			},
+			positiveTest: true,
+		},
+		{
+			name: "exhausted url test",
+			args: args{
+				writer:  httptest.NewRecorder(),
+				request: createRequest(t, http.MethodGet, "/3", nil),
+			},
+			want: want{
+				statusCode: http.StatusGone,
+			},
+			positiveTest: false,
+		},
+		{
+			name: "storage failure test",
+			args: args{
+				writer:  httptest.NewRecorder(),
+				request: createRequest(t, http.MethodGet, "/6", nil),
+			},
+			want: want{
+				statusCode: http.StatusInternalServerError,
+			},
+			positiveTest: false,
+		},
 		{
 			name: "no id test",
 			args: args{
@@ -262,13 +711,17 @@ func TestRedirectURL(t *testing.T) {
 	}
 	urlDB := new(mockDataBase)
 	userDB := new(mockDataBase)
-	urlDB.On("Read", "1").Return(MockURL, nil).Once()
-	urlDB.On("Read", "2").Return(nil, repository.ErrNoSuchValue).Once()
+	urlDB.On("Click", "1").Return(MockLink, nil).Once()
+	urlDB.On("Click", "2").Return(nil, repository.ErrNoSuchValue).Once()
+	urlDB.On("Click", "4").Return(&types.Link{URL: MockURL, RedirectCode: http.StatusMovedPermanently}, nil).Once()
+	urlDB.On("Click", "5").Return(&types.Link{URL: MockURL, QueryMode: types.QueryMerge, UTM: url.Values{"utm_campaign": {"sale"}}}, nil).Once()
+	urlDB.On("Click", "3").Return(&types.Link{URL: MockURL, MaxClicks: 1, Clicks: 1}, repository.ErrClicksExhausted).Once()
+	urlDB.On("Click", "6").Return(nil, context.DeadlineExceeded).Once()
 	userDB.On("Create", []string(nil)).Return("1", nil).Times(len(tests))
 	tb := token.InitTokenBuilder("secret key")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb)
+			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})
 			router.ServeHTTP(tt.args.writer, tt.args.request)
 			result := tt.args.writer.Result()
 			result.Body.Close()
@@ -286,13 +739,72 @@ func TestNotFoundEndpoint(t *testing.T) {
 	DB := new(mockDataBase)
 	DB.On("Create", []string(nil)).Return("1", nil).Once()
 	tb := token.InitTokenBuilder("secret key")
-	router := InitAPI(controllers.InitController(localhost, nil, tb, DB, DB), tb)
+	router := InitAPI(controllers.InitController(localhost, nil, tb, DB, DB), tb, Config{})
 	request := createRequest(t, http.MethodPost, "/asdfalfkasdfkkjasdfasfasfasdfsaf", bytes.NewBuffer([]byte{0}))
 	writer := httptest.NewRecorder()
 	router.ServeHTTP(writer, request)
 	result := writer.Result()
 	result.Body.Close()
 	assert.Equal(t, http.StatusNotFound, result.StatusCode)
+	assert.Equal(t, problemContentType, result.Header.Get("Content-Type"))
+}
+
+func TestProblem(t *testing.T) {
+	tests := []struct {
+		name  string
+		click error
+		want  Problem
+	}{
+		{
+			name:  "not found",
+			click: repository.ErrNoSuchValue,
+			want: Problem{
+				Type:     problemNotFound,
+				Title:    "Not Found",
+				Status:   http.StatusNotFound,
+				Detail:   `link "1" not found`,
+				Instance: "/1",
+			},
+		},
+		{
+			name:  "clicks exhausted",
+			click: repository.ErrClicksExhausted,
+			want: Problem{
+				Type:     problemClicksExhausted,
+				Title:    "Gone",
+				Status:   http.StatusGone,
+				Detail:   repository.ErrClicksExhausted.Error(),
+				Instance: "/1",
+			},
+		},
+		{
+			name:  "storage failure hides details",
+			click: errors.New("connection refused"),
+			want: Problem{
+				Type:     problemBlank,
+				Title:    "Internal Server Error",
+				Status:   http.StatusInternalServerError,
+				Instance: "/1",
+			},
+		},
+	}
+	tb := token.InitTokenBuilder("secret key")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urlDB := new(mockDataBase)
+			userDB := new(mockDataBase)
+			urlDB.On("Click", "1").Return(nil, tt.click).Once()
+			userDB.On("Create", []string(nil)).Return("1", nil).Once()
+			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})
+			writer := httptest.NewRecorder()
+			router.ServeHTTP(writer, createRequest(t, http.MethodGet, "/1", nil))
+			assert.Equal(t, tt.want.Status, writer.Code)
+			assert.Equal(t, problemContentType, writer.Header().Get("Content-Type"))
+			var got Problem
+			require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &got))
+			assert.Equal(t, tt.want, got)
+		})
+	}
 }
 
 //func Test_checkBaseURL(t *testing.T) {
@@ -417,14 +929,15 @@ func Test_encodingHandler(t *testing.T) {
 	}
 	urlDB := new(mockDataBase)
 	userDB := new(mockDataBase)
-	urlDB.On("Create", MockURL).Return("1", nil).Twice()
+	urlDB.On("Create", MockLink).Return("1", nil).Twice()
 	userDB.On("Create", []string(nil)).Return("1", nil).Times(len(tests) - 1)
 	userDB.On("Read", "1").Return([]string(nil), nil).Twice()
 	userDB.On("Update", "1", []string{hashURL}).Return(nil).Twice()
 	tb := token.InitTokenBuilder("secret key")
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb)
+			// ответ короткий, порог сжатия снят, чтобы он все равно сжимался
+			router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{CompressMinSize: 1})
 			b := bytes.NewBuffer(nil)
 			if tt.args.request.needToEncode {
 				w := gzip.NewWriter(b)
@@ -466,3 +979,807 @@ func Test_encodingHandler(t *testing.T) {
 	urlDB.AssertExpectations(t)
 	userDB.AssertExpectations(t)
 }
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: ""},
+		{header: "gzip", want: "gzip"},
+		{header: "gzip, deflate, br", want: "br"},
+		{header: "gzip;q=1.0, br;q=0.5", want: "gzip"},
+		{header: "deflate, zstd;q=0.9", want: "deflate"},
+		{header: "x-gzip", want: "gzip"},
+		{header: "br;q=0", want: ""},
+		{header: "*", want: "br"},
+		{header: "*;q=0.5, br;q=0", want: "zstd"},
+		{header: "gzip;q=0.5, identity", want: ""},
+		{header: "gzip;q=0.5, identity;q=0.1", want: "gzip"},
+		{header: "compress, sdch", want: ""},
+		{header: "gzip;q=abc", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got := negotiateEncoding(tt.header)
+			if len(tt.want) == 0 {
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.Equal(t, tt.want, got.name)
+		})
+	}
+}
+
+func TestEncodingHandler_Codecs(t *testing.T) {
+	userDB := new(mockDataBase)
+	userDB.On("Create", []string(nil)).Return("1", nil)
+	tb := token.InitTokenBuilder("secret key")
+	router := InitAPI(controllers.InitController(localhost, nil, tb, userDB, userDB), tb, Config{})
+	spec, err := json.Marshal(OpenAPI())
+	require.NoError(t, err)
+	for _, cd := range codecs {
+		t.Run(cd.name, func(t *testing.T) {
+			request := createRequest(t, http.MethodGet, "/api/openapi.json", nil)
+			request.Header.Set("Accept-Encoding", cd.name)
+			writer := httptest.NewRecorder()
+			router.ServeHTTP(writer, request)
+			assert.Equal(t, http.StatusOK, writer.Code)
+			assert.Equal(t, cd.name, writer.Header().Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", writer.Header().Get("Vary"))
+			r, err := cd.newReader(writer.Body)
+			require.NoError(t, err)
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, spec, got)
+		})
+	}
+}
+
+func TestEncodingHandler_RequestCodecs(t *testing.T) {
+	urlDB := new(mockDataBase)
+	userDB := new(mockDataBase)
+	urlDB.On("Create", MockLink).Return("1", nil)
+	userDB.On("Create", []string(nil)).Return("1", nil)
+	userDB.On("Read", "1").Return([]string(nil), nil)
+	userDB.On("Update", "1", []string{hashURL}).Return(nil)
+	tb := token.InitTokenBuilder("secret key")
+	router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})
+	encode := func(t *testing.T, body []byte, names ...string) []byte {
+		for _, name := range names {
+			b := bytes.NewBuffer(nil)
+			w := codecByName(name).writer(b)
+			_, err := w.Write(body)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			body = b.Bytes()
+		}
+		return body
+	}
+	tests := []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+		statusCode      int
+	}{
+		{name: "br", contentEncoding: "br", body: encode(t, []byte(MockURLRaw), "br"), statusCode: http.StatusCreated},
+		{name: "zstd", contentEncoding: "zstd", body: encode(t, []byte(MockURLRaw), "zstd"), statusCode: http.StatusCreated},
+		{name: "deflate", contentEncoding: "deflate", body: encode(t, []byte(MockURLRaw), "deflate"), statusCode: http.StatusCreated},
+		{name: "x-gzip", contentEncoding: "x-gzip", body: encode(t, []byte(MockURLRaw), "gzip"), statusCode: http.StatusCreated},
+		{name: "chain", contentEncoding: "gzip, identity, br", body: encode(t, []byte(MockURLRaw), "gzip", "br"), statusCode: http.StatusCreated},
+		{name: "unsupported", contentEncoding: "compress", body: []byte(MockURLRaw), statusCode: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := createRequest(t, http.MethodPost, "/", bytes.NewReader(tt.body))
+			request.Header.Set("Content-Encoding", tt.contentEncoding)
+			writer := httptest.NewRecorder()
+			router.ServeHTTP(writer, request)
+			assert.Equal(t, tt.statusCode, writer.Code)
+			if tt.statusCode == http.StatusCreated {
+				assert.Equal(t, MockURLShorten, writer.Body.String())
+			} else {
+				assert.Equal(t, problemContentType, writer.Header().Get("Content-Type"))
+				assert.Equal(t, supportedEncodings(), writer.Header().Get("Accept-Encoding"))
+			}
+		})
+	}
+}
+
+func TestEncodingHandler_Skip(t *testing.T) {
+	userDB := new(mockDataBase)
+	userDB.On("Create", []string(nil)).Return("1", nil)
+	tb := token.InitTokenBuilder("secret key")
+	router := InitAPI(controllers.InitController(localhost, nil, tb, userDB, userDB), tb, Config{})
+	tests := []struct {
+		name           string
+		route          string
+		acceptEncoding string
+		compressed     bool
+	}{
+		{name: "large json", route: "/api/openapi.json", acceptEncoding: "gzip, deflate, br", compressed: true},
+		{name: "no accept encoding", route: "/api/openapi.json"},
+		{name: "identity preferred", route: "/api/openapi.json", acceptEncoding: "gzip;q=0.1, identity"},
+		{name: "small response", route: "/api/docs", acceptEncoding: "gzip"},
+		{name: "type not in allowlist", route: "/api/docs/favicon-32x32.png", acceptEncoding: "gzip"},
+		{name: "problem below threshold", route: "/api/unknown", acceptEncoding: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := createRequest(t, http.MethodGet, tt.route, nil)
+			if len(tt.acceptEncoding) != 0 {
+				request.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			writer := httptest.NewRecorder()
+			router.ServeHTTP(writer, request)
+			assert.Equal(t, "Accept-Encoding", writer.Header().Get("Vary"))
+			if tt.compressed {
+				assert.Equal(t, "br", writer.Header().Get("Content-Encoding"))
+				assert.Empty(t, writer.Header().Get("Content-Length"))
+			} else {
+				assert.Empty(t, writer.Header().Get("Content-Encoding"))
+			}
+		})
+	}
+}
+
+func TestGetQRCode(t *testing.T) {
+	type want struct {
+		statusCode  int
+		contentType string
+	}
+	tests := []struct {
+		name         string
+		route        string
+		want         want
+		positiveTest bool
+	}{
+		{
+			name:  "png test",
+			route: "/api/qr/1?size=128",
+			want: want{
+				statusCode:  http.StatusOK,
+				contentType: "image/png",
+			},
+			positiveTest: true,
+		},
+		{
+			name:  "svg test",
+			route: "/api/qr/1?format=svg&margin=0&level=H",
+			want: want{
+				statusCode:  http.StatusOK,
+				contentType: "image/svg+xml",
+			},
+			positiveTest: true,
+		},
+		{
+			name:  "bad size test",
+			route: "/api/qr/1?size=1",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:  "size too small for code test",
+			route: "/api/qr/1?size=32&level=H&margin=8",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:  "no such url test",
+			route: "/api/qr/2",
+			want: want{
+				statusCode: http.StatusNotFound,
+			},
+		},
+	}
+	urlDB := new(mockDataBase)
+	userDB := new(mockDataBase)
+	urlDB.On("Read", "1").Return(MockLink, nil).Times(3)
+	urlDB.On("Read", "2").Return(nil, repository.ErrNoSuchValue).Once()
+	userDB.On("Create", []string(nil)).Return("1", nil).Times(len(tests))
+	tb := token.InitTokenBuilder("secret key")
+	router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := httptest.NewRecorder()
+			router.ServeHTTP(writer, createRequest(t, http.MethodGet, tt.route, nil))
+			result := writer.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			if tt.positiveTest {
+				assert.Equal(t, tt.want.contentType, result.Header.Get("content-type"))
+				b, err := io.ReadAll(result.Body)
+				require.NoError(t, err)
+				assert.NotEmpty(t, b)
+			}
+		})
+	}
+	urlDB.AssertExpectations(t)
+	userDB.AssertExpectations(t)
+}
+
+func TestPreviewURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		route        string
+		statusCode   int
+		positiveTest bool
+	}{
+		{
+			name:         "plus suffix test",
+			route:        "/1+",
+			statusCode:   http.StatusOK,
+			positiveTest: true,
+		},
+		{
+			name:         "preview flag test",
+			route:        "/1?preview=1",
+			statusCode:   http.StatusOK,
+			positiveTest: true,
+		},
+		{
+			name:       "no such url test",
+			route:      "/2+",
+			statusCode: http.StatusNotFound,
+		},
+	}
+	urlDB := new(mockDataBase)
+	userDB := new(mockDataBase)
+	urlDB.On("Read", "1").Return(&types.Link{URL: MockURL, Clicks: 2, MaxClicks: 5}, nil).Twice()
+	urlDB.On("Read", "2").Return(nil, repository.ErrNoSuchValue).Once()
+	userDB.On("Create", []string(nil)).Return("1", nil).Times(len(tests))
+	tb := token.InitTokenBuilder("secret key")
+	router := InitAPI(controllers.InitController(localhost, nil, tb, urlDB, userDB), tb, Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := httptest.NewRecorder()
+			router.ServeHTTP(writer, createRequest(t, http.MethodGet, tt.route, nil))
+			result := writer.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.statusCode, result.StatusCode)
+			assert.Empty(t, result.Header.Get("Location"))
+			if tt.positiveTest {
+				assert.Equal(t, "text/html; charset=utf-8", result.Header.Get("content-type"))
+				b, err := io.ReadAll(result.Body)
+				require.NoError(t, err)
+				assert.Contains(t, string(b), MockURLRaw)
+				assert.Contains(t, string(b), "2 of 5")
+			}
+		})
+	}
+	urlDB.AssertExpectations(t)
+	userDB.AssertExpectations(t)
+}
+
+func TestAdminAPI(t *testing.T) {
+	ctx := context.Background()
+	urlRepo, userRepo, err := repository.InitRepositories(ctx, repository.Config{}, nil)
+	require.NoError(t, err)
+	id, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://news.example.com/page")})
+	require.NoError(t, err)
+	alice, err := userRepo.Create(ctx, []string{id})
+	require.NoError(t, err)
+	bob, err := userRepo.Create(ctx, []string(nil))
+	require.NoError(t, err)
+	tb := token.InitTokenBuilder("secret key")
+	controller := controllers.InitController(localhost, nil, tb, urlRepo, userRepo)
+	router := InitAPI(controller, tb, Config{AdminToken: "admin"})
+	send := func(method, target, token, body string) *httptest.ResponseRecorder {
+		request := createRequest(t, method, target, strings.NewReader(body))
+		if len(token) != 0 {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+	decode := func(writer *httptest.ResponseRecorder) AdminLink {
+		require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+		var l AdminLink
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &l))
+		return l
+	}
+	linkPath := "/api/admin/links/" + id
+
+	t.Run("auth", func(t *testing.T) {
+		writer := send(http.MethodGet, linkPath, "", "")
+		assert.Equal(t, http.StatusUnauthorized, writer.Code)
+		assert.Equal(t, problemContentType, writer.Header().Get("Content-Type"))
+		assert.NotEmpty(t, writer.Header().Get("WWW-Authenticate"))
+		assert.Empty(t, writer.Header().Get("Set-Cookie"))
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, linkPath, "wrong", "").Code)
+
+		disabled := InitAPI(controller, tb, Config{})
+		writer = httptest.NewRecorder()
+		disabled.ServeHTTP(writer, createRequest(t, http.MethodGet, linkPath, nil))
+		assert.Equal(t, http.StatusNotFound, writer.Code)
+	})
+	t.Run("get", func(t *testing.T) {
+		l := decode(send(http.MethodGet, linkPath, "admin", ""))
+		assert.Equal(t, id, l.ID)
+		assert.Equal(t, localhost+"/"+id, l.ShortURL)
+		assert.Equal(t, "https://news.example.com/page", l.OriginalURL)
+		assert.Equal(t, []string{alice}, l.Owners)
+		assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/api/admin/links/missing", "admin", "").Code)
+	})
+	t.Run("disable", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodPut, linkPath+"/disabled", "admin", `{"reason": "bored"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodPut, linkPath+"/disabled", "admin", `{}`).Code)
+
+		l := decode(send(http.MethodPut, linkPath+"/disabled", "admin", `{"reason": "legal"}`))
+		assert.Equal(t, string(types.DisabledLegal), l.Disabled)
+		writer := send(http.MethodGet, "/"+id, "", "")
+		assert.Equal(t, http.StatusUnavailableForLegalReasons, writer.Code)
+		var p Problem
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &p))
+		assert.Equal(t, problemLegal, p.Type)
+
+		decode(send(http.MethodPut, linkPath+"/disabled", "admin", `{"reason": "removed"}`))
+		assert.Equal(t, http.StatusGone, send(http.MethodGet, "/"+id, "", "").Code)
+		assert.Equal(t, http.StatusGone, send(http.MethodGet, "/"+id+"+", "", "").Code)
+		assert.Equal(t, http.StatusGone, send(http.MethodGet, "/api/qr/"+id, "", "").Code)
+
+		l = decode(send(http.MethodDelete, linkPath+"/disabled", "admin", ""))
+		assert.Empty(t, l.Disabled)
+		assert.Equal(t, http.StatusTemporaryRedirect, send(http.MethodGet, "/"+id, "", "").Code)
+	})
+	t.Run("transfer", func(t *testing.T) {
+		l := decode(send(http.MethodPut, linkPath+"/owner", "admin", fmt.Sprintf(`{"user_id": %q}`, bob)))
+		assert.Equal(t, []string{bob}, l.Owners)
+		v, err := userRepo.Read(ctx, alice)
+		require.NoError(t, err)
+		assert.Empty(t, v)
+		assert.Equal(t, http.StatusNotFound, send(http.MethodPut, linkPath+"/owner", "admin", `{"user_id": "100"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodPut, linkPath+"/owner", "admin", `{}`).Code)
+	})
+	t.Run("search", func(t *testing.T) {
+		writer := send(http.MethodGet, "/api/admin/links?host=example.com", "admin", "")
+		require.Equal(t, http.StatusOK, writer.Code)
+		var found []AdminLink
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &found))
+		require.Len(t, found, 1)
+		assert.Equal(t, id, found[0].ID)
+		assert.Nil(t, found[0].Owners)
+		assert.Equal(t, "[]", send(http.MethodGet, "/api/admin/links?host=other.com", "admin", "").Body.String())
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/api/admin/links", "admin", "").Code)
+		assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/api/admin/links?host=example.com&limit=5000", "admin", "").Code)
+	})
+}
+
+func TestAdminAPI_DisabledSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	cfg := repository.Config{BackUpPath: filepath.Join(t.TempDir(), "backup")}
+	urlRepo, userRepo, err := repository.InitRepositories(ctx, cfg, nil)
+	require.NoError(t, err)
+	legal, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://news.example.com/legal")})
+	require.NoError(t, err)
+	removed, err := urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://news.example.com/removed"), MaxClicks: 5})
+	require.NoError(t, err)
+	tb := token.InitTokenBuilder("secret key")
+	open := func(urlRepo repository.URLRepository, userRepo repository.Repository) http.Handler {
+		return InitAPI(controllers.InitController(localhost, nil, tb, urlRepo, userRepo), tb, Config{AdminToken: "admin"})
+	}
+	send := func(router http.Handler, method, target string, body string) int {
+		request := createRequest(t, method, target, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer admin")
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer.Code
+	}
+	router := open(urlRepo, userRepo)
+	require.Equal(t, http.StatusOK, send(router, http.MethodPut, "/api/admin/links/"+legal+"/disabled", `{"reason": "legal"}`))
+	require.Equal(t, http.StatusOK, send(router, http.MethodPut, "/api/admin/links/"+removed+"/disabled", `{"reason": "removed"}`))
+
+	check := func(name string) {
+		urlRepo, userRepo, err := repository.InitRepositories(ctx, cfg, nil)
+		require.NoError(t, err)
+		router := open(urlRepo, userRepo)
+		assert.Equal(t, http.StatusUnavailableForLegalReasons, send(router, http.MethodGet, "/"+legal, ""), name)
+		assert.Equal(t, http.StatusGone, send(router, http.MethodGet, "/"+removed, ""), name)
+	}
+	check("reopen")
+	_, err = repository.CompactBackUp(cfg.BackUpPath)
+	require.NoError(t, err)
+	check("compact")
+}
+
+func TestUserURLDeleteAndStats(t *testing.T) {
+	ctx := context.Background()
+	urlRepo, userRepo, err := repository.InitRepositories(ctx, repository.Config{}, nil)
+	require.NoError(t, err)
+	id, err := urlRepo.Create(ctx, &types.Link{URL: MockURL, MaxClicks: 5})
+	require.NoError(t, err)
+	userID, err := userRepo.Create(ctx, []string{id})
+	require.NoError(t, err)
+	tb := token.InitTokenBuilder("secret key")
+	auth, err := tb.CreateToken(userID)
+	require.NoError(t, err)
+	router := InitAPI(controllers.InitController(localhost, nil, tb, urlRepo, userRepo), tb, Config{})
+	send := func(method, target string) *httptest.ResponseRecorder {
+		request := createRequest(t, method, target, nil)
+		request.AddCookie(&http.Cookie{Name: "auth", Value: auth})
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+
+	writer := send(http.MethodGet, "/api/links/"+id)
+	require.Equal(t, http.StatusOK, writer.Code)
+	var stats LinkStats
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &stats))
+	assert.Equal(t, localhost+"/"+id, stats.ShortURL)
+	assert.Equal(t, MockURLRaw, stats.OriginalURL)
+	assert.Equal(t, 5, stats.MaxClicks)
+	assert.NotNil(t, stats.CreatedAt)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/api/links/missing").Code)
+
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/api/user/urls/"+id).Code)
+	assert.Equal(t, http.StatusNoContent, send(http.MethodGet, "/api/user/urls").Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodDelete, "/api/user/urls/"+id).Code)
+	// ссылка убрана только из списка пользователя
+	assert.Equal(t, http.StatusTemporaryRedirect, send(http.MethodGet, "/"+id).Code)
+}
+
+func TestWebhooks(t *testing.T) {
+	ctx := context.Background()
+	urlRepo, userRepo, err := repository.InitRepositories(ctx, repository.Config{}, nil)
+	require.NoError(t, err)
+	tb := token.InitTokenBuilder("secret key")
+	controller := controllers.InitController(localhost, nil, tb, urlRepo, userRepo)
+	router := InitAPI(controller, tb, Config{})
+	var auth string
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		request := createRequest(t, method, target, strings.NewReader(body))
+		if len(auth) != 0 {
+			request.AddCookie(&http.Cookie{Name: "auth", Value: auth})
+		}
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+	writer := send(http.MethodGet, "/api/user/webhooks", "")
+	assert.Equal(t, http.StatusNotImplemented, writer.Code)
+	for _, c := range writer.Result().Cookies() {
+		if c.Name == "auth" {
+			auth = c.Value
+		}
+	}
+	require.NotEmpty(t, auth)
+
+	var secret string
+	var received []webhook.Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if err := webhook.Verify(secret, r.Header.Get(webhook.SignatureHeader), body, time.Minute, time.Now()); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e webhook.Event
+		require.NoError(t, json.Unmarshal(body, &e))
+		received = append(received, e)
+	}))
+	defer receiver.Close()
+	webhooks, err := repository.InitWebhookRepository(ctx, nil)
+	require.NoError(t, err)
+	dispatcher := webhook.InitDispatcher(webhooks, nil, webhook.Config{AllowPrivate: true})
+	controller.SetWebhooks(dispatcher)
+
+	for _, body := range []string{
+		`{"url": "ftp://hooks.test"}`,
+		`{"url": "/relative"}`,
+		`{"url": "` + receiver.URL + `", "events": ["link.renamed"]}`,
+		`{"url": "` + receiver.URL + `", "events": ["link.click_threshold"]}`,
+		`{"url": "` + receiver.URL + `", "click_threshold": -1}`,
+	} {
+		writer := send(http.MethodPost, "/api/user/webhooks", body)
+		assert.Equal(t, http.StatusBadRequest, writer.Code, body)
+		assert.Contains(t, writer.Body.String(), problemInvalidWebhook, body)
+	}
+	writer = send(http.MethodPost, "/api/user/webhooks", `{"url": "`+receiver.URL+`", "click_threshold": 2}`)
+	require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+	var created WebhookResponse
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &created))
+	assert.Len(t, created.Events, len(types.WebhookEvents))
+	assert.Equal(t, 2, created.ClickThreshold)
+	require.NotEmpty(t, created.Secret)
+	secret = created.Secret
+
+	writer = send(http.MethodGet, "/api/user/webhooks", "")
+	require.Equal(t, http.StatusOK, writer.Code)
+	var list []WebhookResponse
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, created.ID, list[0].ID)
+	assert.Empty(t, list[0].Secret)
+
+	writer = send(http.MethodPost, "/api/shorten", `{"url": "https://test.com/hooked", "max_clicks": 2}`)
+	require.Equal(t, http.StatusCreated, writer.Code)
+	var shortened ShortenerResponse
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &shortened))
+	hash := strings.TrimPrefix(shortened.Result, localhost+"/")
+	assert.Equal(t, http.StatusTemporaryRedirect, send(http.MethodGet, "/"+hash, "").Code)
+	assert.Equal(t, http.StatusTemporaryRedirect, send(http.MethodGet, "/"+hash, "").Code)
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/api/user/urls/"+hash, "").Code)
+
+	n, err := dispatcher.DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	var got []types.WebhookEvent
+	for _, e := range received {
+		got = append(got, e.Type)
+		assert.Equal(t, hash, e.Data.ID)
+		assert.Equal(t, "https://test.com/hooked", e.Data.OriginalURL)
+	}
+	assert.ElementsMatch(t, types.WebhookEvents, got)
+
+	writer = send(http.MethodGet, "/api/user/webhooks/"+created.ID+"/deliveries?limit=10", "")
+	require.Equal(t, http.StatusOK, writer.Code)
+	var deliveries []WebhookDeliveryResponse
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &deliveries))
+	require.Len(t, deliveries, 4)
+	assert.Equal(t, string(types.EventLinkDeleted), deliveries[0].Event)
+	for _, d := range deliveries {
+		assert.Equal(t, string(types.DeliveryDelivered), d.Status)
+		assert.Equal(t, http.StatusOK, d.LastStatusCode)
+		assert.Nil(t, d.NextAttemptAt)
+		assert.NotNil(t, d.DeliveredAt)
+	}
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodGet, "/api/user/webhooks/"+created.ID+"/deliveries?limit=1000", "").Code)
+
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/api/user/webhooks/"+created.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodDelete, "/api/user/webhooks/"+created.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/api/user/webhooks/"+created.ID+"/deliveries", "").Code)
+}
+
+func TestWebhooks_ClickThresholdWithCache(t *testing.T) {
+	ctx := context.Background()
+	urlRepo, userRepo, err := repository.InitRepositories(ctx, repository.Config{CacheSize: 10}, nil)
+	require.NoError(t, err)
+	id, err := urlRepo.Create(ctx, &types.Link{URL: MockURL})
+	require.NoError(t, err)
+	userID, err := userRepo.Create(ctx, []string{id})
+	require.NoError(t, err)
+	tb := token.InitTokenBuilder("secret key")
+	controller := controllers.InitController(localhost, nil, tb, urlRepo, userRepo)
+	router := InitAPI(controller, tb, Config{})
+
+	var received []webhook.Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e webhook.Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		received = append(received, e)
+	}))
+	defer receiver.Close()
+	webhooks, err := repository.InitWebhookRepository(ctx, nil)
+	require.NoError(t, err)
+	dispatcher := webhook.InitDispatcher(webhooks, nil, webhook.Config{AllowPrivate: true})
+	controller.SetWebhooks(dispatcher)
+	_, err = dispatcher.Subscribe(ctx, &types.Webhook{UserID: userID, URL: receiver.URL,
+		Events: []types.WebhookEvent{types.EventClickThreshold}, ClickThreshold: 3})
+	require.NoError(t, err)
+
+	// первый переход - промах кеша, остальные обслуживаются из кеша
+	for i := 0; i < 4; i++ {
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, createRequest(t, http.MethodGet, "/"+id, nil))
+		require.Equal(t, http.StatusTemporaryRedirect, writer.Code)
+	}
+	n, err := dispatcher.DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Len(t, received, 1)
+	assert.Equal(t, types.EventClickThreshold, received[0].Type)
+	assert.Equal(t, 3, received[0].Data.Clicks)
+}
+
+func TestStreamUserClicks(t *testing.T) {
+	ctx := context.Background()
+	urlRepo, userRepo, err := repository.InitRepositories(ctx, repository.Config{}, nil)
+	require.NoError(t, err)
+	own, err := urlRepo.Create(ctx, &types.Link{URL: MockURL, MaxClicks: 5})
+	require.NoError(t, err)
+	other, err := urlRepo.Create(ctx, &types.Link{URL: MockURL})
+	require.NoError(t, err)
+	userID, err := userRepo.Create(ctx, []string{own})
+	require.NoError(t, err)
+	tb := token.InitTokenBuilder("secret key")
+	auth, err := tb.CreateToken(userID)
+	require.NoError(t, err)
+	hub := clicks.InitHub(4)
+	router := InitAPI(controllers.InitController(localhost, nil, tb, urlRepo, userRepo), tb, Config{Clicks: hub, StreamHeartbeat: 20 * time.Millisecond})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	request := createRequest(t, http.MethodGet, srv.URL+"/api/user/urls/events", nil)
+	request.AddCookie(&http.Cookie{Name: "auth", Value: auth})
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	// next возвращает следующее событие: имя и data, комментарии пропускаются. Пусто, если за timeout события нет
+	next := func(timeout time.Duration) (string, string) {
+		var event, data string
+		deadline := time.After(timeout)
+		for {
+			select {
+			case line, ok := <-lines:
+				require.True(t, ok, "stream is closed")
+				switch {
+				case strings.HasPrefix(line, "event:"):
+					event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+				case strings.HasPrefix(line, "data:"):
+					data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+				case len(line) == 0 && len(event) != 0:
+					return event, data
+				}
+			case <-deadline:
+				return "", ""
+			}
+		}
+	}
+	// heartbeat приходит комментарием
+	require.Eventually(t, func() bool {
+		return <-lines == ": heartbeat"
+	}, time.Second, time.Millisecond)
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, id := range []string{other, own} {
+		resp, err := noRedirect.Get(srv.URL + "/" + id)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	event, data := next(time.Second)
+	assert.Equal(t, "click", event)
+	var click clicks.Click
+	require.NoError(t, json.Unmarshal([]byte(data), &click))
+	assert.Equal(t, own, click.ID)
+	assert.Equal(t, localhost+"/"+own, click.ShortURL)
+	assert.Equal(t, 1, click.Clicks)
+	assert.Equal(t, 5, click.MaxClicks)
+
+	// ссылка, добавленная после подключения, попадает в поток после heartbeat
+	require.NoError(t, userRepo.Update(ctx, userID, []string{own, other}))
+	for event = ""; event == ""; {
+		hub.Publish(clicks.Click{ID: other, Clicks: 7})
+		event, data = next(50 * time.Millisecond)
+	}
+	assert.Equal(t, "click", event)
+	assert.Contains(t, data, `"clicks":7`)
+
+	// медленный клиент отключается
+	for i := 0; i < 1000; i++ {
+		hub.Publish(clicks.Click{ID: own})
+	}
+	for event != "overflow" {
+		event, _ = next(time.Second)
+		require.NotEmpty(t, event)
+	}
+	for range lines {
+	}
+	assert.Zero(t, hub.Len())
+}
+
+func TestMultiDomain(t *testing.T) {
+	ctx := context.Background()
+	urlRepo, userRepo, err := repository.InitRepositories(ctx, repository.Config{}, nil)
+	require.NoError(t, err)
+	tb := token.InitTokenBuilder("secret key")
+	controller := controllers.InitController(localhost, nil, tb, urlRepo, userRepo)
+	userDomains, err := repository.InitDomainRepository(ctx, nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, controller.SetDomains([]string{"b.co"}, userDomains), controllers.ErrInvalidBaseURL)
+	require.NoError(t, controller.SetDomains([]string{"https://a.co/", "https://b.co/", "http://localhost:8080/"}, userDomains))
+	assert.Equal(t, []string{"localhost:8080", "a.co", "b.co"}, controller.Domains())
+	router := InitAPI(controller, tb, Config{})
+	var auth string
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		request := createRequest(t, method, target, strings.NewReader(body))
+		if len(auth) != 0 {
+			request.AddCookie(&http.Cookie{Name: "auth", Value: auth})
+		}
+		writer := httptest.NewRecorder()
+		router.ServeHTTP(writer, request)
+		return writer
+	}
+	shorten := func(body string) string {
+		writer := send(http.MethodPost, "/api/shorten", body)
+		require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+		var resp ShortenerResponse
+		require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &resp))
+		return resp.Result
+	}
+
+	writer := send(http.MethodGet, "/api/user/domain", "")
+	require.Equal(t, http.StatusOK, writer.Code)
+	for _, c := range writer.Result().Cookies() {
+		if c.Name == "auth" {
+			auth = c.Value
+		}
+	}
+	require.NotEmpty(t, auth)
+	assert.JSONEq(t, `{"domain": "localhost:8080", "domains": ["localhost:8080", "a.co", "b.co"]}`, writer.Body.String())
+
+	// один и тот же ключ на разных доменах ведет на разные урлы
+	onA := shorten(`{"url": "https://first.test", "domain": "a.co"}`)
+	hash := strings.TrimPrefix(onA, "https://a.co/")
+	require.NotEqual(t, onA, hash)
+	writer = send(http.MethodGet, "http://b.co/"+hash, "")
+	assert.Equal(t, http.StatusNotFound, writer.Code)
+	_, err = urlRepo.Create(ctx, &types.Link{URL: mustParseURL(t, "https://first.test"), Domain: "b.co"})
+	require.NoError(t, err)
+	writer = send(http.MethodGet, "http://b.co/"+hash, "")
+	assert.Equal(t, http.StatusTemporaryRedirect, writer.Code)
+	// хеш зависит только от урла, поэтому на a.co подменяем ссылку напрямую
+	require.NoError(t, urlRepo.Update(ctx, types.LinkKey("a.co", hash), &types.Link{URL: mustParseURL(t, "https://other.test")}))
+	writer = send(http.MethodGet, "https://a.co/"+hash, "")
+	assert.Equal(t, "https://other.test", writer.Header().Get("Location"))
+	writer = send(http.MethodGet, "http://b.co/"+hash, "")
+	assert.Equal(t, "https://first.test", writer.Header().Get("Location"))
+	// на домене по умолчанию и неизвестном хосте такой ссылки нет
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "/"+hash, "").Code)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodGet, "http://c.co/"+hash, "").Code)
+
+	writer = send(http.MethodGet, "/api/links/"+hash+"?domain=b.co", "")
+	require.Equal(t, http.StatusOK, writer.Code)
+	var stats LinkStats
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &stats))
+	assert.Equal(t, "https://b.co/"+hash, stats.ShortURL)
+	assert.Equal(t, 2, stats.Clicks)
+
+	writer = send(http.MethodPost, "/api/shorten", `{"url": "https://first.test", "domain": "c.co"}`)
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+	assert.Contains(t, writer.Body.String(), problemInvalidLink)
+	writer = send(http.MethodPut, "/api/user/domain", `{"domain": "c.co"}`)
+	assert.Equal(t, http.StatusBadRequest, writer.Code)
+
+	// домен пользователя используется, когда в запросе домена нет
+	writer = send(http.MethodPut, "/api/user/domain", `{"domain": "B.co"}`)
+	require.Equal(t, http.StatusOK, writer.Code, writer.Body.String())
+	assert.Contains(t, writer.Body.String(), `"domain":"b.co"`)
+	onB := shorten(`{"url": "https://third.test"}`)
+	assert.True(t, strings.HasPrefix(onB, "https://b.co/"), onB)
+	request := createRequest(t, http.MethodPost, "/?domain=localhost:8080", strings.NewReader("https://fourth.test"))
+	request.AddCookie(&http.Cookie{Name: "auth", Value: auth})
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, request)
+	require.Equal(t, http.StatusCreated, writer.Code, writer.Body.String())
+	assert.True(t, strings.HasPrefix(writer.Body.String(), localhost+"/"), writer.Body.String())
+	writer = send(http.MethodPost, "/api/shorten/batch", `[{"correlation_id": "1", "original_url": "https://fifth.test"},
+		{"correlation_id": "2", "original_url": "https://fifth.test", "domain": "a.co"},
+		{"correlation_id": "3", "original_url": "https://fifth.test", "domain": "c.co"}]`)
+	require.Equal(t, http.StatusMultiStatus, writer.Code, writer.Body.String())
+	var batch []ShortenerResponseWithID
+	require.NoError(t, json.Unmarshal(writer.Body.Bytes(), &batch))
+	require.Len(t, batch, 3)
+	assert.True(t, strings.HasPrefix(batch[0].ShortURL, "https://b.co/"), batch[0].ShortURL)
+	assert.True(t, strings.HasPrefix(batch[1].ShortURL, "https://a.co/"), batch[1].ShortURL)
+	assert.Equal(t, string(controllers.BatchInvalid), batch[2].Status)
+
+	// ссылки пользователя показываются на своих доменах и удаляются по домену
+	writer = send(http.MethodGet, "/api/user/urls", "")
+	require.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, writer.Body.String(), onA)
+	assert.Contains(t, writer.Body.String(), onB)
+	assert.Equal(t, http.StatusNotFound, send(http.MethodDelete, "/api/user/urls/"+hash, "").Code)
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/api/user/urls/"+hash+"?domain=a.co", "").Code)
+
+	writer = send(http.MethodPut, "/api/user/domain", `{"domain": ""}`)
+	require.Equal(t, http.StatusOK, writer.Code)
+	assert.Contains(t, writer.Body.String(), `"domain":"localhost:8080"`)
+}
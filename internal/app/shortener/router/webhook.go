@@ -0,0 +1,226 @@
+package router
+
+import (
+	"emperror.dev/errors"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/openapi"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/webhook"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultDeliveriesLimit = 50
+	maxDeliveriesLimit     = 500
+)
+
+type WebhookRequest struct {
+	URL string `json:"url"`
+	// пусто - все события
+	Events []string `json:"events,omitempty"`
+	// нужен для link.click_threshold
+	ClickThreshold int `json:"click_threshold,omitempty"`
+}
+
+type WebhookResponse struct {
+	ID             string    `json:"id"`
+	URL            string    `json:"url"`
+	Events         []string  `json:"events"`
+	ClickThreshold int       `json:"click_threshold,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	// ключ подписи, отдается только при создании
+	Secret string `json:"secret,omitempty"`
+}
+
+type WebhookDeliveryResponse struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	// pending, delivered или failed
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+func webhookResponse(w *types.Webhook) WebhookResponse {
+	events := make([]string, len(w.Events))
+	for i, e := range w.Events {
+		events[i] = string(e)
+	}
+	return WebhookResponse{
+		ID:             w.ID,
+		URL:            w.URL,
+		Events:         events,
+		ClickThreshold: w.ClickThreshold,
+		CreatedAt:      w.CreatedAt.UTC(),
+		Secret:         w.Secret,
+	}
+}
+
+func webhookDeliveryResponse(d *types.WebhookDelivery) WebhookDeliveryResponse {
+	res := WebhookDeliveryResponse{
+		ID:             d.ID,
+		Event:          string(d.Event),
+		Status:         string(d.Status),
+		Attempts:       d.Attempts,
+		LastStatusCode: d.LastStatusCode,
+		LastError:      d.LastError,
+		CreatedAt:      d.CreatedAt.UTC(),
+	}
+	if d.Status == types.DeliveryPending {
+		next := d.NextAttemptAt.UTC()
+		res.NextAttemptAt = &next
+	}
+	if !d.DeliveredAt.IsZero() {
+		delivered := d.DeliveredAt.UTC()
+		res.DeliveredAt = &delivered
+	}
+	return res
+}
+
+func (r *router) CreateWebhook(c *gin.Context) {
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithStatusProblem(c, http.StatusBadRequest, err)
+		return
+	}
+	events := make([]types.WebhookEvent, len(req.Events))
+	for i, e := range req.Events {
+		events[i] = types.WebhookEvent(e)
+	}
+	w, err := r.controller.CreateWebhook(c, c.GetHeader("auth"), req.URL, events, req.ClickThreshold)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, webhookResponse(w))
+}
+
+func (r *router) GetWebhooks(c *gin.Context) {
+	hooks, err := r.controller.Webhooks(c, c.GetHeader("auth"))
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	res := make([]WebhookResponse, len(hooks))
+	for i, w := range hooks {
+		res[i] = webhookResponse(w)
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func (r *router) DeleteWebhook(c *gin.Context) {
+	if err := r.controller.DeleteWebhook(c, c.GetHeader("auth"), c.Param("id")); err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries отдает журнал доставок подписки, новые первыми
+func (r *router) GetWebhookDeliveries(c *gin.Context) {
+	limit, err := intFromQuery(c, "limit")
+	if err != nil || limit < 0 || limit > maxDeliveriesLimit {
+		abortWithStatusProblem(c, http.StatusBadRequest, errors.Errorf("limit must be between 1 and %d", maxDeliveriesLimit))
+		return
+	}
+	if limit == 0 {
+		limit = defaultDeliveriesLimit
+	}
+	deliveries, err := r.controller.WebhookDeliveries(c, c.GetHeader("auth"), c.Param("id"), limit)
+	if err != nil {
+		abortWithProblem(c, err)
+		return
+	}
+	res := make([]WebhookDeliveryResponse, len(deliveries))
+	for i, d := range deliveries {
+		res[i] = webhookDeliveryResponse(d)
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// addWebhookOperations описывает маршруты вебхуков /api/user/webhooks
+func addWebhookOperations(d *openapi.Document, errorResponse func(string) *openapi.Response) {
+	id := &openapi.Parameter{Name: "id", In: "path", Required: true, Description: "id подписки", Schema: &openapi.Schema{Type: "string"}}
+	unauthorized := errorResponse("токен пользователя невалиден")
+	serverError := errorResponse("ошибка хранилища")
+	disabled := errorResponse("вебхуки не настроены на сервере")
+	notFound := errorResponse("у пользователя нет такой подписки")
+
+	d.Add(http.MethodPost, "/api/user/webhooks", &openapi.Operation{
+		Summary: "Подписаться на события своих ссылок",
+		Description: "События отправляются POST запросом с JSON телом. Заголовок " + webhook.SignatureHeader +
+			" - t=<unix время>,v1=<hex HMAC-SHA256 от \"<t>.<тело>\" ключом secret>, " + webhook.DeliveryHeader +
+			" - id доставки, одинаковый у повторов. Неудачные доставки повторяются с экспоненциальной паузой",
+		OperationID: "createWebhook",
+		Tags:        []string{"webhooks"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: d.JSON(WebhookRequest{})},
+		Responses: map[string]*openapi.Response{
+			"201": {Description: "подписка с ключом подписи, ключ больше не показывается", Content: d.JSON(WebhookResponse{})},
+			"400": errorResponse("невалидный урл, событие или порог переходов"),
+			"401": unauthorized,
+			"500": serverError,
+			"501": disabled,
+		},
+	})
+	d.Add(http.MethodGet, "/api/user/webhooks", &openapi.Operation{
+		Summary:     "Подписки текущего пользователя",
+		OperationID: "webhooks",
+		Tags:        []string{"webhooks"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "подписки без ключей подписи", Content: d.JSON([]WebhookResponse{})},
+			"401": unauthorized,
+			"500": serverError,
+			"501": disabled,
+		},
+	})
+	d.Add(http.MethodDelete, "/api/user/webhooks/:id", &openapi.Operation{
+		Summary:     "Удалить подписку",
+		Description: "Недоставленные события подписки пропадают",
+		OperationID: "deleteWebhook",
+		Tags:        []string{"webhooks"},
+		Parameters:  []*openapi.Parameter{id},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "подписка удалена"},
+			"401": unauthorized,
+			"404": notFound,
+			"500": serverError,
+			"501": disabled,
+		},
+	})
+	d.Add(http.MethodGet, "/api/user/webhooks/:id/deliveries", &openapi.Operation{
+		Summary:     "Журнал доставок подписки",
+		Description: "Последние доставки, новые первыми",
+		OperationID: "webhookDeliveries",
+		Tags:        []string{"webhooks"},
+		Parameters: []*openapi.Parameter{id,
+			{Name: "limit", In: "query", Description: "сколько доставок вернуть, по умолчанию 50", Schema: &openapi.Schema{
+				Type: "integer", Minimum: openapi.Int(1), Maximum: openapi.Int(maxDeliveriesLimit),
+			}},
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "доставки", Content: d.JSON([]WebhookDeliveryResponse{})},
+			"400": errorResponse("невалиден limit"),
+			"401": unauthorized,
+			"404": notFound,
+			"500": serverError,
+			"501": disabled,
+		},
+	})
+	events := make([]any, len(types.WebhookEvents))
+	for i, e := range types.WebhookEvents {
+		events[i] = e
+	}
+	eventSchema := &openapi.Schema{Type: "string", Enum: events}
+	d.Components.Schemas["WebhookRequest"].Properties["events"] = &openapi.Schema{Type: "array", Items: eventSchema}
+	d.Components.Schemas["WebhookRequest"].Properties["click_threshold"] = &openapi.Schema{Type: "integer", Minimum: openapi.Int(1)}
+	d.Components.Schemas["WebhookResponse"].Properties["events"] = &openapi.Schema{Type: "array", Items: eventSchema}
+	d.Components.Schemas["WebhookDeliveryResponse"].Properties["event"] = eventSchema
+	d.Components.Schemas["WebhookDeliveryResponse"].Properties["status"] = &openapi.Schema{Type: "string", Enum: []any{
+		types.DeliveryPending, types.DeliveryDelivered, types.DeliveryFailed,
+	}}
+}
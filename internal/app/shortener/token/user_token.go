@@ -44,7 +44,12 @@ func (tb *TokenBuilder) GetIDFromToken(token string) (string, error) {
 }
 
 func (tb *TokenBuilder) createHash(v []byte) []byte {
-	h := hmac.New(sha256.New, tb.secretKey)
+	return Sign(tb.secretKey, v)
+}
+
+// Sign подписывает v ключом key тем же HMAC-SHA256, которым подписываются токены
+func Sign(key []byte, v []byte) []byte {
+	h := hmac.New(sha256.New, key)
 	h.Write(v)
 	return h.Sum(nil)
 }
@@ -0,0 +1,73 @@
+package types
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+// QueryPassthrough определяет, что делать с query параметрами перехода по короткой ссылке
+type QueryPassthrough string
+
+const (
+	// QueryDrop - параметры перехода отбрасываются
+	QueryDrop QueryPassthrough = ""
+	// QueryMerge - параметры перехода добавляются, но не перезаписывают параметры оригинального урла
+	QueryMerge QueryPassthrough = "merge"
+	// QueryOverride - параметры перехода перезаписывают одноименные параметры оригинального урла
+	QueryOverride QueryPassthrough = "override"
+)
+
+// DisableReason - почему модератор отключил ссылку
+type DisableReason string
+
+const (
+	// Enabled - ссылка работает
+	Enabled DisableReason = ""
+	// DisabledLegal - ссылка заблокирована по требованию закона, переход отвечает 451
+	DisabledLegal DisableReason = "legal"
+	// DisabledRemoved - ссылка удалена модератором, переход отвечает 410
+	DisabledRemoved DisableReason = "removed"
+)
+
+type Link struct {
+	URL       *url.URL
+	MaxClicks int
+	Clicks    int
+	CreatedAt time.Time
+	// код ответа при редиректе, 0 - значение по умолчанию из конфига сервера
+	RedirectCode int
+	QueryMode    QueryPassthrough
+	// utm параметры, которые добавляются к оригинальному урлу при каждом переходе
+	UTM url.Values
+	// Enabled, если ссылка не отключена модератором
+	Disabled DisableReason
+	// хост домена, на котором создается ссылка, пусто - домен по умолчанию. Не хранится:
+	// домен входит в ключ ссылки, см. LinkKey
+	Domain string
+}
+
+// LinkKey - ключ ссылки id на домене domain. Ключи ссылок домена по умолчанию - просто id,
+// поэтому у одного id на разных доменах разные ссылки
+func LinkKey(domain, id string) string {
+	if len(domain) == 0 {
+		return id
+	}
+	return domain + "/" + id
+}
+
+// SplitLinkKey разбирает ключ из LinkKey на домен и id
+func SplitLinkKey(key string) (domain, id string) {
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+func (l *Link) IsExhausted() bool {
+	return l.MaxClicks > 0 && l.Clicks >= l.MaxClicks
+}
+
+func (l *Link) IsDisabled() bool {
+	return l.Disabled != Enabled
+}
@@ -0,0 +1,83 @@
+package types
+
+import "time"
+
+// WebhookEvent - событие жизненного цикла ссылки, на которое подписывается вебхук
+type WebhookEvent string
+
+const (
+	// EventLinkCreated - пользователь сократил новую ссылку
+	EventLinkCreated WebhookEvent = "link.created"
+	// EventLinkDeleted - пользователь убрал ссылку из своих ссылок
+	EventLinkDeleted WebhookEvent = "link.deleted"
+	// EventLinkExpired - переход исчерпал лимит переходов ссылки
+	EventLinkExpired WebhookEvent = "link.expired"
+	// EventClickThreshold - число переходов достигло порога, заданного в подписке
+	EventClickThreshold WebhookEvent = "link.click_threshold"
+)
+
+// WebhookEvents - все события в порядке для документации
+var WebhookEvents = []WebhookEvent{EventLinkCreated, EventLinkDeleted, EventLinkExpired, EventClickThreshold}
+
+type Webhook struct {
+	ID     string
+	UserID string
+	// куда отправляются события
+	URL string
+	// ключ подписи, известен только владельцу вебхука
+	Secret string
+	Events []WebhookEvent
+	// порог переходов для EventClickThreshold
+	ClickThreshold int
+	CreatedAt      time.Time
+}
+
+// Subscribed проверяет, нужно ли отправлять вебхуку событие event по ссылке с clicks переходами
+func (w *Webhook) Subscribed(event WebhookEvent, clicks int) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return event != EventClickThreshold || clicks == w.ClickThreshold
+		}
+	}
+	return false
+}
+
+// DeliveryStatus - состояние доставки события вебхуку
+type DeliveryStatus string
+
+const (
+	// DeliveryPending - доставка ждет первой или повторной попытки
+	DeliveryPending DeliveryStatus = "pending"
+	// DeliveryDelivered - получатель ответил 2xx
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryFailed - попытки кончились
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// WebhookDelivery - событие в очереди на отправку одному вебхуку вместе с итогом последней попытки
+type WebhookDelivery struct {
+	ID        string
+	WebhookID string
+	Event     WebhookEvent
+	// тело запроса, подписывается при каждой попытке
+	Payload  []byte
+	Status   DeliveryStatus
+	Attempts int
+	// код ответа последней попытки, 0 - ответа не было
+	LastStatusCode int
+	LastError      string
+	// когда делать следующую попытку
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	// нулевое, пока не доставлено
+	DeliveredAt time.Time
+}
+
+// LinkEventData - ссылка в теле события
+type LinkEventData struct {
+	ID          string `json:"id"`
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+	Clicks      int    `json:"clicks"`
+	MaxClicks   int    `json:"max_clicks,omitempty"`
+}
@@ -0,0 +1,435 @@
+// Package webhook отправляет события жизненного цикла ссылок на вебхуки пользователей. События сначала
+// попадают в исходящую очередь хранилища, а Dispatcher отправляет их в фоне с повторами
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/token"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// SignatureHeader - t=<unix время>,v1=<hex HMAC-SHA256 от "<t>.<тело>" ключом вебхука>
+	SignatureHeader = "Webhook-Signature"
+	EventHeader     = "Webhook-Event"
+	// DeliveryHeader - id доставки, один на все попытки, по нему получатель отбрасывает повторы
+	DeliveryHeader = "Webhook-Delivery"
+)
+
+// сколько ответа получателя читается, чтобы переиспользовать соединение
+const maxResponseDrain = 64 << 10
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+var ErrForbiddenAddress = errors.New("webhook address is not allowed")
+
+// Config - настройки отправки, нулевые поля заменяются значениями по умолчанию
+type Config struct {
+	// сколько попыток до статуса failed, по умолчанию 8
+	MaxAttempts int
+	// пауза после первой неудачи, дальше удваивается. По умолчанию 10 секунд
+	BaseBackoff time.Duration
+	// предел паузы, по умолчанию час
+	MaxBackoff time.Duration
+	// таймаут одной попытки, по умолчанию 10 секунд
+	Timeout time.Duration
+	// как часто проверять очередь, по умолчанию секунда
+	PollInterval time.Duration
+	// сколько доставок отправляется одновременно, по умолчанию 16
+	BatchSize int
+	// разрешить отправку на loopback, приватные и link-local адреса. По умолчанию запрещено,
+	// чтобы через вебхук нельзя было достучаться до внутренней сети сервера
+	AllowPrivate bool
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 8
+	}
+	if c.BaseBackoff <= 0 {
+		c.BaseBackoff = 10 * time.Second
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = time.Hour
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = time.Second
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 16
+	}
+	return c
+}
+
+// Event - тело запроса к вебхуку
+type Event struct {
+	// один на все вебхуки, получившие событие
+	ID        string              `json:"id"`
+	Type      types.WebhookEvent  `json:"type"`
+	CreatedAt time.Time           `json:"created_at"`
+	Data      types.LinkEventData `json:"data"`
+}
+
+// Dispatcher ставит события в очередь подписанным вебхукам и отправляет их
+type Dispatcher struct {
+	repo   repository.WebhookRepository
+	client *http.Client
+	cfg    Config
+	now    func() time.Time
+	// будит Run, когда в очереди появились доставки
+	wake chan struct{}
+	mu   sync.RWMutex
+	// пороги переходов из подписок, чтобы не ходить в хранилище на каждый переход
+	thresholds map[int]bool
+}
+
+// InitDispatcher создает отправителя. Если client nil, используется клиент с таймаутом cfg.Timeout,
+// который без cfg.AllowPrivate не подключается к внутренним адресам
+func InitDispatcher(repo repository.WebhookRepository, client *http.Client, cfg Config) *Dispatcher {
+	cfg = cfg.withDefaults()
+	if client == nil {
+		client = newClient(cfg)
+	}
+	return &Dispatcher{repo: repo, client: client, cfg: cfg, now: time.Now, wake: make(chan struct{}, 1), thresholds: map[int]bool{}}
+}
+
+func newClient(cfg Config) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		// адрес проверяется уже после резолва, прямо перед подключением, так что имя,
+		// которое при повторном резолве указывает на внутренний адрес, не поможет
+		dialer.Control = checkDialAddress
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// через прокси проверялся бы адрес прокси, а не получателя
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: cfg.Timeout, Transport: transport}
+}
+
+// forbiddenNets - внутренние диапазоны, которые не покрывают методы net.IP:
+// разделяемое адресное пространство операторского NAT и префикс NAT64, через который доступны IPv4 адреса
+var forbiddenNets = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return errors.WithMessagef(ErrForbiddenAddress, "%s %s", network, address)
+	}
+	for _, n := range forbiddenNets {
+		if n.Contains(ip) {
+			return errors.WithMessagef(ErrForbiddenAddress, "%s %s", network, address)
+		}
+	}
+	return nil
+}
+
+// Subscribe сохраняет подписку с новым ключом подписи и возвращает ее
+func (d *Dispatcher) Subscribe(ctx context.Context, w *types.Webhook) (*types.Webhook, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	created := *w
+	created.Secret = secret
+	if created.ID, err = d.repo.CreateWebhook(ctx, &created); err != nil {
+		return nil, err
+	}
+	if created.CreatedAt.IsZero() {
+		created.CreatedAt = d.now()
+	}
+	if created.Subscribed(types.EventClickThreshold, created.ClickThreshold) {
+		d.mu.Lock()
+		d.thresholds[created.ClickThreshold] = true
+		d.mu.Unlock()
+	}
+	return &created, nil
+}
+
+// Unsubscribe удаляет подписку пользователя, недоставленные события пропадают вместе с ней
+func (d *Dispatcher) Unsubscribe(ctx context.Context, userID, id string) error {
+	return d.repo.DeleteWebhook(ctx, userID, id)
+}
+
+// Subscriptions возвращает подписки пользователя
+func (d *Dispatcher) Subscriptions(ctx context.Context, userID string) ([]*types.Webhook, error) {
+	return d.repo.Webhooks(ctx, userID)
+}
+
+// Deliveries возвращает журнал доставок подписки пользователя, новые первыми. Чужая подписка - ErrNoSuchValue
+func (d *Dispatcher) Deliveries(ctx context.Context, userID, id string, limit int) ([]*types.WebhookDelivery, error) {
+	w, err := d.repo.Webhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if w.UserID != userID {
+		return nil, repository.ErrNoSuchValue
+	}
+	return d.repo.Deliveries(ctx, id, limit)
+}
+
+// ClickThresholdReached сообщает, есть ли подписки с порогом clicks. Ответ берется из памяти
+// и может отставать от подписок других экземпляров сервера на PollInterval
+func (d *Dispatcher) ClickThresholdReached(clicks int) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.thresholds[clicks]
+}
+
+// Publish ставит событие в очередь всем подпискам пользователей users на event
+func (d *Dispatcher) Publish(ctx context.Context, event types.WebhookEvent, users []string, data types.LinkEventData) error {
+	if len(users) == 0 {
+		return nil
+	}
+	hooks, err := d.repo.Webhooks(ctx, users...)
+	if err != nil {
+		return err
+	}
+	var deliveries []*types.WebhookDelivery
+	var payload []byte
+	for _, w := range hooks {
+		if !w.Subscribed(event, data.Clicks) {
+			continue
+		}
+		if payload == nil {
+			id, err := randomHex(16)
+			if err != nil {
+				return err
+			}
+			payload, err = json.Marshal(Event{ID: id, Type: event, CreatedAt: d.now().UTC(), Data: data})
+			if err != nil {
+				return err
+			}
+		}
+		deliveries = append(deliveries, &types.WebhookDelivery{WebhookID: w.ID, Event: event, Payload: payload, Status: types.DeliveryPending})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if err := d.repo.Enqueue(ctx, deliveries); err != nil {
+		return err
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run отправляет доставки из очереди, пока не отменен ctx
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := d.refreshThresholds(ctx); err != nil {
+			log.Printf("webhook: load click thresholds: %v", err)
+		}
+		for {
+			n, err := d.DispatchDue(ctx)
+			if err != nil {
+				log.Printf("webhook: dispatch: %v", err)
+			}
+			// полная пачка - в очереди, скорее всего, есть еще
+			if err != nil || n < d.cfg.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *Dispatcher) refreshThresholds(ctx context.Context) error {
+	list, err := d.repo.ClickThresholds(ctx)
+	if err != nil {
+		return err
+	}
+	thresholds := make(map[int]bool, len(list))
+	for _, t := range list {
+		thresholds[t] = true
+	}
+	d.mu.Lock()
+	d.thresholds = thresholds
+	d.mu.Unlock()
+	return nil
+}
+
+// DispatchDue отправляет пачку доставок, время которых пришло, и возвращает их число. Одновременно
+// идут только запросы к получателям, хранилище используется последовательно
+func (d *Dispatcher) DispatchDue(ctx context.Context) (int, error) {
+	// доставка вернется в очередь, если попытка не уложилась и в два таймаута
+	due, err := d.repo.ClaimDue(ctx, d.cfg.BatchSize, 2*d.cfg.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	hooks := make([]*types.Webhook, len(due))
+	for i, del := range due {
+		// подписку удалили после постановки в очередь
+		if hooks[i], err = d.repo.Webhook(ctx, del.WebhookID); err != nil && !errors.Is(err, repository.ErrNoSuchValue) {
+			return 0, err
+		}
+	}
+	statuses := make([]int, len(due))
+	errs := make([]error, len(due))
+	var wg sync.WaitGroup
+	for i := range due {
+		if hooks[i] == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i], errs[i] = d.send(ctx, hooks[i], due[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, del := range due {
+		if hooks[i] == nil {
+			continue
+		}
+		d.record(del, statuses[i], errs[i])
+		if err := d.repo.SaveAttempt(ctx, del); err != nil && !errors.Is(err, repository.ErrNoSuchValue) {
+			return len(due), err
+		}
+	}
+	return len(due), nil
+}
+
+// record записывает в доставку итог попытки и решает, повторять ли ее
+func (d *Dispatcher) record(del *types.WebhookDelivery, status int, sendErr error) {
+	now := d.now()
+	del.Attempts++
+	del.LastStatusCode = status
+	del.LastError = ""
+	switch {
+	case sendErr == nil:
+		del.Status = types.DeliveryDelivered
+		del.DeliveredAt = now
+		return
+	case del.Attempts >= d.cfg.MaxAttempts:
+		del.Status = types.DeliveryFailed
+	default:
+		del.NextAttemptAt = now.Add(d.backoff(del.Attempts))
+	}
+	del.LastError = sendErr.Error()
+}
+
+func (d *Dispatcher) send(ctx context.Context, w *types.Webhook, del *types.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "urlshortener-webhook")
+	req.Header.Set(EventHeader, string(del.Event))
+	req.Header.Set(DeliveryHeader, del.ID)
+	req.Header.Set(SignatureHeader, Signature(w.Secret, d.now(), del.Payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseDrain))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff - пауза после attempts неудачных попыток: BaseBackoff, удвоенная attempts-1 раз, но не больше MaxBackoff
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	b := d.cfg.BaseBackoff
+	for i := 1; i < attempts && b < d.cfg.MaxBackoff; i++ {
+		b *= 2
+	}
+	if b > d.cfg.MaxBackoff {
+		return d.cfg.MaxBackoff
+	}
+	return b
+}
+
+// Signature возвращает значение SignatureHeader для тела payload, отправленного в момент t
+func Signature(secret string, t time.Time, payload []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(sign(secret, ts, payload)))
+}
+
+// Verify проверяет подпись header тела payload. Подписи старше tolerance отклоняются, чтобы перехваченный
+// запрос нельзя было повторить. Нужна получателям вебхуков
+func Verify(secret, header string, payload []byte, tolerance time.Duration, now time.Time) error {
+	var ts, v1 string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			v1 = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.WithMessage(ErrInvalidSignature, "no timestamp")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return errors.WithMessage(ErrInvalidSignature, "timestamp is out of tolerance")
+	}
+	got, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(got, sign(secret, ts, payload)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func sign(secret, ts string, payload []byte) []byte {
+	return token.Sign([]byte(secret), append([]byte(ts+"."), payload...))
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
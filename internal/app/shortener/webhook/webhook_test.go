@@ -0,0 +1,258 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/repository"
+	"github.com/SakuraBurst/urlshortener/internal/app/shortener/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver - получатель вебхуков, который проверяет подпись и отвечает кодами из statuses по очереди
+type receiver struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	statuses []int
+	events   []Event
+	headers  []http.Header
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	require.NoError(rc.t, err)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if err := Verify(rc.secret, r.Header.Get(SignatureHeader), body, time.Minute, time.Now()); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	status := http.StatusNoContent
+	if len(rc.statuses) != 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	var e Event
+	require.NoError(rc.t, json.Unmarshal(body, &e))
+	rc.events = append(rc.events, e)
+	rc.headers = append(rc.headers, r.Header.Clone())
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) received() []Event {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]Event(nil), rc.events...)
+}
+
+func setup(t *testing.T, cfg Config, events []types.WebhookEvent, threshold int) (*Dispatcher, *receiver, *types.Webhook) {
+	repo, err := repository.InitWebhookRepository(context.Background(), nil)
+	require.NoError(t, err)
+	// получатель на httptest слушает loopback
+	cfg.AllowPrivate = true
+	d := InitDispatcher(repo, nil, cfg)
+	rc := &receiver{t: t}
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+	w, err := d.Subscribe(context.Background(), &types.Webhook{UserID: "1", URL: srv.URL, Events: events, ClickThreshold: threshold})
+	require.NoError(t, err)
+	require.NotEmpty(t, w.Secret)
+	rc.secret = w.Secret
+	return d, rc, w
+}
+
+func TestDispatcher_Deliver(t *testing.T) {
+	ctx := context.Background()
+	d, rc, w := setup(t, Config{}, []types.WebhookEvent{types.EventLinkCreated, types.EventClickThreshold}, 5)
+	data := types.LinkEventData{ID: "abc", ShortURL: "http://localhost:8080/abc", OriginalURL: "https://test.com", Clicks: 4}
+
+	require.NoError(t, d.Publish(ctx, types.EventLinkCreated, []string{"1", "2"}, data))
+	// чужие ссылки, событие без подписки и порог, которого не достигли, не отправляются
+	require.NoError(t, d.Publish(ctx, types.EventLinkCreated, []string{"2"}, data))
+	require.NoError(t, d.Publish(ctx, types.EventLinkDeleted, []string{"1"}, data))
+	require.NoError(t, d.Publish(ctx, types.EventClickThreshold, []string{"1"}, data))
+	assert.True(t, d.ClickThresholdReached(5))
+	assert.False(t, d.ClickThresholdReached(4))
+	data.Clicks = 5
+	require.NoError(t, d.Publish(ctx, types.EventClickThreshold, []string{"1"}, data))
+
+	n, err := d.DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	events := rc.received()
+	require.Len(t, events, 2)
+	byType := map[types.WebhookEvent]Event{}
+	for _, e := range events {
+		byType[e.Type] = e
+		assert.NotEmpty(t, e.ID)
+		assert.Equal(t, "https://test.com", e.Data.OriginalURL)
+	}
+	assert.Equal(t, 4, byType[types.EventLinkCreated].Data.Clicks)
+	assert.Equal(t, 5, byType[types.EventClickThreshold].Data.Clicks)
+	assert.NotEmpty(t, rc.headers[0].Get(DeliveryHeader))
+	assert.NotEmpty(t, rc.headers[0].Get(EventHeader))
+
+	deliveries, err := d.Deliveries(ctx, "1", w.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	for _, del := range deliveries {
+		assert.Equal(t, types.DeliveryDelivered, del.Status)
+		assert.Equal(t, 1, del.Attempts)
+		assert.Equal(t, http.StatusNoContent, del.LastStatusCode)
+		assert.False(t, del.DeliveredAt.IsZero())
+	}
+	_, err = d.Deliveries(ctx, "2", w.ID, 10)
+	assert.ErrorIs(t, err, repository.ErrNoSuchValue)
+
+	n, err = d.DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestDispatcher_PrivateAddress(t *testing.T) {
+	ctx := context.Background()
+	for _, allow := range []bool{false, true} {
+		repo, err := repository.InitWebhookRepository(ctx, nil)
+		require.NoError(t, err)
+		d := InitDispatcher(repo, nil, Config{AllowPrivate: allow})
+		rc := &receiver{t: t}
+		srv := httptest.NewServer(rc)
+		w, err := d.Subscribe(ctx, &types.Webhook{UserID: "1", URL: srv.URL, Events: types.WebhookEvents})
+		require.NoError(t, err)
+		rc.secret = w.Secret
+		require.NoError(t, d.Publish(ctx, types.EventLinkCreated, []string{"1"}, types.LinkEventData{ID: "abc"}))
+		_, err = d.DispatchDue(ctx)
+		require.NoError(t, err)
+		deliveries, err := d.Deliveries(ctx, "1", w.ID, 1)
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		if allow {
+			assert.Equal(t, types.DeliveryDelivered, deliveries[0].Status)
+			assert.Len(t, rc.received(), 1)
+		} else {
+			assert.Equal(t, types.DeliveryPending, deliveries[0].Status)
+			assert.Contains(t, deliveries[0].LastError, ErrForbiddenAddress.Error())
+			assert.Empty(t, rc.received())
+		}
+		srv.Close()
+	}
+}
+
+func TestCheckDialAddress(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:80", "[::1]:80", "10.1.2.3:80", "192.168.0.1:443", "169.254.169.254:80",
+		"0.0.0.0:80", "[::]:80", "[fe80::1]:80", "[fd00::1]:80", "[::ffff:127.0.0.1]:80", "224.0.0.1:80",
+		"100.64.0.1:80", "100.127.255.254:80", "[64:ff9b::a00:1]:80", "[64:ff9b::7f00:1]:80"} {
+		assert.ErrorIs(t, checkDialAddress("tcp", address, nil), ErrForbiddenAddress, address)
+	}
+	for _, address := range []string{"93.184.216.34:443", "[2606:2800:220:1:248:1893:25c8:1946]:443", "100.128.0.1:443"} {
+		assert.NoError(t, checkDialAddress("tcp", address, nil), address)
+	}
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{MaxAttempts: 5, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	d, rc, w := setup(t, cfg, types.WebhookEvents, 0)
+	rc.statuses = []int{http.StatusInternalServerError, http.StatusServiceUnavailable}
+	require.NoError(t, d.Publish(ctx, types.EventLinkDeleted, []string{"1"}, types.LinkEventData{ID: "abc"}))
+	_, err := d.DispatchDue(ctx)
+	require.NoError(t, err)
+	deliveries, err := d.Deliveries(ctx, "1", w.ID, 1)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, types.DeliveryPending, deliveries[0].Status)
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].LastStatusCode)
+	assert.NotEmpty(t, deliveries[0].LastError)
+
+	require.Eventually(t, func() bool {
+		_, err := d.DispatchDue(ctx)
+		require.NoError(t, err)
+		deliveries, err = d.Deliveries(ctx, "1", w.ID, 1)
+		require.NoError(t, err)
+		return deliveries[0].Status != types.DeliveryPending
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, types.DeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Empty(t, deliveries[0].LastError)
+	events := rc.received()
+	require.Len(t, events, 3)
+	// повторы - та же доставка с тем же событием
+	assert.Equal(t, events[0].ID, events[2].ID)
+	assert.Equal(t, rc.headers[0].Get(DeliveryHeader), rc.headers[2].Get(DeliveryHeader))
+}
+
+func TestDispatcher_Failed(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	d, rc, w := setup(t, cfg, types.WebhookEvents, 0)
+	rc.statuses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusOK}
+	require.NoError(t, d.Publish(ctx, types.EventLinkExpired, []string{"1"}, types.LinkEventData{ID: "abc"}))
+
+	var deliveries []*types.WebhookDelivery
+	require.Eventually(t, func() bool {
+		_, err := d.DispatchDue(ctx)
+		require.NoError(t, err)
+		deliveries, err = d.Deliveries(ctx, "1", w.ID, 1)
+		require.NoError(t, err)
+		return deliveries[0].Status != types.DeliveryPending
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, types.DeliveryFailed, deliveries[0].Status)
+	assert.Equal(t, 2, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusBadGateway, deliveries[0].LastStatusCode)
+	time.Sleep(5 * time.Millisecond)
+	n, err := d.DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Len(t, rc.received(), 2)
+
+	// удаленная подписка забирает недоставленные события с собой
+	require.NoError(t, d.Publish(ctx, types.EventLinkExpired, []string{"1"}, types.LinkEventData{ID: "abc"}))
+	require.NoError(t, d.Unsubscribe(ctx, "1", w.ID))
+	n, err = d.DispatchDue(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestDispatcher_Run(t *testing.T) {
+	d, rc, _ := setup(t, Config{PollInterval: time.Hour}, types.WebhookEvents, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	// Publish будит Run, не дожидаясь PollInterval
+	require.NoError(t, d.Publish(ctx, types.EventLinkCreated, []string{"1"}, types.LinkEventData{ID: "abc"}))
+	require.Eventually(t, func() bool {
+		return len(rc.received()) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestBackoff(t *testing.T) {
+	d := InitDispatcher(nil, nil, Config{BaseBackoff: 10 * time.Second, MaxBackoff: time.Minute})
+	var got []time.Duration
+	for attempts := 1; attempts <= 5; attempts++ {
+		got = append(got, d.backoff(attempts))
+	}
+	assert.Equal(t, []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}, got)
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	payload := []byte(`{"id":"1"}`)
+	header := Signature("secret", now, payload)
+	assert.NoError(t, Verify("secret", header, payload, time.Minute, now.Add(30*time.Second)))
+	assert.ErrorIs(t, Verify("other", header, payload, time.Minute, now), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("secret", header, []byte(`{"id":"2"}`), time.Minute, now), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("secret", header, payload, time.Minute, now.Add(2*time.Minute)), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("secret", "v1=00", payload, time.Minute, now), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("secret", "", payload, time.Minute, now), ErrInvalidSignature)
+}